@@ -0,0 +1,78 @@
+package spnego
+
+import "encoding/asn1"
+
+// PeerNamer is implemented by the mechanisms reporting the name of the peer: the target
+// for an initiator, the authenticated client for an acceptor
+type PeerNamer interface {
+	PeerName() string
+}
+
+// ContextAttributes describes an established security context
+type ContextAttributes struct {
+	Mech            asn1.ObjectIdentifier // Selected mechanism
+	Flags           []ContextFlag         // Negotiated flags, see ContextFlagsReporter
+	Integrity       bool                  // Messages can be signed
+	Confidentiality bool                  // Messages can be sealed
+	Mutual          bool                  // The acceptor authenticated to the initiator
+	PeerName        string                // Empty if the mechanism does not implement PeerNamer
+}
+
+// Attributes returns the attributes of the established context, nil otherwise
+func (c *SPNEGOClient) Attributes() *ContextAttributes {
+	if !c.IsEstablished() {
+		return nil
+	}
+	return attributes(c.SelectedMech.GetOID(), c.SelectedMech)
+}
+
+// ContextFlags returns the flags of the established context, see SPNEGOClient.ContextFlags
+func (s *SPNEGOServer) ContextFlags() []ContextFlag {
+	if !s.IsEstablished() {
+		return nil
+	}
+	return contextFlags(s.SelectedMech)
+}
+
+// Attributes returns the attributes of the established context, nil otherwise
+func (s *SPNEGOServer) Attributes() *ContextAttributes {
+	if !s.IsEstablished() {
+		return nil
+	}
+	return attributes(s.SelectedMech.GetOID(), s.SelectedMech)
+}
+
+// contextFlags converts the GSS-API flags reported by the mechanism
+func contextFlags(mech any) []ContextFlag {
+	reporter, ok := mech.(ContextFlagsReporter)
+	if !ok {
+		return nil
+	}
+
+	negotiated := reporter.NegotiatedContextFlags()
+	var flags []ContextFlag
+	for flag := DelegFlag; flag <= IntegFlag; flag++ {
+		if negotiated&gssFlags[flag] != 0 {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+func attributes(oid asn1.ObjectIdentifier, mech any) *ContextAttributes {
+	attrs := &ContextAttributes{Mech: oid, Flags: contextFlags(mech)}
+	for _, flag := range attrs.Flags {
+		switch flag {
+		case IntegFlag:
+			attrs.Integrity = true
+		case ConfFlag:
+			attrs.Confidentiality = true
+		case MutualFlag:
+			attrs.Mutual = true
+		}
+	}
+	if namer, ok := mech.(PeerNamer); ok {
+		attrs.PeerName = namer.PeerName()
+	}
+	return attrs
+}
@@ -0,0 +1,51 @@
+package spnego
+
+import "encoding/asn1"
+
+// Compatibility selects how the known deviations of Microsoft from RFC 4178 are handled,
+// so that the same code can negotiate with Windows and with MIT or Heimdal peers
+type Compatibility int
+
+const (
+	// CompatMicrosoft interoperates with Windows peers, it is the default:
+	//   - the acceptor leads with a NegTokenInit2 carrying negHints (MS-SPNG 2.2.1)
+	//   - the Kerberos mechanism is also selected under MsKerberosOid, the OID of the
+	//     krb5 mechanism that Windows 2000 wrongly encoded, and still offers first
+	//   - a mechListMIC which is a copy of the responseToken, as sent by Windows 2000
+	//     acceptors, is ignored instead of failing the verification
+	CompatMicrosoft Compatibility = iota
+
+	// CompatRFC4178 follows RFC 4178 to the letter: the acceptor leads with a plain
+	// NegTokenInit, OIDs only match themselves and every mechListMIC is verified
+	CompatRFC4178
+)
+
+var compatibilityNames = map[Compatibility]string{
+	CompatMicrosoft: "microsoft",
+	CompatRFC4178:   "rfc4178",
+}
+
+func (c Compatibility) String() string {
+	if name, ok := compatibilityNames[c]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// sameMechanism reports whether the OIDs designate the same mechanism, the aliases of
+// mechanismAliases only matching in the Microsoft compatibility mode
+func (c Compatibility) sameMechanism(a, b asn1.ObjectIdentifier) bool {
+	if a.Equal(b) {
+		return true
+	}
+	if c != CompatMicrosoft {
+		return false
+	}
+	if alias, ok := mechanismAliases[a.String()]; ok {
+		a = alias
+	}
+	if alias, ok := mechanismAliases[b.String()]; ok {
+		b = alias
+	}
+	return a.Equal(b)
+}
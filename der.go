@@ -0,0 +1,169 @@
+package spnego
+
+import (
+	"encoding/asn1"
+	"errors"
+)
+
+// DER tags of the SPNEGO structures
+const (
+	derTagBitString   = 0x03
+	derTagOctetString = 0x04
+	derTagOID         = 0x06
+	derTagEnumerated  = 0x0a
+	derTagSequence    = 0x30
+	derTagApplication = 0x60 // [APPLICATION 0] of the InitialContextToken
+	derTagContext     = 0xa0 // [n] constructed, n is added to it
+)
+
+// derLength encodes the length of a TLV in the definite form, short for less than 128 bytes
+func derLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// derTLV concatenates the contents under the tag
+func derTLV(tag byte, contents ...[]byte) []byte {
+	var value []byte
+	for _, content := range contents {
+		value = append(value, content...)
+	}
+	b := append([]byte{tag}, derLength(len(value))...)
+	return append(b, value...)
+}
+
+// derEnumerated encodes the value as the minimal two's complement
+func derEnumerated(v asn1.Enumerated) []byte {
+	n := int64(v)
+	b := []byte{byte(n)}
+	for (n > 0x7f || n < -0x80) && len(b) < 8 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return derTLV(derTagEnumerated, b)
+}
+
+// derOID encodes the arcs of the OID in base 128, the first two in a single subidentifier
+func derOID(oid asn1.ObjectIdentifier) ([]byte, error) {
+	if len(oid) < 2 || oid[0] > 2 || (oid[0] < 2 && oid[1] >= 40) {
+		return nil, errors.New("invalid object identifier: " + oid.String())
+	}
+
+	var b []byte
+	arcs := append([]int{oid[0]*40 + oid[1]}, oid[2:]...)
+	for _, arc := range arcs {
+		if arc < 0 {
+			return nil, errors.New("invalid object identifier: " + oid.String())
+		}
+		sub := []byte{byte(arc & 0x7f)}
+		for arc >>= 7; arc > 0; arc >>= 7 {
+			sub = append([]byte{0x80 | byte(arc&0x7f)}, sub...)
+		}
+		b = append(b, sub...)
+	}
+	return derTLV(derTagOID, b), nil
+}
+
+// derBitString encodes the bits with their count of unused bits in the last byte
+func derBitString(bs asn1.BitString) []byte {
+	return derTLV(derTagBitString, []byte{byte(len(bs.Bytes)*8 - bs.BitLength)}, bs.Bytes)
+}
+
+// derExplicit wraps the encoded value in the [tag] constructed context specific tag
+func derExplicit(tag byte, value []byte) []byte {
+	return derTLV(derTagContext|tag, value)
+}
+
+// marshalNegTokenResp encodes the NegTokenResp as the [1] choice of NegotiationToken.
+// Absent and empty fields are omitted
+func marshalNegTokenResp(token NegTokenResp) ([]byte, error) {
+	var fields [][]byte
+	if token.NegState != NegStateAbsent {
+		fields = append(fields, derExplicit(0, derEnumerated(token.NegState)))
+	}
+	if len(token.SupportedMech) > 0 {
+		oid, err := derOID(token.SupportedMech)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, derExplicit(1, oid))
+	}
+	if len(token.ResponseToken) > 0 {
+		fields = append(fields, derExplicit(2, derTLV(derTagOctetString, token.ResponseToken)))
+	}
+	if len(token.MechListMIC) > 0 {
+		fields = append(fields, derExplicit(3, derTLV(derTagOctetString, token.MechListMIC)))
+	}
+	return derExplicit(1, derTLV(derTagSequence, fields...)), nil
+}
+
+// marshalInitialToken encodes the NegTokenInit within the InitialContextToken of SPNEGO
+func marshalInitialToken(token NegTokenInit) ([]byte, error) {
+	var mechTypes [][]byte
+	for _, mech := range token.MechTypes {
+		oid, err := derOID(mech)
+		if err != nil {
+			return nil, err
+		}
+		mechTypes = append(mechTypes, oid)
+	}
+
+	fields := [][]byte{derExplicit(0, derTLV(derTagSequence, mechTypes...))}
+	if token.ReqFlags.BitLength > 0 {
+		fields = append(fields, derExplicit(1, derBitString(token.ReqFlags)))
+	}
+	if len(token.MechToken) > 0 {
+		fields = append(fields, derExplicit(2, derTLV(derTagOctetString, token.MechToken)))
+	}
+	if len(token.MechListMIC) > 0 {
+		fields = append(fields, derExplicit(3, derTLV(derTagOctetString, token.MechListMIC)))
+	}
+
+	spnego, err := derOID(SpnegoOID)
+	if err != nil {
+		return nil, err
+	}
+	return derTLV(derTagApplication, spnego, derExplicit(0, derTLV(derTagSequence, fields...))), nil
+}
+
+// gssTokenLength returns the length of the GSS-API token the data starts with, i.e. the
+// [APPLICATION 0] TLV of RFC 2743 3.1 starting with the OID of the mechanism, which frames
+// the Kerberos tokens. The length is -1 if the header itself is truncated
+func gssTokenLength(data []byte) (int, bool) {
+	if len(data) == 0 || data[0] != derTagApplication {
+		return 0, false
+	}
+	if len(data) < 2 {
+		return -1, true
+	}
+	length, header := int(data[1]), 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return 0, false
+		}
+		if len(data) < 2+n {
+			return -1, true
+		}
+		length, header = 0, 2+n
+		for _, b := range data[2 : 2+n] {
+			length = length<<8 | int(b)
+		}
+	}
+	if len(data) > header && data[header] != derTagOID {
+		return 0, false
+	}
+	return header + length, true
+}
+
+// derTruncated reports whether the data is the beginning of a GSS-API token
+func derTruncated(data []byte) bool {
+	length, ok := gssTokenLength(data)
+	return ok && (length < 0 || len(data) < length)
+}
@@ -0,0 +1,89 @@
+package spnego_test
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/hex"
+	"testing"
+
+	"github.com/msultra/spnego"
+)
+
+// The hand-rolled encoder must produce the same DER as encoding/asn1
+func TestDEREncoderMatchesReflection(t *testing.T) {
+	large := bytes.Repeat([]byte{0xaa}, 70000)
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 2097152}
+
+	for i, resp := range []spnego.NegTokenResp{
+		{NegState: spnego.AcceptCompleted},
+		{NegState: spnego.RequestMIC, SupportedMech: oid},
+		{NegState: 200, ResponseToken: []byte("token")},
+		{NegState: -300, MechListMIC: []byte("mic")},
+		{NegState: spnego.NegStateAbsent, ResponseToken: large},
+		{NegState: spnego.AcceptIncomplete, SupportedMech: spnego.NtlmOID, ResponseToken: large[:200], MechListMIC: large[:16]},
+	} {
+		expected, err := asn1.MarshalWithParams(resp, "explicit,tag:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded, err := spnego.EncodeNegTokenResp(resp); err != nil || !bytes.Equal(encoded, expected) {
+			t.Errorf("%d: EncodeNegTokenResp() = %x, %v, expected %x", i, encoded[:min(len(encoded), 32)], err, expected[:min(len(expected), 32)])
+		}
+	}
+
+	// NegTokenResp sent by the Windows Server of the lab.lan domain during an NTLM handshake
+	for i, e := range []struct {
+		NegState      asn1.Enumerated
+		SupportedMech asn1.ObjectIdentifier
+		ResponseToken string
+		MechListMIC   string
+		Captured      string
+	}{
+		{
+			// First leg: accept-incomplete carrying the CHALLENGE message
+			spnego.AcceptIncomplete,
+			spnego.NtlmOID,
+			"4e544c4d53535000020000000600060038000000358299e2212ba239356b3d8200000000000000005e005e003e0000000a0063450000000f4c0041004200020006004c0041004200010004004400430004000e006c00610062002e006c0061006e0003001400440043002e006c00610062002e006c0061006e0005000e006c00610062002e006c0061006e0007000800f364eebe92ecd80100000000",
+			"",
+			"a181b83081b5a0030a0101a10c060a2b06010401823702020aa2819f04819c4e544c4d53535000020000000600060038000000358299e2212ba239356b3d8200000000000000005e005e003e0000000a0063450000000f4c0041004200020006004c0041004200010004004400430004000e006c00610062002e006c0061006e0003001400440043002e006c00610062002e006c0061006e0005000e006c00610062002e006c0061006e0007000800f364eebe92ecd80100000000",
+		},
+		{
+			// Last leg: accept-completed carrying only the mechListMIC
+			spnego.AcceptCompleted,
+			nil,
+			"",
+			"01000000a3b9d2a7c3e6e0b200000000",
+			"a11b3019a0030a0100a312041001000000a3b9d2a7c3e6e0b200000000",
+		},
+	} {
+		resp := spnego.NegTokenResp{NegState: e.NegState, SupportedMech: e.SupportedMech}
+		resp.ResponseToken, _ = hex.DecodeString(e.ResponseToken)
+		resp.MechListMIC, _ = hex.DecodeString(e.MechListMIC)
+		if encoded, err := spnego.EncodeNegTokenResp(resp); err != nil || hex.EncodeToString(encoded) != e.Captured {
+			t.Errorf("%d: EncodeNegTokenResp() = %x, %v, expected %s", i, encoded, err, e.Captured)
+		}
+	}
+
+	for i, init := range []spnego.NegTokenInit{
+		{MechTypes: []asn1.ObjectIdentifier{spnego.MsKerberosOid, spnego.KerberosOID, spnego.NtlmOID}},
+		{MechTypes: []asn1.ObjectIdentifier{oid}, ReqFlags: spnego.NewReqFlags(spnego.MutualFlag, spnego.IntegFlag), MechToken: large},
+		{MechTypes: []asn1.ObjectIdentifier{spnego.NtlmOID}, MechToken: []byte("token"), MechListMIC: []byte("mic")},
+	} {
+		type initialContextToken struct {
+			ThisMech asn1.ObjectIdentifier
+			Init     spnego.NegTokenInit `asn1:"explicit,tag:0"`
+		}
+		expected, err := asn1.Marshal(initialContextToken{spnego.SpnegoOID, init})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[0] = 0x60
+		if encoded, err := spnego.EncodeInitialToken(init); err != nil || !bytes.Equal(encoded, expected) {
+			t.Errorf("%d: EncodeInitialToken() = %x, %v, expected %x", i, encoded[:min(len(encoded), 32)], err, expected[:min(len(expected), 32)])
+		}
+	}
+
+	if _, err := spnego.EncodeNegTokenResp(spnego.NegTokenResp{SupportedMech: asn1.ObjectIdentifier{3, 1}}); err == nil {
+		t.Errorf("EncodeNegTokenResp() should fail for an invalid OID")
+	}
+}
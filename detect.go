@@ -0,0 +1,77 @@
+package spnego
+
+import (
+	"bytes"
+	"encoding/asn1"
+)
+
+// TokenType is the kind of an authentication token, as found in the security blobs of
+// SMB or in the Authorization headers of HTTP
+type TokenType int
+
+// Token types returned by DetectTokenType
+const (
+	TokenUnknown     TokenType = iota
+	TokenSPNEGOInit            // InitialContextToken carrying a NegTokenInit
+	TokenSPNEGOResp            // NegTokenResp
+	TokenNTLMSSP               // Raw NTLM message
+	TokenKerberos              // InitialContextToken of Kerberos, usually carrying an AP-REQ
+	TokenKerberosRaw           // AP-REQ without the GSS-API framing
+	TokenNegoex                // Raw NEGOEX messages
+)
+
+var tokenTypeNames = map[TokenType]string{
+	TokenUnknown:     "unknown",
+	TokenSPNEGOInit:  "SPNEGO NegTokenInit",
+	TokenSPNEGOResp:  "SPNEGO NegTokenResp",
+	TokenNTLMSSP:     "NTLMSSP",
+	TokenKerberos:    "Kerberos",
+	TokenKerberosRaw: "Kerberos AP-REQ",
+	TokenNegoex:      "NEGOEX",
+}
+
+func (t TokenType) String() string {
+	if name, ok := tokenTypeNames[t]; ok {
+		return name
+	}
+	return tokenTypeNames[TokenUnknown]
+}
+
+// ntlmSignature starts every NTLM message, "NTLMSSP\0"
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// DetectTokenType inspects the framing of the token to route it to the right mechanism.
+// The token is not validated, the parsers of the mechanism have to be used for that
+func DetectTokenType(token []byte) TokenType {
+	switch {
+	case len(token) == 0:
+		return TokenUnknown
+	case bytes.HasPrefix(token, ntlmSignature):
+		return TokenNTLMSSP
+	case IsNegoexToken(token):
+		return TokenNegoex
+	}
+
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(token, &raw); err != nil {
+		return TokenUnknown
+	}
+	switch {
+	case raw.Class == asn1.ClassContextSpecific && raw.Tag == 1 && raw.IsCompound:
+		return TokenSPNEGOResp
+	case raw.Class == asn1.ClassApplication && raw.Tag == 14 && raw.IsCompound:
+		return TokenKerberosRaw
+	}
+
+	mech, _, err := UnwrapGSSToken(token)
+	if err != nil {
+		return TokenUnknown
+	}
+	switch {
+	case mech.Equal(SpnegoOID):
+		return TokenSPNEGOInit
+	case mech.Equal(KerberosOID), mech.Equal(MsKerberosOid):
+		return TokenKerberos
+	}
+	return TokenUnknown
+}
@@ -0,0 +1,145 @@
+package spnego_test
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"strings"
+	"testing"
+
+	"github.com/msultra/spnego"
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+// gssToken frames the inner token as a GSS-API InitialContextToken of the mechanism
+func gssToken(t *testing.T, mech asn1.ObjectIdentifier, inner []byte) []byte {
+	t.Helper()
+	bs, err := spnego.WrapGSSToken(mech, inner)
+	if err != nil {
+		t.Fatalf("WrapGSSToken() failed: %v", err)
+	}
+	return bs
+}
+
+func TestGSSToken(t *testing.T) {
+	// Long form length, the inner token is larger than 127 bytes
+	inner := bytes.Repeat([]byte{0x01}, 300)
+	bs := gssToken(t, spnego.KerberosOID, inner)
+	if bs[0] != 0x60 || bs[1] != 0x82 {
+		t.Fatalf("token starts with %x", bs[:2])
+	}
+	mech, got, err := spnego.UnwrapGSSToken(bs)
+	if err != nil || !mech.Equal(spnego.KerberosOID) || !bytes.Equal(got, inner) {
+		t.Fatalf("UnwrapGSSToken() = %v, %x, %v", mech, got, err)
+	}
+
+	// SPNEGO uses the same framing around the NegotiationToken
+	init, err := spnego.EncodeNegTokenInit([]asn1.ObjectIdentifier{spnego.NtlmOID}, []byte("token"))
+	if err != nil {
+		t.Fatalf("EncodeNegTokenInit() failed: %v", err)
+	}
+	if mech, inner, err = spnego.UnwrapGSSToken(init); err != nil || !mech.Equal(spnego.SpnegoOID) {
+		t.Fatalf("UnwrapGSSToken() = %v, %v", mech, err)
+	}
+	if !bytes.Equal(gssToken(t, spnego.SpnegoOID, inner), init) {
+		t.Fatalf("WrapGSSToken() differs from EncodeNegTokenInit()")
+	}
+
+	for _, invalid := range [][]byte{nil, {0x60, 0x00}, append(bs, 0x00), {0x30, 0x00}} {
+		if _, _, err := spnego.UnwrapGSSToken(invalid); err == nil {
+			t.Fatalf("UnwrapGSSToken() should fail for %x", invalid)
+		}
+	}
+}
+
+func TestDetectTokenType(t *testing.T) {
+	negotiate, err := (&ntlm.NtlmProvider{User: "User", Password: "Password"}).InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	init, err := spnego.EncodeNegTokenInit([]asn1.ObjectIdentifier{spnego.NtlmOID}, negotiate)
+	if err != nil {
+		t.Fatalf("EncodeNegTokenInit() failed: %v", err)
+	}
+	resp, err := spnego.EncodeNegTokenResp(spnego.NegTokenResp{NegState: spnego.AcceptCompleted})
+	if err != nil {
+		t.Fatalf("EncodeNegTokenResp() failed: %v", err)
+	}
+	apReq, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 14, IsCompound: true, Bytes: []byte{0x30, 0x00}})
+	if err != nil {
+		t.Fatalf("asn1.Marshal() failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		token    []byte
+		expected spnego.TokenType
+	}{
+		{"empty", nil, spnego.TokenUnknown},
+		{"garbage", []byte("garbage"), spnego.TokenUnknown},
+		{"NTLMSSP", negotiate, spnego.TokenNTLMSSP},
+		{"NegTokenInit", init, spnego.TokenSPNEGOInit},
+		{"NegTokenResp", resp, spnego.TokenSPNEGOResp},
+		{"Kerberos", gssToken(t, spnego.KerberosOID, append([]byte{0x01, 0x00}, apReq...)), spnego.TokenKerberos},
+		{"MS Kerberos", gssToken(t, spnego.MsKerberosOid, append([]byte{0x01, 0x00}, apReq...)), spnego.TokenKerberos},
+		{"raw AP-REQ", apReq, spnego.TokenKerberosRaw},
+		{"NEGOEX", negoexToken(), spnego.TokenNegoex},
+		{"unknown mechanism", gssToken(t, asn1.ObjectIdentifier{1, 2, 3}, nil), spnego.TokenUnknown},
+	} {
+		if got := spnego.DetectTokenType(tc.token); got != tc.expected {
+			t.Errorf("%s: DetectTokenType() = %s, expected %s", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	negotiate, err := (&ntlm.NtlmProvider{User: "User", Password: "Password"}).InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	init, err := spnego.EncodeNegTokenInitGeneric(spnego.NegTokenInit{
+		MechTypes: []asn1.ObjectIdentifier{spnego.NtlmOID, spnego.KerberosOID},
+		ReqFlags:  spnego.NewReqFlags(spnego.MutualFlag, spnego.IntegFlag),
+		MechToken: negotiate,
+	})
+	if err != nil {
+		t.Fatalf("EncodeNegTokenInitGeneric() failed: %v", err)
+	}
+	resp, err := spnego.EncodeNegTokenResp(spnego.NegTokenResp{
+		NegState:      spnego.AcceptIncomplete,
+		SupportedMech: spnego.NtlmOID,
+		MechListMIC:   []byte{0xde, 0xad},
+	})
+	if err != nil {
+		t.Fatalf("EncodeNegTokenResp() failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token []byte
+		want  []string
+	}{
+		{"NegTokenInit", init, []string{
+			"SPNEGO NegTokenInit\n",
+			"    1.3.6.1.4.1.311.2.2.10 (NTLM)\n",
+			"  reqFlags: mutualFlag|integFlag\n",
+			"  mechToken:\n    NTLM NEGOTIATE\n      NegotiateFlags: ",
+		}},
+		{"NegTokenResp", resp, []string{
+			"SPNEGO NegTokenResp\n",
+			"  negState: accept-incomplete\n",
+			"  supportedMech: 1.3.6.1.4.1.311.2.2.10 (NTLM)\n",
+			"  mechListMIC: dead\n",
+		}},
+		{"Kerberos", gssToken(t, spnego.KerberosOID, []byte{0x01, 0x00, 0x6e, 0x00}), []string{"Kerberos (1.2.840.113554.1.2.2), 4 bytes\n"}},
+		{"garbage", []byte("garbage"), []string{"unknown token, 7 bytes: 67617262616765\n"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dump := spnego.Dump(tc.token)
+			for _, want := range tc.want {
+				if !strings.Contains(dump, want) {
+					t.Fatalf("Dump() = %s, want it to contain %q", dump, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package spnego
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+// contextFlagNames are the names of the reqFlags bits (RFC 4178 4.2.1)
+var contextFlagNames = []string{
+	DelegFlag:    "delegFlag",
+	MutualFlag:   "mutualFlag",
+	ReplayFlag:   "replayFlag",
+	SequenceFlag: "sequenceFlag",
+	AnonFlag:     "anonFlag",
+	ConfFlag:     "confFlag",
+	IntegFlag:    "integFlag",
+}
+
+// negoexTypeNames are the names of the NEGOEX message types
+var negoexTypeNames = map[uint32]string{
+	NegoexInitiatorNego:     "INITIATOR_NEGO",
+	NegoexAcceptorNego:      "ACCEPTOR_NEGO",
+	NegoexInitiatorMetaData: "INITIATOR_META_DATA",
+	NegoexAcceptorMetaData:  "ACCEPTOR_META_DATA",
+	NegoexChallenge:         "CHALLENGE",
+	NegoexAPRequest:         "AP_REQUEST",
+	NegoexVerify:            "VERIFY",
+	NegoexAlert:             "ALERT",
+}
+
+// Dump decodes a SPNEGO or mechanism token into a human readable tree for debugging
+// purposes: the fields, the flags by name, the OIDs and the AV pairs of NTLM. The
+// mechanism tokens are dumped recursively, the decoding errors are reported inline
+func Dump(token []byte) string {
+	var sb strings.Builder
+	dumpToken(&sb, token, "")
+	return sb.String()
+}
+
+func dumpToken(sb *strings.Builder, token []byte, indent string) {
+	switch tokenType := DetectTokenType(token); tokenType {
+	case TokenSPNEGOInit:
+		dumpNegTokenInit(sb, token, indent)
+	case TokenSPNEGOResp:
+		dumpNegTokenResp(sb, token, indent)
+	case TokenNTLMSSP:
+		dumpLines(sb, ntlm.Dump(token), indent)
+	case TokenNegoex:
+		dumpNegoex(sb, token, indent)
+	case TokenKerberos:
+		mech, inner, _ := UnwrapGSSToken(token)
+		fmt.Fprintf(sb, "%s%s (%s), %d bytes\n", indent, tokenType, mech, len(inner))
+	case TokenKerberosRaw:
+		fmt.Fprintf(sb, "%s%s, %d bytes\n", indent, tokenType, len(token))
+	default:
+		fmt.Fprintf(sb, "%s%s token, %d bytes: %s\n", indent, tokenType, len(token), hex.EncodeToString(token))
+	}
+}
+
+// dumpLines writes the lines of a nested dump under the indentation
+func dumpLines(sb *strings.Builder, dump, indent string) {
+	for _, line := range strings.Split(strings.TrimSuffix(dump, "\n"), "\n") {
+		sb.WriteString(indent + line + "\n")
+	}
+}
+
+func dumpNegTokenInit(sb *strings.Builder, token []byte, indent string) {
+	fmt.Fprintf(sb, "%sSPNEGO NegTokenInit\n", indent)
+	init, err := UnwrapInitialToken(token)
+	if err != nil {
+		fmt.Fprintf(sb, "%s  error: %v\n", indent, err)
+		return
+	}
+
+	fmt.Fprintf(sb, "%s  mechTypes:\n", indent)
+	for _, mech := range init.MechTypes {
+		fmt.Fprintf(sb, "%s    %s (%s)\n", indent, mech, MechanismName(mech))
+	}
+	if init.ReqFlags.BitLength > 0 {
+		var flags []string
+		for flag, name := range contextFlagNames {
+			if init.HasFlag(ContextFlag(flag)) {
+				flags = append(flags, name)
+			}
+		}
+		fmt.Fprintf(sb, "%s  reqFlags: %s\n", indent, strings.Join(flags, "|"))
+	}
+	if len(init.MechToken) > 0 {
+		fmt.Fprintf(sb, "%s  mechToken:\n", indent)
+		dumpToken(sb, init.MechToken, indent+"    ")
+	}
+	if len(init.MechListMIC) > 0 {
+		fmt.Fprintf(sb, "%s  mechListMIC: %x\n", indent, init.MechListMIC)
+	}
+}
+
+func dumpNegTokenResp(sb *strings.Builder, token []byte, indent string) {
+	fmt.Fprintf(sb, "%sSPNEGO NegTokenResp\n", indent)
+	resp, err := ParseResponseToken(token)
+	if err != nil {
+		fmt.Fprintf(sb, "%s  error: %v\n", indent, err)
+		return
+	}
+
+	fmt.Fprintf(sb, "%s  negState: %s\n", indent, NegStateName(resp.NegState))
+	if len(resp.SupportedMech) > 0 {
+		fmt.Fprintf(sb, "%s  supportedMech: %s (%s)\n", indent, resp.SupportedMech, MechanismName(resp.SupportedMech))
+	}
+	if len(resp.ResponseToken) > 0 {
+		fmt.Fprintf(sb, "%s  responseToken:\n", indent)
+		dumpToken(sb, resp.ResponseToken, indent+"    ")
+	}
+	if len(resp.MechListMIC) > 0 {
+		fmt.Fprintf(sb, "%s  mechListMIC: %x\n", indent, resp.MechListMIC)
+	}
+}
+
+func dumpNegoex(sb *strings.Builder, token []byte, indent string) {
+	fmt.Fprintf(sb, "%sNEGOEX\n", indent)
+	msgs, err := ParseNegoexMessages(token)
+	if err != nil {
+		fmt.Fprintf(sb, "%s  error: %v\n", indent, err)
+		return
+	}
+
+	for _, msg := range msgs {
+		fmt.Fprintf(sb, "%s  %s (sequence %d, conversation %x)\n", indent, negoexTypeNames[msg.Type], msg.SequenceNum, msg.ConversationID)
+		switch msg.Type {
+		case NegoexInitiatorNego, NegoexAcceptorNego:
+			for _, scheme := range msg.AuthSchemes {
+				fmt.Fprintf(sb, "%s    authScheme: %x\n", indent, scheme)
+			}
+		case NegoexVerify:
+			fmt.Fprintf(sb, "%s    authScheme: %x\n", indent, msg.AuthScheme)
+			fmt.Fprintf(sb, "%s    checksum: type %d, %x\n", indent, msg.ChecksumType, msg.Checksum)
+		case NegoexAlert:
+			fmt.Fprintf(sb, "%s    authScheme: %x\n", indent, msg.AuthScheme)
+			fmt.Fprintf(sb, "%s    errorCode: 0x%08x\n", indent, msg.ErrorCode)
+		default:
+			fmt.Fprintf(sb, "%s    authScheme: %x\n", indent, msg.AuthScheme)
+			fmt.Fprintf(sb, "%s    exchange: %d bytes\n", indent, len(msg.Exchange))
+		}
+	}
+}
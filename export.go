@@ -0,0 +1,85 @@
+package spnego
+
+import (
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+)
+
+// ContextExporter is implemented by the mechanisms able to serialize an established
+// security context, e.g. ntlm.NtlmProvider
+type ContextExporter interface {
+	Export() ([]byte, error)
+}
+
+// ExportableContext is a security context ExportSecContext can serialize: an Initiator,
+// an Acceptor or the SPNEGOClient and SPNEGOServer wrapping them
+type ExportableContext interface {
+	GetOID() asn1.ObjectIdentifier
+	IsEstablished() bool
+}
+
+// ContextImporter restores a security context serialized by the Export method of a mechanism
+type ContextImporter func(b []byte) (Initiator, error)
+
+// exportedSecContext is the serialized form of ExportSecContext
+type exportedSecContext struct {
+	Mech    asn1.ObjectIdentifier
+	Context []byte
+}
+
+// RegisterContextImporter makes ImportSecContext able to restore the contexts of a mechanism,
+// e.g. with ntlm.Import. Registering an OID again replaces its importer
+func RegisterContextImporter(oid asn1.ObjectIdentifier, importer ContextImporter) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if registry.importers == nil {
+		registry.importers = make(map[string]ContextImporter)
+	}
+	registry.importers[oid.String()] = importer
+}
+
+// ExportSecContext serializes an established security context, tagged with its mechanism,
+// so that another process can sign and seal with ImportSecContext. For SPNEGO, the context
+// of the selected mechanism is exported, on the initiator or the acceptor side. The output
+// contains secret key material
+func ExportSecContext(ctx ExportableContext) ([]byte, error) {
+	switch spnego := ctx.(type) {
+	case *SPNEGOClient:
+		ctx = spnego.SelectedMech
+	case *SPNEGOServer:
+		ctx = spnego.SelectedMech
+	}
+	if ctx == nil || !ctx.IsEstablished() {
+		return nil, errors.New("security context is not established")
+	}
+
+	exporter, ok := ctx.(ContextExporter)
+	if !ok {
+		return nil, errors.New("security context of " + MechanismName(ctx.GetOID()) + " cannot be exported")
+	}
+	b, err := exporter.Export()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(exportedSecContext{Mech: ctx.GetOID(), Context: b})
+}
+
+// ImportSecContext restores a security context serialized by ExportSecContext with the
+// importer registered for its mechanism
+func ImportSecContext(b []byte) (Initiator, error) {
+	var ctx exportedSecContext
+	if err := json.Unmarshal(b, &ctx); err != nil {
+		return nil, errors.New("failed to unmarshal security context: " + err.Error())
+	}
+
+	registry.RLock()
+	importer, ok := registry.importers[ctx.Mech.String()]
+	registry.RUnlock()
+
+	if !ok {
+		return nil, errors.New("no context importer for " + MechanismName(ctx.Mech))
+	}
+	return importer(ctx.Context)
+}
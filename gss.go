@@ -0,0 +1,47 @@
+package spnego
+
+import (
+	"encoding/asn1"
+	"errors"
+)
+
+// WrapGSSToken frames an inner token as an InitialContextToken of the mechanism
+// (RFC 2743 3.1): the [APPLICATION 0] tag, the mechanism OID, then the inner token.
+// A Kerberos AP-REQ inner token starts with its two bytes TOK_ID (RFC 1964 1.1)
+func WrapGSSToken(mech asn1.ObjectIdentifier, inner []byte) ([]byte, error) {
+	oid, err := asn1.Marshal(mech)
+	if err != nil {
+		return nil, errors.New("failed to marshal mechanism: " + err.Error())
+	}
+	return asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassApplication,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      append(oid, inner...),
+	})
+}
+
+// UnwrapGSSToken returns the mechanism OID and the inner token of an InitialContextToken
+func UnwrapGSSToken(data []byte) (asn1.ObjectIdentifier, []byte, error) {
+	if err := checkLimit("MaxTokenLength", len(data), Limits.MaxTokenLength); err != nil {
+		return nil, nil, err
+	}
+
+	var token asn1.RawValue
+	rest, err := asn1.Unmarshal(data, &token)
+	if err != nil {
+		return nil, nil, errors.New("failed to unmarshal InitialContextToken: " + err.Error())
+	}
+	if len(rest) > 0 {
+		return nil, nil, errors.New("trailing data after InitialContextToken")
+	}
+	if token.Class != asn1.ClassApplication || token.Tag != 0 {
+		return nil, nil, errors.New("not a GSS-API InitialContextToken")
+	}
+
+	var mech asn1.ObjectIdentifier
+	if rest, err = asn1.Unmarshal(token.Bytes, &mech); err != nil {
+		return nil, nil, errors.New("failed to unmarshal mechanism: " + err.Error())
+	}
+	return mech, rest, nil
+}
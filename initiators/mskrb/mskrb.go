@@ -1 +1,284 @@
 package mskrb
+
+import (
+	"encoding/asn1"
+	"errors"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+var (
+	KerberosOID   = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+	MsKerberosOID = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
+)
+
+// DefaultContextFlags are the GSS-API flags requested by Windows clients
+var DefaultContextFlags = []int{gssapi.ContextFlagMutual, gssapi.ContextFlagInteg, gssapi.ContextFlagConf}
+
+type KerberosProvider struct {
+	// SPN (service principal name of the target, e.g. cifs/dc.lab.lan)
+	SPN string
+
+	// CCachePath (path to the credential cache holding the TGT, e.g. /tmp/krb5cc_1000)
+	// Only used if Client is nil
+	CCachePath string
+
+	// Config (krb5.conf used to reach the KDC)
+	// Can be nil if the service ticket is already in the credential cache
+	Config *config.Config
+
+	// Client (Kerberos client, e.g. created from a keytab with client.NewWithKeytab)
+	// Takes precedence over CCachePath
+	Client *client.Client
+
+	// ContextFlags (GSS-API flags sent in the authenticator checksum)
+	// DefaultContextFlags are used if nil
+	ContextFlags []int
+
+	// Ticket (service ticket for the SPN)
+	// Don't touch unless you know what you're doing
+	Ticket *messages.Ticket
+
+	// Key (session key of the ticket, replaced by the acceptor subkey if one is sent)
+	// Don't touch unless you know what you're doing
+	Key types.EncryptionKey
+
+	// SequenceNumber (used to sequence MIC tokens, starts from the authenticator sequence number)
+	// Don't touch unless you know what you're doing
+	SequenceNumber uint64
+
+	// PeerSequenceNumber (expected sequence number of the next acceptor MIC token)
+	// Only checked with mutual authentication, where the AP-REP carries the initial value
+	PeerSequenceNumber uint64
+
+	acceptorSubkey bool
+	peerSequence   bool
+	mutual         bool
+	established    bool
+}
+
+// GetOID returns the Kerberos 5 mechanism OID
+func (k *KerberosProvider) GetOID() asn1.ObjectIdentifier {
+	return KerberosOID
+}
+
+// InitSecContext acquires a service ticket for the SPN and generates the AP-REQ token
+func (k *KerberosProvider) InitSecContext() ([]byte, error) {
+	if k.SPN == "" {
+		return nil, errors.New("no service principal name provided")
+	}
+
+	if k.Client == nil {
+		if err := k.loadCCache(); err != nil {
+			return nil, err
+		}
+	}
+
+	if k.Ticket == nil {
+		tkt, key, err := k.Client.GetServiceTicket(k.SPN)
+		if err != nil {
+			return nil, errors.New("failed to get service ticket: " + err.Error())
+		}
+		k.Ticket, k.Key = &tkt, key
+	}
+
+	contextFlags := k.ContextFlags
+	if contextFlags == nil {
+		contextFlags = DefaultContextFlags
+	}
+
+	var apOptions []int
+	k.mutual = false
+	for _, f := range contextFlags {
+		if f == gssapi.ContextFlagMutual {
+			apOptions = append(apOptions, flags.APOptionMutualRequired)
+			k.mutual = true
+		}
+	}
+
+	token, err := spnego.NewKRB5TokenAPREQ(k.Client, *k.Ticket, k.Key, contextFlags, apOptions)
+	if err != nil {
+		return nil, errors.New("failed to create AP-REQ: " + err.Error())
+	}
+
+	// RFC 4121 4.2.6.1: MIC tokens are sequenced from the number chosen in the authenticator
+	if err := token.APReq.DecryptAuthenticator(k.Key); err != nil {
+		return nil, errors.New("failed to read authenticator: " + err.Error())
+	}
+	k.SequenceNumber = uint64(token.APReq.Authenticator.SeqNumber)
+	k.peerSequence = false
+
+	bs, err := token.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	// Without mutual authentication, the acceptor does not answer with an AP-REP
+	k.established = !k.mutual
+	return bs, nil
+}
+
+// RequestContextFlags sets ContextFlags from GSS-API flags (RFC 2744 values) for the next AP-REQ
+func (k *KerberosProvider) RequestContextFlags(flags uint32) {
+	k.ContextFlags = nil
+	for flag := 1; flag <= gssapi.ContextFlagAnon; flag <<= 1 {
+		if flags&uint32(flag) != 0 {
+			k.ContextFlags = append(k.ContextFlags, flag)
+		}
+	}
+}
+
+// NegotiatedContextFlags returns the GSS-API flags sent in the authenticator once the
+// context is established, mutual authentication only if the AP-REP was verified
+func (k *KerberosProvider) NegotiatedContextFlags() uint32 {
+	if !k.established {
+		return 0
+	}
+	contextFlags := k.ContextFlags
+	if contextFlags == nil {
+		contextFlags = DefaultContextFlags
+	}
+
+	var flags uint32
+	for _, flag := range contextFlags {
+		flags |= uint32(flag)
+	}
+	if !k.mutual {
+		flags &^= gssapi.ContextFlagMutual
+	}
+	return flags
+}
+
+// PeerName returns the service principal name of the acceptor
+func (k *KerberosProvider) PeerName() string {
+	return k.SPN
+}
+
+// AcceptSecContext processes the AP-REP (or KRB-ERROR) token sent by the acceptor
+func (k *KerberosProvider) AcceptSecContext(sc []byte) ([]byte, error) {
+	if k.Ticket == nil {
+		return nil, errors.New("InitSecContext must be called first")
+	}
+
+	var token spnego.KRB5Token
+	if err := token.Unmarshal(sc); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case token.IsKRBError():
+		return nil, token.KRBError
+	case token.IsAPRep():
+		b, err := crypto.DecryptEncPart(token.APRep.EncPart, k.Key, keyusage.AP_REP_ENCPART)
+		if err != nil {
+			return nil, errors.New("failed to decrypt AP-REP: " + err.Error())
+		}
+
+		var part messages.EncAPRepPart
+		if err := part.Unmarshal(b); err != nil {
+			return nil, err
+		}
+
+		// RFC 4121 4.2.2: the acceptor subkey protects the messages when it is present
+		if part.Subkey.KeyType != 0 {
+			k.Key = part.Subkey
+			k.acceptorSubkey = true
+		}
+		k.PeerSequenceNumber = uint64(part.SequenceNumber)
+		k.peerSequence = true
+		k.established = true
+		return nil, nil
+	}
+	return nil, errors.New("unexpected Kerberos token")
+}
+
+// GetMIC generates an RFC 4121 MIC token for the given bytes
+func (k *KerberosProvider) GetMIC(bs []byte) ([]byte, error) {
+	if !k.established {
+		return nil, errors.New("security context is not established")
+	}
+
+	token := gssapi.MICToken{
+		SndSeqNum: k.SequenceNumber,
+		Payload:   bs,
+	}
+	if k.acceptorSubkey {
+		token.Flags |= gssapi.MICTokenFlagAcceptorSubkey
+	}
+
+	if err := token.SetChecksum(k.Key, keyusage.GSSAPI_INITIATOR_SIGN); err != nil {
+		return nil, err
+	}
+	k.SequenceNumber++
+	return token.Marshal()
+}
+
+// VerifyMIC checks an RFC 4121 MIC token generated by the acceptor for the given bytes,
+// and its sequence number when it was announced in the AP-REP
+func (k *KerberosProvider) VerifyMIC(bs, mic []byte) error {
+	if !k.established {
+		return errors.New("security context is not established")
+	}
+
+	var token gssapi.MICToken
+	if err := token.Unmarshal(mic, true); err != nil {
+		return err
+	}
+	token.Payload = bs
+	if ok, err := token.Verify(k.Key, keyusage.GSSAPI_ACCEPTOR_SIGN); !ok {
+		if err == nil {
+			err = errors.New("MIC token verification failed")
+		}
+		return err
+	}
+	if k.peerSequence {
+		if token.SndSeqNum != k.PeerSequenceNumber {
+			return errors.New("unexpected MIC token sequence number")
+		}
+		k.PeerSequenceNumber++
+	}
+	return nil
+}
+
+// VerifyMechListMIC verifies the mechListMIC sent by the acceptor over the DER-encoded MechTypeList
+func (k *KerberosProvider) VerifyMechListMIC(mechList, mic []byte) error {
+	return k.VerifyMIC(mechList, mic)
+}
+
+// SessionKey returns the established session key
+func (k *KerberosProvider) SessionKey() []byte {
+	return k.Key.KeyValue
+}
+
+// IsEstablished reports whether the AP exchange completed
+func (k *KerberosProvider) IsEstablished() bool {
+	return k.established
+}
+
+func (k *KerberosProvider) loadCCache() error {
+	if k.CCachePath == "" {
+		return errors.New("no credential cache or client provided")
+	}
+
+	ccache, err := credentials.LoadCCache(k.CCachePath)
+	if err != nil {
+		return errors.New("failed to load credential cache: " + err.Error())
+	}
+
+	cfg := k.Config
+	if cfg == nil {
+		cfg = config.New()
+	}
+
+	k.Client, err = client.NewFromCCache(ccache, cfg)
+	return err
+}
@@ -0,0 +1,294 @@
+package mskrb_test
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/msultra/spnego/initiators/mskrb"
+)
+
+const (
+	testRealm = "LAB.LAN"
+	testSPN   = "cifs/dc.lab.lan"
+)
+
+// newTestProvider returns a provider holding a service ticket issued for testSPN,
+// as if it was returned by the KDC in a TGS-REP, along with the service keytab
+func newTestProvider(t *testing.T, contextFlags []int) (*mskrb.KerberosProvider, *keytab.Keytab) {
+	t.Helper()
+
+	kt := keytab.New()
+	if err := kt.AddEntry(testSPN, testRealm, "service password", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatalf("failed to create service keytab: %v", err)
+	}
+
+	now := time.Now().UTC()
+	tkt, key, err := messages.NewTicket(
+		types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "user"),
+		testRealm,
+		types.NewPrincipalName(nametype.KRB_NT_SRV_INST, testSPN),
+		testRealm,
+		types.NewKrbFlags(),
+		kt,
+		etypeID.AES256_CTS_HMAC_SHA1_96,
+		1,
+		now,
+		now,
+		now.Add(time.Hour),
+		now.Add(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("failed to create service ticket: %v", err)
+	}
+
+	return &mskrb.KerberosProvider{
+		SPN:          testSPN,
+		Client:       client.NewWithPassword("user", testRealm, "password", config.New()),
+		ContextFlags: contextFlags,
+		Ticket:       &tkt,
+		Key:          key,
+	}, kt
+}
+
+func TestInitSecContext(t *testing.T) {
+	provider, kt := newTestProvider(t, []int{gssapi.ContextFlagInteg, gssapi.ContextFlagConf})
+
+	bs, err := provider.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	if bs[0] != 0x60 {
+		t.Fatalf("token is not a GSS-API InitialContextToken")
+	}
+
+	var token spnego.KRB5Token
+	if err := token.Unmarshal(bs); err != nil {
+		t.Fatalf("failed to unmarshal KRB5 token: %v", err)
+	}
+	if !token.IsAPReq() {
+		t.Fatalf("token is not an AP-REQ")
+	}
+
+	// The service decrypts the ticket with its key, then the authenticator with the session key
+	if err := token.APReq.Ticket.DecryptEncPart(kt, nil); err != nil {
+		t.Fatalf("failed to decrypt ticket: %v", err)
+	}
+	if err := token.APReq.DecryptAuthenticator(token.APReq.Ticket.DecryptedEncPart.Key); err != nil {
+		t.Fatalf("failed to decrypt authenticator: %v", err)
+	}
+	if name := token.APReq.Authenticator.CName.PrincipalNameString(); name != "user" {
+		t.Fatalf("authenticator client name is %s, expected user", name)
+	}
+
+	if !provider.IsEstablished() {
+		t.Fatalf("provider should be established without mutual authentication")
+	}
+	if !bytes.Equal(provider.SessionKey(), token.APReq.Ticket.DecryptedEncPart.Key.KeyValue) {
+		t.Fatalf("session key is different from the ticket one")
+	}
+}
+
+func TestInitSecContextMutual(t *testing.T) {
+	provider, _ := newTestProvider(t, nil)
+
+	if _, err := provider.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	if provider.IsEstablished() {
+		t.Fatalf("provider should wait for the AP-REP with mutual authentication")
+	}
+	if _, err := provider.GetMIC([]byte("message")); err == nil {
+		t.Fatalf("GetMIC() should fail before the context is established")
+	}
+}
+
+func TestContextFlags(t *testing.T) {
+	provider, _ := newTestProvider(t, nil)
+	provider.RequestContextFlags(gssapi.ContextFlagInteg | gssapi.ContextFlagConf | gssapi.ContextFlagDeleg)
+	if len(provider.ContextFlags) != 3 || provider.ContextFlags[0] != gssapi.ContextFlagDeleg {
+		t.Fatalf("ContextFlags = %v", provider.ContextFlags)
+	}
+
+	if provider.NegotiatedContextFlags() != 0 {
+		t.Fatalf("no flags should be reported before the context is established")
+	}
+	if _, err := provider.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	if flags := provider.NegotiatedContextFlags(); flags != gssapi.ContextFlagInteg|gssapi.ContextFlagConf|gssapi.ContextFlagDeleg {
+		t.Fatalf("NegotiatedContextFlags() = %d", flags)
+	}
+}
+
+func TestGetMIC(t *testing.T) {
+	provider, _ := newTestProvider(t, []int{gssapi.ContextFlagInteg})
+
+	bs, err := provider.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+
+	var apReq spnego.KRB5Token
+	if err := apReq.Unmarshal(bs); err != nil {
+		t.Fatalf("failed to unmarshal KRB5 token: %v", err)
+	}
+	if err := apReq.APReq.DecryptAuthenticator(provider.Key); err != nil {
+		t.Fatalf("failed to decrypt authenticator: %v", err)
+	}
+
+	// The sequence starts from the number chosen in the authenticator
+	seq := uint64(apReq.APReq.Authenticator.SeqNumber)
+	for i := seq; i < seq+2; i++ {
+		bs, err := provider.GetMIC([]byte("message"))
+		if err != nil {
+			t.Fatalf("GetMIC() failed: %v", err)
+		}
+
+		var token gssapi.MICToken
+		if err := token.Unmarshal(bs, false); err != nil {
+			t.Fatalf("failed to unmarshal MIC token: %v", err)
+		}
+		if token.SndSeqNum != i {
+			t.Fatalf("sequence number is %d, expected %d", token.SndSeqNum, i)
+		}
+
+		token.Payload = []byte("message")
+		if ok, err := token.Verify(provider.Key, keyusage.GSSAPI_INITIATOR_SIGN); !ok {
+			t.Fatalf("MIC token verification failed: %v", err)
+		}
+	}
+}
+
+func TestVerifyMIC(t *testing.T) {
+	provider, _ := newTestProvider(t, []int{gssapi.ContextFlagInteg})
+	if _, err := provider.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+
+	token := gssapi.MICToken{
+		Flags:     gssapi.MICTokenFlagSentByAcceptor,
+		SndSeqNum: 0,
+		Payload:   []byte("message"),
+	}
+	if err := token.SetChecksum(provider.Key, keyusage.GSSAPI_ACCEPTOR_SIGN); err != nil {
+		t.Fatalf("SetChecksum() failed: %v", err)
+	}
+	mic, err := token.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal MIC token: %v", err)
+	}
+
+	if err := provider.VerifyMIC([]byte("message"), mic); err != nil {
+		t.Fatalf("VerifyMIC() failed: %v", err)
+	}
+	if err := provider.VerifyMechListMIC([]byte("tampered"), mic); err == nil {
+		t.Fatalf("VerifyMechListMIC() should fail for another message")
+	}
+
+	// A MIC generated by the initiator is not accepted
+	own, err := provider.GetMIC([]byte("message"))
+	if err != nil {
+		t.Fatalf("GetMIC() failed: %v", err)
+	}
+	if err := provider.VerifyMIC([]byte("message"), own); err == nil {
+		t.Fatalf("VerifyMIC() should reject a MIC token sent by the initiator")
+	}
+}
+
+// newAPRep returns the KRB5 token of an AP-REP announcing the acceptor sequence number,
+// as gokrb5 can't marshal one
+func newAPRep(t *testing.T, key types.EncryptionKey, seq int64) []byte {
+	t.Helper()
+
+	part, err := asn1.MarshalWithParams(messages.EncAPRepPart{
+		CTime:          time.Now().UTC().Truncate(time.Second),
+		SequenceNumber: seq,
+	}, "application,explicit,tag:27")
+	if err != nil {
+		t.Fatalf("failed to marshal EncAPRepPart: %v", err)
+	}
+	encPart, err := crypto.GetEncryptedData(part, key, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		t.Fatalf("failed to encrypt EncAPRepPart: %v", err)
+	}
+	rep, err := asn1.MarshalWithParams(messages.APRep{
+		PVNO:    5,
+		MsgType: msgtype.KRB_AP_REP,
+		EncPart: encPart,
+	}, "application,explicit,tag:15")
+	if err != nil {
+		t.Fatalf("failed to marshal AP-REP: %v", err)
+	}
+
+	oid, _ := asn1.Marshal(mskrb.KerberosOID)
+	bs := append(oid, 0x02, 0x00)
+	return asn1tools.AddASNAppTag(append(bs, rep...), 0)
+}
+
+// acceptorMIC returns a MIC token generated by the acceptor with the given sequence number
+func acceptorMIC(t *testing.T, key types.EncryptionKey, seq uint64, bs []byte) []byte {
+	t.Helper()
+
+	token := gssapi.MICToken{
+		Flags:     gssapi.MICTokenFlagSentByAcceptor,
+		SndSeqNum: seq,
+		Payload:   bs,
+	}
+	if err := token.SetChecksum(key, keyusage.GSSAPI_ACCEPTOR_SIGN); err != nil {
+		t.Fatalf("SetChecksum() failed: %v", err)
+	}
+	mic, err := token.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal MIC token: %v", err)
+	}
+	return mic
+}
+
+func TestVerifyMICMutual(t *testing.T) {
+	provider, _ := newTestProvider(t, nil)
+	if _, err := provider.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	if _, err := provider.AcceptSecContext(newAPRep(t, provider.Key, 42)); err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+	if !provider.IsEstablished() || provider.PeerSequenceNumber != 42 {
+		t.Fatalf("AP-REP was not processed, PeerSequenceNumber = %d", provider.PeerSequenceNumber)
+	}
+
+	mic := acceptorMIC(t, provider.Key, 42, []byte("message"))
+	if err := provider.VerifyMIC([]byte("message"), mic); err != nil {
+		t.Fatalf("VerifyMIC() failed: %v", err)
+	}
+	if err := provider.VerifyMIC([]byte("message"), mic); err == nil {
+		t.Fatalf("VerifyMIC() should reject a replayed MIC token")
+	}
+	if err := provider.VerifyMIC([]byte("message"), acceptorMIC(t, provider.Key, 44, []byte("message"))); err == nil {
+		t.Fatalf("VerifyMIC() should reject an out of sequence MIC token")
+	}
+	if err := provider.VerifyMIC([]byte("message"), acceptorMIC(t, provider.Key, 43, []byte("message"))); err != nil {
+		t.Fatalf("VerifyMIC() failed: %v", err)
+	}
+}
+
+func TestInitSecContextWithoutCredentials(t *testing.T) {
+	provider := mskrb.KerberosProvider{SPN: testSPN}
+	if _, err := provider.InitSecContext(); err == nil {
+		t.Fatalf("InitSecContext() should fail without credentials")
+	}
+}
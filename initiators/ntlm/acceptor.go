@@ -0,0 +1,398 @@
+package ntlm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/msultra/encoder"
+)
+
+// acceptorFlags are always set in the CHALLENGE message, as the initiators require the target
+const acceptorFlags = RequestTarget | NegotiateTargetInfo | TargetTypeDomain
+
+// Acceptor drives the acceptor side of the provider through the GSS-API calls used
+// by SPNEGO. The methods of the provider, such as GetMIC and IsEstablished, are promoted
+type Acceptor struct {
+	*NtlmProvider
+}
+
+// NewAcceptor returns the acceptor of the provider, which holds the server credentials.
+// The NTLMv1 responses are accepted unless RequireNTLMv2 is set, and the anonymous
+// clients only with AllowAnonymous. A rejected Type 3 message ends the handshake
+func NewAcceptor(p *NtlmProvider) *Acceptor {
+	return &Acceptor{NtlmProvider: p}
+}
+
+// AcceptSecContext answers the Type 1 message with the Type 2 message, then validates
+// the Type 3 message, which completes the handshake without any token to send back. In
+// datagram mode, an empty first token starts the connectionless handshake with the Type 2 message
+func (a *Acceptor) AcceptSecContext(sc []byte) ([]byte, error) {
+	if err := checkLimit("MaxMessageLength", len(sc), Limits.MaxMessageLength); err != nil {
+		return nil, err
+	}
+	switch a.state {
+	case StateInitial:
+		if a.Datagram && len(sc) == 0 {
+			// Connectionless mode: the handshake starts with the CHALLENGE message
+			a.NegotiateMessage = nil
+			return a.GenerateChallengeMessage()
+		}
+		a.NegotiateMessage = append([]byte(nil), sc...)
+		return a.GenerateChallengeMessage()
+	case StateChallengeSent:
+		return nil, a.ValidateAuthenticateMessage(sc)
+	case StateFailed:
+		return nil, fmt.Errorf("%w: the handshake already failed", ErrAuthenticationFailed)
+	}
+	return nil, ErrOutOfOrder
+}
+
+// PeerName returns the client authenticated by the AUTHENTICATE message, as DOMAIN\user
+// or as the UPN it sent, or an empty string for an anonymous client
+func (a *Acceptor) PeerName() string {
+	return a.clientName
+}
+
+// IsLoopback reports whether the authenticated client runs on this machine, i.e. whether
+// it sent MachineID in MsvAvSingleHost. It is always false if MachineID is nil
+func (a *Acceptor) IsLoopback() bool {
+	return len(a.MachineID) == 32 && a.clientHost.MachineID == [32]byte(a.MachineID)
+}
+
+// GenerateChallengeMessage generates the Type 2 message of an acceptor. The flags are
+// NegotiateFlags (DefaultNegotiateFlags if zero), restricted to the ones offered by the
+// client if its Type 1 message was stored in NegotiateMessage. The target name is Domain,
+// the target information holds Domain, Workstation as the server name and the current time
+func (n *NtlmProvider) GenerateChallengeMessage() ([]byte, error) {
+	//        ChallengeMessage
+	//   0-8: Signature
+	//  8-12: MessageType
+	// 12-20: TargetNameFields
+	// 20-24: NegotiateFlags
+	// 24-32: ServerChallenge
+	// 32-40: _
+	// 40-48: TargetInfoFields
+	// 48-56: Version
+	//   56-: Payload
+	if n.state != StateInitial {
+		return nil, ErrOutOfOrder
+	}
+
+	n.configuredFlags = n.NegotiateFlags
+	flags := n.NegotiateFlags
+	if flags == 0 {
+		flags = DefaultNegotiateFlags
+	}
+	if n.Datagram {
+		flags |= NegotiateDatagram
+	}
+	if n.NegotiateMessage != nil {
+		offered, err := negotiateMessageFlags(n.NegotiateMessage)
+		if err != nil {
+			return nil, err
+		}
+		flags &= offered
+	}
+	flags |= acceptorFlags
+	if flags&NegotiateUnicode != 0 {
+		flags &^= NegotiateOEM
+	} else {
+		flags |= NegotiateOEM
+	}
+	n.NegotiateFlags, n.challengeFlags = flags, flags
+
+	if n.ServerChallenge == nil {
+		n.ServerChallenge = make([]byte, 8)
+		if _, err := io.ReadFull(n.random(), n.ServerChallenge); err != nil {
+			return nil, errors.New("failed to generate the server challenge: " + err.Error())
+		}
+	} else if len(n.ServerChallenge) != 8 {
+		return nil, errors.New("server challenge must be 8 bytes long")
+	}
+
+	var err error
+	n.TargetInfo, err = NewTargetInformation(AvPairs{
+		AvIDMsvAvNbDomainName:   encoder.StrToUTF16(n.Domain),
+		AvIDMsvAvNbComputerName: encoder.StrToUTF16(n.Workstation),
+		AvIDMsvAvTimestamp:      binary.LittleEndian.AppendUint64(nil, fileTime(n.now())),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := n.version()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := 56
+	var payload []byte
+	n.TargetName = n.encodeString(n.Domain)
+	challenge := ChallengeMessage{
+		Signature:         Signature,
+		MessageType:       MessageTypeNtLmChallenge,
+		TargetName:        NewVarField(&payload, n.TargetName, &offset),
+		NegotiateFlags:    flags,
+		ServerChallenge:   [8]byte(n.ServerChallenge),
+		TargetInformation: NewVarField(&payload, n.TargetInfo.AvPairsBytes, &offset),
+		Version:           version,
+		Payload:           payload,
+	}
+
+	if n.ChallengeMessage, err = encoder.Marshal(challenge); err != nil {
+		return nil, err
+	}
+	n.debug("NTLM CHALLENGE message", "flags", fmt.Sprintf("0x%08x", flags), "size", len(n.ChallengeMessage))
+	n.state = StateChallengeSent
+	return n.ChallengeMessage, nil
+}
+
+// negotiateMessageFlags returns the flags offered in a Type 1 message
+func negotiateMessageFlags(msg []byte) (uint32, error) {
+	if len(msg) < 16 {
+		return 0, fmt.Errorf("%w: negotiate message is %d bytes long", ErrTruncatedMessage, len(msg))
+	}
+	//   0-8: Signature
+	if !bytes.Equal(msg[:8], Signature[:]) {
+		return 0, ErrBadSignature
+	}
+	//  8-12: MessageType
+	if msgType := binary.LittleEndian.Uint32(msg[8:12]); msgType != MessageTypeNtLmNegotiate {
+		return 0, fmt.Errorf("%w: %d", ErrUnexpectedMessageType, msgType)
+	}
+	// 12-16: NegotiateFlags
+	return binary.LittleEndian.Uint32(msg[12:16]), nil
+}
+
+// ValidateAuthenticateMessage verifies the Type 3 message of the client against the
+// credentials of the provider (User, Domain and Password or Hash) and derives the
+// session keys. The MIC is required for NTLMv2 responses, as the challenge carries a
+// timestamp, so the client Type 1 message must be stored in NegotiateMessage. Once
+// validated, GetMIC and Seal protect the messages sent to the client. On any error the
+// provider moves to StateFailed, so that the client cannot try again against the same
+// challenge, and keeps the negotiate flags of the CHALLENGE message
+func (n *NtlmProvider) ValidateAuthenticateMessage(type3 []byte) error {
+	if n.state != StateChallengeSent {
+		return ErrOutOfOrder
+	}
+
+	// The flags of the client only replace the offered ones once its message is validated
+	flags := n.NegotiateFlags
+	if err := n.validateAuthenticateMessage(type3); err != nil {
+		n.NegotiateFlags = flags
+		n.state = StateFailed
+		return err
+	}
+	n.state = StateAuthenticated
+	return nil
+}
+
+func (n *NtlmProvider) validateAuthenticateMessage(type3 []byte) error {
+	//        AuthenticateMessage
+	//   0-8: Signature
+	//  8-12: MessageType
+	// 12-20: LmChallengeResponseFields
+	// 20-28: NtChallengeResponseFields
+	// 28-36: DomainNameFields
+	// 36-44: UserNameFields
+	// 44-52: WorkstationFields
+	// 52-60: EncryptedRandomSessionKeyFields
+	// 60-64: NegotiateFlags
+	// 64-72: Version
+	// 72-88: MIC
+	//   88-: Payload
+	if len(type3) < 88 {
+		return fmt.Errorf("%w: authenticate message is %d bytes long", ErrTruncatedMessage, len(type3))
+	}
+	if err := checkLimit("MaxMessageLength", len(type3), Limits.MaxMessageLength); err != nil {
+		return err
+	}
+
+	var auth AuthenicateMessage
+	if err := encoder.Unmarshal(type3, &auth); err != nil {
+		return fmt.Errorf("%w: %v", ErrTruncatedMessage, err)
+	}
+	if !bytes.Equal(auth.Signature[:], Signature[:]) {
+		return ErrBadSignature
+	}
+	if auth.MessageType != MessageTypeNtLmAuthenticate {
+		return fmt.Errorf("%w: %d", ErrUnexpectedMessageType, auth.MessageType)
+	}
+	if unsupported := auth.NegotiateFlags &^ (n.challengeFlags | NegotiateAnonymous); unsupported != 0 {
+		return fmt.Errorf("%w: %08x not offered", ErrUnsupportedFlags, unsupported)
+	}
+
+	var fields [6][]byte
+	for i, field := range []VarField{
+		auth.LmChallengeResponseFields,
+		auth.NtChallengeResponseFields,
+		auth.DomainNameFields,
+		auth.UsernameFields,
+		auth.WorkstationFields,
+		auth.EncryptedRandomSessionKeyField,
+	} {
+		var err error
+		if fields[i], err = field.Extract(88, auth.Payload); err != nil {
+			return fmt.Errorf("%w: authenticate message fields: %v", ErrTruncatedMessage, err)
+		}
+	}
+	lm, nt, encryptedKey := fields[0], fields[1], fields[5]
+	domain, user := n.decodeString(fields[2]), n.decodeString(fields[3])
+
+	n.NegotiateFlags = auth.NegotiateFlags
+	v1 := len(nt) == 24
+	if err := n.verifyResponses(lm, nt, domain, user); err != nil {
+		return err
+	}
+
+	n.KeyExchangeKey = n.keyExchangeKey(v1, lm)
+	n.ExportedSessionKey = n.KeyExchangeKey
+	if n.NegotiateFlags&NegotiateKeyExch != 0 {
+		if len(encryptedKey) != 16 {
+			return fmt.Errorf("%w: encrypted random session key", ErrTruncatedMessage)
+		}
+		cipher, err := rc4.NewCipher(n.KeyExchangeKey)
+		if err != nil {
+			return err
+		}
+		n.EncryptedRandomSessionKey = append([]byte(nil), encryptedKey...)
+		n.RandomSessionKey = make([]byte, 16)
+		cipher.XORKeyStream(n.RandomSessionKey, encryptedKey)
+		n.ExportedSessionKey = n.RandomSessionKey
+	}
+
+	if len(nt) > 24 {
+		//	 28-: AvPairs of the NTLMv2ClientChallenge
+		pairs, err := NewAvPairs(nt[16+28:])
+		if err != nil {
+			return err
+		}
+		info, err := NewTargetInformation(pairs)
+		if err != nil {
+			return err
+		}
+		if err := n.verifyAuthenticateMIC(type3, info); err != nil {
+			return err
+		}
+		n.clientHost = info.Host
+	}
+	n.AuthenticateMessage = append([]byte(nil), type3...)
+
+	if err := n.deriveSessionKeys(true); err != nil {
+		return err
+	}
+	if isUPN(user) && domain == "" {
+		n.clientName = user
+	} else if user != "" {
+		if domain == "" {
+			domain = n.Domain
+		}
+		n.clientName = domain + `\` + user
+	}
+	n.debug("NTLM AUTHENTICATE message validated", "user", user, "domain", domain, "ntlmv1", v1)
+	return nil
+}
+
+// decodeString decodes the AUTHENTICATE message strings, see encodeString
+func (n *NtlmProvider) decodeString(b []byte) string {
+	if n.challengeFlags&NegotiateUnicode != 0 {
+		return encoder.UTF16ToStr(b)
+	}
+	return string(b)
+}
+
+// verifyResponses checks the challenge responses of the client and sets the session base key
+func (n *NtlmProvider) verifyResponses(lm, nt []byte, domain, user string) error {
+	if len(nt) == 0 && user == "" {
+		if !n.AllowAnonymous {
+			return fmt.Errorf("%w: anonymous authentication is not allowed", ErrAuthenticationFailed)
+		}
+		n.SessionBaseKey = make([]byte, 16)
+		return nil
+	}
+	if !strings.EqualFold(user, n.User) {
+		return fmt.Errorf("%w: unknown user %q", ErrAuthenticationFailed, user)
+	}
+	// The NTLMv1 responses do not cover the domain, which is checked as it is published by PeerName
+	if domain != "" && n.Domain != "" && !strings.EqualFold(domain, n.Domain) {
+		return fmt.Errorf("%w: unknown domain %q", ErrAuthenticationFailed, domain)
+	}
+
+	switch {
+	case len(nt) == 24:
+		//        NTLMv1Response
+		//  0-24: Response
+		if n.RequireNTLMv2 {
+			return fmt.Errorf("%w: NTLMv1 response refused", ErrAuthenticationFailed)
+		}
+		if n.NegotiateFlags&NegotiateExtendedSecurity != 0 {
+			if len(lm) < 8 {
+				return fmt.Errorf("%w: LM challenge response", ErrTruncatedMessage)
+			}
+			n.ClientChallenge = append([]byte(nil), lm[:8]...)
+		}
+		expected, err := n.newNtlmv1Response()
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal(nt, expected) {
+			return fmt.Errorf("%w: invalid NTLMv1 response", ErrAuthenticationFailed)
+		}
+		return nil
+
+	case len(nt) >= 16+28:
+		//        NTLMv2Response
+		//  0-16: Response
+		//   16-: NTLMv2ClientChallenge
+		responseKey, err := n.responseKeyNTv2(encoder.StrToUTF16(domain))
+		if err != nil {
+			return err
+		}
+		h := hmac.New(md5.New, responseKey)
+		h.Write(n.ServerChallenge)
+		h.Write(nt[16:])
+		if !hmac.Equal(nt[:16], h.Sum(nil)) {
+			return fmt.Errorf("%w: invalid NTLMv2 response", ErrAuthenticationFailed)
+		}
+
+		// 16-24: ChallengeFromClient of the NTLMv2ClientChallenge
+		n.ClientChallenge = append([]byte(nil), nt[32:40]...)
+		h = hmac.New(md5.New, responseKey)
+		h.Write(nt[:16])
+		n.SessionBaseKey = h.Sum(nil)
+		return nil
+	}
+	return fmt.Errorf("%w: NT challenge response is %d bytes long", ErrTruncatedMessage, len(nt))
+}
+
+// verifyAuthenticateMIC checks the MIC of the AUTHENTICATE message, which the client
+// must send as the challenge carries a timestamp
+func (n *NtlmProvider) verifyAuthenticateMIC(type3 []byte, info *TargetInformation) error {
+	if info.Flags&MsvAvFlagMICPresent == 0 {
+		return fmt.Errorf("%w: MIC is missing", ErrMICMismatch)
+	}
+	if n.NegotiateMessage == nil && n.NegotiateFlags&NegotiateDatagram == 0 {
+		return fmt.Errorf("%w: the NEGOTIATE message is unknown", ErrMICMismatch)
+	}
+
+	// HMAC_MD5(ExportedSessionKey, NEGOTIATE_MESSAGE || CHALLENGE_MESSAGE || AUTHENTICATE_MESSAGE),
+	// the MIC field of the AUTHENTICATE message being zeroed. There is no NEGOTIATE_MESSAGE
+	// in connectionless mode
+	zeroed := append([]byte(nil), type3...)
+	clear(zeroed[72:88])
+	h := hmac.New(md5.New, n.ExportedSessionKey)
+	h.Write(n.NegotiateMessage)
+	h.Write(n.ChallengeMessage)
+	h.Write(zeroed)
+	if !hmac.Equal(type3[72:88], h.Sum(nil)) {
+		return ErrMICMismatch
+	}
+	return nil
+}
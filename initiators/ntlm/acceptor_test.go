@@ -0,0 +1,271 @@
+package ntlm_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+// acceptorHandshake runs a handshake between the client and the server providers
+func acceptorHandshake(t *testing.T, client, server *ntlm.NtlmProvider) error {
+	t.Helper()
+
+	negotiate, err := client.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	server.NegotiateMessage = negotiate
+
+	challenge, err := server.GenerateChallengeMessage()
+	if err != nil {
+		t.Fatalf("GenerateChallengeMessage() failed: %v", err)
+	}
+
+	authenticate, err := client.AcceptSecContext(challenge)
+	if err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+	return server.ValidateAuthenticateMessage(authenticate)
+}
+
+func TestAcceptor(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		client *ntlm.NtlmProvider
+		server *ntlm.NtlmProvider
+	}{
+		{
+			"NTLMv2",
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"},
+			&ntlm.NtlmProvider{User: "user", Domain: "Domain", Password: "Password", Workstation: "SERVER"},
+		},
+		{
+			"NTLMv1",
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", UseNTLMv1: true},
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"},
+		},
+		{
+			"pass-the-hash",
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Hash: ntlm.NTOWFv1("Password")},
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Hash: ntlm.NTOWFv1("Password")},
+		},
+		{
+			"sealing",
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", NegotiateFlags: ntlm.DefaultNegotiateFlags | ntlm.NegotiateSeal},
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", NegotiateFlags: ntlm.DefaultNegotiateFlags | ntlm.NegotiateSeal},
+		},
+		{
+			"anonymous",
+			&ntlm.NtlmProvider{Anonymous: true},
+			&ntlm.NtlmProvider{AllowAnonymous: true},
+		},
+	} {
+		if err := acceptorHandshake(t, tc.client, tc.server); err != nil {
+			t.Fatalf("%s: ValidateAuthenticateMessage() failed: %v", tc.name, err)
+		}
+		if !tc.server.IsEstablished() {
+			t.Fatalf("%s: server should be established", tc.name)
+		}
+		if !bytes.Equal(tc.client.SessionKey(), tc.server.SessionKey()) {
+			t.Fatalf("%s: session keys differ: %x and %x", tc.name, tc.client.SessionKey(), tc.server.SessionKey())
+		}
+
+		// Both directions are protected with the derived keys
+		for i := 0; i < 2; i++ {
+			mic, err := tc.client.GetMIC([]byte("client message"))
+			if err != nil {
+				t.Fatalf("%s: GetMIC() failed: %v", tc.name, err)
+			}
+			if err := tc.server.VerifyMIC([]byte("client message"), mic); err != nil {
+				t.Fatalf("%s: server VerifyMIC() failed: %v", tc.name, err)
+			}
+			if mic, err = tc.server.GetMIC([]byte("server message")); err != nil {
+				t.Fatalf("%s: GetMIC() failed: %v", tc.name, err)
+			}
+			if err := tc.client.VerifyMIC([]byte("server message"), mic); err != nil {
+				t.Fatalf("%s: client VerifyMIC() failed: %v", tc.name, err)
+			}
+		}
+
+		if tc.client.SupportsSealing() {
+			sealed, signature, err := tc.server.Seal([]byte("sealed message"))
+			if err != nil {
+				t.Fatalf("%s: Seal() failed: %v", tc.name, err)
+			}
+			plaintext, err := tc.client.Unseal(sealed, signature)
+			if err != nil || string(plaintext) != "sealed message" {
+				t.Fatalf("%s: Unseal() = %q, %v", tc.name, plaintext, err)
+			}
+		}
+	}
+}
+
+func TestAcceptorAuthenticationFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		client *ntlm.NtlmProvider
+		server *ntlm.NtlmProvider
+	}{
+		{
+			"wrong password",
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Wrong"},
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"},
+		},
+		{
+			"wrong NTLMv1 password",
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Wrong", UseNTLMv1: true},
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"},
+		},
+		{
+			"unknown user",
+			&ntlm.NtlmProvider{User: "Other", Domain: "Domain", Password: "Password"},
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"},
+		},
+		{
+			"unknown domain",
+			&ntlm.NtlmProvider{User: "User", Domain: "Other", Password: "Password"},
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"},
+		},
+		{
+			"unknown NTLMv1 domain",
+			&ntlm.NtlmProvider{User: "User", Domain: "Other", Password: "Password", UseNTLMv1: true},
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"},
+		},
+		{
+			"anonymous not allowed",
+			&ntlm.NtlmProvider{Anonymous: true},
+			&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"},
+		},
+	} {
+		if err := acceptorHandshake(t, tc.client, tc.server); !errors.Is(err, ntlm.ErrAuthenticationFailed) {
+			t.Fatalf("%s: ValidateAuthenticateMessage() returned %v, expected %v", tc.name, err, ntlm.ErrAuthenticationFailed)
+		}
+		if tc.server.IsEstablished() {
+			t.Fatalf("%s: server should not be established", tc.name)
+		}
+	}
+}
+
+func TestAcceptorFailureIsTerminal(t *testing.T) {
+	server := ntlm.NewAcceptor(&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"})
+	negotiate, err := (&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Wrong"}).InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	challenge, err := server.AcceptSecContext(negotiate)
+	if err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+	offered := server.NegotiateFlags
+
+	// Each guess needs a new challenge, even with the right password
+	for _, password := range []string{"Wrong", "Password"} {
+		client := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: password}
+		if _, err := client.InitSecContext(); err != nil {
+			t.Fatalf("InitSecContext() failed: %v", err)
+		}
+		authenticate, err := client.AcceptSecContext(challenge)
+		if err != nil {
+			t.Fatalf("AcceptSecContext() failed: %v", err)
+		}
+		if _, err := server.AcceptSecContext(authenticate); !errors.Is(err, ntlm.ErrAuthenticationFailed) {
+			t.Fatalf("%s: AcceptSecContext() returned %v, expected %v", password, err, ntlm.ErrAuthenticationFailed)
+		}
+		if server.State() != ntlm.StateFailed || server.NegotiateFlags != offered {
+			t.Fatalf("%s: state %v, flags %08x instead of %08x", password, server.State(), server.NegotiateFlags, offered)
+		}
+	}
+}
+
+func TestAcceptorMIC(t *testing.T) {
+	client := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	server := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+
+	negotiate, err := client.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	server.NegotiateMessage = negotiate
+	challenge, err := server.GenerateChallengeMessage()
+	if err != nil {
+		t.Fatalf("GenerateChallengeMessage() failed: %v", err)
+	}
+	authenticate, err := client.AcceptSecContext(challenge)
+	if err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+
+	// 72-88: MIC
+	tampered := bytes.Clone(authenticate)
+	tampered[72] ^= 0xff
+	if err := server.ValidateAuthenticateMessage(tampered); !errors.Is(err, ntlm.ErrMICMismatch) {
+		t.Fatalf("ValidateAuthenticateMessage() returned %v, expected %v", err, ntlm.ErrMICMismatch)
+	}
+}
+
+func TestAcceptorUPN(t *testing.T) {
+	const upn = "user@corp.example.com"
+	for _, v1 := range []bool{false, true} {
+		client := &ntlm.NtlmProvider{User: upn, Domain: "CORP", Password: "Password", UseNTLMv1: v1}
+		server := &ntlm.NtlmProvider{User: upn, Domain: "CORP", Password: "Password"}
+		if err := acceptorHandshake(t, client, server); err != nil {
+			t.Fatalf("NTLMv1 %v: handshake failed: %v", v1, err)
+		}
+
+		// 28-36: DomainNameFields
+		if length := binary.LittleEndian.Uint16(client.AuthenticateMessage[28:30]); length != 0 {
+			t.Fatalf("NTLMv1 %v: domain name is %d bytes long, expected empty", v1, length)
+		}
+		if name := ntlm.NewAcceptor(server).PeerName(); name != strings.ToUpper(upn) {
+			t.Fatalf("NTLMv1 %v: PeerName() is %q", v1, name)
+		}
+	}
+}
+
+func TestAcceptorLoopback(t *testing.T) {
+	machineID := bytes.Repeat([]byte{0x42}, 32)
+	for _, tc := range []struct {
+		name             string
+		client, server   []byte
+		expectedLoopback bool
+	}{
+		{"same machine", machineID, machineID, true},
+		{"other machine", bytes.Repeat([]byte{0x24}, 32), machineID, false},
+		{"no client machine ID", nil, machineID, false},
+		{"no server machine ID", machineID, nil, false},
+	} {
+		client := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", MachineID: tc.client}
+		server := ntlm.NewAcceptor(&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", MachineID: tc.server})
+		if err := acceptorHandshake(t, client, server.NtlmProvider); err != nil {
+			t.Fatalf("%s: handshake failed: %v", tc.name, err)
+		}
+		if server.IsLoopback() != tc.expectedLoopback {
+			t.Fatalf("%s: IsLoopback() is %v", tc.name, server.IsLoopback())
+		}
+	}
+
+	client := &ntlm.NtlmProvider{User: "User", Password: "Password", MachineID: []byte{0x42}}
+	if err := client.Validate(); !errors.Is(err, ntlm.ErrInvalidConfiguration) {
+		t.Fatalf("Validate() returned %v, expected %v", err, ntlm.ErrInvalidConfiguration)
+	}
+}
+
+func TestAcceptorOutOfOrder(t *testing.T) {
+	server := &ntlm.NtlmProvider{User: "User", Password: "Password"}
+	if err := server.ValidateAuthenticateMessage(make([]byte, 88)); !errors.Is(err, ntlm.ErrOutOfOrder) {
+		t.Fatalf("ValidateAuthenticateMessage() returned %v, expected %v", err, ntlm.ErrOutOfOrder)
+	}
+	if _, err := server.GenerateChallengeMessage(); err != nil {
+		t.Fatalf("GenerateChallengeMessage() failed: %v", err)
+	}
+	if _, err := server.GenerateChallengeMessage(); !errors.Is(err, ntlm.ErrOutOfOrder) {
+		t.Fatalf("GenerateChallengeMessage() returned %v, expected %v", err, ntlm.ErrOutOfOrder)
+	}
+	if err := server.ValidateAuthenticateMessage(make([]byte, 40)); !errors.Is(err, ntlm.ErrTruncatedMessage) {
+		t.Fatalf("ValidateAuthenticateMessage() returned %v, expected %v", err, ntlm.ErrTruncatedMessage)
+	}
+}
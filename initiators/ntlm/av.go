@@ -1,8 +1,13 @@
 package ntlm
 
 import (
+	"crypto/md5"
 	"encoding/binary"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/msultra/encoder"
 )
@@ -23,6 +28,34 @@ const (
 	AvIDMsvChannelBindings
 )
 
+// MsvAvFlags bits
+const (
+	MsvAvFlagAuthenticationConstrained = 0x00000001
+	MsvAvFlagMICPresent                = 0x00000002
+	MsvAvFlagUntrustedSPN              = 0x00000004
+)
+
+var avIDNames = map[AvID]string{
+	AvIDMsvAvEOL:             "MsvAvEOL",
+	AvIDMsvAvNbComputerName:  "MsvAvNbComputerName",
+	AvIDMsvAvNbDomainName:    "MsvAvNbDomainName",
+	AvIDMsvAvDNSComputerName: "MsvAvDnsComputerName",
+	AvIDMsvAvDNSDomainName:   "MsvAvDnsDomainName",
+	AvIDMsvAvDNSTreeName:     "MsvAvDnsTreeName",
+	AvIDMsvAvFlags:           "MsvAvFlags",
+	AvIDMsvAvTimestamp:       "MsvAvTimestamp",
+	AvIDMsvAvSingleHost:      "MsvAvSingleHost",
+	AvIDMsvAvTargetName:      "MsvAvTargetName",
+	AvIDMsvChannelBindings:   "MsvChannelBindings",
+}
+
+func (id AvID) String() string {
+	if name, ok := avIDNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("AvID(%d)", uint16(id))
+}
+
 type AvPairs map[AvID][]byte
 
 func NewAvPairs(b []byte) (AvPairs, error) {
@@ -31,11 +64,16 @@ func NewAvPairs(b []byte) (AvPairs, error) {
 	//   2-4: AvLen
 	//    4-: Value
 	if len(b) < 4 {
-		return nil, fmt.Errorf("no av pair to parse")
+		return nil, fmt.Errorf("%w: no av pair to parse", ErrTruncatedMessage)
 	}
 
 	m := make(AvPairs)
-	for i := 0; i < len(b); {
+	for i, n := 0, 1; i < len(b); n++ {
+		// Make sure the AvId and AvLen can be read
+		if len(b) < i+4 {
+			return nil, fmt.Errorf("%w: av pair header", ErrTruncatedMessage)
+		}
+
 		// Read AvID
 		id := AvID(binary.LittleEndian.Uint16(b[i : i+2]))
 
@@ -54,7 +92,13 @@ func NewAvPairs(b []byte) (AvPairs, error) {
 		// Read value size and check that it is not OOB
 		sz := binary.LittleEndian.Uint16(b[i+2 : i+4])
 		if len(b) < i+4+int(sz) {
-			return nil, fmt.Errorf("corrupted data - refusing to go out of bounds")
+			return nil, fmt.Errorf("%w: corrupted data - refusing to go out of bounds", ErrTruncatedMessage)
+		}
+		if err := checkLimit("MaxAvPairLength", int(sz), Limits.MaxAvPairLength); err != nil {
+			return nil, err
+		}
+		if err := checkLimit("MaxAvPairs", n, Limits.MaxAvPairs); err != nil {
+			return nil, err
 		}
 
 		m[id] = b[i+4 : i+4+int(sz)]
@@ -63,12 +107,14 @@ func NewAvPairs(b []byte) (AvPairs, error) {
 	return nil, fmt.Errorf("never reached AvId == AvIDMsvAvEOL")
 }
 
+// Bytes encodes the AV pairs in ascending AvID order, terminated by MsvAvEOL
 func (a AvPairs) Bytes() []byte {
 	var buf []byte
-	for k, v := range a {
+	for _, k := range slices.Sorted(maps.Keys(a)) {
 		if k == AvIDMsvAvEOL {
 			continue
 		}
+		v := a[k]
 		buf = binary.LittleEndian.AppendUint16(buf, uint16(k))
 		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(v)))
 		buf = append(buf, v...)
@@ -78,22 +124,42 @@ func (a AvPairs) Bytes() []byte {
 	return buf
 }
 
+// SingleHost is the Single_Host_Data structure of MsvAvSingleHost, whose MachineID lets a
+// server detect that the client runs on the same machine, as Windows does for loopback
 type SingleHost struct {
 	Size       uint32
 	Z4         uint32
-	CustomData uint8
+	CustomData [8]byte
 	MachineID  [32]byte
 }
 
+// NewSingleHost parses a Single_Host_Data structure, the zero value is returned if v is too short
 func NewSingleHost(v []byte) SingleHost {
+	//        Single_Host_Data
+	//   0-4: Size
+	//   4-8: Z4
+	//  8-16: CustomData
+	// 16-48: MachineID
 	var sh SingleHost
+	if len(v) < 48 {
+		return sh
+	}
+
 	sh.Size = binary.LittleEndian.Uint32(v[0:4])
 	sh.Z4 = binary.LittleEndian.Uint32(v[4:8])
-	sh.CustomData = v[8]
-	copy(sh.MachineID[:], v[9:])
+	copy(sh.CustomData[:], v[8:16])
+	copy(sh.MachineID[:], v[16:48])
 	return sh
 }
 
+// Bytes encodes the Single_Host_Data structure, Size being always 48
+func (sh SingleHost) Bytes() []byte {
+	b := binary.LittleEndian.AppendUint32(nil, 48)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = append(b, sh.CustomData[:]...)
+	return append(b, sh.MachineID[:]...)
+}
+
 // ChannelBindings represents the NTLM Channel Binding structure
 // as defined in [MS-NLMP]. Either MD5Hash or gss_channel_bindings_struct
 type ChannelBindings struct {
@@ -106,11 +172,34 @@ type ChannelBindings struct {
 	ApplicationData   []byte
 }
 
+// channelBindingsHash computes the MsvAvChannelBindings value: the MD5 hash of a
+// gss_channel_bindings_struct without addresses, carrying the application data.
+// Without application data, the hash is all zeros as required by [MS-NLMP]
+func channelBindingsHash(applicationData []byte) []byte {
+	if len(applicationData) == 0 {
+		return make([]byte, 16)
+	}
+
+	//        gss_channel_bindings_struct
+	//   0-4: InitiatorAddrType
+	//   4-8: InitiatorAddrLength
+	//  8-12: AcceptorAddrType
+	// 12-16: AcceptorAddrLength
+	// 16-20: ApplicationDataLength
+	//   20-: ApplicationData
+	buf := make([]byte, 20, 20+len(applicationData))
+	binary.LittleEndian.PutUint32(buf[16:20], uint32(len(applicationData)))
+	buf = append(buf, applicationData...)
+
+	hash := md5.Sum(buf)
+	return hash[:]
+}
+
 func NewChannelBindings(v []byte) (ChannelBindings, error) {
 	var cb ChannelBindings
 
 	if len(v) < 12 { // Minimum size for addr types and empty addresses
-		return cb, fmt.Errorf("channel bindings data too short")
+		return cb, fmt.Errorf("%w: channel bindings data too short", ErrTruncatedMessage)
 	}
 
 	if len(v) == 16 {
@@ -119,27 +208,16 @@ func NewChannelBindings(v []byte) (ChannelBindings, error) {
 	}
 
 	offset := 0
+	var err error
 
 	// Read initiator address info
-	cb.InitiatorAddrType = binary.LittleEndian.Uint32(v[offset:])
-	offset += 4
-	initAddrLen := binary.LittleEndian.Uint32(v[offset:])
-	offset += 4
-	if initAddrLen > 0 {
-		cb.InitiatorAddr = make([]byte, initAddrLen)
-		copy(cb.InitiatorAddr, v[offset:offset+int(initAddrLen)])
-		offset += int(initAddrLen)
+	if cb.InitiatorAddrType, cb.InitiatorAddr, err = readAddress(v, &offset); err != nil {
+		return cb, err
 	}
 
 	// Read acceptor address info
-	cb.AcceptorAddrType = binary.LittleEndian.Uint32(v[offset:])
-	offset += 4
-	acceptAddrLen := binary.LittleEndian.Uint32(v[offset:])
-	offset += 4
-	if acceptAddrLen > 0 {
-		cb.AcceptorAddr = make([]byte, acceptAddrLen)
-		copy(cb.AcceptorAddr, v[offset:offset+int(acceptAddrLen)])
-		offset += int(acceptAddrLen)
+	if cb.AcceptorAddrType, cb.AcceptorAddr, err = readAddress(v, &offset); err != nil {
+		return cb, err
 	}
 
 	// Read application data
@@ -151,6 +229,26 @@ func NewChannelBindings(v []byte) (ChannelBindings, error) {
 	return cb, nil
 }
 
+// readAddress reads an address type, length and value of a gss_channel_bindings_struct
+func readAddress(v []byte, offset *int) (addrType uint32, addr []byte, err error) {
+	if len(v) < *offset+8 {
+		return 0, nil, fmt.Errorf("%w: channel bindings address", ErrTruncatedMessage)
+	}
+	addrType = binary.LittleEndian.Uint32(v[*offset:])
+	addrLen := binary.LittleEndian.Uint32(v[*offset+4:])
+	*offset += 8
+
+	if uint64(len(v)-*offset) < uint64(addrLen) {
+		return 0, nil, fmt.Errorf("%w: channel bindings address", ErrTruncatedMessage)
+	}
+	if addrLen > 0 {
+		addr = make([]byte, addrLen)
+		copy(addr, v[*offset:])
+		*offset += int(addrLen)
+	}
+	return addrType, addr, nil
+}
+
 type TargetInformation struct {
 	NbComputerName  string
 	NbDomainName    string
@@ -176,9 +274,9 @@ func NewTargetInformation(pairs AvPairs) (*TargetInformation, error) {
 			return nil, err
 		}
 	}
-	info.AvPairsSize = len(info.AvPairsBytes)
 	info.AvPairs = pairs
 	info.AvPairsBytes = pairs.Bytes()
+	info.AvPairsSize = len(info.AvPairsBytes)
 	return &info, nil
 }
 
@@ -195,10 +293,19 @@ func (t *TargetInformation) Set(k AvID, v []byte) (err error) {
 	case AvIDMsvAvDNSTreeName:
 		t.DNSTreeName = encoder.UTF16ToStr(v)
 	case AvIDMsvAvFlags:
+		if len(v) != 4 {
+			return fmt.Errorf("%w: %s must be 4 bytes long", ErrTruncatedMessage, k)
+		}
 		t.Flags = binary.LittleEndian.Uint32(v)
 	case AvIDMsvAvTimestamp:
+		if len(v) != 8 {
+			return fmt.Errorf("%w: %s must be 8 bytes long", ErrTruncatedMessage, k)
+		}
 		t.Timestamp = binary.LittleEndian.Uint64(v)
 	case AvIDMsvAvSingleHost:
+		if len(v) < 48 {
+			return fmt.Errorf("%w: %s is too short", ErrTruncatedMessage, k)
+		}
 		t.Host = NewSingleHost(v)
 	case AvIDMsvAvTargetName:
 		t.TargetName = encoder.UTF16ToStr(v)
@@ -207,3 +314,49 @@ func (t *TargetInformation) Set(k AvID, v []byte) (err error) {
 	}
 	return err
 }
+
+// AuthenticationConstrained reports whether the server set MsvAvFlagAuthenticationConstrained
+func (t *TargetInformation) AuthenticationConstrained() bool {
+	return t.Flags&MsvAvFlagAuthenticationConstrained != 0
+}
+
+// NetBIOSComputerName returns the NetBIOS name of the server (MsvAvNbComputerName)
+func (t *TargetInformation) NetBIOSComputerName() string {
+	return t.NbComputerName
+}
+
+// NetBIOSDomainName returns the NetBIOS name of the server domain (MsvAvNbDomainName)
+func (t *TargetInformation) NetBIOSDomainName() string {
+	return t.NbDomainName
+}
+
+// Time returns the server time (MsvAvTimestamp), or the zero time if it was not sent
+func (t *TargetInformation) Time() time.Time {
+	if t.Timestamp == 0 {
+		return time.Time{}
+	}
+
+	// FILETIME: 100ns intervals since January 1, 1601 (UTC)
+	const epochDelta = 11644473600
+	return time.Unix(int64(t.Timestamp/1e7)-epochDelta, int64(t.Timestamp%1e7)*100).UTC()
+}
+
+// String dumps the AV pairs, one per line, for debugging purposes
+func (t *TargetInformation) String() string {
+	var sb strings.Builder
+	for _, id := range slices.Sorted(maps.Keys(t.AvPairs)) {
+		v := t.AvPairs[id]
+		switch id {
+		case AvIDMsvAvNbComputerName, AvIDMsvAvNbDomainName, AvIDMsvAvDNSComputerName,
+			AvIDMsvAvDNSDomainName, AvIDMsvAvDNSTreeName, AvIDMsvAvTargetName:
+			fmt.Fprintf(&sb, "%s: %s\n", id, encoder.UTF16ToStr(v))
+		case AvIDMsvAvFlags:
+			fmt.Fprintf(&sb, "%s: 0x%08x\n", id, t.Flags)
+		case AvIDMsvAvTimestamp:
+			fmt.Fprintf(&sb, "%s: %s\n", id, t.Time().Format(time.RFC3339Nano))
+		default:
+			fmt.Fprintf(&sb, "%s: %x\n", id, v)
+		}
+	}
+	return sb.String()
+}
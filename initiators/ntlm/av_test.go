@@ -1,7 +1,11 @@
 package ntlm_test
 
 import (
+	"encoding/hex"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/msultra/encoder"
 	"github.com/msultra/spnego/initiators/ntlm"
@@ -36,6 +40,91 @@ func TestAvPairs(t *testing.T) {
 	t.Logf("Verified successfully")
 }
 
+func TestTargetInformationAccessors(t *testing.T) {
+	provider := ntlm.NtlmProvider{}
+
+	challenge, err := hex.DecodeString(testChallenge)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+	if err := provider.ValidateChallengeMessage(challenge); err != nil {
+		t.Fatalf("ValidateChallengeMessage() failed: %v", err)
+	}
+
+	tinfo := provider.TargetInfo
+	if tinfo.NetBIOSDomainName() != "LAB" || tinfo.NetBIOSComputerName() != "DC" {
+		t.Fatalf("NetBIOS names are incorrect: %s\\%s", tinfo.NetBIOSDomainName(), tinfo.NetBIOSComputerName())
+	}
+
+	expected := time.Date(2022, time.October, 30, 19, 6, 42, 10443500, time.UTC)
+	if !tinfo.Time().Equal(expected) {
+		t.Fatalf("Time is %v, expected %v", tinfo.Time(), expected)
+	}
+	t.Logf("Target information:\n%s", tinfo)
+
+	for _, line := range []string{
+		"MsvAvNbComputerName: DC\n",
+		"MsvAvNbDomainName: LAB\n",
+		"MsvAvDnsComputerName: DC.lab.lan\n",
+		"MsvAvDnsDomainName: lab.lan\n",
+		"MsvAvDnsTreeName: lab.lan\n",
+		"MsvAvTimestamp: 2022-10-30T19:06:42.0104435Z\n",
+	} {
+		if !strings.Contains(tinfo.String(), line) {
+			t.Fatalf("String() is missing %q", line)
+		}
+	}
+}
+
+func TestTargetInformationAbsentPairs(t *testing.T) {
+	p := make(ntlm.AvPairs)
+	p[ntlm.AvIDMsvAvNbComputerName] = encoder.StrToUTF16("DC01")
+	p[ntlm.AvIDMsvAvNbDomainName] = encoder.StrToUTF16("CONTOSO")
+
+	tinfo, err := ntlm.NewTargetInformation(p)
+	if err != nil {
+		t.Fatalf("failed to create target information: %v", err)
+	}
+	if tinfo.DNSDomainName != "" || tinfo.Flags != 0 || !tinfo.Time().IsZero() {
+		t.Fatalf("absent pairs should be zero values: %v", tinfo)
+	}
+}
+
 func TestChannelBindings(t *testing.T) {
 	// TODO: Gather channel bindings from a real NTLM authentication
 }
+
+func TestTargetInformationMalformedValues(t *testing.T) {
+	for _, tc := range []struct {
+		id    ntlm.AvID
+		value []byte
+	}{
+		{ntlm.AvIDMsvAvFlags, []byte{0x02}},
+		{ntlm.AvIDMsvAvTimestamp, []byte{0x01, 0x02, 0x03, 0x04}},
+		{ntlm.AvIDMsvAvSingleHost, []byte{0x30}},
+		{ntlm.AvIDMsvAvSingleHost, make([]byte, 47)},
+		{ntlm.AvIDMsvChannelBindings, make([]byte, 12)},
+		{ntlm.AvIDMsvChannelBindings, append(make([]byte, 4), 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)},
+	} {
+		var info ntlm.TargetInformation
+		if err := info.Set(tc.id, tc.value); !errors.Is(err, ntlm.ErrTruncatedMessage) {
+			t.Fatalf("Set(%s, %x) returned %v, expected %v", tc.id, tc.value, err, ntlm.ErrTruncatedMessage)
+		}
+	}
+}
+
+func TestSingleHost(t *testing.T) {
+	host := ntlm.SingleHost{CustomData: [8]byte{0x01}, MachineID: [32]byte{0xaa, 0xbb}}
+	b := host.Bytes()
+	if len(b) != 48 {
+		t.Fatalf("Single_Host_Data is %d bytes long, expected 48", len(b))
+	}
+
+	var info ntlm.TargetInformation
+	if err := info.Set(ntlm.AvIDMsvAvSingleHost, b); err != nil {
+		t.Fatalf("Set() failed: %v", err)
+	}
+	if info.Host.Size != 48 || info.Host.CustomData != host.CustomData || info.Host.MachineID != host.MachineID {
+		t.Fatalf("Single_Host_Data is %+v, expected %+v", info.Host, host)
+	}
+}
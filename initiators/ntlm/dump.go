@@ -0,0 +1,227 @@
+package ntlm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/msultra/encoder"
+)
+
+// flagNames are the names of the negotiate flags, by bit
+var flagNames = [32]string{
+	0:  "NegotiateUnicode",
+	1:  "NegotiateOEM",
+	2:  "RequestTarget",
+	4:  "NegotiateSign",
+	5:  "NegotiateSeal",
+	6:  "NegotiateDatagram",
+	7:  "NegotiateLMKey",
+	9:  "NegotiateNTLM",
+	11: "NegotiateAnonymous",
+	12: "NegotiateOEMDomainSupplied",
+	13: "NegotiateOEMWorkstationSupplied",
+	15: "NegotiateAlwaysSign",
+	16: "TargetTypeDomain",
+	17: "TargetTypeServer",
+	19: "NegotiateExtendedSecurity",
+	20: "NegotiateIdentify",
+	22: "RequestNonNTSessionKey",
+	23: "NegotiateTargetInfo",
+	25: "NegotiateVersion",
+	29: "Negotiate128",
+	30: "NegotiateKeyExch",
+	31: "Negotiate56",
+}
+
+// FlagNames returns the names of the negotiate flags set, reserved bits as Reserved(bit)
+func FlagNames(flags uint32) []string {
+	var names []string
+	for bit := 0; bit < 32; bit++ {
+		if flags&(1<<bit) == 0 {
+			continue
+		}
+		if flagNames[bit] == "" {
+			names = append(names, fmt.Sprintf("Reserved(%d)", bit))
+			continue
+		}
+		names = append(names, flagNames[bit])
+	}
+	return names
+}
+
+// Dump decodes a NTLM message into a human readable tree for debugging purposes:
+// the fields, the flags by name and the AV pairs. Invalid messages are reported inline
+func Dump(msg []byte) string {
+	var sb strings.Builder
+	if len(msg) < 12 || !bytes.Equal(msg[:8], Signature[:]) {
+		fmt.Fprintf(&sb, "NTLM: invalid message (%d bytes)\n", len(msg))
+		return sb.String()
+	}
+
+	var err error
+	switch msgType := binary.LittleEndian.Uint32(msg[8:12]); msgType {
+	case MessageTypeNtLmNegotiate:
+		err = dumpNegotiate(&sb, msg)
+	case MessageTypeNtLmChallenge:
+		err = dumpChallenge(&sb, msg)
+	case MessageTypeNtLmAuthenticate:
+		err = dumpAuthenticate(&sb, msg)
+	default:
+		err = fmt.Errorf("%w: %d", ErrUnexpectedMessageType, msgType)
+	}
+	if err != nil {
+		fmt.Fprintf(&sb, "  error: %v\n", err)
+	}
+	return sb.String()
+}
+
+func dumpFlags(sb *strings.Builder, flags uint32) {
+	fmt.Fprintf(sb, "  NegotiateFlags: 0x%08x (%s)\n", flags, strings.Join(FlagNames(flags), "|"))
+}
+
+func dumpVersion(sb *strings.Builder, flags uint32, version [8]byte) {
+	if flags&NegotiateVersion != 0 {
+		fmt.Fprintf(sb, "  Version: %d.%d.%d (NTLM revision %d)\n", version[0], version[1], binary.LittleEndian.Uint16(version[2:4]), version[7])
+	}
+}
+
+// dumpString decodes a string of the message according to its flags
+func dumpString(flags uint32, b []byte) string {
+	if flags&NegotiateUnicode != 0 {
+		return encoder.UTF16ToStr(b)
+	}
+	return string(b)
+}
+
+func dumpNegotiate(sb *strings.Builder, msg []byte) error {
+	sb.WriteString("NTLM NEGOTIATE\n")
+	var negotiate NegotiateMessage
+	if len(msg) < 32 {
+		return ErrTruncatedMessage
+	}
+	if err := encoder.Unmarshal(msg, &negotiate); err != nil {
+		return fmt.Errorf("%w: %v", ErrTruncatedMessage, err)
+	}
+
+	dumpFlags(sb, negotiate.NegotiateFlags)
+	domain, err := negotiate.DomainNameFields.Extract(40, negotiate.Payload)
+	if err != nil {
+		return err
+	}
+	workstation, err := negotiate.WorkstationFields.Extract(40, negotiate.Payload)
+	if err != nil {
+		return err
+	}
+	// The domain and the workstation are always OEM strings
+	fmt.Fprintf(sb, "  DomainName: %q\n", domain)
+	fmt.Fprintf(sb, "  Workstation: %q\n", workstation)
+	dumpVersion(sb, negotiate.NegotiateFlags, negotiate.Version)
+	return nil
+}
+
+func dumpChallenge(sb *strings.Builder, msg []byte) error {
+	sb.WriteString("NTLM CHALLENGE\n")
+	var challenge ChallengeMessage
+	if len(msg) < 48 {
+		return ErrTruncatedMessage
+	}
+	if err := encoder.Unmarshal(msg, &challenge); err != nil {
+		return fmt.Errorf("%w: %v", ErrTruncatedMessage, err)
+	}
+
+	dumpFlags(sb, challenge.NegotiateFlags)
+	targetName, err := challenge.TargetName.Extract(56, challenge.Payload)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sb, "  TargetName: %q\n", dumpString(challenge.NegotiateFlags, targetName))
+	fmt.Fprintf(sb, "  ServerChallenge: %x\n", challenge.ServerChallenge)
+	dumpVersion(sb, challenge.NegotiateFlags, challenge.Version)
+
+	targetInfo, err := challenge.TargetInformation.Extract(56, challenge.Payload)
+	if err != nil {
+		return err
+	}
+	return dumpAvPairs(sb, "TargetInfo", targetInfo)
+}
+
+func dumpAvPairs(sb *strings.Builder, name string, b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	pairs, err := NewAvPairs(b)
+	if err != nil {
+		return err
+	}
+	info, err := NewTargetInformation(pairs)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sb, "  %s:\n", name)
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(info.String(), "\n"), "\n") {
+		sb.WriteString("    " + strings.TrimSuffix(line, "\n") + "\n")
+	}
+	return nil
+}
+
+func dumpAuthenticate(sb *strings.Builder, msg []byte) error {
+	sb.WriteString("NTLM AUTHENTICATE\n")
+	var auth AuthenicateMessage
+	if len(msg) < 88 {
+		return ErrTruncatedMessage
+	}
+	if err := encoder.Unmarshal(msg, &auth); err != nil {
+		return fmt.Errorf("%w: %v", ErrTruncatedMessage, err)
+	}
+
+	dumpFlags(sb, auth.NegotiateFlags)
+	var fields [6][]byte
+	for i, field := range []VarField{
+		auth.LmChallengeResponseFields,
+		auth.NtChallengeResponseFields,
+		auth.DomainNameFields,
+		auth.UsernameFields,
+		auth.WorkstationFields,
+		auth.EncryptedRandomSessionKeyField,
+	} {
+		var err error
+		if fields[i], err = field.Extract(88, auth.Payload); err != nil {
+			return err
+		}
+	}
+	lm, nt := fields[0], fields[1]
+
+	fmt.Fprintf(sb, "  DomainName: %q\n", dumpString(auth.NegotiateFlags, fields[2]))
+	fmt.Fprintf(sb, "  UserName: %q\n", dumpString(auth.NegotiateFlags, fields[3]))
+	fmt.Fprintf(sb, "  Workstation: %q\n", dumpString(auth.NegotiateFlags, fields[4]))
+	fmt.Fprintf(sb, "  LmChallengeResponse: %d bytes\n", len(lm))
+	switch {
+	case len(nt) == 0:
+		sb.WriteString("  NtChallengeResponse: anonymous\n")
+	case len(nt) == 24:
+		sb.WriteString("  NtChallengeResponse: NTLMv1\n")
+	case len(nt) >= 16+28:
+		//        NTLMv2Response
+		//  0-16: Response
+		// 24-32: TimeStamp of the NTLMv2ClientChallenge
+		// 32-40: ChallengeFromClient
+		//   44-: AvPairs
+		fmt.Fprintf(sb, "  NtChallengeResponse: NTLMv2 (%d bytes)\n", len(nt))
+		fmt.Fprintf(sb, "  ClientChallenge: %x\n", nt[32:40])
+		if err := dumpAvPairs(sb, "ClientAvPairs", nt[44:]); err != nil {
+			return err
+		}
+	default:
+		fmt.Fprintf(sb, "  NtChallengeResponse: %d bytes\n", len(nt))
+	}
+	if len(fields[5]) > 0 {
+		fmt.Fprintf(sb, "  EncryptedRandomSessionKey: %x\n", fields[5])
+	}
+	dumpVersion(sb, auth.NegotiateFlags, auth.Version)
+	if auth.MIC != [16]byte{} {
+		fmt.Fprintf(sb, "  MIC: %x\n", auth.MIC)
+	}
+	return nil
+}
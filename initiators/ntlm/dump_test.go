@@ -0,0 +1,57 @@
+package ntlm_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+func TestFlagNames(t *testing.T) {
+	got := ntlm.FlagNames(ntlm.NegotiateUnicode | ntlm.NegotiateSign | 1<<3 | ntlm.Negotiate56)
+	want := []string{"NegotiateUnicode", "Reserved(3)", "NegotiateSign", "Negotiate56"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("FlagNames() = %v, want %v", got, want)
+	}
+}
+
+func TestDump(t *testing.T) {
+	client := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", Workstation: "CLIENT"}
+	server := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", Workstation: "SERVER"}
+
+	negotiate, err := client.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	server.NegotiateMessage = negotiate
+	challenge, err := server.GenerateChallengeMessage()
+	if err != nil {
+		t.Fatalf("GenerateChallengeMessage() failed: %v", err)
+	}
+	authenticate, err := client.AcceptSecContext(challenge)
+	if err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+		want []string
+	}{
+		{"negotiate", negotiate, []string{"NTLM NEGOTIATE\n", "NegotiateExtendedSecurity", "Version: 10.0.0"}},
+		{"challenge", challenge, []string{"NTLM CHALLENGE\n", "ServerChallenge: ", "TargetInfo:\n", "MsvAvNbComputerName"}},
+		{"authenticate", authenticate, []string{"NTLM AUTHENTICATE\n", `UserName: "USER"`, `Workstation: "CLIENT"`, "NTLMv2", "ClientAvPairs:\n"}},
+		{"truncated", authenticate[:40], []string{"NTLM AUTHENTICATE\n", "error: truncated message"}},
+		{"invalid", []byte("NTLM"), []string{"NTLM: invalid message (4 bytes)"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dump := ntlm.Dump(tc.msg)
+			for _, want := range tc.want {
+				if !strings.Contains(dump, want) {
+					t.Fatalf("Dump() = %s, want it to contain %q", dump, want)
+				}
+			}
+		})
+	}
+}
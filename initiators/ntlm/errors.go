@@ -0,0 +1,68 @@
+package ntlm
+
+import "errors"
+
+var (
+	// ErrOutOfOrder is returned when a handshake step is called in the wrong state
+	ErrOutOfOrder = errors.New("handshake step called out of order")
+
+	// ErrContextNotEstablished is returned when the session keys are needed before the handshake completes
+	ErrContextNotEstablished = errors.New("security context is not established")
+
+	// ErrMICMismatch is returned when a message signature does not match the expected one
+	ErrMICMismatch = errors.New("message signature mismatch")
+
+	// ErrSealNotNegotiated is returned when sealing is requested but NegotiateSeal is not set
+	ErrSealNotNegotiated = errors.New("message confidentiality was not negotiated")
+
+	// ErrSigningNotNegotiated is returned when a signature is required but neither NegotiateSign nor NegotiateSeal is set
+	ErrSigningNotNegotiated = errors.New("message integrity was not negotiated")
+
+	// ErrDatagramNotNegotiated is returned when an explicit sequence number is given outside datagram mode
+	ErrDatagramNotNegotiated = errors.New("connectionless mode was not negotiated")
+
+	// ErrInvalidHash is returned when the provided NT hash, or the LM hash given to ParseHash, is not 16 bytes long
+	ErrInvalidHash = errors.New("hash must be 16 bytes long")
+
+	// ErrInvalidConfiguration is returned by Validate when fields of the provider cannot work together
+	ErrInvalidConfiguration = errors.New("invalid provider configuration")
+
+	// ErrConflictingCredentials is returned when both a password and an NT hash are provided
+	ErrConflictingCredentials = errors.New("password and hash are mutually exclusive")
+
+	// ErrInvalidVersion is returned when the provided version is not 8 bytes long
+	ErrInvalidVersion = errors.New("version must be 8 bytes long")
+
+	// ErrBadSignature is returned when a message does not start with "NTLMSSP\x00"
+	ErrBadSignature = errors.New("invalid signature")
+
+	// ErrUnexpectedMessageType is returned when a message is not of the expected type
+	ErrUnexpectedMessageType = errors.New("unexpected message type")
+
+	// ErrTruncatedMessage is returned when a message or one of its fields is too short
+	ErrTruncatedMessage = errors.New("truncated message")
+
+	// ErrDowngrade is returned when the server strips security flags offered by the client, see AllowDowngrade
+	ErrDowngrade = errors.New("session security downgraded by the server")
+
+	// ErrWeakKey is returned when the negotiated keys are weaker than MinKeyBits or RequireKeyExch demands
+	ErrWeakKey = errors.New("negotiated key strength is too weak")
+
+	// ErrUnsupportedFlags is returned when the server negotiated flags the client cannot work with
+	ErrUnsupportedFlags = errors.New("unsupported negotiate flags")
+
+	// ErrNoAuthScheme is returned when an HTTP header offers neither the NTLM nor the Negotiate scheme
+	ErrNoAuthScheme = errors.New("no NTLM or Negotiate authentication scheme")
+
+	// ErrAuthenticationFailed is returned by an acceptor when the client response does not match the credentials
+	ErrAuthenticationFailed = errors.New("authentication failed")
+
+	// ErrWiped is returned when a provider erased by Wipe is used to authenticate
+	ErrWiped = errors.New("provider credentials were wiped")
+
+	// ErrInvalidContext is returned by Import when the exported security context cannot be restored
+	ErrInvalidContext = errors.New("invalid exported security context")
+
+	// ErrLimitExceeded is returned when a message of the peer is over one of the Limits
+	ErrLimitExceeded = errors.New("message limit exceeded")
+)
@@ -0,0 +1,98 @@
+package ntlm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// exportVersion is bumped whenever the layout of exportedContext changes
+const exportVersion = 1
+
+// maxKeystream bounds the RC4 keystream replayed by Import for each handle, 1 GiB
+// takes a few seconds to replay
+const maxKeystream = 1 << 30
+
+// exportedContext is the serialized form of an established security context
+type exportedContext struct {
+	Version              int
+	NegotiateFlags       uint32
+	ExportedSessionKey   []byte
+	ClientSigningKey     []byte
+	ServerSigningKey     []byte
+	ClientSealingKey     []byte
+	ServerSealingKey     []byte
+	ClientSequenceNumber uint32
+	ServerSequenceNumber uint32
+	ClientKeystream      uint64
+	ServerKeystream      uint64
+}
+
+// Export serializes the established security context: negotiate flags, session,
+// signing and sealing keys, sequence numbers and the position of the RC4 handles, that
+// Import replays. The output contains secret key material and must be protected accordingly
+func (n *NtlmProvider) Export() ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ClientHandle == nil || n.ServerHandle == nil {
+		return nil, ErrContextNotEstablished
+	}
+	if n.ClientSealingKey == nil || n.ServerSealingKey == nil {
+		return nil, errors.New("sealing keys are unknown, the handles cannot be exported")
+	}
+	if n.clientKeystream > maxKeystream || n.serverKeystream > maxKeystream {
+		return nil, fmt.Errorf("RC4 handles are over %d bytes of keystream, they cannot be exported", maxKeystream)
+	}
+
+	return json.Marshal(exportedContext{
+		Version:              exportVersion,
+		NegotiateFlags:       n.NegotiateFlags,
+		ExportedSessionKey:   n.ExportedSessionKey,
+		ClientSigningKey:     n.ClientSigningKey,
+		ServerSigningKey:     n.ServerSigningKey,
+		ClientSealingKey:     n.ClientSealingKey,
+		ServerSealingKey:     n.ServerSealingKey,
+		ClientSequenceNumber: n.ClientSequenceNumber,
+		ServerSequenceNumber: n.ServerSequenceNumber,
+		ClientKeystream:      n.clientKeystream,
+		ServerKeystream:      n.serverKeystream,
+	})
+}
+
+// Import restores a security context serialized by Export. The RC4 handles are
+// recreated from the sealing keys and moved forward to where they were exported,
+// ErrInvalidContext is returned if they are over 1 GiB of keystream
+func Import(b []byte) (*NtlmProvider, error) {
+	var ctx exportedContext
+	if err := json.Unmarshal(b, &ctx); err != nil {
+		return nil, err
+	}
+	if ctx.Version != exportVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidContext, ctx.Version)
+	}
+	if ctx.ClientKeystream > maxKeystream || ctx.ServerKeystream > maxKeystream {
+		return nil, fmt.Errorf("%w: RC4 handles are over %d bytes of keystream", ErrInvalidContext, maxKeystream)
+	}
+
+	n := &NtlmProvider{
+		NegotiateFlags:       ctx.NegotiateFlags,
+		ExportedSessionKey:   ctx.ExportedSessionKey,
+		ClientSigningKey:     ctx.ClientSigningKey,
+		ServerSigningKey:     ctx.ServerSigningKey,
+		ClientSealingKey:     ctx.ClientSealingKey,
+		ServerSealingKey:     ctx.ServerSealingKey,
+		ClientSequenceNumber: ctx.ClientSequenceNumber,
+		SequenceNumber:       ctx.ClientSequenceNumber,
+		ServerSequenceNumber: ctx.ServerSequenceNumber,
+		state:                StateAuthenticated,
+	}
+	if err := n.rekey(); err != nil {
+		return nil, err
+	}
+
+	discardKeystream(n.ClientHandle, ctx.ClientKeystream)
+	discardKeystream(n.ServerHandle, ctx.ServerKeystream)
+	n.clientKeystream, n.serverKeystream = ctx.ClientKeystream, ctx.ServerKeystream
+	return n, nil
+}
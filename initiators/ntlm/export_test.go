@@ -0,0 +1,95 @@
+package ntlm_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+func TestExportImport(t *testing.T) {
+	for _, flags := range []uint32{
+		ntlm.DefaultNegotiateFlags | ntlm.NegotiateSeal,
+		ntlm.DefaultNegotiateFlags&^ntlm.NegotiateExtendedSecurity | ntlm.NegotiateSeal,
+	} {
+		client, server := newSessionPair(t, flags)
+
+		// Move both handles forward before exporting
+		sealed, signature, err := client.Seal([]byte("before export"))
+		if err != nil {
+			t.Fatalf("Seal() failed: %v", err)
+		}
+		if _, err := server.Unseal(sealed, signature); err != nil {
+			t.Fatalf("Unseal() failed: %v", err)
+		}
+		sealed, signature, err = server.Seal([]byte("sealed before export"))
+		if err != nil {
+			t.Fatalf("Seal() failed: %v", err)
+		}
+
+		exported, err := client.Export()
+		if err != nil {
+			t.Fatalf("Export() failed: %v", err)
+		}
+		imported, err := ntlm.Import(exported)
+		if err != nil {
+			t.Fatalf("Import() failed: %v", err)
+		}
+
+		if !imported.IsEstablished() || imported.ClientSequenceNumber != client.ClientSequenceNumber {
+			t.Fatalf("imported context is not in the exported state")
+		}
+
+		plaintext, err := imported.Unseal(sealed, signature)
+		if err != nil {
+			t.Fatalf("Unseal() after Import() failed: %v", err)
+		}
+		if !bytes.Equal(plaintext, []byte("sealed before export")) {
+			t.Fatalf("unsealed message is %q", plaintext)
+		}
+
+		// The client handle also resumes where it was exported
+		sealed, signature, err = imported.Seal([]byte("sealed after import"))
+		if err != nil {
+			t.Fatalf("Seal() failed: %v", err)
+		}
+		if plaintext, err = server.Unseal(sealed, signature); err != nil {
+			t.Fatalf("Unseal() of a message sealed after Import() failed: %v", err)
+		}
+		if !bytes.Equal(plaintext, []byte("sealed after import")) {
+			t.Fatalf("unsealed message is %q", plaintext)
+		}
+	}
+}
+
+func TestImportKeystreamLimit(t *testing.T) {
+	client, _ := newSessionPair(t, ntlm.DefaultNegotiateFlags|ntlm.NegotiateSeal)
+	exported, err := client.Export()
+	if err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+
+	for _, field := range []string{"ClientKeystream", "ServerKeystream"} {
+		var ctx map[string]any
+		if err := json.Unmarshal(exported, &ctx); err != nil {
+			t.Fatalf("Unmarshal() failed: %v", err)
+		}
+		ctx[field] = uint64(1) << 62
+		tampered, err := json.Marshal(ctx)
+		if err != nil {
+			t.Fatalf("Marshal() failed: %v", err)
+		}
+		if _, err := ntlm.Import(tampered); !errors.Is(err, ntlm.ErrInvalidContext) {
+			t.Fatalf("%s: Import() returned %v, expected %v", field, err, ntlm.ErrInvalidContext)
+		}
+	}
+}
+
+func TestExportNotEstablished(t *testing.T) {
+	provider := ntlm.NtlmProvider{}
+	if _, err := provider.Export(); !errors.Is(err, ntlm.ErrContextNotEstablished) {
+		t.Fatalf("Export() returned %v, expected %v", err, ntlm.ErrContextNotEstablished)
+	}
+}
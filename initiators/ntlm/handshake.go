@@ -0,0 +1,74 @@
+package ntlm
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Framer reads and writes a single NTLM token on a transport
+type Framer interface {
+	ReadToken(r io.Reader) ([]byte, error)
+	WriteToken(w io.Writer, token []byte) error
+}
+
+// maxTokenSize is the largest token accepted by LengthPrefixedFramer
+const maxTokenSize = 64 * 1024
+
+// LengthPrefixedFramer frames each token with its length as a 4 bytes big endian integer
+type LengthPrefixedFramer struct{}
+
+// ReadToken reads the length of the token, then the token itself
+func (LengthPrefixedFramer) ReadToken(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxTokenSize {
+		return nil, errors.New("token is too large")
+	}
+
+	token := make([]byte, size)
+	if _, err := io.ReadFull(r, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// WriteToken writes the length of the token followed by the token
+func (LengthPrefixedFramer) WriteToken(w io.Writer, token []byte) error {
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(token)), uint32(len(token)))
+	_, err := w.Write(append(buf, token...))
+	return err
+}
+
+// Handshake runs the whole client handshake on the transport: it sends the Type 1 message,
+// reads the Type 2 message and answers with the Type 3 message. LengthPrefixedFramer
+// is used if frame is nil
+func (n *NtlmProvider) Handshake(rw io.ReadWriter, frame Framer) error {
+	if frame == nil {
+		frame = LengthPrefixedFramer{}
+	}
+
+	negotiate, err := n.InitSecContext()
+	if err != nil {
+		return err
+	}
+	if err := frame.WriteToken(rw, negotiate); err != nil {
+		return errors.New("failed to send the NEGOTIATE message: " + err.Error())
+	}
+
+	challenge, err := frame.ReadToken(rw)
+	if err != nil {
+		return errors.New("failed to read the CHALLENGE message: " + err.Error())
+	}
+
+	authenticate, err := n.AcceptSecContext(challenge)
+	if err != nil {
+		return err
+	}
+	if err := frame.WriteToken(rw, authenticate); err != nil {
+		return errors.New("failed to send the AUTHENTICATE message: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package ntlm_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+// fakeServer answers the NEGOTIATE message with testChallenge and returns the AUTHENTICATE message
+func fakeServer(t *testing.T, conn net.Conn) <-chan []byte {
+	t.Helper()
+	challenge, err := hex.DecodeString(testChallenge)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+
+	done := make(chan []byte, 1)
+	go func() {
+		defer close(done)
+		defer conn.Close()
+
+		var framer ntlm.LengthPrefixedFramer
+		negotiate, err := framer.ReadToken(conn)
+		if err != nil || binary.LittleEndian.Uint32(negotiate[8:12]) != ntlm.MessageTypeNtLmNegotiate {
+			return
+		}
+		if err := framer.WriteToken(conn, challenge); err != nil {
+			return
+		}
+		authenticate, err := framer.ReadToken(conn)
+		if err != nil {
+			return
+		}
+		done <- authenticate
+	}()
+	return done
+}
+
+func TestHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := fakeServer(t, server)
+
+	provider := ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	if err := provider.Handshake(client, nil); err != nil {
+		t.Fatalf("Handshake() failed: %v", err)
+	}
+	if !provider.IsEstablished() {
+		t.Fatalf("provider should be established after the handshake")
+	}
+
+	authenticate := <-done
+	if !bytes.Equal(authenticate, provider.AuthenticateMessage) {
+		t.Fatalf("server received %x, expected the AUTHENTICATE message", authenticate)
+	}
+}
+
+func TestHandshakeServerClosed(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		var framer ntlm.LengthPrefixedFramer
+		framer.ReadToken(server)
+		server.Close()
+	}()
+
+	provider := ntlm.NtlmProvider{User: "User", Password: "Password"}
+	if err := provider.Handshake(client, ntlm.LengthPrefixedFramer{}); err == nil {
+		t.Fatalf("Handshake() should fail when the server closes the connection")
+	}
+}
+
+func TestLengthPrefixedFramer(t *testing.T) {
+	var buf bytes.Buffer
+	var framer ntlm.LengthPrefixedFramer
+	if err := framer.WriteToken(&buf, []byte("token")); err != nil {
+		t.Fatalf("WriteToken() failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte("\x00\x00\x00\x05token")) {
+		t.Fatalf("framed token is %x", buf.Bytes())
+	}
+
+	token, err := framer.ReadToken(&buf)
+	if err != nil || !bytes.Equal(token, []byte("token")) {
+		t.Fatalf("ReadToken() returned %q, %v", token, err)
+	}
+
+	if _, err := framer.ReadToken(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})); err == nil {
+		t.Fatalf("ReadToken() should refuse oversized tokens")
+	}
+}
@@ -0,0 +1,224 @@
+package ntlm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// negotiateTransport authenticates requests with NTLM over HTTP
+type negotiateTransport struct {
+	base     http.RoundTripper
+	provider *NtlmProvider
+
+	// bindTLS is set when the channel bindings are taken from each TLS connection
+	bindTLS bool
+
+	// Serializes the handshakes, which run on the provider
+	mu sync.Mutex
+}
+
+// NewNegotiateTransport wraps base so that requests answered with a 401 offering the
+// NTLM or Negotiate scheme are authenticated with the provider. The handshake is run
+// on the connection of the original request, which is sent again with its body once
+// authenticated. http.DefaultTransport is used if base is nil. Over HTTPS, the channel
+// bindings of the connection are sent unless ChannelBinding is already set. The body is
+// replayed with GetBody when set, and buffered otherwise. The transport is safe for
+// concurrent use: every 401 starts a new handshake on the provider, which is reset first,
+// and the handshakes are serialized. The legs of concurrent handshakes may still be sent
+// on different connections by base, a single connection per host avoids it
+func NewNegotiateTransport(base http.RoundTripper, p *NtlmProvider) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &negotiateTransport{base: base, provider: p, bindTLS: p.ChannelBinding == nil}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *negotiateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, err := replayable(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The request is sent as is first, its body is only replayed with GetBody after a 401
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	scheme := challengeScheme(resp)
+	if scheme == "" {
+		return resp, nil
+	}
+	drain(resp)
+
+	authenticate, resp, err := t.handshake(req, scheme)
+	if authenticate == nil || err != nil {
+		return resp, err
+	}
+	last, err := withBody(req, true, EncodeAuthHeader(scheme, authenticate))
+	if err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(last)
+}
+
+// handshake resets the provider and runs the NEGOTIATE and CHALLENGE legs, returning the
+// AUTHENTICATE message, or the response of the server if it did not send a challenge
+func (t *negotiateTransport) handshake(req *http.Request, scheme string) ([]byte, *http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.provider.Reset()
+
+	// The NEGOTIATE message is sent without the body, the server always answers it with a 401
+	negotiate, err := t.provider.InitSecContext()
+	if err != nil {
+		return nil, nil, err
+	}
+	leg, err := withBody(req, false, EncodeAuthHeader(scheme, negotiate))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := t.base.RoundTrip(leg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil, resp, nil
+	}
+	challenge, err := challengeToken(resp)
+	drain(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Extended Protection: the AUTHENTICATE message is bound to the TLS connection
+	if t.bindTLS {
+		t.provider.ChannelBinding = nil
+		if resp.TLS != nil {
+			if t.provider.ChannelBinding, err = TLSServerEndPoint(resp.TLS); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	authenticate, err := t.provider.AcceptSecContext(challenge)
+	if err != nil {
+		return nil, nil, err
+	}
+	return authenticate, nil, nil
+}
+
+// replayable returns the request with a GetBody, so that the body can be sent more than
+// once. The body is only buffered if the request has no GetBody
+func replayable(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return req, nil
+	}
+	defer req.Body.Close()
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	clone := req.Clone(req.Context())
+	clone.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	clone.Body, clone.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+	return clone, nil
+}
+
+// withBody clones the replayable request with a new copy of its body, or without body,
+// and the given Authorization header
+func withBody(req *http.Request, body bool, authorization string) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	clone.Body, clone.GetBody, clone.ContentLength = http.NoBody, nil, 0
+	if body && req.GetBody != nil {
+		b, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body, clone.GetBody, clone.ContentLength = b, req.GetBody, req.ContentLength
+	}
+	if authorization != "" {
+		clone.Header.Set("Authorization", authorization)
+	}
+	return clone, nil
+}
+
+// drain reads the rest of the body so that the connection can be reused for the next leg
+func drain(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// EncodeAuthHeader formats the token as the value of an Authorization header for the scheme
+func EncodeAuthHeader(scheme string, token []byte) string {
+	if len(token) == 0 {
+		return scheme
+	}
+	return scheme + " " + base64.StdEncoding.EncodeToString(token)
+}
+
+// ParseAuthHeader extracts the NTLM or Negotiate challenge from a WWW-Authenticate header
+// which may list several comma separated challenges. A challenge carrying a token is
+// preferred, then NTLM over Negotiate. The token is nil for a bare challenge
+func ParseAuthHeader(header string) (scheme string, token []byte, err error) {
+	var encoded string
+	for _, challenge := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.EqualFold(name, "NTLM"):
+			name = "NTLM"
+		case strings.EqualFold(name, "Negotiate"):
+			name = "Negotiate"
+		default:
+			continue
+		}
+
+		if value != "" {
+			scheme, encoded = name, value
+			break
+		}
+		if scheme == "" || name == "NTLM" {
+			scheme = name
+		}
+	}
+	if scheme == "" {
+		return "", nil, ErrNoAuthScheme
+	}
+	if encoded == "" {
+		return scheme, nil, nil
+	}
+
+	token, err = base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, errors.New("invalid " + scheme + " token: " + err.Error())
+	}
+	return scheme, token, nil
+}
+
+// challengeScheme returns the scheme offered by a 401 response
+func challengeScheme(resp *http.Response) string {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return ""
+	}
+	scheme, _, _ := ParseAuthHeader(strings.Join(resp.Header.Values("WWW-Authenticate"), ","))
+	return scheme
+}
+
+// challengeToken returns the CHALLENGE message sent by the server
+func challengeToken(resp *http.Response) ([]byte, error) {
+	_, token, err := ParseAuthHeader(strings.Join(resp.Header.Values("WWW-Authenticate"), ","))
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, errors.New("server did not send a CHALLENGE message")
+	}
+	return token, nil
+}
@@ -0,0 +1,261 @@
+package ntlm_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+// ntlmServer emulates the NTLM dance: the request is only served once the connection
+// sent a NEGOTIATE then an AUTHENTICATE message
+func ntlmServer(t *testing.T, scheme string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(ntlmHandler(t, scheme))
+}
+
+// ntlmHandler is the handler of ntlmServer
+func ntlmHandler(t *testing.T, scheme string) http.Handler {
+	t.Helper()
+	challenge, err := hex.DecodeString(testChallenge)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+
+	var mu sync.Mutex
+	negotiated := make(map[string]bool)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		msg, err := base64.StdEncoding.DecodeString(token)
+		if name != scheme || err != nil || len(msg) < 12 {
+			w.Header().Set("WWW-Authenticate", scheme)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch binary.LittleEndian.Uint32(msg[8:12]) {
+		case ntlm.MessageTypeNtLmNegotiate:
+			mu.Lock()
+			negotiated[r.RemoteAddr] = true
+			mu.Unlock()
+			w.Header().Set("WWW-Authenticate", scheme+" "+base64.StdEncoding.EncodeToString(challenge))
+			w.WriteHeader(http.StatusUnauthorized)
+		case ntlm.MessageTypeNtLmAuthenticate:
+			mu.Lock()
+			ok := negotiated[r.RemoteAddr]
+			mu.Unlock()
+			if !ok {
+				http.Error(w, "handshake on another connection", http.StatusBadRequest)
+				return
+			}
+			io.Copy(w, r.Body)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+}
+
+func TestNegotiateTransport(t *testing.T) {
+	for _, scheme := range []string{"NTLM", "Negotiate"} {
+		srv := ntlmServer(t, scheme)
+		defer srv.Close()
+
+		provider := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+		client := &http.Client{Transport: ntlm.NewNegotiateTransport(srv.Client().Transport, provider)}
+		resp, err := client.Post(srv.URL, "text/plain", strings.NewReader("request body"))
+		if err != nil {
+			t.Fatalf("%s: Post() failed: %v", scheme, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status is %d: %s", scheme, resp.StatusCode, body)
+		}
+		if string(body) != "request body" {
+			t.Fatalf("%s: the body was not sent again, got %q", scheme, body)
+		}
+		if !provider.IsEstablished() {
+			t.Fatalf("%s: provider should be established", scheme)
+		}
+	}
+}
+
+func TestNegotiateTransportTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(ntlmHandler(t, "NTLM"))
+	defer srv.Close()
+
+	provider := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	client := &http.Client{Transport: ntlm.NewNegotiateTransport(srv.Client().Transport, provider)}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status is %d", resp.StatusCode)
+	}
+
+	hash := sha256.Sum256(srv.Certificate().Raw)
+	if expected := append([]byte("tls-server-end-point:"), hash[:]...); !bytes.Equal(provider.ChannelBinding, expected) {
+		t.Fatalf("channel binding is %q, expected %q", provider.ChannelBinding, expected)
+	}
+}
+
+func TestNegotiateTransportTwice(t *testing.T) {
+	srv := ntlmServer(t, "NTLM")
+	defer srv.Close()
+
+	provider := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	client := &http.Client{Transport: ntlm.NewNegotiateTransport(srv.Client().Transport, provider)}
+	for i := 0; i < 2; i++ {
+		body := fmt.Sprintf("request %d", i)
+		resp, err := client.Post(srv.URL, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("request %d: Post() failed: %v", i, err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(got) != body {
+			t.Fatalf("request %d: status is %d: %q", i, resp.StatusCode, got)
+		}
+	}
+}
+
+func TestNegotiateTransportConcurrent(t *testing.T) {
+	srv := ntlmServer(t, "NTLM")
+	defer srv.Close()
+
+	// The legs of a handshake must be sent on the same connection
+	base := srv.Client().Transport.(*http.Transport).Clone()
+	base.MaxConnsPerHost = 1
+	provider := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	client := &http.Client{Transport: ntlm.NewNegotiateTransport(base, provider)}
+
+	const requests = 8
+	errs := make(chan error, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf("request %d", i)
+			resp, err := client.Post(srv.URL, "text/plain", strings.NewReader(body))
+			if err != nil {
+				errs <- err
+				return
+			}
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(got) != body {
+				errs <- fmt.Errorf("request %d: status is %d: %q", i, resp.StatusCode, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestNegotiateTransportGetBody(t *testing.T) {
+	srv := ntlmServer(t, "NTLM")
+	defer srv.Close()
+
+	provider := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	client := &http.Client{Transport: ntlm.NewNegotiateTransport(srv.Client().Transport, provider)}
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("request body"))
+	if err != nil {
+		t.Fatalf("NewRequest() failed: %v", err)
+	}
+	getBody, replays := req.GetBody, 0
+	req.GetBody = func() (io.ReadCloser, error) {
+		replays++
+		return getBody()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do() failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "request body" {
+		t.Fatalf("status is %d: %q", resp.StatusCode, body)
+	}
+	if replays != 1 {
+		t.Fatalf("the body was replayed %d times with GetBody, expected once", replays)
+	}
+}
+
+func TestNegotiateTransportWithoutChallenge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", "Basic realm=test")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	provider := &ntlm.NtlmProvider{User: "User", Password: "Password"}
+	client := &http.Client{Transport: ntlm.NewNegotiateTransport(nil, provider)}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || provider.State() != ntlm.StateInitial {
+		t.Fatalf("the handshake should not start without an NTLM challenge")
+	}
+}
+
+func TestEncodeAuthHeader(t *testing.T) {
+	if got := ntlm.EncodeAuthHeader("NTLM", []byte{0x4e, 0x54, 0x4c, 0x4d}); got != "NTLM TlRMTQ==" {
+		t.Fatalf("EncodeAuthHeader() = %q", got)
+	}
+	if got := ntlm.EncodeAuthHeader("Negotiate", nil); got != "Negotiate" {
+		t.Fatalf("EncodeAuthHeader() = %q", got)
+	}
+}
+
+func TestParseAuthHeader(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		scheme string
+		token  []byte
+		err    bool
+	}{
+		{"NTLM", "NTLM", nil, false},
+		{"  Negotiate  ", "Negotiate", nil, false},
+		{"Negotiate, NTLM", "NTLM", nil, false},
+		{`Basic realm="intranet", Negotiate,NTLM`, "NTLM", nil, false},
+		{"NTLM TlRMTQ==", "NTLM", []byte("NTLM"), false},
+		{"ntlm   TlRMTQ==  ", "NTLM", []byte("NTLM"), false},
+		{"NTLM, Negotiate TlRMTQ==", "Negotiate", []byte("NTLM"), false},
+		{`Basic realm="intranet"`, "", nil, true},
+		{"", "", nil, true},
+		{"NTLM not-base64!", "", nil, true},
+	} {
+		scheme, token, err := ntlm.ParseAuthHeader(tc.header)
+		if (err != nil) != tc.err {
+			t.Fatalf("ParseAuthHeader(%q) error = %v", tc.header, err)
+		}
+		if scheme != tc.scheme || !bytes.Equal(token, tc.token) || (tc.token == nil && token != nil) {
+			t.Fatalf("ParseAuthHeader(%q) = %q, %q", tc.header, scheme, token)
+		}
+	}
+
+	if _, _, err := ntlm.ParseAuthHeader("Basic"); !errors.Is(err, ntlm.ErrNoAuthScheme) {
+		t.Fatalf("expected ErrNoAuthScheme, got %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package ntlm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// smb3KeyBits is the length L in bits of the keys derived for SMB 3
+const smb3KeyBits = 128
+
+// DeriveSMB3SigningKey derives a SMB 3 key from the exported session key with the
+// SP800-108 KDF in counter mode using HMAC-SHA256, as specified in MS-SMB2 3.1.4.2.
+// The label and context must include their trailing null byte, e.g. "SMB2AESCMAC\x00"
+// and "SmbSign\x00" for the SMB 3.0 signing key. It returns nil before authentication
+func (n *NtlmProvider) DeriveSMB3SigningKey(label, context []byte) []byte {
+	if n.ExportedSessionKey == nil {
+		return nil
+	}
+
+	// K(1) = PRF(KI, [i]2 || Label || 0x00 || Context || [L]2), a single iteration gives 128 bits
+	mac := hmac.New(sha256.New, n.ExportedSessionKey)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	mac.Write(label)
+	mac.Write([]byte{0x00})
+	mac.Write(context)
+	mac.Write(binary.BigEndian.AppendUint32(nil, smb3KeyBits))
+	return mac.Sum(nil)[:smb3KeyBits/8]
+}
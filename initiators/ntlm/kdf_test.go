@@ -0,0 +1,35 @@
+package ntlm_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+// SMB 3.0 key derivation example from "SMB 2 and SMB 3 security in Windows 10: the
+// anatomy of signing and cryptographic keys"
+func TestDeriveSMB3SigningKey(t *testing.T) {
+	sessionKey, _ := hex.DecodeString("7cd451825d0450d235424e44ba6e78cc")
+	provider := &ntlm.NtlmProvider{ExportedSessionKey: sessionKey}
+
+	for _, tc := range []struct {
+		label, context string
+		expected       string
+	}{
+		{"SMB2AESCMAC\x00", "SmbSign\x00", "0b7e9c5cac36c0f6ea9ab275298cedce"},
+		{"SMB2AESCCM\x00", "ServerIn \x00", "fad27796665b313ebb578f388632b4f7"},
+		{"SMB2AESCCM\x00", "ServerOut\x00", "b0f0427f7ceb416d1d9dcc0cd4f99447"},
+		{"SMB2APP\x00", "SmbRpc\x00", "bb23a4575aa26c721af525af15a87b4f"},
+	} {
+		expected, _ := hex.DecodeString(tc.expected)
+		if key := provider.DeriveSMB3SigningKey([]byte(tc.label), []byte(tc.context)); !bytes.Equal(key, expected) {
+			t.Fatalf("DeriveSMB3SigningKey(%q, %q) = %x, expected %x", tc.label, tc.context, key, expected)
+		}
+	}
+
+	if key := (&ntlm.NtlmProvider{}).DeriveSMB3SigningKey([]byte("SMB2AESCMAC\x00"), []byte("SmbSign\x00")); key != nil {
+		t.Fatalf("DeriveSMB3SigningKey() should return nil before authentication, got %x", key)
+	}
+}
@@ -0,0 +1,27 @@
+package ntlm
+
+import "fmt"
+
+// MessageLimits bound the NTLM messages accepted by the parsers, a zero field disables its limit
+type MessageLimits struct {
+	MaxMessageLength int // Bytes of a NEGOTIATE, CHALLENGE or AUTHENTICATE message
+	MaxAvPairs       int // AV pairs of a target information, MsvAvEOL excluded
+	MaxAvPairLength  int // Bytes of the value of an AV pair
+}
+
+// Limits are enforced on the messages received from the peer, so that the ones coming
+// from untrusted networks are rejected with ErrLimitExceeded before being decoded.
+// They are read on every message and should be set before the first handshake
+var Limits = MessageLimits{
+	MaxMessageLength: 64 << 10,
+	MaxAvPairs:       64,
+	MaxAvPairLength:  1024,
+}
+
+// checkLimit returns ErrLimitExceeded if the value is over the limit
+func checkLimit(name string, value, limit int) error {
+	if limit > 0 && value > limit {
+		return fmt.Errorf("%w: %d is over %s of %d", ErrLimitExceeded, value, name, limit)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package ntlm_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/msultra/encoder"
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+func TestLimits(t *testing.T) {
+	defaults := ntlm.Limits
+	defer func() { ntlm.Limits = defaults }()
+
+	p := make(ntlm.AvPairs)
+	p[ntlm.AvIDMsvAvNbComputerName] = encoder.StrToUTF16("DC01")
+	p[ntlm.AvIDMsvAvNbDomainName] = encoder.StrToUTF16("CONTOSO")
+	p[ntlm.AvIDMsvAvDNSTreeName] = bytes.Repeat([]byte{'a'}, 2048)
+	if _, err := ntlm.NewAvPairs(p.Bytes()); !errors.Is(err, ntlm.ErrLimitExceeded) {
+		t.Fatalf("NewAvPairs() with a long value error = %v, want ErrLimitExceeded", err)
+	}
+
+	delete(p, ntlm.AvIDMsvAvDNSTreeName)
+	ntlm.Limits.MaxAvPairs = 1
+	if _, err := ntlm.NewAvPairs(p.Bytes()); !errors.Is(err, ntlm.ErrLimitExceeded) {
+		t.Fatalf("NewAvPairs() with too many pairs error = %v, want ErrLimitExceeded", err)
+	}
+	ntlm.Limits.MaxAvPairs = 0
+	if _, err := ntlm.NewAvPairs(p.Bytes()); err != nil {
+		t.Fatalf("NewAvPairs() without limit failed: %v", err)
+	}
+
+	ntlm.Limits = defaults
+	acceptor := ntlm.NewAcceptor(&ntlm.NtlmProvider{User: "User", Password: "Password"})
+	if _, err := acceptor.AcceptSecContext(make([]byte, defaults.MaxMessageLength+1)); !errors.Is(err, ntlm.ErrLimitExceeded) {
+		t.Fatalf("AcceptSecContext() with a large message error = %v, want ErrLimitExceeded", err)
+	}
+	client := &ntlm.NtlmProvider{User: "User", Password: "Password"}
+	if err := client.ValidateChallengeMessage(make([]byte, defaults.MaxMessageLength+1)); !errors.Is(err, ntlm.ErrLimitExceeded) {
+		t.Fatalf("ValidateChallengeMessage() with a large message error = %v, want ErrLimitExceeded", err)
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/md5"
-	"crypto/rc4"
 	"encoding/asn1"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"strings"
 
 	"github.com/msultra/encoder"
@@ -17,10 +19,30 @@ var (
 	Signature = [8]byte{0x4E, 0x54, 0x4C, 0x4D, 0x53, 0x53, 0x50, 0x00} // "NTLMSSP\x00"
 )
 
+// NTLMRevisionCurrent is the NTLMSSP_REVISION_W2K3 revision of the VERSION structure
+const NTLMRevisionCurrent = 0x0f
+
+// ClientVersion is the VERSION advertised by default, Windows 10
 var ClientVersion = [8]byte{
-	0: 0x0a, // Windows Major Version
-	1: 0x00, // Windows Minor Version
-	7: 0x0f, // Build Number
+	0: 0x0a,                // Windows Major Version
+	1: 0x00,                // Windows Minor Version
+	7: NTLMRevisionCurrent, // NTLM Revision
+}
+
+// NewVersion encodes the VERSION structure of the given Windows release, to be set as
+// the Version of the provider, e.g. NewVersion(6, 1, 7601, NTLMRevisionCurrent) for Windows 7 SP1
+func NewVersion(major, minor uint8, build uint16, revision uint8) []byte {
+	//        VERSION
+	//   0-1: ProductMajorVersion
+	//   1-2: ProductMinorVersion
+	//   2-4: ProductBuild
+	//   4-7: Reserved
+	//   7-8: NTLMRevisionCurrent
+	version := make([]byte, 8)
+	version[0], version[1] = major, minor
+	binary.LittleEndian.PutUint16(version[2:4], build)
+	version[7] = revision
+	return version
 }
 
 const DefaultNegotiateFlags = Negotiate56 | Negotiate128 | NegotiateKeyExch | NegotiateTargetInfo | NegotiateExtendedSecurity | NegotiateAlwaysSign | NegotiateNTLM | NegotiateSign | RequestTarget | NegotiateUnicode | NegotiateVersion
@@ -85,8 +107,11 @@ func (n *NtlmProvider) NewNegotiateMessage() (msg []byte, err error) {
 	// 24-32: WorkstationFields
 	// 32-40: Version
 	//   40-: Payload
-	if n.NegotiateFlags == 0 {
-		n.NegotiateFlags = DefaultNegotiateFlags
+	n.initNegotiateFlags()
+
+	version, err := n.version()
+	if err != nil {
+		return nil, err
 	}
 
 	offset := 40
@@ -96,13 +121,11 @@ func (n *NtlmProvider) NewNegotiateMessage() (msg []byte, err error) {
 		n.NegotiateFlags |= NegotiateOEM
 		if n.Domain != "" {
 			n.NegotiateFlags |= NegotiateOEMDomainSupplied
-			uniStr := encoder.StrToUTF16(n.Domain)
-			domainFields = NewVarField(&payload, uniStr, &offset)
+			domainFields = NewVarField(&payload, toOEM(n.Domain), &offset)
 		}
 		if n.Workstation != "" {
 			n.NegotiateFlags |= NegotiateOEMWorkstationSupplied
-			uniStr := encoder.StrToUTF16(n.Workstation)
-			workstationFields = NewVarField(&payload, uniStr, &offset)
+			workstationFields = NewVarField(&payload, toOEM(n.Workstation), &offset)
 		}
 	}
 
@@ -112,10 +135,44 @@ func (n *NtlmProvider) NewNegotiateMessage() (msg []byte, err error) {
 		NegotiateFlags:    n.NegotiateFlags,
 		DomainNameFields:  domainFields,
 		WorkstationFields: workstationFields,
-		Version:           ClientVersion,
+		Version:           version,
 		Payload:           payload,
 	})
-	return n.NegotiateMessage, err
+	if err != nil {
+		return nil, err
+	}
+	n.debug("NTLM NEGOTIATE message", "flags", fmt.Sprintf("0x%08x", n.NegotiateFlags), "size", len(n.NegotiateMessage))
+	return n.NegotiateMessage, nil
+}
+
+// initNegotiateFlags sets the flags offered by the client, in the NEGOTIATE message or,
+// in connectionless mode, directly in the AUTHENTICATE message
+func (n *NtlmProvider) initNegotiateFlags() {
+	if n.NegotiateFlags == 0 {
+		n.NegotiateFlags = DefaultNegotiateFlags
+	}
+	// The server only sends its name, required by ValidateChallengeMessage, if it is requested
+	n.NegotiateFlags |= RequestTarget
+	if n.OmitVersion {
+		n.NegotiateFlags &^= NegotiateVersion
+	}
+	if n.Datagram {
+		n.NegotiateFlags |= NegotiateDatagram
+	}
+}
+
+// version returns the VERSION structure sent in the NEGOTIATE and AUTHENTICATE messages
+func (n *NtlmProvider) version() ([8]byte, error) {
+	if n.OmitVersion {
+		return [8]byte{}, nil
+	}
+	if n.Version == nil {
+		return ClientVersion, nil
+	}
+	if len(n.Version) != 8 {
+		return [8]byte{}, ErrInvalidVersion
+	}
+	return [8]byte(n.Version), nil
 }
 
 type ChallengeMessage struct {
@@ -142,43 +199,71 @@ func (n *NtlmProvider) ValidateChallengeMessage(sc []byte) (err error) {
 	// 48-56: Version
 	//   56-: Payload
 	if len(sc) < 56 {
-		return errors.New("invalid challenge message length")
+		return fmt.Errorf("%w: challenge message is %d bytes long", ErrTruncatedMessage, len(sc))
+	}
+	if err := checkLimit("MaxMessageLength", len(sc), Limits.MaxMessageLength); err != nil {
+		return err
 	}
 
 	var challenge ChallengeMessage
 	if err := encoder.Unmarshal(sc, &challenge); err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrTruncatedMessage, err)
 	}
 
 	//   0-8: Signature
 	if !bytes.Equal(challenge.Signature[:], Signature[:]) {
-		return errors.New("invalid signature")
+		return ErrBadSignature
 	}
 
 	//  8-12: MessageType
 	if challenge.MessageType != MessageTypeNtLmChallenge {
-		return errors.New("invalid message type")
+		return fmt.Errorf("%w: %d", ErrUnexpectedMessageType, challenge.MessageType)
 	}
 
 	// 12-20: TargetNameFields
-	if n.TargetName, err = challenge.TargetName.Extract(56, challenge.Payload); err != nil {
-		return err
+	targetName, err := challenge.TargetName.Extract(56, challenge.Payload)
+	if err != nil {
+		return fmt.Errorf("%w: target name: %v", ErrTruncatedMessage, err)
 	}
 
 	// 20-24: NegotiateFlags
+	n.debug("NTLM CHALLENGE message", "flags", fmt.Sprintf("0x%08x", challenge.NegotiateFlags), "size", len(sc))
 	if challenge.NegotiateFlags&RequestTarget == 0 || challenge.NegotiateFlags&NegotiateTargetInfo == 0 {
-		return errors.New("invalid negotiate flags")
+		return fmt.Errorf("%w: %08x", ErrUnsupportedFlags, challenge.NegotiateFlags)
 	}
 
-	// 24-32: ServerChallenge
-	copy(n.ServerChallenge[:], challenge.ServerChallenge[:])
+	// Only the capabilities offered by both sides are used from now on
+	offered := n.NegotiateFlags
+	if offered == 0 {
+		offered = DefaultNegotiateFlags
+	}
+	checked := uint32(downgradeFlags)
+	if n.AllowNoExtendedSecurity {
+		checked &^= NegotiateExtendedSecurity
+	}
+	if stripped := offered &^ challenge.NegotiateFlags & checked; stripped != 0 && !n.AllowDowngrade {
+		return fmt.Errorf("%w: %s not offered", ErrDowngrade, strings.Join(FlagNames(stripped), "|"))
+	}
+	flags := offered & challenge.NegotiateFlags
+
+	minKeyBits := n.MinKeyBits
+	if minKeyBits == 0 {
+		minKeyBits = 128
+	}
+	if bits := keyBits(flags); bits < minKeyBits {
+		return fmt.Errorf("%w: %d bits negotiated, %d required", ErrWeakKey, bits, minKeyBits)
+	}
+	if n.RequireKeyExch && flags&NegotiateKeyExch == 0 {
+		return fmt.Errorf("%w: key exchange not negotiated", ErrWeakKey)
+	}
 
+	// 24-32: ServerChallenge
 	// 32-40: _ (reserved)
 
 	// 40-48: TargetInfoFields
 	targetInfo, err := challenge.TargetInformation.Extract(56, challenge.Payload)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: target info: %v", ErrTruncatedMessage, err)
 	}
 
 	avpairs, err := NewAvPairs(targetInfo)
@@ -186,8 +271,60 @@ func (n *NtlmProvider) ValidateChallengeMessage(sc []byte) (err error) {
 		return err
 	}
 
-	n.TargetInfo, err = NewTargetInformation(avpairs)
-	return err
+	info, err := NewTargetInformation(avpairs)
+	if err != nil {
+		return err
+	}
+
+	// The provider is only updated once the whole message was validated
+	n.TargetName, n.TargetInfo = targetName, info
+	n.challengeFlags, n.NegotiateFlags = challenge.NegotiateFlags, flags
+	n.ChallengeMessage = append([]byte(nil), sc...)
+	n.ServerChallenge = append([]byte(nil), challenge.ServerChallenge[:]...)
+	n.debug("NTLM target info", "target", n.TargetNameString(), "avpairs", n.TargetInfo.String())
+	return nil
+}
+
+// encodeString encodes the AUTHENTICATE message strings as Unicode or OEM,
+// depending on the character set chosen by the server in the challenge
+func (n *NtlmProvider) encodeString(s string) []byte {
+	if n.challengeFlags&NegotiateUnicode != 0 {
+		return encoder.StrToUTF16(s)
+	}
+	return toOEM(s)
+}
+
+// downgradeFlags are the security flags which the server must not strip from the NEGOTIATE
+// message, unless AllowDowngrade is set, or AllowNoExtendedSecurity for NegotiateExtendedSecurity
+const downgradeFlags = NegotiateSign | NegotiateSeal | Negotiate128 | NegotiateKeyExch | NegotiateExtendedSecurity
+
+// keyBits returns the strength of the session keys for the negotiate flags
+func keyBits(flags uint32) int {
+	switch {
+	case flags&Negotiate128 != 0:
+		return 128
+	case flags&Negotiate56 != 0:
+		return 56
+	}
+	return 40
+}
+
+// TargetNameString decodes the target name sent by the server, as Unicode
+// or OEM depending on the flags of the challenge
+func (n *NtlmProvider) TargetNameString() string {
+	if n.challengeFlags&NegotiateUnicode != 0 {
+		return encoder.UTF16ToStr(n.TargetName)
+	}
+	return string(n.TargetName)
+}
+
+// ServerTargetInfo returns the target information of the CHALLENGE message, e.g. the DNS
+// domain of the server to try Kerberos instead, or nil if no challenge was processed yet
+func (n *NtlmProvider) ServerTargetInfo() *TargetInformation {
+	if n.challengeFlags == 0 {
+		return nil
+	}
+	return n.TargetInfo
 }
 
 type AuthenicateMessage struct {
@@ -221,6 +358,23 @@ func (n *NtlmProvider) NewAuthenticateMessage() ([]byte, error) {
 	//   88-: Payload
 	var payload []byte
 
+	// Generate Random Client Challenge, unless one was provided
+	if n.ClientChallenge == nil {
+		challenge := make([]byte, 8)
+		if _, err := io.ReadFull(n.random(), challenge); err != nil {
+			return nil, errors.New("failed to generate the client challenge: " + err.Error())
+		}
+		n.ClientChallenge = challenge
+	} else if len(n.ClientChallenge) != 8 {
+		return nil, errors.New("client challenge must be 8 bytes long")
+	}
+
+	domain, user := n.domainName(), n.User
+	if n.isAnonymous() {
+		n.NegotiateFlags |= NegotiateAnonymous
+		domain, user = "", ""
+	}
+
 	lm, err := n.NewLMChallengeResponse()
 	if err != nil {
 		return nil, err
@@ -231,18 +385,27 @@ func (n *NtlmProvider) NewAuthenticateMessage() ([]byte, error) {
 		return nil, err
 	}
 
+	if err := n.newExportedSessionKey(lm); err != nil {
+		return nil, err
+	}
+
+	version, err := n.version()
+	if err != nil {
+		return nil, err
+	}
+
 	offset := 88
 	auth := AuthenicateMessage{
 		Signature:                      Signature,
 		MessageType:                    MessageTypeNtLmAuthenticate,
 		LmChallengeResponseFields:      NewVarField(&payload, lm, &offset),
 		NtChallengeResponseFields:      NewVarField(&payload, nt, &offset),
-		DomainNameFields:               NewVarField(&payload, encoder.StrToUTF16(strings.ToUpper(n.Domain)), &offset),
-		UsernameFields:                 NewVarField(&payload, encoder.StrToUTF16(strings.ToUpper(n.User)), &offset),
-		WorkstationFields:              NewVarField(&payload, encoder.StrToUTF16(strings.ToUpper(n.Workstation)), &offset),
-		EncryptedRandomSessionKeyField: NewVarField(&payload, n.RandomSessionKey, &offset),
+		DomainNameFields:               NewVarField(&payload, n.encodeString(strings.ToUpper(domain)), &offset),
+		UsernameFields:                 NewVarField(&payload, n.encodeString(strings.ToUpper(user)), &offset),
+		WorkstationFields:              NewVarField(&payload, n.encodeString(strings.ToUpper(n.Workstation)), &offset),
+		EncryptedRandomSessionKeyField: NewVarField(&payload, n.EncryptedRandomSessionKey, &offset),
 		NegotiateFlags:                 n.NegotiateFlags,
-		Version:                        ClientVersion,
+		Version:                        version,
 		MIC:                            [16]byte{},
 		Payload:                        payload,
 	}
@@ -251,62 +414,40 @@ func (n *NtlmProvider) NewAuthenticateMessage() ([]byte, error) {
 		return nil, err
 	}
 
-	hash := hmac.New(md5.New, n.ExportedSessionKey)
-	if _, err := hash.Write(n.NegotiateMessage); err != nil {
-		return nil, err
-	}
-
-	if _, err = hash.Write(n.AuthenticateMessage); err != nil {
-		return nil, err
+	// 72-88: MIC
+	// HMAC_MD5(ExportedSessionKey, NEGOTIATE_MESSAGE || CHALLENGE_MESSAGE || AUTHENTICATE_MESSAGE),
+	// computed while the MIC field is still zeroed
+	if n.micRequired() {
+		hash := hmac.New(md5.New, n.ExportedSessionKey)
+		hash.Write(n.NegotiateMessage)
+		hash.Write(n.ChallengeMessage)
+		hash.Write(n.AuthenticateMessage)
+		copy(n.AuthenticateMessage[72:88], hash.Sum(nil))
 	}
-	copy(n.AuthenticateMessage[72:88], hash.Sum(nil))
 
 	// Before returning, we need to generate the session keys
-	n.ServerSigningKey, err = signKey(
-		n.ExportedSessionKey,
-		[]byte("session key to server-to-client signing key magic constant\x00"),
-		n.NegotiateFlags,
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	n.ClientSigningKey, err = signKey(
-		n.ExportedSessionKey,
-		[]byte("session key to client-to-server signing key magic constant\x00"),
-		n.NegotiateFlags,
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	var sealedClientKey, sealedServerKey []byte
-
-	sealedClientKey, err = sealKey(
-		n.ExportedSessionKey,
-		[]byte("session key to client-to-server sealing key magic constant\x00"),
-		n.NegotiateFlags,
-	)
-	if err != nil {
+	if err := n.deriveSessionKeys(false); err != nil {
 		return nil, err
 	}
 
-	sealedServerKey, err = sealKey(
-		n.ExportedSessionKey,
-		[]byte("session key to server-to-client sealing key magic constant\x00"),
-		n.NegotiateFlags,
+	n.debug("NTLM AUTHENTICATE message",
+		"response", n.responseVariant(),
+		"flags", fmt.Sprintf("0x%08x", n.NegotiateFlags),
+		"mic", n.micRequired(),
+		"size", len(n.AuthenticateMessage),
 	)
-	if err != nil {
-		return nil, err
-	}
-
-	if n.ClientHandle, err = rc4.NewCipher(sealedClientKey); err != nil {
-		return nil, err
-	}
+	return n.AuthenticateMessage, nil
+}
 
-	if n.ServerHandle, err = rc4.NewCipher(sealedServerKey); err != nil {
-		return nil, err
+// responseVariant names the challenge responses sent in the AUTHENTICATE message
+func (n *NtlmProvider) responseVariant() string {
+	switch {
+	case n.isAnonymous():
+		return "anonymous"
+	case n.UseNTLMv1 && n.NegotiateFlags&NegotiateExtendedSecurity != 0:
+		return "NTLMv1 with extended session security"
+	case n.UseNTLMv1:
+		return "NTLMv1"
 	}
-
-	return n.AuthenticateMessage, nil
+	return "NTLMv2"
 }
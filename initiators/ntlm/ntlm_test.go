@@ -2,14 +2,30 @@ package ntlm_test
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	cryptorand "crypto/rand"
+	"crypto/rc4"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/msultra/encoder"
 	"github.com/msultra/spnego/initiators/ntlm"
 )
 
+// CHALLENGE message sent by the LAB domain controller
+const testChallenge = "4e544c4d53535000020000000600060038000000358299e2212ba239356b3d8200000000000000005e005e003e0000000a0063450000000f4c0041004200020006004c0041004200010004004400430004000e006c00610062002e006c0061006e0003001400440043002e006c00610062002e006c0061006e0005000e006c00610062002e006c0061006e0007000800f364eebe92ecd80100000000"
+
 func TestInitSecContext(t *testing.T) {
 	provider := ntlm.NtlmProvider{
 		NegotiateFlags: 0xe21882b7,
@@ -34,7 +50,7 @@ func TestInitSecContext(t *testing.T) {
 func TestAcceptSecContext(t *testing.T) {
 	provider := ntlm.NtlmProvider{}
 
-	challenge, err := hex.DecodeString("4e544c4d53535000020000000600060038000000358299e2212ba239356b3d8200000000000000005e005e003e0000000a0063450000000f4c0041004200020006004c0041004200010004004400430004000e006c00610062002e006c0061006e0003001400440043002e006c00610062002e006c0061006e0005000e006c00610062002e006c0061006e0007000800f364eebe92ecd80100000000")
+	challenge, err := hex.DecodeString(testChallenge)
 	if err != nil {
 		t.Fatalf("Failed to decode challenge hex string: %v", err)
 	}
@@ -84,3 +100,1057 @@ func TestAcceptSecContext(t *testing.T) {
 		t.Fatalf("Timestamp is incorrect")
 	}
 }
+
+func TestAuthenticateMessageNtlmv1(t *testing.T) {
+	provider := ntlm.NtlmProvider{
+		User:      "User",
+		Domain:    "Domain",
+		Password:  "Password",
+		UseNTLMv1: true,
+	}
+
+	if _, err := provider.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+
+	challenge, err := hex.DecodeString(testChallenge)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+
+	auth, err := provider.AcceptSecContext(challenge)
+	if err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+
+	// 12-20: LmChallengeResponseFields
+	// 20-28: NtChallengeResponseFields
+	if lmLen := binary.LittleEndian.Uint16(auth[12:14]); lmLen != 24 {
+		t.Fatalf("LM response length is %d, expected 24", lmLen)
+	}
+	if ntLen := binary.LittleEndian.Uint16(auth[20:22]); ntLen != 24 {
+		t.Fatalf("NT response length is %d, expected 24", ntLen)
+	}
+}
+
+func TestHandshakeState(t *testing.T) {
+	provider := ntlm.NtlmProvider{User: "User", Password: "Password"}
+
+	if provider.State() != ntlm.StateInitial || provider.IsEstablished() {
+		t.Fatalf("provider should be in the initial state")
+	}
+	if _, err := provider.GetMIC([]byte("message")); !errors.Is(err, ntlm.ErrContextNotEstablished) {
+		t.Fatalf("GetMIC() returned %v, expected %v", err, ntlm.ErrContextNotEstablished)
+	}
+
+	if _, err := provider.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	if provider.State() != ntlm.StateNegotiateSent || provider.IsEstablished() {
+		t.Fatalf("provider should be waiting for the challenge")
+	}
+
+	challenge, err := hex.DecodeString(testChallenge)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+	if _, err := provider.AcceptSecContext(challenge[:40]); err == nil {
+		t.Fatalf("AcceptSecContext() should fail on a truncated challenge")
+	}
+	if provider.State() != ntlm.StateNegotiateSent {
+		t.Fatalf("a failed AcceptSecContext() should not change the state")
+	}
+
+	if _, err := provider.AcceptSecContext(challenge); err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+	if provider.State() != ntlm.StateAuthenticated || !provider.IsEstablished() {
+		t.Fatalf("provider should be established")
+	}
+	if _, err := provider.GetMIC([]byte("message")); err != nil {
+		t.Fatalf("GetMIC() failed: %v", err)
+	}
+}
+
+func TestHandshakeOutOfOrder(t *testing.T) {
+	challenge, err := hex.DecodeString(testChallenge)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+
+	provider := ntlm.NtlmProvider{}
+	if _, err := provider.AcceptSecContext(challenge); !errors.Is(err, ntlm.ErrOutOfOrder) {
+		t.Fatalf("AcceptSecContext() before InitSecContext() returned %v, expected %v", err, ntlm.ErrOutOfOrder)
+	}
+
+	if _, err := provider.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	if _, err := provider.InitSecContext(); !errors.Is(err, ntlm.ErrOutOfOrder) {
+		t.Fatalf("second InitSecContext() returned %v, expected %v", err, ntlm.ErrOutOfOrder)
+	}
+
+	if _, err := provider.AcceptSecContext(challenge); err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+	if _, err := provider.AcceptSecContext(challenge); !errors.Is(err, ntlm.ErrOutOfOrder) {
+		t.Fatalf("second AcceptSecContext() returned %v, expected %v", err, ntlm.ErrOutOfOrder)
+	}
+}
+
+// Same challenge as testChallenge, without the MsvAvTimestamp pair
+const testChallengeWithoutTimestamp = "4e544c4d53535000020000000600060038000000358299e2212ba239356b3d820000000000000000520052003e0000000a0063450000000f4c0041004200020006004c0041004200010004004400430004000e006c00610062002e006c0061006e0003001400440043002e006c00610062002e006c0061006e0005000e006c00610062002e006c0061006e0000000000"
+
+// authenticate runs the handshake against the given challenge and returns the
+// NEGOTIATE, CHALLENGE and AUTHENTICATE messages along with the NTLMv2 client challenge blob
+func authenticate(t *testing.T, provider *ntlm.NtlmProvider, challengeHex string) (neg, chal, auth, blob []byte) {
+	t.Helper()
+
+	neg, err := provider.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+
+	if chal, err = hex.DecodeString(challengeHex); err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+
+	if auth, err = provider.AcceptSecContext(chal); err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+
+	// 20-28: NtChallengeResponseFields
+	ntLen := binary.LittleEndian.Uint16(auth[20:22])
+	ntOffset := binary.LittleEndian.Uint32(auth[24:28])
+	if ntLen < 16 {
+		return neg, chal, auth, nil
+	}
+	return neg, chal, auth, auth[ntOffset+16 : ntOffset+uint32(ntLen)]
+}
+
+func TestReset(t *testing.T) {
+	provider := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	neg, _, _, _ := authenticate(t, provider, testChallenge)
+	sessionKey := provider.SessionKey()
+
+	provider.Reset()
+	if provider.State() != ntlm.StateInitial || provider.IsEstablished() || provider.SessionKey() != nil {
+		t.Fatalf("Reset() should clear the handshake state")
+	}
+	if provider.ClientHandle != nil || provider.ServerHandle != nil || provider.ChallengeMessage != nil {
+		t.Fatalf("Reset() should clear the handles and the stored messages")
+	}
+	if provider.User != "User" || provider.Domain != "Domain" || provider.Password != "Password" {
+		t.Fatalf("Reset() should keep the credentials")
+	}
+
+	again, _, _, _ := authenticate(t, provider, testChallengeWithoutTimestamp)
+	if !provider.IsEstablished() {
+		t.Fatalf("second handshake should succeed")
+	}
+	if !bytes.Equal(neg, again) {
+		t.Fatalf("NEGOTIATE message after Reset() is %x, expected %x", again, neg)
+	}
+	if bytes.Equal(provider.SessionKey(), sessionKey) {
+		t.Fatalf("second handshake should derive a new session key")
+	}
+}
+
+func TestAuthenticateMessageTimestamp(t *testing.T) {
+	provider := ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	neg, chal, auth, blob := authenticate(t, &provider, testChallenge)
+
+	//	8-16: TimeStamp
+	ts, _ := hex.DecodeString("f364eebe92ecd801")
+	if !bytes.Equal(blob[8:16], ts) {
+		t.Fatalf("response timestamp is %x, expected the server one %x", blob[8:16], ts)
+	}
+
+	// 28-: AvPairs
+	pairs, err := ntlm.NewAvPairs(blob[28 : len(blob)-4])
+	if err != nil {
+		t.Fatalf("NewAvPairs() failed: %v", err)
+	}
+	if !bytes.Equal(pairs[ntlm.AvIDMsvAvTimestamp], ts) {
+		t.Fatalf("MsvAvTimestamp is %x, expected %x", pairs[ntlm.AvIDMsvAvTimestamp], ts)
+	}
+	flags, ok := pairs[ntlm.AvIDMsvAvFlags]
+	if !ok || binary.LittleEndian.Uint32(flags)&ntlm.MsvAvFlagMICPresent == 0 {
+		t.Fatalf("MsvAvFlags is %x, expected the MIC present bit", flags)
+	}
+
+	// MIC = HMAC_MD5(ExportedSessionKey, NEGOTIATE || CHALLENGE || AUTHENTICATE with a zero MIC)
+	withoutMIC := append([]byte(nil), auth...)
+	clear(withoutMIC[72:88])
+	h := hmac.New(md5.New, provider.ExportedSessionKey)
+	h.Write(neg)
+	h.Write(chal)
+	h.Write(withoutMIC)
+	if mic := h.Sum(nil); !bytes.Equal(auth[72:88], mic) {
+		t.Fatalf("MIC is %x, expected %x", auth[72:88], mic)
+	}
+}
+
+func TestAuthenticateMessageClock(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	provider := ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", Now: func() time.Time { return now }}
+	_, _, _, blob := authenticate(t, &provider, testChallengeWithoutTimestamp)
+
+	//	8-16: TimeStamp
+	info, err := ntlm.NewTargetInformation(ntlm.AvPairs{ntlm.AvIDMsvAvTimestamp: blob[8:16]})
+	if err != nil {
+		t.Fatalf("NewTargetInformation() failed: %v", err)
+	}
+	if !info.Time().Equal(now) {
+		t.Fatalf("response timestamp is %v, expected the clock time %v", info.Time(), now)
+	}
+}
+
+func TestAuthenticateMessageTargetSPN(t *testing.T) {
+	for _, spn := range []string{"", "HTTP/proxy.corp.example.com"} {
+		provider := ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", TargetSPN: spn}
+		_, _, _, blob := authenticate(t, &provider, testChallenge)
+
+		// 28-: AvPairs
+		pairs, err := ntlm.NewAvPairs(blob[28 : len(blob)-4])
+		if err != nil {
+			t.Fatalf("NewAvPairs() failed: %v", err)
+		}
+		value, ok := pairs[ntlm.AvIDMsvAvTargetName]
+		if ok != (spn != "") || encoder.UTF16ToStr(value) != spn {
+			t.Fatalf("MsvAvTargetName is %q, expected %q", encoder.UTF16ToStr(value), spn)
+		}
+	}
+}
+
+func TestAuthenticateMessageAvFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		challenge    string
+		untrusted    bool
+		serverFlags  uint32
+		expected     uint32
+		expectedPair bool
+	}{
+		{"MIC", testChallenge, false, 0, ntlm.MsvAvFlagMICPresent, true},
+		{"no MIC", testChallengeWithoutTimestamp, false, 0, 0, false},
+		{"untrusted SPN", testChallengeWithoutTimestamp, true, 0, ntlm.MsvAvFlagUntrustedSPN, true},
+		{"constrained", testChallenge, true, ntlm.MsvAvFlagAuthenticationConstrained,
+			ntlm.MsvAvFlagAuthenticationConstrained | ntlm.MsvAvFlagMICPresent | ntlm.MsvAvFlagUntrustedSPN, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			challenge := tc.challenge
+			if tc.serverFlags != 0 {
+				challenge = challengeWithAvFlags(t, challenge, tc.serverFlags)
+			}
+			provider := ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", TargetSPN: "HTTP/server", UntrustedSPN: tc.untrusted}
+			_, _, _, blob := authenticate(t, &provider, challenge)
+			if constrained := provider.ServerTargetInfo().AuthenticationConstrained(); constrained != (tc.serverFlags != 0) {
+				t.Fatalf("AuthenticationConstrained() is %v", constrained)
+			}
+
+			// 28-: AvPairs
+			pairs, err := ntlm.NewAvPairs(blob[28 : len(blob)-4])
+			if err != nil {
+				t.Fatalf("NewAvPairs() failed: %v", err)
+			}
+			value, ok := pairs[ntlm.AvIDMsvAvFlags]
+			if ok != tc.expectedPair || (ok && binary.LittleEndian.Uint32(value) != tc.expected) {
+				t.Fatalf("MsvAvFlags is %x, expected %08x", value, tc.expected)
+			}
+		})
+	}
+}
+
+// challengeWithAvFlags adds the MsvAvFlags pair to the target information of the challenge
+func challengeWithAvFlags(t *testing.T, challengeHex string, flags uint32) string {
+	t.Helper()
+
+	challenge, err := hex.DecodeString(challengeHex)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+	// 40-48: TargetInfoFields, the target info ends the payload
+	length := binary.LittleEndian.Uint16(challenge[40:42])
+	offset := binary.LittleEndian.Uint32(challenge[44:48])
+	pairs, err := ntlm.NewAvPairs(challenge[offset : offset+uint32(length)])
+	if err != nil {
+		t.Fatalf("NewAvPairs() failed: %v", err)
+	}
+	pairs[ntlm.AvIDMsvAvFlags] = binary.LittleEndian.AppendUint32(nil, flags)
+	targetInfo := pairs.Bytes()
+
+	challenge = append(challenge[:offset], targetInfo...)
+	binary.LittleEndian.PutUint16(challenge[40:42], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(challenge[42:44], uint16(len(targetInfo)))
+	return hex.EncodeToString(challenge)
+}
+
+func TestAuthenticateMessageWithoutTimestamp(t *testing.T) {
+	provider := ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	before := time.Now()
+	_, _, _, blob := authenticate(t, &provider, testChallengeWithoutTimestamp)
+
+	// The client falls back to its own clock
+	const epochDelta = 116444736000000000
+	ts := binary.LittleEndian.Uint64(blob[8:16])
+	if now := uint64(before.UnixNano()/100) + epochDelta; ts < now || ts > now+uint64(time.Minute/100) {
+		t.Fatalf("response timestamp %d is not the current time %d", ts, now)
+	}
+
+	pairs, err := ntlm.NewAvPairs(blob[28 : len(blob)-4])
+	if err != nil {
+		t.Fatalf("NewAvPairs() failed: %v", err)
+	}
+	if _, ok := pairs[ntlm.AvIDMsvAvTimestamp]; ok {
+		t.Fatalf("MsvAvTimestamp should not be sent back when the server did not send it")
+	}
+	if flags, ok := pairs[ntlm.AvIDMsvAvFlags]; ok && binary.LittleEndian.Uint32(flags)&ntlm.MsvAvFlagMICPresent != 0 {
+		t.Fatalf("MIC present bit should not be set without a server timestamp")
+	}
+}
+
+func TestAuthenticateMessageMIC(t *testing.T) {
+	provider := ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	_, chal, auth, _ := authenticate(t, &provider, testChallenge)
+
+	if !bytes.Equal(provider.ChallengeMessage, chal) {
+		t.Fatalf("ChallengeMessage is not the received challenge")
+	}
+	if bytes.Equal(auth[72:88], make([]byte, 16)) {
+		t.Fatalf("MIC should be set when the server sends a timestamp")
+	}
+
+	// The MIC covers the challenge, not only NEGOTIATE || AUTHENTICATE
+	withoutMIC := append([]byte(nil), auth...)
+	clear(withoutMIC[72:88])
+	h := hmac.New(md5.New, provider.ExportedSessionKey)
+	h.Write(provider.NegotiateMessage)
+	h.Write(withoutMIC)
+	if bytes.Equal(auth[72:88], h.Sum(nil)) {
+		t.Fatalf("MIC is computed without the CHALLENGE message")
+	}
+
+	provider = ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	_, _, auth, _ = authenticate(t, &provider, testChallengeWithoutTimestamp)
+	if !bytes.Equal(auth[72:88], make([]byte, 16)) {
+		t.Fatalf("MIC is %x, expected zeros without a server timestamp", auth[72:88])
+	}
+}
+
+func TestAuthenticateMessageAnonymous(t *testing.T) {
+	for _, provider := range []*ntlm.NtlmProvider{
+		{},
+		{User: "User", Password: "Password", Anonymous: true},
+	} {
+		_, _, auth, _ := authenticate(t, provider, testChallenge)
+
+		// 12-20: LmChallengeResponseFields
+		lmLen := binary.LittleEndian.Uint16(auth[12:14])
+		lmOffset := binary.LittleEndian.Uint32(auth[16:20])
+		if lmLen != 1 || auth[lmOffset] != 0 {
+			t.Fatalf("LM response should be a single null byte, got %x", auth[lmOffset:lmOffset+uint32(lmLen)])
+		}
+
+		// 20-28: NtChallengeResponseFields
+		if ntLen := binary.LittleEndian.Uint16(auth[20:22]); ntLen != 0 {
+			t.Fatalf("NT response length is %d, expected 0", ntLen)
+		}
+
+		// 36-44: UserNameFields
+		if userLen := binary.LittleEndian.Uint16(auth[36:38]); userLen != 0 {
+			t.Fatalf("user name length is %d, expected 0", userLen)
+		}
+
+		// 60-64: NegotiateFlags
+		if flags := binary.LittleEndian.Uint32(auth[60:64]); flags&ntlm.NegotiateAnonymous == 0 {
+			t.Fatalf("NegotiateAnonymous is not set in the AUTHENTICATE message flags %08x", flags)
+		}
+
+		// The session base key of the anonymous user is the null key
+		if !bytes.Equal(provider.SessionBaseKey, make([]byte, 16)) {
+			t.Fatalf("session base key is %x, expected the null key", provider.SessionBaseKey)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	version := []byte{0x06, 0x01, 0xb1, 0x1d, 0x00, 0x00, 0x00, 0x0f} // Windows 7 SP1 (7601)
+	provider := ntlm.NtlmProvider{User: "User", Password: "Password", Version: version}
+	neg, _, auth, _ := authenticate(t, &provider, testChallenge)
+
+	// 32-40: Version
+	if !bytes.Equal(neg[32:40], version) {
+		t.Fatalf("NEGOTIATE version is %x, expected %x", neg[32:40], version)
+	}
+	// 64-72: Version
+	if !bytes.Equal(auth[64:72], version) {
+		t.Fatalf("AUTHENTICATE version is %x, expected %x", auth[64:72], version)
+	}
+
+	provider = ntlm.NtlmProvider{Version: version[:4]}
+	if _, err := provider.InitSecContext(); !errors.Is(err, ntlm.ErrInvalidVersion) {
+		t.Fatalf("InitSecContext() returned %v, expected %v", err, ntlm.ErrInvalidVersion)
+	}
+}
+
+func TestOmitVersion(t *testing.T) {
+	provider := ntlm.NtlmProvider{User: "User", Password: "Password", OmitVersion: true}
+	neg, _, auth, _ := authenticate(t, &provider, testChallenge)
+
+	// 12-16: NegotiateFlags
+	if flags := binary.LittleEndian.Uint32(neg[12:16]); flags&ntlm.NegotiateVersion != 0 {
+		t.Fatalf("NegotiateVersion should not be set in the NEGOTIATE message flags %08x", flags)
+	}
+	// 60-64: NegotiateFlags
+	if flags := binary.LittleEndian.Uint32(auth[60:64]); flags&ntlm.NegotiateVersion != 0 {
+		t.Fatalf("NegotiateVersion should not be set in the AUTHENTICATE message flags %08x", flags)
+	}
+
+	if !bytes.Equal(neg[32:40], make([]byte, 8)) {
+		t.Fatalf("NEGOTIATE version is %x, expected zeros", neg[32:40])
+	}
+	if !bytes.Equal(auth[64:72], make([]byte, 8)) {
+		t.Fatalf("AUTHENTICATE version is %x, expected zeros", auth[64:72])
+	}
+}
+
+func TestValidateChallengeMessageErrors(t *testing.T) {
+	challenge, err := hex.DecodeString(testChallenge)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+
+	// mutate returns a copy of the challenge modified by f
+	mutate := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), challenge...))
+	}
+
+	for _, tc := range []struct {
+		name     string
+		message  []byte
+		expected error
+	}{
+		{"truncated header", challenge[:40], ntlm.ErrTruncatedMessage},
+		{"truncated payload", challenge[:len(challenge)-16], ntlm.ErrTruncatedMessage},
+		{"bad signature", mutate(func(b []byte) []byte { b[0] = 'X'; return b }), ntlm.ErrBadSignature},
+		{"negotiate message type", mutate(func(b []byte) []byte { b[8] = ntlm.MessageTypeNtLmNegotiate; return b }), ntlm.ErrUnexpectedMessageType},
+		{"no target info flag", mutate(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[20:24], binary.LittleEndian.Uint32(b[20:24])&^ntlm.NegotiateTargetInfo)
+			return b
+		}), ntlm.ErrUnsupportedFlags},
+	} {
+		provider := ntlm.NtlmProvider{}
+		if err := provider.ValidateChallengeMessage(tc.message); !errors.Is(err, tc.expected) {
+			t.Fatalf("%s: ValidateChallengeMessage() returned %v, expected %v", tc.name, err, tc.expected)
+		}
+	}
+}
+
+func TestValidateChallengeMessageTruncated(t *testing.T) {
+	challenge, err := hex.DecodeString(testChallenge)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+
+	// Every truncation must be rejected without panicking
+	for i := 0; i < len(challenge)-4; i++ {
+		provider := ntlm.NtlmProvider{}
+		if err := provider.ValidateChallengeMessage(challenge[:i]); err == nil {
+			t.Fatalf("ValidateChallengeMessage() should fail on a %d bytes challenge", i)
+		}
+	}
+
+	// Truncated AV pairs, announced with a consistent TargetInfoFields length
+	for i := 1; i < 4; i++ {
+		b := append([]byte(nil), challenge[:len(challenge)-i]...)
+		binary.LittleEndian.PutUint16(b[40:42], binary.LittleEndian.Uint16(b[40:42])-uint16(i))
+		provider := ntlm.NtlmProvider{}
+		if err := provider.ValidateChallengeMessage(b); !errors.Is(err, ntlm.ErrTruncatedMessage) {
+			t.Fatalf("ValidateChallengeMessage() returned %v, expected %v", err, ntlm.ErrTruncatedMessage)
+		}
+	}
+
+	// Random corruptions of the header and the target info
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 10000; i++ {
+		b := append([]byte(nil), challenge...)
+		for j := 0; j < 1+rng.IntN(4); j++ {
+			b[rng.IntN(len(b))] = byte(rng.Uint32())
+		}
+		provider := ntlm.NtlmProvider{}
+		_ = provider.ValidateChallengeMessage(b[:rng.IntN(len(b)+1)])
+	}
+}
+
+func FuzzValidateChallengeMessage(f *testing.F) {
+	for _, s := range []string{testChallenge, testChallengeWithoutTimestamp} {
+		challenge, err := hex.DecodeString(s)
+		if err != nil {
+			f.Fatalf("Failed to decode challenge hex string: %v", err)
+		}
+		f.Add(challenge)
+
+		// Zero-length target info
+		empty := append([]byte(nil), challenge...)
+		binary.LittleEndian.PutUint16(empty[40:42], 0)
+		binary.LittleEndian.PutUint16(empty[42:44], 0)
+		f.Add(empty)
+
+		// Target name overlapping the target info
+		overlap := append([]byte(nil), challenge...)
+		copy(overlap[12:20], overlap[40:48])
+		f.Add(overlap)
+	}
+
+	f.Fuzz(func(t *testing.T, challenge []byte) {
+		provider := ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+		if _, err := provider.InitSecContext(); err != nil {
+			t.Fatalf("InitSecContext() failed: %v", err)
+		}
+
+		auth, err := provider.AcceptSecContext(challenge)
+		if err != nil {
+			return
+		}
+
+		// The AUTHENTICATE message must be well-formed
+		if len(auth) < 88 || !bytes.Equal(auth[0:8], ntlm.Signature[:]) {
+			t.Fatalf("AUTHENTICATE message has an invalid header: %x", auth)
+		}
+		if binary.LittleEndian.Uint32(auth[8:12]) != ntlm.MessageTypeNtLmAuthenticate {
+			t.Fatalf("AUTHENTICATE message has an invalid type: %x", auth[8:12])
+		}
+		// 12-60: Lm, Nt, Domain, User, Workstation and EncryptedRandomSessionKey fields
+		for i := 12; i < 60; i += 8 {
+			length := binary.LittleEndian.Uint16(auth[i : i+2])
+			offset := binary.LittleEndian.Uint32(auth[i+4 : i+8])
+			if int(offset)+int(length) > len(auth) {
+				t.Fatalf("field at %d points out of the message", i)
+			}
+		}
+	})
+}
+
+// Same challenge as testChallenge, negotiating OEM strings with an OEM target name
+const testChallengeOEM = "4e544c4d53535000020000000300030038000000368299e2212ba239356b3d8200000000000000005e005e003b0000000a0063450000000f4c4142020006004c0041004200010004004400430004000e006c00610062002e006c0061006e0003001400440043002e006c00610062002e006c0061006e0005000e006c00610062002e006c0061006e0007000800f364eebe92ecd80100000000"
+
+func TestTargetNameString(t *testing.T) {
+	for _, challengeHex := range []string{testChallenge, testChallengeOEM} {
+		challenge, err := hex.DecodeString(challengeHex)
+		if err != nil {
+			t.Fatalf("Failed to decode challenge hex string: %v", err)
+		}
+
+		provider := ntlm.NtlmProvider{}
+		if err := provider.ValidateChallengeMessage(challenge); err != nil {
+			t.Fatalf("ValidateChallengeMessage() failed: %v", err)
+		}
+		if name := provider.TargetNameString(); name != "LAB" {
+			t.Fatalf("TargetNameString() is %q, expected LAB", name)
+		}
+	}
+}
+
+func TestServerTargetInfo(t *testing.T) {
+	provider := ntlm.NtlmProvider{User: "User", Password: "Password"}
+	if info := provider.ServerTargetInfo(); info != nil {
+		t.Fatalf("ServerTargetInfo() is %v before the challenge", info)
+	}
+
+	authenticate(t, &provider, testChallenge)
+	info := provider.ServerTargetInfo()
+	if info == nil {
+		t.Fatal("ServerTargetInfo() is nil after the challenge")
+	}
+	if info.DNSDomainName != "lab.lan" || info.DNSComputerName != "DC.lab.lan" || info.NetBIOSDomainName() != "LAB" {
+		t.Fatalf("target info is %+v", info)
+	}
+}
+
+func TestRequestTarget(t *testing.T) {
+	provider := ntlm.NtlmProvider{NegotiateFlags: ntlm.NegotiateUnicode | ntlm.NegotiateNTLM}
+	neg, err := provider.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	if flags := binary.LittleEndian.Uint32(neg[12:16]); flags&ntlm.RequestTarget == 0 {
+		t.Fatalf("RequestTarget is not set in the NEGOTIATE message flags %08x", flags)
+	}
+}
+
+func TestNegotiateMessageOEM(t *testing.T) {
+	provider := ntlm.NtlmProvider{Domain: "Domain", Workstation: "Computer", IsOEM: true}
+	neg, err := provider.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+
+	// 16-24: DomainNameFields
+	// 24-32: WorkstationFields
+	for _, tc := range []struct {
+		field    int
+		expected string
+	}{{16, "Domain"}, {24, "Computer"}} {
+		length := binary.LittleEndian.Uint16(neg[tc.field : tc.field+2])
+		offset := binary.LittleEndian.Uint32(neg[tc.field+4 : tc.field+8])
+		if int(length) != len(tc.expected) || string(neg[offset:offset+uint32(length)]) != tc.expected {
+			t.Fatalf("field at %d is %x, expected the OEM string %q", tc.field, neg[offset:offset+uint32(length)], tc.expected)
+		}
+	}
+}
+
+// NEGOTIATE message of Windows 10 (build 19041) in Unicode mode: no domain nor workstation
+func TestNegotiateMessageWindows(t *testing.T) {
+	const flags = ntlm.NegotiateUnicode | ntlm.NegotiateOEM | ntlm.RequestTarget | ntlm.NegotiateNTLM | ntlm.NegotiateAlwaysSign |
+		ntlm.NegotiateExtendedSecurity | ntlm.NegotiateVersion | ntlm.Negotiate128 | ntlm.Negotiate56
+	provider := ntlm.NtlmProvider{Domain: "Domain", Workstation: "Computer", NegotiateFlags: flags, Version: ntlm.NewVersion(10, 0, 19041, ntlm.NTLMRevisionCurrent)}
+	neg, err := provider.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+
+	expected, err := base64.StdEncoding.DecodeString("TlRMTVNTUAABAAAAB4IIogAAAAAAAAAAAAAAAAAAAAAKAGFKAAAADw==")
+	if err != nil {
+		t.Fatalf("Failed to decode reference base64 string: %v", err)
+	}
+	if !bytes.Equal(neg, expected) {
+		t.Fatalf("NEGOTIATE message is %x, expected %x", neg, expected)
+	}
+}
+
+func TestAuthenticateMessageCharset(t *testing.T) {
+	for _, tc := range []struct {
+		challenge string
+		expected  []byte
+	}{
+		{testChallenge, encoder.StrToUTF16("USER")},
+		{testChallengeOEM, []byte("USER")},
+	} {
+		provider := ntlm.NtlmProvider{User: "User", Password: "Password"}
+		_, _, auth, _ := authenticate(t, &provider, tc.challenge)
+
+		// 36-44: UserNameFields
+		length := binary.LittleEndian.Uint16(auth[36:38])
+		offset := binary.LittleEndian.Uint32(auth[40:44])
+		if user := auth[offset : offset+uint32(length)]; !bytes.Equal(user, tc.expected) {
+			t.Fatalf("user name is %x, expected %x", user, tc.expected)
+		}
+	}
+}
+
+func TestAuthenticateMessageReference(t *testing.T) {
+	provider := ntlm.NtlmProvider{
+		User:            "User",
+		Domain:          "Domain",
+		Password:        "Password",
+		NegotiateFlags:  ntlm.DefaultNegotiateFlags &^ ntlm.NegotiateKeyExch,
+		ClientChallenge: []byte{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa},
+	}
+	_, _, auth, _ := authenticate(t, &provider, testChallenge)
+
+	expected, err := hex.DecodeString("4e544c4d53535000030000001800180058000000aa00aa00700000000c000c001a0100000800080026010000000000002e010000000000002e010000158288a20a0000000000000fb2d13a46fbf6c5ac8b0979857cbf58c80000000000000000000000000000000000000000000000004633d81159d918f644329380219b20060101000000000000f364eebe92ecd801aaaaaaaaaaaaaaaa000000000100040044004300020006004c004100420003001400440043002e006c00610062002e006c0061006e0004000e006c00610062002e006c0061006e0005000e006c00610062002e006c0061006e00060004000200000007000800f364eebe92ecd8010a00100000000000000000000000000000000000000000000000000044004f004d00410049004e005500530045005200")
+	if err != nil {
+		t.Fatalf("Failed to decode reference hex string: %v", err)
+	}
+	if !bytes.Equal(auth, expected) {
+		t.Fatalf("AUTHENTICATE message is\n%x\nexpected\n%x", auth, expected)
+	}
+}
+
+func TestAuthenticateMessageInvalidClientChallenge(t *testing.T) {
+	provider := ntlm.NtlmProvider{User: "User", Password: "Password", ClientChallenge: []byte{0x01}}
+	if _, err := provider.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+
+	challenge, err := hex.DecodeString(testChallenge)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+	if _, err := provider.AcceptSecContext(challenge); err == nil {
+		t.Fatalf("AcceptSecContext() should fail with a short client challenge")
+	}
+}
+
+// failingReader is a random source that always fails
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("entropy source failure")
+}
+
+func TestAuthenticateMessageRandomFailure(t *testing.T) {
+	reader := cryptorand.Reader
+	cryptorand.Reader = failingReader{}
+	t.Cleanup(func() { cryptorand.Reader = reader })
+
+	for _, provider := range []*ntlm.NtlmProvider{
+		// Client challenge generation
+		{User: "User", Password: "Password"},
+		// Random session key generation
+		{User: "User", Password: "Password", ClientChallenge: make([]byte, 8)},
+	} {
+		if _, err := provider.InitSecContext(); err != nil {
+			t.Fatalf("InitSecContext() failed: %v", err)
+		}
+
+		challenge, err := hex.DecodeString(testChallenge)
+		if err != nil {
+			t.Fatalf("Failed to decode challenge hex string: %v", err)
+		}
+		if _, err := provider.AcceptSecContext(challenge); err == nil || !strings.Contains(err.Error(), "entropy source failure") {
+			t.Fatalf("AcceptSecContext() returned %v, expected the random source error", err)
+		}
+		if provider.IsEstablished() {
+			t.Fatalf("provider should not be established")
+		}
+	}
+}
+
+func TestAuthenticateMessageRandomSessionKey(t *testing.T) {
+	provider := ntlm.NtlmProvider{User: "User", Password: "Password"}
+	authenticate(t, &provider, testChallenge)
+
+	if bytes.Equal(provider.ExportedSessionKey, make([]byte, 16)) {
+		t.Fatalf("ExportedSessionKey should be random with key exchange")
+	}
+}
+
+func TestAuthenticateMessageRand(t *testing.T) {
+	seed := [32]byte{0x01}
+
+	var messages [2][]byte
+	for i := range messages {
+		provider := ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", Rand: rand.NewChaCha8(seed)}
+		_, _, messages[i], _ = authenticate(t, &provider, testChallenge)
+	}
+	if !bytes.Equal(messages[0], messages[1]) {
+		t.Fatalf("providers with the same random source produced different messages:\n%x\n%x", messages[0], messages[1])
+	}
+
+	provider := ntlm.NtlmProvider{User: "User", Password: "Password", Rand: failingReader{}}
+	if _, err := provider.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	challenge, err := hex.DecodeString(testChallenge)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+	if _, err := provider.AcceptSecContext(challenge); err == nil {
+		t.Fatalf("AcceptSecContext() should fail when Rand fails")
+	}
+	if provider.ClientChallenge != nil {
+		t.Fatalf("the client challenge should not be set when Rand fails: %x", provider.ClientChallenge)
+	}
+}
+
+// MS-NLMP 4.2.3: the client challenge 0xaa * 8 of the spec is drawn from Rand, so the
+// whole handshake reproduces the NTLMv1 responses with extended session security
+func TestAuthenticateMessageRandVector(t *testing.T) {
+	challenge, err := hex.DecodeString(testChallenge)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+	// 24-32: ServerChallenge
+	copy(challenge[24:32], decodeHex(t, "0123456789abcdef"))
+
+	provider := ntlm.NtlmProvider{
+		User:           "User",
+		Domain:         "Domain",
+		Password:       "Password",
+		UseNTLMv1:      true,
+		NegotiateFlags: 0x820a8233 &^ ntlm.NegotiateSeal, // sealing requires the key exchange
+		MinKeyBits:     56,
+		Rand:           bytes.NewReader(bytes.Repeat([]byte{0xaa}, 8)),
+	}
+	if _, err := provider.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	auth, err := provider.AcceptSecContext(challenge)
+	if err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+
+	// 12-20: LmChallengeResponseFields, 20-28: NtChallengeResponseFields
+	for _, tc := range []struct {
+		field    int
+		expected string
+	}{
+		{12, "aaaaaaaaaaaaaaaa00000000000000000000000000000000"},
+		{20, "7537f803ae367128ca458204bde7caf81e97ed2683267232"},
+	} {
+		length := binary.LittleEndian.Uint16(auth[tc.field:])
+		offset := binary.LittleEndian.Uint32(auth[tc.field+4:])
+		if response := auth[offset : offset+uint32(length)]; !bytes.Equal(response, decodeHex(t, tc.expected)) {
+			t.Fatalf("response at %d is %x, expected %s", tc.field, response, tc.expected)
+		}
+	}
+}
+
+// MS-NLMP 4.2.2.2.3: RandomSessionKey 0x55 * 16 encrypted with the NTLMv1 KXKEY
+func TestAuthenticateMessageKeyExchange(t *testing.T) {
+	randomSessionKey := bytes.Repeat([]byte{0x55}, 16)
+	provider := ntlm.NtlmProvider{
+		User:            "User",
+		Domain:          "Domain",
+		Password:        "Password",
+		UseNTLMv1:       true,
+		NegotiateFlags:  0xe2028233,
+		ClientChallenge: bytes.Repeat([]byte{0xaa}, 8),
+		Rand:            bytes.NewReader(randomSessionKey),
+	}
+	_, _, auth, _ := authenticate(t, &provider, testChallenge)
+
+	// 52-60: EncryptedRandomSessionKeyFields
+	length := binary.LittleEndian.Uint16(auth[52:54])
+	offset := binary.LittleEndian.Uint32(auth[56:60])
+	encrypted := auth[offset : offset+uint32(length)]
+
+	expected, _ := hex.DecodeString("518822b1b3f350c8958682ecbb3e3cb7")
+	if !bytes.Equal(encrypted, expected) {
+		t.Fatalf("EncryptedRandomSessionKey is %x, expected %x", encrypted, expected)
+	}
+
+	// The encrypted blob decrypts back to the random key, which is the exported one
+	handle, err := rc4.NewCipher(provider.KeyExchangeKey)
+	if err != nil {
+		t.Fatalf("rc4.NewCipher() failed: %v", err)
+	}
+	decrypted := make([]byte, len(encrypted))
+	handle.XORKeyStream(decrypted, encrypted)
+	if !bytes.Equal(decrypted, randomSessionKey) || !bytes.Equal(provider.RandomSessionKey, randomSessionKey) {
+		t.Fatalf("EncryptedRandomSessionKey decrypts to %x, expected %x", decrypted, randomSessionKey)
+	}
+	if !bytes.Equal(provider.ExportedSessionKey, randomSessionKey) {
+		t.Fatalf("ExportedSessionKey is %x, expected the random session key", provider.ExportedSessionKey)
+	}
+}
+
+// challengeWithFlags returns testChallenge with the negotiate flags altered by f, hex encoded
+func challengeWithFlags(t *testing.T, f func(flags uint32) uint32) string {
+	t.Helper()
+	challenge, err := hex.DecodeString(testChallenge)
+	if err != nil {
+		t.Fatalf("Failed to decode challenge hex string: %v", err)
+	}
+
+	// 20-24: NegotiateFlags
+	binary.LittleEndian.PutUint32(challenge[20:24], f(binary.LittleEndian.Uint32(challenge[20:24])))
+	return hex.EncodeToString(challenge)
+}
+
+func TestNegotiatedFlags(t *testing.T) {
+	provider := ntlm.NtlmProvider{
+		User:           "User",
+		Password:       "Password",
+		NegotiateFlags: ntlm.DefaultNegotiateFlags,
+	}
+	if provider.NegotiatedFlags() != 0 || provider.SupportsSigning() {
+		t.Fatalf("no flags should be negotiated before the challenge")
+	}
+
+	// The server supports sealing, which the client did not request
+	_, _, auth, _ := authenticate(t, &provider, challengeWithFlags(t, func(flags uint32) uint32 {
+		return flags | ntlm.NegotiateSeal
+	}))
+
+	if flags := provider.NegotiatedFlags(); flags&ntlm.NegotiateSeal != 0 || flags&ntlm.NegotiateSign == 0 {
+		t.Fatalf("negotiated flags %08x should only allow signing", flags)
+	}
+	if provider.SupportsSealing() || !provider.SupportsSigning() {
+		t.Fatalf("provider should support signing but not sealing")
+	}
+
+	// 60-64: NegotiateFlags
+	if flags := binary.LittleEndian.Uint32(auth[60:64]); flags != provider.NegotiatedFlags() {
+		t.Fatalf("AUTHENTICATE flags are %08x, expected the negotiated %08x", flags, provider.NegotiatedFlags())
+	}
+	if _, _, err := provider.Seal([]byte("message")); !errors.Is(err, ntlm.ErrSealNotNegotiated) {
+		t.Fatalf("Seal() returned %v, expected %v", err, ntlm.ErrSealNotNegotiated)
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	const offered = ntlm.DefaultNegotiateFlags | ntlm.NegotiateSeal
+	for _, stripped := range []uint32{ntlm.NegotiateExtendedSecurity, ntlm.Negotiate128, ntlm.NegotiateSign, ntlm.NegotiateSeal, ntlm.NegotiateKeyExch} {
+		challenge, err := hex.DecodeString(challengeWithFlags(t, func(flags uint32) uint32 {
+			return flags &^ stripped
+		}))
+		if err != nil {
+			t.Fatalf("Failed to decode challenge hex string: %v", err)
+		}
+
+		provider := ntlm.NtlmProvider{User: "User", Password: "Password", NegotiateFlags: offered}
+		if _, err := provider.InitSecContext(); err != nil {
+			t.Fatalf("InitSecContext() failed: %v", err)
+		}
+		if _, err := provider.AcceptSecContext(challenge); !errors.Is(err, ntlm.ErrDowngrade) {
+			t.Fatalf("AcceptSecContext() returned %v, expected %v", err, ntlm.ErrDowngrade)
+		}
+
+		provider = ntlm.NtlmProvider{User: "User", Password: "Password", NegotiateFlags: offered, AllowDowngrade: true, MinKeyBits: 56}
+		if _, err := provider.InitSecContext(); err != nil {
+			t.Fatalf("InitSecContext() failed: %v", err)
+		}
+		if _, err := provider.AcceptSecContext(challenge); err != nil {
+			t.Fatalf("AcceptSecContext() with AllowDowngrade failed: %v", err)
+		}
+		if provider.NegotiatedFlags()&stripped != 0 {
+			t.Fatalf("stripped flag %08x should not be negotiated", stripped)
+		}
+	}
+}
+
+func TestRejectedChallenge(t *testing.T) {
+	for _, stripped := range []uint32{ntlm.NegotiateSign, ntlm.Negotiate128} {
+		challenge, err := hex.DecodeString(challengeWithFlags(t, func(flags uint32) uint32 {
+			return flags &^ stripped
+		}))
+		if err != nil {
+			t.Fatalf("Failed to decode challenge hex string: %v", err)
+		}
+
+		provider := ntlm.NtlmProvider{User: "User", Password: "Password"}
+		if _, err := provider.InitSecContext(); err != nil {
+			t.Fatalf("InitSecContext() failed: %v", err)
+		}
+		offered := provider.NegotiateFlags
+		if _, err := provider.AcceptSecContext(challenge); err == nil {
+			t.Fatalf("stripped %08x: AcceptSecContext() should fail", stripped)
+		}
+
+		// The flags of the rejected challenge are not kept
+		if provider.NegotiateFlags != offered || provider.NegotiatedFlags() != 0 || provider.ServerChallenge != nil || provider.TargetInfo != nil {
+			t.Fatalf("stripped %08x: the provider was updated by the rejected challenge, flags %08x", stripped, provider.NegotiateFlags)
+		}
+	}
+}
+
+func TestMinKeyBits(t *testing.T) {
+	const strengths = ntlm.Negotiate128 | ntlm.Negotiate56
+	for _, tc := range []struct {
+		offered    uint32
+		minKeyBits int
+		ok         bool
+	}{
+		{ntlm.Negotiate128, 0, true},
+		{ntlm.Negotiate56, 0, false},
+		{ntlm.Negotiate56, 128, false},
+		{ntlm.Negotiate56, 56, true},
+		{0, 56, false},
+		{0, 40, true},
+	} {
+		challenge, err := hex.DecodeString(challengeWithFlags(t, func(flags uint32) uint32 {
+			return flags&^strengths | tc.offered
+		}))
+		if err != nil {
+			t.Fatalf("Failed to decode challenge hex string: %v", err)
+		}
+
+		provider := ntlm.NtlmProvider{User: "User", Password: "Password", AllowDowngrade: true, MinKeyBits: tc.minKeyBits}
+		if _, err := provider.InitSecContext(); err != nil {
+			t.Fatalf("InitSecContext() failed: %v", err)
+		}
+		_, err = provider.AcceptSecContext(challenge)
+		if tc.ok && err != nil {
+			t.Fatalf("offered %08x, MinKeyBits %d: AcceptSecContext() failed: %v", tc.offered, tc.minKeyBits, err)
+		}
+		if !tc.ok && !errors.Is(err, ntlm.ErrWeakKey) {
+			t.Fatalf("offered %08x, MinKeyBits %d: AcceptSecContext() returned %v, expected %v", tc.offered, tc.minKeyBits, err, ntlm.ErrWeakKey)
+		}
+	}
+
+	provider := ntlm.NtlmProvider{MinKeyBits: 64}
+	if err := provider.Validate(); !errors.Is(err, ntlm.ErrInvalidConfiguration) {
+		t.Fatalf("Validate() returned %v, expected %v", err, ntlm.ErrInvalidConfiguration)
+	}
+}
+
+func TestRequireKeyExch(t *testing.T) {
+	for _, keyExch := range []bool{true, false} {
+		challenge, err := hex.DecodeString(challengeWithFlags(t, func(flags uint32) uint32 {
+			if keyExch {
+				return flags | ntlm.NegotiateKeyExch
+			}
+			return flags &^ ntlm.NegotiateKeyExch
+		}))
+		if err != nil {
+			t.Fatalf("Failed to decode challenge hex string: %v", err)
+		}
+
+		provider, err := ntlm.NewProvider(ntlm.WithCredentials("", "User", "Password"), ntlm.WithStrongSessionSecurity())
+		if err != nil {
+			t.Fatalf("NewProvider() failed: %v", err)
+		}
+		// The server keeps the requested flags, the client alone decides on the key exchange
+		if !keyExch {
+			provider.NegotiateFlags = ntlm.DefaultNegotiateFlags &^ ntlm.NegotiateKeyExch
+		}
+		if _, err := provider.InitSecContext(); err != nil {
+			t.Fatalf("InitSecContext() failed: %v", err)
+		}
+		_, err = provider.AcceptSecContext(challenge)
+		if keyExch && err != nil {
+			t.Fatalf("AcceptSecContext() failed: %v", err)
+		}
+		if !keyExch && !errors.Is(err, ntlm.ErrWeakKey) {
+			t.Fatalf("AcceptSecContext() without key exchange returned %v, expected %v", err, ntlm.ErrWeakKey)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	for _, tc := range []struct {
+		provider *ntlm.NtlmProvider
+		response string
+	}{
+		{&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}, "NTLMv2"},
+		{&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", UseNTLMv1: true}, "NTLMv1 with extended session security"},
+		{&ntlm.NtlmProvider{Anonymous: true}, "anonymous"},
+	} {
+		var buf bytes.Buffer
+		tc.provider.Logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		authenticate(t, tc.provider, testChallenge)
+
+		var events []map[string]any
+		for dec := json.NewDecoder(&buf); dec.More(); {
+			var event map[string]any
+			if err := dec.Decode(&event); err != nil {
+				t.Fatalf("failed to decode log event: %v", err)
+			}
+			events = append(events, event)
+		}
+
+		var messages []string
+		for _, event := range events {
+			messages = append(messages, event["msg"].(string))
+		}
+		expected := []string{"NTLM NEGOTIATE message", "NTLM CHALLENGE message", "NTLM target info", "NTLM AUTHENTICATE message"}
+		if !slices.Equal(messages, expected) {
+			t.Fatalf("%s: logged events %q, expected %q", tc.response, messages, expected)
+		}
+		if events[0]["flags"] != fmt.Sprintf("0x%08x", binary.LittleEndian.Uint32(tc.provider.NegotiateMessage[12:16])) {
+			t.Fatalf("%s: logged NEGOTIATE flags %v", tc.response, events[0]["flags"])
+		}
+		if events[1]["flags"] != "0xe2998235" {
+			t.Fatalf("%s: logged CHALLENGE flags %v", tc.response, events[1]["flags"])
+		}
+		if !strings.Contains(events[2]["avpairs"].(string), "MsvAvDnsDomainName: lab.lan") {
+			t.Fatalf("%s: logged AV pairs %q", tc.response, events[2]["avpairs"])
+		}
+		if events[3]["response"] != tc.response {
+			t.Fatalf("logged response %v, expected %s", events[3]["response"], tc.response)
+		}
+
+		logged := buf.String()
+		for _, secret := range [][]byte{tc.provider.ExportedSessionKey, tc.provider.ClientSigningKey, tc.provider.SessionBaseKey} {
+			if len(secret) > 0 && strings.Contains(logged, hex.EncodeToString(secret)) {
+				t.Fatalf("%s: secret key material was logged", tc.response)
+			}
+		}
+		if tc.provider.Password != "" && strings.Contains(logged, tc.provider.Password) {
+			t.Fatalf("%s: password was logged", tc.response)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package ntlm
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// Option configures an NtlmProvider created with NewProvider
+type Option func(*NtlmProvider)
+
+// WithCredentials sets the domain, user and password used to authenticate
+func WithCredentials(domain, user, password string) Option {
+	return func(n *NtlmProvider) {
+		n.Domain, n.User, n.Password = domain, user, password
+	}
+}
+
+// WithAccount sets the user given as DOMAIN\user, .\user or a UPN and its password, see ParseUserName
+func WithAccount(name, password string) Option {
+	return func(n *NtlmProvider) {
+		n.Domain, n.User = ParseUserName(name)
+		n.Password = password
+	}
+}
+
+// WithHash sets the NT hash used instead of the password (pass-the-hash)
+func WithHash(hash []byte) Option {
+	return func(n *NtlmProvider) {
+		n.Hash = hash
+	}
+}
+
+// WithHashString sets the NT hash used instead of the password from its hexadecimal
+// form, alone or as LMHASH:NTHASH, see ParseHash
+func WithHashString(hash string) Option {
+	return func(n *NtlmProvider) {
+		var err error
+		if n.Hash, err = ParseHash(hash); err != nil {
+			n.optionErr = err
+		}
+	}
+}
+
+// WithWorkstation sets the workstation name sent to the server
+func WithWorkstation(workstation string) Option {
+	return func(n *NtlmProvider) {
+		n.Workstation = workstation
+	}
+}
+
+// WithChannelBinding sets the application data of the channel bindings (Extended Protection)
+func WithChannelBinding(applicationData []byte) Option {
+	return func(n *NtlmProvider) {
+		n.ChannelBinding = applicationData
+	}
+}
+
+// WithTargetSPN sets the service principal name of the server sent as MsvAvTargetName
+func WithTargetSPN(spn string) Option {
+	return func(n *NtlmProvider) {
+		n.TargetSPN = spn
+	}
+}
+
+// WithNegotiateFlags overrides DefaultNegotiateFlags, prefer the options such as WithSigning
+// and WithSealing which keep the other flags
+func WithNegotiateFlags(flags uint32) Option {
+	return func(n *NtlmProvider) {
+		n.NegotiateFlags = flags
+	}
+}
+
+// WithNTLMv1 sends the legacy NTLMv1 responses, for old devices rejecting NTLMv2. Without
+// extendedSecurity, NegotiateExtendedSecurity is not offered either, for the devices which
+// only know the original NTLMv1 responses, whose session keys are much weaker
+func WithNTLMv1(extendedSecurity bool) Option {
+	return func(n *NtlmProvider) {
+		n.UseNTLMv1 = true
+		WithExtendedSessionSecurity(extendedSecurity)(n)
+	}
+}
+
+// WithExtendedSessionSecurity offers or not NegotiateExtendedSecurity, set by DefaultNegotiateFlags.
+// The server decides: SupportsExtendedSessionSecurity reports whether it was negotiated
+func WithExtendedSessionSecurity(enabled bool) Option {
+	if enabled {
+		return withFlags(NegotiateExtendedSecurity, 0)
+	}
+	return withFlags(0, NegotiateExtendedSecurity)
+}
+
+// WithSigning requests message integrity, see GetMIC
+func WithSigning() Option {
+	return withFlags(NegotiateSign, 0)
+}
+
+// WithSealing requests message confidentiality, see Seal, which implies integrity and
+// requires the key exchange
+func WithSealing() Option {
+	return withFlags(NegotiateSeal|NegotiateSign|NegotiateKeyExch, 0)
+}
+
+// WithInsecureLMResponse sends the LMv1 or LMv2 response, for the old servers which require
+// it. The LM responses are derived from the password with weak primitives, and are easily
+// cracked offline by anyone capturing them
+func WithInsecureLMResponse() Option {
+	return func(n *NtlmProvider) {
+		n.AllowLMResponse = true
+	}
+}
+
+// WithAnonymous authenticates as the anonymous user, the credentials being ignored
+func WithAnonymous() Option {
+	return func(n *NtlmProvider) {
+		n.Anonymous = true
+	}
+}
+
+// withFlags sets then clears negotiate flags, starting from DefaultNegotiateFlags if none
+// were set yet. The combination is checked by NewProvider
+func withFlags(set, unset uint32) Option {
+	return func(n *NtlmProvider) {
+		if n.NegotiateFlags == 0 {
+			n.NegotiateFlags = DefaultNegotiateFlags
+		}
+		n.NegotiateFlags = n.NegotiateFlags&^unset | set
+	}
+}
+
+// WithCompatibilityLevel configures the responses and the session security like the
+// LmCompatibilityLevel setting of Windows does:
+//   - 0: LM and NTLMv1 responses, no extended session security
+//   - 1: LM and NTLMv1 responses, extended session security if the server supports it
+//   - 2: NTLMv1 response only, extended session security if the server supports it
+//   - 3: NTLMv2 response only, the default of this package
+//   - 4: same as 3 for a client, an acceptor never accepts the LM response alone anyway
+//   - 5: same as 4, an acceptor also refuses the NTLMv1 responses
+//
+// NewProvider fails with ErrInvalidConfiguration if the level is not between 0 and 5
+func WithCompatibilityLevel(level int) Option {
+	return func(n *NtlmProvider) {
+		if level < 0 || level > 5 {
+			n.optionErr = fmt.Errorf("%w: compatibility level %d is not between 0 and 5", ErrInvalidConfiguration, level)
+			return
+		}
+		if n.NegotiateFlags == 0 {
+			n.NegotiateFlags = DefaultNegotiateFlags
+		}
+		n.NegotiateFlags |= NegotiateExtendedSecurity
+		n.UseNTLMv1 = level <= 2
+		n.AllowLMResponse = level <= 1
+		n.AllowNoExtendedSecurity = level == 1 || level == 2
+		n.RequireNTLMv2 = level == 5
+		if level == 0 {
+			n.NegotiateFlags &^= NegotiateExtendedSecurity
+		}
+	}
+}
+
+// WithStrongSessionSecurity fails the handshake unless both Negotiate128 and NegotiateKeyExch
+// are negotiated, instead of proceeding with weaker session keys
+func WithStrongSessionSecurity() Option {
+	return func(n *NtlmProvider) {
+		n.MinKeyBits = 128
+		n.RequireKeyExch = true
+	}
+}
+
+// WithVersion sets the Windows release advertised in the messages, see NewVersion
+func WithVersion(major, minor uint8, build uint16, revision uint8) Option {
+	return func(n *NtlmProvider) {
+		n.Version = NewVersion(major, minor, build, revision)
+	}
+}
+
+// WithDatagram enables the connectionless mode
+func WithDatagram() Option {
+	return func(n *NtlmProvider) {
+		n.Datagram = true
+	}
+}
+
+// WithRand sets the random source used instead of crypto/rand.Reader
+func WithRand(r io.Reader) Option {
+	return func(n *NtlmProvider) {
+		n.Rand = r
+	}
+}
+
+// WithClock sets the clock used instead of time.Now for the timestamps
+func WithClock(now func() time.Time) Option {
+	return func(n *NtlmProvider) {
+		n.Now = now
+	}
+}
+
+// WithLogger sets the logger receiving the debug events of the handshake
+func WithLogger(logger *slog.Logger) Option {
+	return func(n *NtlmProvider) {
+		n.Logger = logger
+	}
+}
+
+// NewProvider creates an NtlmProvider from the options, applied in order so that
+// the last one wins, and checks that the resulting configuration is usable
+func NewProvider(opts ...Option) (*NtlmProvider, error) {
+	n := &NtlmProvider{}
+	for _, opt := range opts {
+		opt(n)
+	}
+	if n.optionErr != nil {
+		return nil, n.optionErr
+	}
+
+	if err := n.Validate(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
@@ -0,0 +1,407 @@
+package ntlm_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+func TestNewProvider(t *testing.T) {
+	hash := ntlm.NTOWFv1("Password")
+	provider, err := ntlm.NewProvider(
+		ntlm.WithCredentials("Domain", "User", "Password"),
+		ntlm.WithCredentials("Domain", "User", ""), // the last option wins
+		ntlm.WithHash(hash),
+		ntlm.WithWorkstation("COMPUTER"),
+		ntlm.WithChannelBinding([]byte("tls-server-end-point:")),
+		ntlm.WithNegotiateFlags(ntlm.DefaultNegotiateFlags|ntlm.NegotiateSeal),
+		ntlm.WithDatagram(),
+	)
+	if err != nil {
+		t.Fatalf("NewProvider() failed: %v", err)
+	}
+
+	if provider.Domain != "Domain" || provider.User != "User" || provider.Password != "" {
+		t.Fatalf("credentials are not the last ones provided")
+	}
+	if !bytes.Equal(provider.Hash, hash) || provider.Workstation != "COMPUTER" {
+		t.Fatalf("hash or workstation is not set")
+	}
+	if !bytes.Equal(provider.ChannelBinding, []byte("tls-server-end-point:")) {
+		t.Fatalf("channel binding is not set")
+	}
+	if provider.NegotiateFlags != ntlm.DefaultNegotiateFlags|ntlm.NegotiateSeal || !provider.Datagram {
+		t.Fatalf("negotiate flags or datagram mode are not set")
+	}
+
+	// The provider is ready to be used
+	if _, err := provider.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+}
+
+func TestNewProviderValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []ntlm.Option
+		expected error
+	}{
+		{"password and hash", []ntlm.Option{
+			ntlm.WithCredentials("Domain", "User", "Password"),
+			ntlm.WithHash(ntlm.NTOWFv1("Password")),
+		}, ntlm.ErrConflictingCredentials},
+		{"short hash", []ntlm.Option{
+			ntlm.WithCredentials("Domain", "User", ""),
+			ntlm.WithHash([]byte{0x01}),
+		}, ntlm.ErrInvalidHash},
+	} {
+		if _, err := ntlm.NewProvider(tc.opts...); !errors.Is(err, tc.expected) {
+			t.Fatalf("%s: NewProvider() returned %v, expected %v", tc.name, err, tc.expected)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		provider *ntlm.NtlmProvider
+		expected error
+	}{
+		{"password and hash", &ntlm.NtlmProvider{Password: "Password", Hash: ntlm.NTOWFv1("Password")}, ntlm.ErrConflictingCredentials},
+		{"short hash", &ntlm.NtlmProvider{Hash: []byte{0x01}}, ntlm.ErrInvalidHash},
+		{"short version", &ntlm.NtlmProvider{Version: []byte{0x0a}}, ntlm.ErrInvalidVersion},
+		{"long domain", &ntlm.NtlmProvider{Domain: strings.Repeat("d", 256)}, ntlm.ErrInvalidConfiguration},
+		{"long workstation", &ntlm.NtlmProvider{Workstation: strings.Repeat("w", 256)}, ntlm.ErrInvalidConfiguration},
+		{"OEM without names", &ntlm.NtlmProvider{IsOEM: true}, ntlm.ErrInvalidConfiguration},
+		{"no charset", &ntlm.NtlmProvider{NegotiateFlags: ntlm.NegotiateNTLM | ntlm.RequestTarget}, ntlm.ErrInvalidConfiguration},
+		{"seal without key exchange", &ntlm.NtlmProvider{
+			NegotiateFlags: ntlm.DefaultNegotiateFlags&^ntlm.NegotiateKeyExch | ntlm.NegotiateSeal,
+		}, ntlm.ErrInvalidConfiguration},
+		{"datagram without key exchange", &ntlm.NtlmProvider{
+			Datagram:       true,
+			NegotiateFlags: ntlm.DefaultNegotiateFlags &^ ntlm.NegotiateKeyExch,
+		}, ntlm.ErrInvalidConfiguration},
+	} {
+		err := tc.provider.Validate()
+		if !errors.Is(err, tc.expected) {
+			t.Fatalf("%s: Validate() returned %v, expected %v", tc.name, err, tc.expected)
+		}
+		t.Logf("%s: %v", tc.name, err)
+
+		if _, err := tc.provider.InitSecContext(); !errors.Is(err, tc.expected) {
+			t.Fatalf("%s: InitSecContext() returned %v, expected %v", tc.name, err, tc.expected)
+		}
+	}
+
+	valid := ntlm.NtlmProvider{User: "User", Password: "Password", Domain: "Domain", IsOEM: true}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate() failed on a valid provider: %v", err)
+	}
+}
+
+func TestWithNTLMv1(t *testing.T) {
+	for _, extendedSecurity := range []bool{true, false} {
+		client, err := ntlm.NewProvider(ntlm.WithCredentials("Domain", "User", "Password"), ntlm.WithNTLMv1(extendedSecurity))
+		if err != nil {
+			t.Fatalf("NewProvider() failed: %v", err)
+		}
+		if !client.UseNTLMv1 || (client.NegotiateFlags&ntlm.NegotiateExtendedSecurity != 0) != extendedSecurity {
+			t.Fatalf("extended security %v: flags 0x%08x", extendedSecurity, client.NegotiateFlags)
+		}
+
+		server := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+		if err := acceptorHandshake(t, client, server); err != nil {
+			t.Fatalf("extended security %v: handshake failed: %v", extendedSecurity, err)
+		}
+		if !bytes.Equal(client.SessionKey(), server.SessionKey()) {
+			t.Fatalf("extended security %v: session keys differ", extendedSecurity)
+		}
+	}
+}
+
+func TestFlagOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []ntlm.Option
+		expected uint32
+		err      error
+	}{
+		{"signing", []ntlm.Option{ntlm.WithSigning()}, ntlm.DefaultNegotiateFlags, nil},
+		{"sealing", []ntlm.Option{ntlm.WithSealing()}, ntlm.DefaultNegotiateFlags | ntlm.NegotiateSeal, nil},
+		{"sealing without NTLM2", []ntlm.Option{ntlm.WithSealing(), ntlm.WithExtendedSessionSecurity(false)}, ntlm.DefaultNegotiateFlags&^ntlm.NegotiateExtendedSecurity | ntlm.NegotiateSeal, nil},
+		{"raw override", []ntlm.Option{ntlm.WithNegotiateFlags(ntlm.NegotiateUnicode | ntlm.NegotiateNTLM), ntlm.WithSigning()}, ntlm.NegotiateUnicode | ntlm.NegotiateNTLM | ntlm.NegotiateSign, nil},
+		{"sealing without key exchange", []ntlm.Option{ntlm.WithNegotiateFlags(ntlm.NegotiateUnicode | ntlm.NegotiateNTLM), ntlm.WithSigning(), func(n *ntlm.NtlmProvider) { n.NegotiateFlags |= ntlm.NegotiateSeal }}, 0, ntlm.ErrInvalidConfiguration},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, err := ntlm.NewProvider(append([]ntlm.Option{ntlm.WithCredentials("Domain", "User", "Password")}, tc.opts...)...)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("NewProvider() returned %v, expected %v", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewProvider() failed: %v", err)
+			}
+			if provider.NegotiateFlags != tc.expected {
+				t.Fatalf("flags are 0x%08x, expected 0x%08x", provider.NegotiateFlags, tc.expected)
+			}
+		})
+	}
+
+	provider, err := ntlm.NewProvider(ntlm.WithCredentials("Domain", "User", "Password"), ntlm.WithAnonymous())
+	if err != nil {
+		t.Fatalf("NewProvider() failed: %v", err)
+	}
+	if !provider.Anonymous {
+		t.Fatal("anonymous authentication is not set")
+	}
+}
+
+func TestParseUserName(t *testing.T) {
+	for _, tc := range []struct {
+		name, domain, user string
+	}{
+		{`CORP\User`, "CORP", "User"},
+		{`.\User`, ".", "User"},
+		{"User", "", "User"},
+		{"user@corp.example.com", "", "user@corp.example.com"},
+		{`CORP\`, "CORP", ""},
+	} {
+		if domain, user := ntlm.ParseUserName(tc.name); domain != tc.domain || user != tc.user {
+			t.Fatalf("ParseUserName(%q) = %q, %q, expected %q, %q", tc.name, domain, user, tc.domain, tc.user)
+		}
+	}
+}
+
+func TestWithAccountLocal(t *testing.T) {
+	client, err := ntlm.NewProvider(ntlm.WithAccount(`.\User`, "Password"))
+	if err != nil {
+		t.Fatalf("NewProvider() failed: %v", err)
+	}
+	if client.Domain != ntlm.LocalDomain || client.User != "User" {
+		t.Fatalf("account is %s\\%s", client.Domain, client.User)
+	}
+
+	// The local accounts of a standalone server belong to its NetBIOS name
+	server := ntlm.NewAcceptor(&ntlm.NtlmProvider{User: "User", Domain: "SERVER", Password: "Password", Workstation: "SERVER"})
+	if err := acceptorHandshake(t, client, server.NtlmProvider); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if name := server.PeerName(); name != `SERVER\USER` {
+		t.Fatalf("PeerName() is %q, expected SERVER\\USER", name)
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	hash := ntlm.NTOWFv1("Password")
+	for _, tc := range []struct {
+		input string
+		err   bool
+	}{
+		{hex.EncodeToString(hash), false},
+		{strings.ToUpper(hex.EncodeToString(hash)), false},
+		{"aad3b435b51404eeaad3b435b51404ee:" + hex.EncodeToString(hash), false},
+		{hex.EncodeToString(hash) + "\n", false},
+		{hex.EncodeToString(hash[:15]), true},
+		{"zz" + hex.EncodeToString(hash[1:]), true},
+		{"aad3b435b51404ee:" + hex.EncodeToString(hash), true},
+		{"aad3b435b51404eeaad3b435b51404ee:", true},
+	} {
+		parsed, err := ntlm.ParseHash(tc.input)
+		if tc.err {
+			if !errors.Is(err, ntlm.ErrInvalidHash) {
+				t.Fatalf("ParseHash(%q) returned %v, expected %v", tc.input, err, ntlm.ErrInvalidHash)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ParseHash(%q) failed: %v", tc.input, err)
+		}
+		if !bytes.Equal(parsed, hash) {
+			t.Fatalf("ParseHash(%q) = %x, expected %x", tc.input, parsed, hash)
+		}
+	}
+
+	if _, err := ntlm.NewProvider(ntlm.WithCredentials("Domain", "User", ""), ntlm.WithHashString("invalid")); !errors.Is(err, ntlm.ErrInvalidHash) {
+		t.Fatalf("NewProvider() returned %v, expected %v", err, ntlm.ErrInvalidHash)
+	}
+	provider, err := ntlm.NewProvider(ntlm.WithCredentials("Domain", "User", ""), ntlm.WithHashString(hex.EncodeToString(hash)))
+	if err != nil {
+		t.Fatalf("NewProvider() failed: %v", err)
+	}
+	if !bytes.Equal(provider.Hash, hash) {
+		t.Fatalf("Hash is %x, expected %x", provider.Hash, hash)
+	}
+}
+
+func TestWithExtendedSessionSecurity(t *testing.T) {
+	for _, tc := range []struct {
+		client, server bool
+	}{
+		{true, true},
+		{true, false},
+		{false, true},
+	} {
+		client, err := ntlm.NewProvider(ntlm.WithCredentials("Domain", "User", "Password"), ntlm.WithNTLMv1(true), ntlm.WithExtendedSessionSecurity(tc.client))
+		if err != nil {
+			t.Fatalf("NewProvider() failed: %v", err)
+		}
+		client.AllowDowngrade = true
+		server, err := ntlm.NewProvider(ntlm.WithCredentials("Domain", "User", "Password"), ntlm.WithExtendedSessionSecurity(tc.server))
+		if err != nil {
+			t.Fatalf("NewProvider() failed: %v", err)
+		}
+
+		if err := acceptorHandshake(t, client, server); err != nil {
+			t.Fatalf("client %v, server %v: handshake failed: %v", tc.client, tc.server, err)
+		}
+		if expected := tc.client && tc.server; client.SupportsExtendedSessionSecurity() != expected || server.SupportsExtendedSessionSecurity() != expected {
+			t.Fatalf("client %v, server %v: extended session security is %v on the client, %v on the server",
+				tc.client, tc.server, client.SupportsExtendedSessionSecurity(), server.SupportsExtendedSessionSecurity())
+		}
+		if !bytes.Equal(client.SessionKey(), server.SessionKey()) {
+			t.Fatalf("client %v, server %v: session keys differ", tc.client, tc.server)
+		}
+	}
+}
+
+func TestWithCompatibilityLevel(t *testing.T) {
+	for level := 0; level <= 5; level++ {
+		client, err := ntlm.NewProvider(ntlm.WithCredentials("Domain", "User", "Password"), ntlm.WithCompatibilityLevel(level))
+		if err != nil {
+			t.Fatalf("level %d: NewProvider() failed: %v", level, err)
+		}
+		if client.UseNTLMv1 != (level <= 2) || (client.NegotiateFlags&ntlm.NegotiateExtendedSecurity != 0) != (level > 0) {
+			t.Fatalf("level %d: NTLMv1 %v, flags 0x%08x", level, client.UseNTLMv1, client.NegotiateFlags)
+		}
+
+		server, err := ntlm.NewProvider(ntlm.WithCredentials("Domain", "User", "Password"), ntlm.WithCompatibilityLevel(5))
+		if err != nil {
+			t.Fatalf("NewProvider() failed: %v", err)
+		}
+		err = acceptorHandshake(t, client, server)
+		if level <= 2 && !errors.Is(err, ntlm.ErrAuthenticationFailed) {
+			t.Fatalf("level %d: expected ErrAuthenticationFailed from a level 5 server, got %v", level, err)
+		}
+		if level > 2 && err != nil {
+			t.Fatalf("level %d: handshake failed: %v", level, err)
+		}
+	}
+
+	if _, err := ntlm.NewProvider(ntlm.WithCompatibilityLevel(6)); !errors.Is(err, ntlm.ErrInvalidConfiguration) {
+		t.Fatalf("expected ErrInvalidConfiguration for level 6, got %v", err)
+	}
+}
+
+// Levels 1 and 2 tolerate a server without extended session security, not the other downgrades
+func TestWithCompatibilityLevelDowngrade(t *testing.T) {
+	for _, tc := range []struct {
+		stripped uint32
+		err      error
+	}{
+		{ntlm.NegotiateExtendedSecurity, nil},
+		{ntlm.NegotiateSign, ntlm.ErrDowngrade},
+		{ntlm.NegotiateKeyExch, ntlm.ErrDowngrade},
+	} {
+		challenge, err := hex.DecodeString(challengeWithFlags(t, func(flags uint32) uint32 {
+			return flags &^ tc.stripped
+		}))
+		if err != nil {
+			t.Fatalf("Failed to decode challenge hex string: %v", err)
+		}
+
+		client, err := ntlm.NewProvider(ntlm.WithCredentials("Domain", "User", "Password"), ntlm.WithCompatibilityLevel(2))
+		if err != nil {
+			t.Fatalf("NewProvider() failed: %v", err)
+		}
+		if _, err := client.InitSecContext(); err != nil {
+			t.Fatalf("InitSecContext() failed: %v", err)
+		}
+		if _, err := client.AcceptSecContext(challenge); !errors.Is(err, tc.err) {
+			t.Fatalf("stripped %08x: AcceptSecContext() returned %v, expected %v", tc.stripped, err, tc.err)
+		}
+	}
+}
+
+// At level 2, a server without extended session security gets the NTLMv1 response twice
+func TestWithCompatibilityLevelNoLMResponse(t *testing.T) {
+	client, err := ntlm.NewProvider(ntlm.WithCredentials("Domain", "User", "Password"), ntlm.WithCompatibilityLevel(2))
+	if err != nil {
+		t.Fatalf("NewProvider() failed: %v", err)
+	}
+	server := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", NegotiateFlags: ntlm.DefaultNegotiateFlags &^ ntlm.NegotiateExtendedSecurity}
+
+	negotiate, err := client.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	server.NegotiateMessage = negotiate
+	challenge, err := server.GenerateChallengeMessage()
+	if err != nil {
+		t.Fatalf("GenerateChallengeMessage() failed: %v", err)
+	}
+	authenticate, err := client.AcceptSecContext(challenge)
+	if err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+
+	// 12-20: LmChallengeResponseFields, 20-28: NtChallengeResponseFields
+	field := func(offset int) []byte {
+		length := int(binary.LittleEndian.Uint16(authenticate[offset:]))
+		start := int(binary.LittleEndian.Uint32(authenticate[offset+4:]))
+		return authenticate[start : start+length]
+	}
+	if lm, nt := field(12), field(20); len(nt) != 24 || !bytes.Equal(lm, nt) {
+		t.Fatalf("LM response %x, expected the NTLMv1 response %x", lm, nt)
+	}
+	if err := server.ValidateAuthenticateMessage(authenticate); err != nil {
+		t.Fatalf("ValidateAuthenticateMessage() failed: %v", err)
+	}
+}
+
+func TestWithInsecureLMResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options []ntlm.Option
+		zero    bool
+	}{
+		{"default", nil, true},
+		{"insecure", []ntlm.Option{ntlm.WithInsecureLMResponse()}, false},
+	} {
+		client, err := ntlm.NewProvider(append([]ntlm.Option{ntlm.WithCredentials("Domain", "User", "Password")}, tc.options...)...)
+		if err != nil {
+			t.Fatalf("%s: NewProvider() failed: %v", tc.name, err)
+		}
+		_, _, auth, _ := authenticate(t, client, testChallengeWithoutTimestamp)
+
+		// 12-20: LmChallengeResponseFields
+		length := binary.LittleEndian.Uint16(auth[12:14])
+		offset := binary.LittleEndian.Uint32(auth[16:20])
+		lm := auth[offset : offset+uint32(length)]
+		if len(lm) != 24 || bytes.Equal(lm, make([]byte, 24)) != tc.zero {
+			t.Fatalf("%s: LM response is %x", tc.name, lm)
+		}
+	}
+}
+
+func TestWithVersion(t *testing.T) {
+	provider, err := ntlm.NewProvider(ntlm.WithCredentials("Domain", "User", "Password"), ntlm.WithVersion(6, 1, 7601, ntlm.NTLMRevisionCurrent))
+	if err != nil {
+		t.Fatalf("NewProvider() failed: %v", err)
+	}
+	negotiate, err := provider.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+
+	// 32-40: Version
+	if expected := []byte{0x06, 0x01, 0xb1, 0x1d, 0x00, 0x00, 0x00, 0x0f}; !bytes.Equal(negotiate[32:40], expected) {
+		t.Fatalf("NEGOTIATE version is %x, expected %x", negotiate[32:40], expected)
+	}
+}
@@ -1,12 +1,52 @@
 package ntlm
 
 import (
+	"crypto/hmac"
 	"crypto/rc4"
 	"encoding/asn1"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
 )
 
+// State of the NTLM handshake
+type State int
+
+const (
+	StateInitial       State = iota // Nothing was sent yet
+	StateNegotiateSent              // Type 1 sent, waiting for the Type 2 message
+	StateAuthenticated              // Type 3 generated, session keys are derived
+	StateChallengeSent              // Acceptor only: Type 2 sent, waiting for the Type 3 message
+	StateWiped                      // Terminal, the credentials and keys were erased by Wipe
+	StateFailed                     // Acceptor only: the Type 3 message was rejected, see Reset
+)
+
+var stateNames = map[State]string{
+	StateInitial:       "Initial",
+	StateNegotiateSent: "NegotiateSent",
+	StateAuthenticated: "Authenticated",
+	StateChallengeSent: "ChallengeSent",
+	StateWiped:         "Wiped",
+	StateFailed:        "Failed",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// LocalDomain is the domain of the local accounts of the server, as in .\user
+const LocalDomain = "."
+
+// NtlmProvider is the client side of the NTLM authentication. Signing and sealing are
+// safe for concurrent use once authenticated, and a provider must not be copied after first use
 type NtlmProvider struct {
 	// User (username for authentication)
+	// Can be a UPN (user@corp.example.com), Domain is ignored then
 	// Can be empty (anonymous login)
 	User string
 
@@ -14,16 +54,96 @@ type NtlmProvider struct {
 	// Can be empty
 	Password string
 
-	// Hash (NTLM hash of the password)
+	// Hash (16 bytes NT hash of the password, used instead of Password for pass-the-hash)
 	// Can be nil if the password is not known or not provided
 	Hash []byte
 
+	// Anonymous (authenticate as the anonymous user, User, Password and Hash are ignored)
+	// Implied when User, Password and Hash are all empty
+	// Ignored by the acceptor, see AllowAnonymous
+	Anonymous bool
+
+	// AllowAnonymous (acceptor only, accept the anonymous clients with a null session key)
+	AllowAnonymous bool
+
 	// Domain (domain for authentication)
+	// LocalDomain for the local accounts of the server, replaced by its NetBIOS name
 	Domain string
 
 	// Workstation (workstation for authentication)
 	Workstation string
 
+	// ChannelBinding (application data of the channel bindings, for Extended Protection)
+	// e.g. "tls-server-end-point:" followed by the hash of the server certificate, see TLSServerEndPoint
+	// Can be nil if the transport does not provide channel bindings
+	ChannelBinding []byte
+
+	// TargetSPN (service principal name of the server, e.g. "HTTP/proxy.corp.example.com")
+	// Sent as MsvAvTargetName in the NTLMv2 response, checked by the servers enforcing Extended Protection
+	TargetSPN string
+
+	// UntrustedSPN (TargetSPN comes from an untrusted source, e.g. a DNS lookup or the user)
+	// Sent as MsvAvFlagUntrustedSPN in the MsvAvFlags of the NTLMv2 response
+	UntrustedSPN bool
+
+	// MachineID (32 bytes identifying this machine, e.g. random and generated once per process)
+	// Sent as MsvAvSingleHost by the client, an acceptor compares it to detect loopback, see IsLoopback
+	// Can be nil, MsvAvSingleHost is not sent then
+	MachineID []byte
+
+	// UseNTLMv1 (use the legacy NTLMv1 responses instead of NTLMv2)
+	// Only needed for old targets that do not support NTLMv2
+	UseNTLMv1 bool
+
+	// AllowLMResponse (insecure: send the LMv1 or LMv2 response, for the old servers requiring it)
+	// Otherwise Z(24) is sent in place of the LMv2 response, and the NTLMv1 response in
+	// place of the LMv1 one. The LMv2 response is always zeroed when the server sends a timestamp
+	AllowLMResponse bool
+
+	// RequireNTLMv2 (acceptor only: reject the clients authenticating with an NTLMv1 response)
+	RequireNTLMv2 bool
+
+	// AllowDowngrade (accept a server stripping the offered NegotiateSign, NegotiateSeal, Negotiate128,
+	// NegotiateKeyExch or NegotiateExtendedSecurity)
+	// Only needed for legacy servers, the session security is much weaker otherwise
+	AllowDowngrade bool
+
+	// AllowNoExtendedSecurity (accept a server stripping only NegotiateExtendedSecurity)
+	// The NTLMv1 session security is used then, the other flags are still checked
+	AllowNoExtendedSecurity bool
+
+	// MinKeyBits (minimum strength of the session keys: 40, 56 or 128)
+	// 128 if zero, the challenge is rejected if the server does not offer enough
+	MinKeyBits int
+
+	// RequireKeyExch (reject a challenge not offering NegotiateKeyExch)
+	// Without key exchange, the session keys are derived from the password hash only
+	RequireKeyExch bool
+
+	// Version (8 bytes VERSION structure advertised in the messages, ClientVersion if nil)
+	// 0: major, 1: minor, 2-4: build (little endian), 4-7: reserved, 7: NTLM revision
+	Version []byte
+
+	// OmitVersion (do not advertise a version, NegotiateVersion is cleared and the field zeroed)
+	OmitVersion bool
+
+	// Datagram (connectionless mode, e.g. DCE/RPC over UDP)
+	// Messages are protected with explicit sequence numbers, see GetMICWithSeqNum and SealWithSeqNum.
+	// The NEGOTIATE message is optional, see AcceptSecContext
+	Datagram bool
+
+	// Rand (source of the client challenge and random session key)
+	// crypto/rand.Reader is used if nil, only set it for a FIPS RNG or deterministic tests
+	Rand io.Reader
+
+	// Now (clock of the NTLMv2 response timestamp when the server does not send MsvAvTimestamp,
+	// and of the acceptor challenge), time.Now is used if nil
+	Now func() time.Time
+
+	// Logger (receives debug events about the handshake: flags, message sizes and AV pairs)
+	// Nothing is logged if nil, secret key material and credentials are never logged
+	Logger *slog.Logger
+
 	// IsOEM (indicates if the NTLM is OEM)
 	// Don't touch unless you know what you're doing
 	IsOEM bool
@@ -33,7 +153,7 @@ type NtlmProvider struct {
 	TargetName []byte
 
 	// Negotiate Flags
-	// Don't touch unless you know what you're doing
+	// Don't touch unless you know what you're doing, see WithSigning and WithSealing
 	NegotiateFlags uint32
 
 	// SessionBaseKey (used to derive session keys)
@@ -44,10 +164,14 @@ type NtlmProvider struct {
 	// Don't touch unless you know what you're doing
 	KeyExchangeKey []byte
 
-	// RandomSessionKey (used to derive session keys)
+	// RandomSessionKey (random key becoming the ExportedSessionKey with key exchange)
 	// Don't touch unless you know what you're doing
 	RandomSessionKey []byte
 
+	// EncryptedRandomSessionKey (RC4(KeyExchangeKey, RandomSessionKey), sent in the Type 3)
+	// Don't touch unless you know what you're doing
+	EncryptedRandomSessionKey []byte
+
 	// ExportedSessionKey (session key)
 	// Don't touch unless you know what you're doing
 	ExportedSessionKey []byte
@@ -60,6 +184,14 @@ type NtlmProvider struct {
 	// Don't touch unless you know what you're doing
 	ServerSigningKey []byte
 
+	// ClientSealingKey (RC4 key of the client handle)
+	// Don't touch unless you know what you're doing
+	ClientSealingKey []byte
+
+	// ServerSealingKey (RC4 key of the server handle)
+	// Don't touch unless you know what you're doing
+	ServerSealingKey []byte
+
 	// ServerHandle (used to decrypt messages)
 	// Don't touch unless you know what you're doing
 	ServerHandle *rc4.Cipher
@@ -68,22 +200,35 @@ type NtlmProvider struct {
 	// Don't touch unless you know what you're doing
 	ClientHandle *rc4.Cipher
 
-	// SequenceNumber (used to sequence messages)
+	// ClientSequenceNumber (used to sequence messages sent to the server)
 	// Don't touch unless you know what you're doing
+	ClientSequenceNumber uint32
+
+	// SequenceNumber mirrors ClientSequenceNumber, writing to it has no effect
+	//
+	// Deprecated: use ClientSequenceNumber instead
 	SequenceNumber uint32
 
+	// ServerSequenceNumber (used to sequence messages received from the server)
+	// Don't touch unless you know what you're doing
+	ServerSequenceNumber uint32
+
 	// ServerChallenge
 	// Don't touch unless you know what you're doing
 	ServerChallenge []byte
 
-	// ClientChallenge
-	// Don't touch unless you know what you're doing
+	// ClientChallenge (8 random bytes generated for the AUTHENTICATE message)
+	// Only set it to reproduce a capture or in tests, production code must leave it nil
 	ClientChallenge []byte
 
 	// NegotiateMessage (Type 1)
 	// Don't touch unless you know what you're doing
 	NegotiateMessage []byte
 
+	// ChallengeMessage (Type 2)
+	// Don't touch unless you know what you're doing
+	ChallengeMessage []byte
+
 	// AuthenticateMessage (Type 3)
 	// Don't touch unless you know what you're doing
 	AuthenticateMessage []byte
@@ -91,6 +236,30 @@ type NtlmProvider struct {
 	// Target Information (avpairs)
 	// Don't touch unless you know what you're doing
 	TargetInfo *TargetInformation
+
+	state State
+
+	// Negotiate flags of the CHALLENGE message
+	challengeFlags uint32
+
+	// Negotiate flags set by the user before the handshake, restored by Reset
+	configuredFlags uint32
+
+	// Error of an Option, reported by NewProvider
+	optionErr error
+
+	// Name of the client authenticated by ValidateAuthenticateMessage, as DOMAIN\user
+	clientName string
+
+	// MsvAvSingleHost of the client authenticated by ValidateAuthenticateMessage
+	clientHost SingleHost
+
+	// Bytes of the RC4 keystreams consumed so far, to restore the handles on Import
+	clientKeystream uint64
+	serverKeystream uint64
+
+	// Serializes signing and sealing, the handles and sequence numbers are shared
+	mu sync.Mutex
 }
 
 // GetOID returns the NTLM mechanism OID
@@ -100,32 +269,398 @@ func (n *NtlmProvider) GetOID() asn1.ObjectIdentifier {
 
 // InitSecContext generates the initial NTLM Type 1 message
 func (n *NtlmProvider) InitSecContext() ([]byte, error) {
-	return n.NewNegotiateMessage()
+	if n.state == StateWiped {
+		return nil, ErrWiped
+	}
+	if n.state != StateInitial {
+		return nil, ErrOutOfOrder
+	}
+
+	if err := n.Validate(); err != nil {
+		return nil, err
+	}
+
+	n.configuredFlags = n.NegotiateFlags
+	msg, err := n.NewNegotiateMessage()
+	if err != nil {
+		return nil, err
+	}
+	n.state = StateNegotiateSent
+	return msg, nil
+}
+
+// Reset clears the state of the handshake and the derived keys so that the provider can
+// authenticate again. The credentials and the configuration, including the negotiate
+// flags set before the first handshake, are kept. A wiped provider stays in StateWiped
+func (n *NtlmProvider) Reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.state == StateWiped {
+		return
+	}
+
+	if n.state != StateInitial {
+		n.NegotiateFlags = n.configuredFlags
+	}
+	n.TargetName = nil
+	n.SessionBaseKey, n.KeyExchangeKey = nil, nil
+	n.RandomSessionKey, n.EncryptedRandomSessionKey, n.ExportedSessionKey = nil, nil, nil
+	n.ClientSigningKey, n.ServerSigningKey = nil, nil
+	n.ClientSealingKey, n.ServerSealingKey = nil, nil
+	n.ClientHandle, n.ServerHandle = nil, nil
+	n.ClientSequenceNumber, n.SequenceNumber, n.ServerSequenceNumber = 0, 0, 0
+	n.ServerChallenge, n.ClientChallenge = nil, nil
+	n.NegotiateMessage, n.ChallengeMessage, n.AuthenticateMessage = nil, nil, nil
+	n.TargetInfo = nil
+	n.state = StateInitial
+	n.challengeFlags, n.configuredFlags = 0, 0
+	n.clientName, n.clientHost = "", SingleHost{}
+	n.clientKeystream, n.serverKeystream = 0, 0
+}
+
+// Wipe zeroes and releases the secret material held by the provider: the NT hash, the
+// session keys and the signing and sealing keys. The RC4 handles are reset and released
+// and the password is dropped, although Go strings cannot be zeroed. The credentials
+// are erased: the provider ends in StateWiped, in which it cannot sign, seal or
+// authenticate anymore, InitSecContext returning ErrWiped
+func (n *NtlmProvider) Wipe() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, secret := range [][]byte{
+		n.Hash,
+		n.SessionBaseKey,
+		n.KeyExchangeKey,
+		n.RandomSessionKey,
+		n.ExportedSessionKey,
+		n.ClientSigningKey,
+		n.ServerSigningKey,
+		n.ClientSealingKey,
+		n.ServerSealingKey,
+	} {
+		clear(secret)
+	}
+	n.Password, n.Hash = "", nil
+	n.SessionBaseKey, n.KeyExchangeKey = nil, nil
+	n.RandomSessionKey, n.ExportedSessionKey = nil, nil
+	n.ClientSigningKey, n.ServerSigningKey = nil, nil
+	n.ClientSealingKey, n.ServerSealingKey = nil, nil
+
+	if n.ClientHandle != nil {
+		n.ClientHandle.Reset()
+	}
+	if n.ServerHandle != nil {
+		n.ServerHandle.Reset()
+	}
+	n.ClientHandle, n.ServerHandle = nil, nil
+	n.state = StateWiped
+}
+
+// redacted hides the secret fields in String
+const redacted = "[redacted]"
+
+// String describes the provider for debugging purposes. The password, the hash
+// and the key material are redacted so that the output can be logged safely
+func (n *NtlmProvider) String() string {
+	secret := func(set bool) string {
+		if set {
+			return redacted
+		}
+		return "<empty>"
+	}
+
+	return fmt.Sprintf(
+		"NtlmProvider{User: %q, Domain: %q, Workstation: %q, Password: %s, Hash: %s, NegotiateFlags: 0x%08x, State: %s, SessionKey: %s}",
+		n.User,
+		n.Domain,
+		n.Workstation,
+		secret(n.Password != ""),
+		secret(len(n.Hash) > 0),
+		n.NegotiateFlags,
+		n.state,
+		secret(len(n.ExportedSessionKey) > 0),
+	)
+}
+
+// GoString redacts the provider printed with %#v, see String
+func (n *NtlmProvider) GoString() string {
+	return n.String()
+}
+
+// debug logs a handshake event if a Logger is set
+func (n *NtlmProvider) debug(msg string, args ...any) {
+	if n.Logger != nil {
+		n.Logger.Debug(msg, args...)
+	}
 }
 
-// AcceptSecContext processes the NTLM Type 2 message and generates Type 3 response
+// maxNameLength is the longest domain or workstation name accepted, as a DNS name
+const maxNameLength = 255
+
+// Validate checks that the fields of the provider can be used together
+func (n *NtlmProvider) Validate() error {
+	if n.Password != "" && n.Hash != nil {
+		return ErrConflictingCredentials
+	}
+	if n.Hash != nil && len(n.Hash) != 16 {
+		return ErrInvalidHash
+	}
+	if n.Version != nil && len(n.Version) != 8 {
+		return ErrInvalidVersion
+	}
+	if n.MachineID != nil && len(n.MachineID) != 32 {
+		return fmt.Errorf("%w: MachineID must be 32 bytes long", ErrInvalidConfiguration)
+	}
+
+	switch n.MinKeyBits {
+	case 0, 40, 56, 128:
+	default:
+		return fmt.Errorf("%w: MinKeyBits must be 40, 56 or 128", ErrInvalidConfiguration)
+	}
+
+	if len([]rune(n.Domain)) > maxNameLength {
+		return fmt.Errorf("%w: domain is longer than %d characters", ErrInvalidConfiguration, maxNameLength)
+	}
+	if len([]rune(n.Workstation)) > maxNameLength {
+		return fmt.Errorf("%w: workstation is longer than %d characters", ErrInvalidConfiguration, maxNameLength)
+	}
+	if n.IsOEM && n.Domain == "" && n.Workstation == "" {
+		return fmt.Errorf("%w: IsOEM requires a domain or a workstation to supply", ErrInvalidConfiguration)
+	}
+
+	flags := n.NegotiateFlags
+	if flags == 0 {
+		flags = DefaultNegotiateFlags
+	}
+	if flags&(NegotiateUnicode|NegotiateOEM) == 0 && !n.IsOEM {
+		return fmt.Errorf("%w: neither NegotiateUnicode nor NegotiateOEM is set", ErrInvalidConfiguration)
+	}
+	if flags&NegotiateSeal != 0 && flags&NegotiateKeyExch == 0 {
+		return fmt.Errorf("%w: NegotiateSeal requires NegotiateKeyExch", ErrInvalidConfiguration)
+	}
+	if (n.Datagram || flags&NegotiateDatagram != 0) && flags&NegotiateKeyExch == 0 {
+		return fmt.Errorf("%w: datagram mode requires NegotiateKeyExch", ErrInvalidConfiguration)
+	}
+	return nil
+}
+
+// AcceptSecContext processes the NTLM Type 2 message and generates Type 3 response. In
+// datagram mode, the connectionless variant may skip InitSecContext: no Type 1 message is
+// sent and the handshake starts with the Type 2 message, which must offer NegotiateDatagram
 func (n *NtlmProvider) AcceptSecContext(sc []byte) ([]byte, error) {
+	connectionless := n.state == StateInitial && n.Datagram
+	if connectionless {
+		if err := n.Validate(); err != nil {
+			return nil, err
+		}
+		n.configuredFlags = n.NegotiateFlags
+		n.initNegotiateFlags()
+		n.state = StateNegotiateSent
+	}
+	if n.state != StateNegotiateSent {
+		return nil, ErrOutOfOrder
+	}
+
 	if err := n.ValidateChallengeMessage(sc); err != nil {
 		return nil, err
 	}
-	return n.NewAuthenticateMessage()
+	if connectionless && n.NegotiateFlags&NegotiateDatagram == 0 {
+		return nil, ErrDatagramNotNegotiated
+	}
+
+	msg, err := n.NewAuthenticateMessage()
+	if err != nil {
+		return nil, err
+	}
+	n.state = StateAuthenticated
+	return msg, nil
+}
+
+// GetMIC generates a Message Integrity Code for the given bytes. The MIC is empty if signing
+// was not negotiated, as the mechListMIC is omitted then, see Wrap which requires it
+func (n *NtlmProvider) GetMIC(bs []byte) ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getMIC(bs)
 }
 
-// GetMIC generates a Message Integrity Code for the given bytes
-func (n *NtlmProvider) GetMIC(bs []byte) (mic []byte) {
-	if n.NegotiateFlags&NegotiateSign == 0 {
-		return []byte{}
+func (n *NtlmProvider) getMIC(bs []byte) (mic []byte, err error) {
+	if n.ClientHandle == nil {
+		return nil, ErrContextNotEstablished
+	}
+
+	if !n.isSigning() {
+		return []byte{}, nil
+	}
+
+	handle, err := n.messageHandle(n.ClientHandle, n.ClientSealingKey, n.ClientSequenceNumber)
+	if err != nil {
+		return nil, err
 	}
 
-	mic, n.SequenceNumber = sign(
+	mic, n.ClientSequenceNumber = sign(
 		nil,
 		n.NegotiateFlags,
-		n.ClientHandle,
+		handle,
 		n.ClientSigningKey,
-		n.SequenceNumber,
+		n.ClientSequenceNumber,
+		bs,
+	)
+	n.clientKeystream += signatureKeystreamLen(n.NegotiateFlags)
+	n.SequenceNumber = n.ClientSequenceNumber
+	return mic, nil
+}
+
+// VerifyMIC checks a Message Integrity Code generated by the server for the given bytes
+func (n *NtlmProvider) VerifyMIC(bs, mic []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.verifyServerMIC(bs, mic)
+}
+
+func (n *NtlmProvider) verifyServerMIC(bs, mic []byte) error {
+	if n.ServerHandle == nil {
+		return ErrContextNotEstablished
+	}
+
+	if !n.isSigning() {
+		if len(mic) != 0 {
+			return ErrMICMismatch
+		}
+		return nil
+	}
+
+	handle, err := n.messageHandle(n.ServerHandle, n.ServerSealingKey, n.ServerSequenceNumber)
+	if err != nil {
+		return err
+	}
+	return n.verifyMIC(handle, bs, mic)
+}
+
+// verifyMIC checks the signature of the server with the given handle
+func (n *NtlmProvider) verifyMIC(handle *rc4.Cipher, bs, mic []byte) error {
+	// The server handle is consumed even if the signature does not match,
+	// so the sequence number has to move forward in any case to stay in sync
+	var expected []byte
+	expected, n.ServerSequenceNumber = sign(
+		nil,
+		n.NegotiateFlags,
+		handle,
+		n.ServerSigningKey,
+		n.ServerSequenceNumber,
 		bs,
 	)
-	return mic
+	n.serverKeystream += signatureKeystreamLen(n.NegotiateFlags)
+	if !hmac.Equal(mic, expected) {
+		return ErrMICMismatch
+	}
+	return nil
+}
+
+// GenerateMechListMIC signs the DER-encoded MechTypeList offered in the NegTokenInit.
+// The acceptor verifies it to make sure the list was not altered to downgrade the mechanism
+func (n *NtlmProvider) GenerateMechListMIC(mechList []byte) ([]byte, error) {
+	return n.GetMIC(mechList)
+}
+
+// VerifyMechListMIC verifies the mechListMIC sent by the acceptor over the DER-encoded
+// MechTypeList. Callers MUST verify it before trusting the negotiated mechanism, the
+// mechanism selection is not protected otherwise
+func (n *NtlmProvider) VerifyMechListMIC(mechList, mic []byte) error {
+	return n.VerifyMIC(mechList, mic)
+}
+
+// isSigning reports whether message integrity was negotiated (sealing implies signing)
+func (n *NtlmProvider) isSigning() bool {
+	return n.NegotiateFlags&(NegotiateSign|NegotiateSeal) != 0
+}
+
+// NegotiatedFlags returns the flags agreed upon with the server, i.e. the client flags
+// also present in the CHALLENGE message, or 0 if no challenge was processed yet.
+// They drive the session security: NegotiateSign and NegotiateSeal enable integrity
+// and confidentiality, NegotiateExtendedSecurity selects the NTLMv2 session security,
+// Negotiate128 and Negotiate56 the strength of the keys and NegotiateKeyExch a random session key
+func (n *NtlmProvider) NegotiatedFlags() uint32 {
+	if n.challengeFlags == 0 {
+		return 0
+	}
+	return n.NegotiateFlags
+}
+
+// SupportsSigning reports whether messages can be signed with GetMIC
+func (n *NtlmProvider) SupportsSigning() bool {
+	return n.NegotiatedFlags()&(NegotiateSign|NegotiateSeal) != 0
+}
+
+// SupportsSealing reports whether messages can be encrypted with Seal
+func (n *NtlmProvider) SupportsSealing() bool {
+	return n.NegotiatedFlags()&NegotiateSeal != 0
+}
+
+// SupportsExtendedSessionSecurity reports whether NegotiateExtendedSecurity was negotiated,
+// i.e. whether the keys are derived with the NTLMv2 session security. With NTLMv1, the NTLM2
+// session response is then sent instead of the original NTLMv1 response
+func (n *NtlmProvider) SupportsExtendedSessionSecurity() bool {
+	return n.NegotiatedFlags()&NegotiateExtendedSecurity != 0
+}
+
+// GSS-API context flags (RFC 2744) mapped to the NTLM session security
+const (
+	gssReplayFlag   = 4
+	gssSequenceFlag = 8
+	gssConfFlag     = 16
+	gssIntegFlag    = 32
+	gssAnonFlag     = 64
+)
+
+// RequestContextFlags requests the GSS-API context flags for the next handshake:
+// integrity adds NegotiateSign and confidentiality NegotiateSeal to the negotiate flags.
+// NTLM cannot provide mutual authentication nor delegation, those flags are ignored
+func (n *NtlmProvider) RequestContextFlags(flags uint32) {
+	if n.NegotiateFlags == 0 {
+		n.NegotiateFlags = DefaultNegotiateFlags
+	}
+	if flags&gssIntegFlag != 0 {
+		n.NegotiateFlags |= NegotiateSign
+	}
+	if flags&gssConfFlag != 0 {
+		n.NegotiateFlags |= NegotiateSeal
+	}
+}
+
+// NegotiatedContextFlags returns the GSS-API context flags of the established context.
+// Signed messages carry a sequence number, so replay and sequence detection come with integrity
+func (n *NtlmProvider) NegotiatedContextFlags() uint32 {
+	if !n.IsEstablished() {
+		return 0
+	}
+	var flags uint32
+	if n.SupportsSigning() {
+		flags |= gssIntegFlag | gssReplayFlag | gssSequenceFlag
+	}
+	if n.SupportsSealing() {
+		flags |= gssConfFlag
+	}
+	if n.NegotiateFlags&NegotiateAnonymous != 0 {
+		flags |= gssAnonFlag
+	}
+	return flags
+}
+
+// PeerName returns the target name sent by the server in the CHALLENGE message
+func (n *NtlmProvider) PeerName() string {
+	return n.TargetNameString()
+}
+
+// IsEstablished reports whether the handshake completed and the session keys are derived
+func (n *NtlmProvider) IsEstablished() bool {
+	return n.state == StateAuthenticated
+}
+
+// State returns the current state of the handshake
+func (n *NtlmProvider) State() State {
+	return n.state
 }
 
 // SessionKey returns the established session key
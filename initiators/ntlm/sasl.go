@@ -0,0 +1,67 @@
+package ntlm
+
+import "encoding/binary"
+
+// SASLMechanism is the SASL mechanism name used by LDAP to negotiate NTLM
+const SASLMechanism = "GSS-SPNEGO"
+
+// SASLClient is a minimal SASL client mechanism, compatible with the common Go SASL packages
+type SASLClient interface {
+	Start() (mech string, ir []byte, err error)     // Mechanism name and initial response
+	Next(challenge []byte) (resp []byte, err error) // Response to a server challenge
+}
+
+// saslClient runs the NTLM handshake over a SASL bind. Active Directory accepts the
+// raw NTLM messages for GSS-SPNEGO, so they are not wrapped in SPNEGO tokens
+type saslClient struct {
+	provider *NtlmProvider
+}
+
+// SASLClient returns a SASL client sending the NEGOTIATE message as initial response
+// and answering the CHALLENGE message with the AUTHENTICATE message
+func (n *NtlmProvider) SASLClient() SASLClient {
+	return &saslClient{provider: n}
+}
+
+// Start implements SASLClient
+func (c *saslClient) Start() (string, []byte, error) {
+	negotiate, err := c.provider.InitSecContext()
+	if err != nil {
+		return "", nil, err
+	}
+	return SASLMechanism, negotiate, nil
+}
+
+// Next implements SASLClient
+func (c *saslClient) Next(challenge []byte) ([]byte, error) {
+	if c.provider.IsEstablished() {
+		return nil, ErrOutOfOrder
+	}
+	return c.provider.AcceptSecContext(challenge)
+}
+
+// WrapSASL protects an LDAP message once the SASL bind completed. The message is sealed
+// when confidentiality was negotiated and only signed otherwise. The output is the SASL
+// buffer: a 4 bytes big endian length followed by the token of Wrap
+func (n *NtlmProvider) WrapSASL(msg []byte) ([]byte, error) {
+	token, err := n.Wrap(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4, 4+len(token))
+	binary.BigEndian.PutUint32(buf, uint32(len(token)))
+	return append(buf, token...), nil
+}
+
+// UnwrapSASL verifies, and decrypts if confidentiality was negotiated, a SASL buffer
+// sent by the server and returns the LDAP message it carries
+func (n *NtlmProvider) UnwrapSASL(buf []byte) ([]byte, error) {
+	if len(buf) < 4+signatureLen {
+		return nil, ErrTruncatedMessage
+	}
+	if size := binary.BigEndian.Uint32(buf); size != uint32(len(buf)-4) {
+		return nil, ErrTruncatedMessage
+	}
+	return n.Unwrap(buf[4:])
+}
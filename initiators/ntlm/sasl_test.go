@@ -0,0 +1,109 @@
+package ntlm_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+// fakeLDAPBind plays the server side of a SASL bind: it answers the NEGOTIATE message
+// with testChallenge and accepts any AUTHENTICATE message
+func fakeLDAPBind(t *testing.T, mech string, cred []byte, step int) (serverCred []byte, done bool) {
+	t.Helper()
+	if mech != ntlm.SASLMechanism {
+		t.Fatalf("bind uses mechanism %q", mech)
+	}
+	if len(cred) < 12 {
+		t.Fatalf("SASL credentials are too short: %x", cred)
+	}
+
+	switch msgType := binary.LittleEndian.Uint32(cred[8:12]); {
+	case step == 0 && msgType == ntlm.MessageTypeNtLmNegotiate:
+		challenge, err := hex.DecodeString(testChallenge)
+		if err != nil {
+			t.Fatalf("Failed to decode challenge hex string: %v", err)
+		}
+		return challenge, false
+	case step == 1 && msgType == ntlm.MessageTypeNtLmAuthenticate:
+		return nil, true
+	default:
+		t.Fatalf("unexpected message type %d at step %d", msgType, step)
+		return nil, false
+	}
+}
+
+func TestSASLClient(t *testing.T) {
+	provider := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	client := provider.SASLClient()
+
+	mech, cred, err := client.Start()
+	if err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	for step := 0; ; step++ {
+		serverCred, done := fakeLDAPBind(t, mech, cred, step)
+		if done {
+			break
+		}
+		if cred, err = client.Next(serverCred); err != nil {
+			t.Fatalf("Next() failed: %v", err)
+		}
+	}
+
+	if !provider.IsEstablished() {
+		t.Fatalf("provider should be established after the bind")
+	}
+	if _, err := client.Next(nil); !errors.Is(err, ntlm.ErrOutOfOrder) {
+		t.Fatalf("Next() after the bind should fail with ErrOutOfOrder, got %v", err)
+	}
+}
+
+func TestWrapSASL(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		flags uint32
+	}{
+		{"sign", ntlm.DefaultNegotiateFlags},
+		{"seal", ntlm.DefaultNegotiateFlags | ntlm.NegotiateSeal},
+	} {
+		client, server := newSessionPair(t, tc.flags)
+		msg := []byte("LDAP search request")
+
+		for i := 0; i < 3; i++ {
+			buf, err := client.WrapSASL(msg)
+			if err != nil {
+				t.Fatalf("%s: WrapSASL() failed: %v", tc.name, err)
+			}
+			if binary.BigEndian.Uint32(buf) != uint32(len(buf)-4) {
+				t.Fatalf("%s: invalid SASL buffer length", tc.name)
+			}
+			if sealed := !bytes.Contains(buf, msg); sealed != (tc.flags&ntlm.NegotiateSeal != 0) {
+				t.Fatalf("%s: message confidentiality is %v", tc.name, sealed)
+			}
+
+			plaintext, err := server.UnwrapSASL(buf)
+			if err != nil {
+				t.Fatalf("%s: UnwrapSASL() failed: %v", tc.name, err)
+			}
+			if !bytes.Equal(plaintext, msg) {
+				t.Fatalf("%s: UnwrapSASL() = %q", tc.name, plaintext)
+			}
+		}
+
+		buf, err := server.WrapSASL(msg)
+		if err != nil {
+			t.Fatalf("%s: WrapSASL() failed: %v", tc.name, err)
+		}
+		buf[len(buf)-1] ^= 0xff
+		if _, err := client.UnwrapSASL(buf); !errors.Is(err, ntlm.ErrMICMismatch) {
+			t.Fatalf("%s: tampered buffer should fail with ErrMICMismatch, got %v", tc.name, err)
+		}
+		if _, err := client.UnwrapSASL(buf[:10]); !errors.Is(err, ntlm.ErrTruncatedMessage) {
+			t.Fatalf("%s: truncated buffer should fail with ErrTruncatedMessage, got %v", tc.name, err)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package ntlm
 
 import (
-	"bytes"
+	"crypto/des"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rc4"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"hash/crc32"
+	"io"
+	"maps"
 	"strings"
 	"time"
 
@@ -112,111 +116,364 @@ func sign(dst []byte, negotiateFlags uint32, handle *rc4.Cipher, signingKey []by
 	return ret, seqNum
 }
 
-func (n *NtlmProvider) VerifyMIC(mic, msg []byte, seqNum uint32) (bool, uint32) {
-	expectedMIC, seqNum := sign(nil, n.NegotiateFlags, n.ServerHandle, n.ServerSigningKey, seqNum, msg)
-	return bytes.Equal(mic, expectedMIC), seqNum
+// signatureKeystreamLen returns the number of RC4 keystream bytes consumed by sign
+func signatureKeystreamLen(negotiateFlags uint32) uint64 {
+	switch {
+	case negotiateFlags&NegotiateExtendedSecurity == 0:
+		return 12
+	case negotiateFlags&NegotiateKeyExch != 0:
+		return 8
+	}
+	return 0
 }
 
-func (n *NtlmProvider) SealMessage(msg []byte) ([]byte, uint32) {
-	ret, ciphertext := growSlice(nil, len(msg))
-	switch {
-	case n.NegotiateFlags&NegotiateSeal != 0:
-		n.ClientHandle.XORKeyStream(ciphertext[16:], msg)
-		_, n.SequenceNumber = sign(ciphertext[:0], n.NegotiateFlags, n.ClientHandle, n.ClientSigningKey, n.SequenceNumber, msg)
-	case n.NegotiateFlags&NegotiateSign != 0:
-		copy(ciphertext[16:], msg)
-		_, n.SequenceNumber = sign(ciphertext[:0], n.NegotiateFlags, n.ClientHandle, n.ClientSigningKey, n.SequenceNumber, msg)
+// deriveSessionKeys derives the signing and sealing keys from the exported session key
+// and creates the RC4 handles. The Client keys protect the outbound messages, so an
+// acceptor stores the server-to-client keys in ClientSigningKey and ClientSealingKey
+func (n *NtlmProvider) deriveSessionKeys(acceptor bool) error {
+	clientSigningKey, err := signKey(
+		n.ExportedSessionKey,
+		[]byte("session key to client-to-server signing key magic constant\x00"),
+		n.NegotiateFlags,
+	)
+	if err != nil {
+		return err
+	}
+
+	serverSigningKey, err := signKey(
+		n.ExportedSessionKey,
+		[]byte("session key to server-to-client signing key magic constant\x00"),
+		n.NegotiateFlags,
+	)
+	if err != nil {
+		return err
+	}
+
+	clientSealingKey, err := sealKey(
+		n.ExportedSessionKey,
+		[]byte("session key to client-to-server sealing key magic constant\x00"),
+		n.NegotiateFlags,
+	)
+	if err != nil {
+		return err
+	}
+
+	serverSealingKey, err := sealKey(
+		n.ExportedSessionKey,
+		[]byte("session key to server-to-client sealing key magic constant\x00"),
+		n.NegotiateFlags,
+	)
+	if err != nil {
+		return err
+	}
+
+	if acceptor {
+		clientSigningKey, serverSigningKey = serverSigningKey, clientSigningKey
+		clientSealingKey, serverSealingKey = serverSealingKey, clientSealingKey
 	}
-	return ret, n.SequenceNumber
+	n.ClientSigningKey, n.ServerSigningKey = clientSigningKey, serverSigningKey
+	n.ClientSealingKey, n.ServerSealingKey = clientSealingKey, serverSealingKey
+	return n.rekey()
 }
 
-func (n *NtlmProvider) UnsealMessage(msg []byte) ([]byte, uint32, error) {
-	ret, plaintext := growSlice(nil, len(msg))
-	switch {
-	case n.NegotiateFlags&NegotiateSeal != 0:
-		n.ServerHandle.XORKeyStream(plaintext[16:], msg)
-		_, n.SequenceNumber = sign(plaintext[:0], n.NegotiateFlags, n.ServerHandle, n.ServerSigningKey, n.SequenceNumber, msg)
-	case n.NegotiateFlags&NegotiateSign != 0:
-		copy(plaintext[16:], msg)
-		_, n.SequenceNumber = sign(plaintext[:0], n.NegotiateFlags, n.ServerHandle, n.ServerSigningKey, n.SequenceNumber, msg)
-	default:
-		copy(plaintext, msg[16:])
-		for _, s := range msg[:16] {
-			if s != 0x0 {
-				return nil, 0, errors.New("signature mismatch")
-			}
-		}
+// rekey rebuilds the RC4 handles from the sealing keys, resetting their keystreams
+func (n *NtlmProvider) rekey() (err error) {
+	if n.ClientHandle, err = rc4.NewCipher(n.ClientSealingKey); err != nil {
+		return err
+	}
+	if n.ServerHandle, err = rc4.NewCipher(n.ServerSealingKey); err != nil {
+		return err
 	}
-	return ret, n.SequenceNumber, nil
+	n.clientKeystream, n.serverKeystream = 0, 0
+	return nil
 }
 
-func (n *NtlmProvider) NewLMChallengeResponse() ([]byte, error) {
-	//        LMv2Response
-	//  0-16: Response
-	// 16-24: ChallengeFromClient
-	// Empty LMv2ChallengeResponse => unsupported
-	return make([]byte, 24), nil
+// messageHandle returns the RC4 handle protecting the message with the given sequence number.
+// Connection-oriented sessions use the continuous handle, whereas datagram sessions
+// reinitialize it for each message with SealingKey' = MD5(SealingKey || SeqNum)
+func (n *NtlmProvider) messageHandle(handle *rc4.Cipher, sealingKey []byte, seqNum uint32) (*rc4.Cipher, error) {
+	if n.NegotiateFlags&NegotiateDatagram == 0 {
+		return handle, nil
+	}
+
+	h := md5.New()
+	h.Write(sealingKey)
+	binary.Write(h, binary.LittleEndian, seqNum)
+	return rc4.NewCipher(h.Sum(nil))
 }
 
-func (n *NtlmProvider) NewNtChallengeResponse(target []byte) ([]byte, error) {
-	//        NTLMv2Response
-	//  0-16: Response
-	//   16-: NTLMv2ClientChallenge
+// discardKeystream moves the handle forward by n bytes of keystream
+func discardKeystream(handle *rc4.Cipher, n uint64) {
+	buf := make([]byte, 4096)
+	for n > 0 {
+		chunk := buf[:min(n, uint64(len(buf)))]
+		handle.XORKeyStream(chunk, chunk)
+		n -= uint64(len(chunk))
+	}
+}
 
-	// Generate Random Client Challenge
-	var challenge [8]byte
-	if _, err := rand.Read(challenge[:]); err != nil {
-		return nil, err
+// Seal encrypts the message with the client handle and signs its plaintext
+func (n *NtlmProvider) Seal(message []byte) (sealed, signature []byte, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.seal(message)
+}
+
+func (n *NtlmProvider) seal(message []byte) (sealed, signature []byte, err error) {
+	if n.NegotiateFlags&NegotiateSeal == 0 {
+		return nil, nil, ErrSealNotNegotiated
+	}
+	if n.ClientHandle == nil {
+		return nil, nil, ErrContextNotEstablished
 	}
 
-	// Generate Hash Function
-	domain := encoder.StrToUTF16(n.Domain)
-	if domain == nil {
-		domain = target
+	handle, err := n.messageHandle(n.ClientHandle, n.ClientSealingKey, n.ClientSequenceNumber)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	user := encoder.StrToUTF16(strings.ToUpper(n.User))
-	if user == nil {
-		// Should be valid for anonymous login
-		// TODO: check if this is correct
-		user = encoder.StrToUTF16("ANONYMOUS")
+	// The message has to be encrypted before signing, as both consume the same handle
+	sealed = make([]byte, len(message))
+	handle.XORKeyStream(sealed, message)
+	signature, n.ClientSequenceNumber = sign(
+		nil,
+		n.NegotiateFlags,
+		handle,
+		n.ClientSigningKey,
+		n.ClientSequenceNumber,
+		message,
+	)
+	n.clientKeystream += uint64(len(message)) + signatureKeystreamLen(n.NegotiateFlags)
+	n.SequenceNumber = n.ClientSequenceNumber
+	return sealed, signature, nil
+}
+
+// Unseal decrypts a message sealed by the server and verifies its signature
+func (n *NtlmProvider) Unseal(sealed, signature []byte) ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.unseal(sealed, signature)
+}
+
+func (n *NtlmProvider) unseal(sealed, signature []byte) (plaintext []byte, err error) {
+	if n.NegotiateFlags&NegotiateSeal == 0 {
+		return nil, ErrSealNotNegotiated
+	}
+	if n.ServerHandle == nil {
+		return nil, ErrContextNotEstablished
 	}
 
-	if n.Hash == nil {
-		// Use password
-		password := encoder.StrToUTF16(n.Password)
-		m4 := md4.New()
-		_, err := m4.Write(password)
-		if err != nil {
-			return nil, err
-		}
-		hash := m4.Sum(nil)
-		n.Hash = hash
+	handle, err := n.messageHandle(n.ServerHandle, n.ServerSealingKey, n.ServerSequenceNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext = make([]byte, len(sealed))
+	handle.XORKeyStream(plaintext, sealed)
+	n.serverKeystream += uint64(len(sealed))
+	if err := n.verifyMIC(handle, plaintext, signature); err != nil {
+		return nil, err
 	}
+	return plaintext, nil
+}
 
-	hm := hmac.New(md5.New, n.Hash)
-	_, err := hm.Write(user)
+// signatureLen is the size of the NTLMSSP_MESSAGE_SIGNATURE
+const signatureLen = 16
+
+// Wrap protects a message sent to the server as a single token: the NTLMSSP_MESSAGE_SIGNATURE
+// followed by the message, sealed when confidentiality was negotiated and only signed
+// otherwise, e.g. for the LDAP sign and seal or the DCE/RPC packet privacy level
+func (n *NtlmProvider) Wrap(message []byte) ([]byte, error) {
+	var payload, signature []byte
+	var err error
+	if n.NegotiateFlags&NegotiateSeal != 0 {
+		payload, signature, err = n.Seal(message)
+	} else {
+		payload = message
+		signature, err = n.GetMIC(message)
+	}
 	if err != nil {
 		return nil, err
 	}
-	_, err = hm.Write(domain)
+	if len(signature) != signatureLen {
+		return nil, ErrSigningNotNegotiated
+	}
+	return append(signature, payload...), nil
+}
+
+// Unwrap verifies, and decrypts if confidentiality was negotiated, a token wrapped by
+// the server and returns the message it carries
+func (n *NtlmProvider) Unwrap(token []byte) ([]byte, error) {
+	if len(token) < signatureLen {
+		return nil, ErrTruncatedMessage
+	}
+	signature, payload := token[:signatureLen], token[signatureLen:]
+
+	if n.NegotiateFlags&NegotiateSeal != 0 {
+		return n.Unseal(payload, signature)
+	}
+	if !n.isSigning() {
+		return nil, ErrSigningNotNegotiated
+	}
+	if err := n.VerifyMIC(payload, signature); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// GetMICWithSeqNum signs the message with an explicit sequence number (datagram mode only)
+func (n *NtlmProvider) GetMICWithSeqNum(bs []byte, seqNum uint32) ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.NegotiateFlags&NegotiateDatagram == 0 {
+		return nil, ErrDatagramNotNegotiated
+	}
+	if !n.isSigning() {
+		return nil, ErrSigningNotNegotiated
+	}
+	n.ClientSequenceNumber = seqNum
+	return n.getMIC(bs)
+}
+
+// VerifyMICWithSeqNum checks a server signature made with an explicit sequence number (datagram mode only)
+func (n *NtlmProvider) VerifyMICWithSeqNum(bs, mic []byte, seqNum uint32) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.NegotiateFlags&NegotiateDatagram == 0 {
+		return ErrDatagramNotNegotiated
+	}
+	if !n.isSigning() {
+		return ErrSigningNotNegotiated
+	}
+	n.ServerSequenceNumber = seqNum
+	return n.verifyServerMIC(bs, mic)
+}
+
+// SealWithSeqNum seals the message with an explicit sequence number (datagram mode only)
+func (n *NtlmProvider) SealWithSeqNum(message []byte, seqNum uint32) (sealed, signature []byte, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.NegotiateFlags&NegotiateDatagram == 0 {
+		return nil, nil, ErrDatagramNotNegotiated
+	}
+	n.ClientSequenceNumber = seqNum
+	return n.seal(message)
+}
+
+// UnsealWithSeqNum unseals a server message sealed with an explicit sequence number (datagram mode only)
+func (n *NtlmProvider) UnsealWithSeqNum(sealed, signature []byte, seqNum uint32) ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.NegotiateFlags&NegotiateDatagram == 0 {
+		return nil, ErrDatagramNotNegotiated
+	}
+	n.ServerSequenceNumber = seqNum
+	return n.unseal(sealed, signature)
+}
+
+func (n *NtlmProvider) NewLMChallengeResponse() ([]byte, error) {
+	if n.isAnonymous() {
+		// Anonymous authentication: LmChallengeResponse = Z(1)
+		return []byte{0}, nil
+	}
+
+	if n.UseNTLMv1 {
+		return n.newLMv1Response()
+	}
+
+	// A server sending its time only checks the NTLMv2 response, Z(24) is sent instead.
+	// The same goes when the LMv2 response is not allowed
+	if !n.AllowLMResponse || n.micRequired() {
+		return make([]byte, 24), nil
+	}
+
+	//        LMv2Response
+	//  0-16: Response
+	// 16-24: ChallengeFromClient
+	responseKey, err := n.responseKeyNTv2(n.TargetName)
 	if err != nil {
 		return nil, err
 	}
 
-	hashfunction := hmac.New(md5.New, hm.Sum(nil))
-	_, err = hashfunction.Write(n.ServerChallenge)
+	// HMAC_MD5(ResponseKeyLM, ServerChallenge || ClientChallenge), ResponseKeyLM being NTOWFv2
+	h := hmac.New(md5.New, responseKey)
+	h.Write(n.ServerChallenge)
+	h.Write(n.ClientChallenge)
+	return append(h.Sum(nil), n.ClientChallenge...), nil
+}
+
+func (n *NtlmProvider) newLMv1Response() ([]byte, error) {
+	//        LMv1Response
+	//  0-24: Response
+	if n.NegotiateFlags&NegotiateExtendedSecurity != 0 {
+		// With extended session security, the client challenge is sent instead
+		response := make([]byte, 24)
+		copy(response, n.ClientChallenge)
+		return response, nil
+	}
+
+	if !n.AllowLMResponse {
+		// Only the NTLMv1 response is sent, in both fields (NoLMResponseNTLMv1)
+		return n.newNtlmv1Response()
+	}
+	if n.Password == "" && n.Hash != nil {
+		// LMOWFv1 cannot be derived from the NT hash, so the NT response is sent twice
+		return n.newNtlmv1Response()
+	}
+	return desl(LMOWFv1(n.Password), n.ServerChallenge)
+}
+
+func (n *NtlmProvider) NewNtChallengeResponse(target []byte) ([]byte, error) {
+	if n.isAnonymous() {
+		// Anonymous authentication: empty NtChallengeResponse, null session base key
+		n.SessionBaseKey = make([]byte, 16)
+		return nil, nil
+	}
+
+	if n.UseNTLMv1 {
+		return n.newNtlmv1Response()
+	}
+	return n.newNtlmv2Response(target)
+}
+
+func (n *NtlmProvider) newNtlmv1Response() ([]byte, error) {
+	//        NTLMv1Response
+	//  0-24: Response
+	hash, err := n.ntowfv1()
 	if err != nil {
 		return nil, err
 	}
-	_, err = hashfunction.Write(challenge[:])
+
+	challenge := n.ServerChallenge
+	if n.NegotiateFlags&NegotiateExtendedSecurity != 0 {
+		// NTLM2 session response: MD5(ServerChallenge || ClientChallenge)[0:8]
+		h := md5.New()
+		h.Write(n.ServerChallenge)
+		h.Write(n.ClientChallenge)
+		challenge = h.Sum(nil)[:8]
+	}
+
+	response, err := desl(hash, challenge)
 	if err != nil {
 		return nil, err
 	}
 
+	// Before returning, we need to generate the session base key
+	m4 := md4.New()
+	m4.Write(hash)
+	n.SessionBaseKey = m4.Sum(nil)
+	return response, nil
+}
+
+func (n *NtlmProvider) newNtlmv2Response(target []byte) ([]byte, error) {
+	//        NTLMv2Response
 	//  0-16: Response
-	response := make([]byte, 16)
-	_ = hashfunction.Sum(response[:])
+	//   16-: NTLMv2ClientChallenge
+
+	responseKey, err := n.responseKeyNTv2(target)
+	if err != nil {
+		return nil, err
+	}
 
 	//   16-: NTLMv2ClientChallenge
 
@@ -231,6 +488,7 @@ func (n *NtlmProvider) NewNtChallengeResponse(target []byte) ([]byte, error) {
 	// 24-28: _
 	//
 	//	 28-: AvPairs
+	//	    : _
 
 	//	      NTLMv2ClientChallenge
 	clientChallenge := make([]byte, 28)
@@ -249,43 +507,295 @@ func (n *NtlmProvider) NewNtChallengeResponse(target []byte) ([]byte, error) {
 
 	// if no timestamp provided in AvPairs, provide our own
 	if n.TargetInfo.Timestamp == 0 {
-		n.TargetInfo.Timestamp = uint64((time.Now().UnixNano() / 100) + 116444736000000000)
+		n.TargetInfo.Timestamp = fileTime(n.now())
 	}
 	binary.LittleEndian.PutUint64(clientChallenge[8:16], n.TargetInfo.Timestamp)
 
 	// 16-24: ChallengeFromClient
-	copy(clientChallenge[16:24], challenge[:])
+	copy(clientChallenge[16:24], n.ClientChallenge)
 
 	// 24-28: _
 
 	// 28-: AvPairs
-	clientChallenge = append(clientChallenge, n.TargetInfo.AvPairsBytes...)
+	clientChallenge = append(clientChallenge, n.responseAvPairs().Bytes()...)
+
+	//    : _
+	clientChallenge = append(clientChallenge, 0, 0, 0, 0)
+
+	//  0-16: Response
+	hashfunction := hmac.New(md5.New, responseKey)
+	_, err = hashfunction.Write(n.ServerChallenge)
+	if err != nil {
+		return nil, err
+	}
+	_, err = hashfunction.Write(clientChallenge)
+	if err != nil {
+		return nil, err
+	}
+	response := hashfunction.Sum(nil)
 
 	ntlmv2Response := append(response, clientChallenge...)
 
-	// Before returning, we need to generate the session keys
+	// Before returning, we need to generate the session base key
 	hashfunction.Reset()
-	hashfunction.Write(response[:])
+	hashfunction.Write(response)
 	n.SessionBaseKey = hashfunction.Sum(nil)
-	n.KeyExchangeKey = n.SessionBaseKey
-	n.ExportedSessionKey = make([]byte, 16)
 
+	// Return the NTLMv2Response
+	return ntlmv2Response, nil
+}
+
+// isAnonymous reports whether the provider authenticates as the anonymous user
+func (n *NtlmProvider) isAnonymous() bool {
+	return n.Anonymous || (n.User == "" && n.Password == "" && n.Hash == nil)
+}
+
+// isUPN reports whether the user name is a user principal name (user@corp.example.com),
+// which is sent with an empty domain name and stands for both in NTOWFv2
+func isUPN(user string) bool {
+	return strings.Contains(user, "@")
+}
+
+// ParseUserName splits the DOMAIN\user syntax into the domain and the user, a UPN or a user
+// without domain being returned as is with an empty domain. The domain "." designates the
+// local accounts of the server, see Domain
+func ParseUserName(name string) (domain, user string) {
+	if domain, user, ok := strings.Cut(name, `\`); ok {
+		return domain, user
+	}
+	return "", name
+}
+
+// domainName returns the domain sent in the AUTHENTICATE message and used by NTOWFv2: empty
+// for a UPN and the NetBIOS name of the server for its local accounts
+func (n *NtlmProvider) domainName() string {
+	if isUPN(n.User) {
+		return ""
+	}
+	if n.Domain == LocalDomain && n.TargetInfo != nil {
+		return n.TargetInfo.NbComputerName
+	}
+	return n.Domain
+}
+
+// responseKeyNTv2 returns NTOWFv2 of the user, the target name being used if no domain is
+// set, except for a UPN which always goes with an empty domain
+func (n *NtlmProvider) responseKeyNTv2(target []byte) ([]byte, error) {
+	domain := encoder.StrToUTF16(n.domainName())
+	if domain == nil && !isUPN(n.User) {
+		domain = target
+	}
+
+	user := encoder.StrToUTF16(strings.ToUpper(n.User))
+	if user == nil {
+		// Should be valid for anonymous login
+		// TODO: check if this is correct
+		user = encoder.StrToUTF16("ANONYMOUS")
+	}
+
+	hash, err := n.ntowfv1()
+	if err != nil {
+		return nil, err
+	}
+	return ntowfv2(hash, user, domain), nil
+}
+
+// responseAvPairs returns the target information sent back to the server in the NTLMv2 response
+func (n *NtlmProvider) responseAvPairs() AvPairs {
+	pairs := maps.Clone(n.TargetInfo.AvPairs)
+	if pairs == nil {
+		pairs = make(AvPairs)
+	}
+	pairs[AvIDMsvChannelBindings] = channelBindingsHash(n.ChannelBinding)
+	if n.MachineID != nil {
+		pairs[AvIDMsvAvSingleHost] = SingleHost{MachineID: [32]byte(n.MachineID)}.Bytes()
+	}
+
+	flags := n.TargetInfo.Flags
+	if n.TargetSPN != "" {
+		pairs[AvIDMsvAvTargetName] = encoder.StrToUTF16(n.TargetSPN)
+		if n.UntrustedSPN {
+			flags |= MsvAvFlagUntrustedSPN
+		}
+	}
+
+	// The flags of the server, e.g. MsvAvFlagAuthenticationConstrained, are sent back
+	if n.micRequired() {
+		flags |= MsvAvFlagMICPresent
+	}
+	if flags != 0 {
+		pairs[AvIDMsvAvFlags] = binary.LittleEndian.AppendUint32(nil, flags)
+	}
+	return pairs
+}
+
+// micRequired reports whether the AUTHENTICATE message must carry a MIC,
+// which is the case when the server sent its time in the target information
+func (n *NtlmProvider) micRequired() bool {
+	if n.UseNTLMv1 || n.TargetInfo == nil {
+		return false
+	}
+	_, ok := n.TargetInfo.AvPairs[AvIDMsvAvTimestamp]
+	return ok
+}
+
+// random returns the source of the client challenge and random session key
+func (n *NtlmProvider) random() io.Reader {
+	if n.Rand != nil {
+		return n.Rand
+	}
+	return rand.Reader
+}
+
+// now returns the current time of the clock of the provider
+func (n *NtlmProvider) now() time.Time {
+	if n.Now != nil {
+		return n.Now()
+	}
+	return time.Now()
+}
+
+// fileTime converts the time to a FILETIME: 100ns intervals since January 1, 1601 (UTC)
+func fileTime(t time.Time) uint64 {
+	return uint64((t.UnixNano() / 100) + 116444736000000000)
+}
+
+// keyExchangeKey computes KXKEY from the session base key and the LM response
+func (n *NtlmProvider) keyExchangeKey(v1 bool, lm []byte) []byte {
+	if v1 && n.NegotiateFlags&NegotiateExtendedSecurity != 0 {
+		// HMAC_MD5(SessionBaseKey, ServerChallenge || LmChallengeResponse[0:8])
+		h := hmac.New(md5.New, n.SessionBaseKey)
+		h.Write(n.ServerChallenge)
+		h.Write(lm[:8])
+		return h.Sum(nil)
+	}
+	return n.SessionBaseKey
+}
+
+func (n *NtlmProvider) newExportedSessionKey(lm []byte) error {
+	n.KeyExchangeKey = n.keyExchangeKey(n.UseNTLMv1, lm)
 	if n.NegotiateFlags&NegotiateKeyExch == 0 {
 		n.ExportedSessionKey = n.KeyExchangeKey
-		return ntlmv2Response, nil
+		return nil
 	}
 
-	if _, err := rand.Read(n.RandomSessionKey[:]); err != nil {
-		return nil, err
+	// Key exchange: the exported session key is a random one, sent encrypted with the KXKEY
+	n.RandomSessionKey = make([]byte, 16)
+	if _, err := io.ReadFull(n.random(), n.RandomSessionKey); err != nil {
+		return errors.New("failed to generate the random session key: " + err.Error())
 	}
 
 	cipher, err := rc4.NewCipher(n.KeyExchangeKey)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	n.RandomSessionKey = make([]byte, 16)
-	cipher.XORKeyStream(n.RandomSessionKey, n.ExportedSessionKey)
+	n.EncryptedRandomSessionKey = make([]byte, 16)
+	cipher.XORKeyStream(n.EncryptedRandomSessionKey, n.RandomSessionKey)
+	n.ExportedSessionKey = n.RandomSessionKey
+	return nil
+}
 
-	// Return the NTLMv2Response
-	return ntlmv2Response, nil
+// NTOWFv1 computes the NT hash of the password: MD4(UNICODE(Password))
+func NTOWFv1(password string) []byte {
+	m4 := md4.New()
+	m4.Write(encoder.StrToUTF16(password))
+	return m4.Sum(nil)
+}
+
+// NTOWFv2 computes the NTLMv2 response key of the user:
+// HMAC_MD5(NTOWFv1(Password), UNICODE(Uppercase(User) || Domain))
+// As Windows does, the user name is uppercased but the domain is used as is. For a UPN
+// such as user@corp.example.com, the domain is empty
+func NTOWFv2(domain, user, password string) []byte {
+	return ntowfv2(NTOWFv1(password), encoder.StrToUTF16(strings.ToUpper(user)), encoder.StrToUTF16(domain))
+}
+
+// ntowfv2 derives the NTLMv2 response key from the NT hash and the UNICODE user and domain
+func ntowfv2(hash, user, domain []byte) []byte {
+	h := hmac.New(md5.New, hash)
+	h.Write(user)
+	h.Write(domain)
+	return h.Sum(nil)
+}
+
+// ntowfv1 returns the NT hash, preferring Hash (pass-the-hash) over NTOWFv1(Password)
+func (n *NtlmProvider) ntowfv1() ([]byte, error) {
+	if n.Hash != nil {
+		if len(n.Hash) != 16 {
+			return nil, ErrInvalidHash
+		}
+		return n.Hash, nil
+	}
+	return NTOWFv1(n.Password), nil
+}
+
+// ParseHash parses an NT hash for pass-the-hash given in hexadecimal, either alone or in
+// the LMHASH:NTHASH format of secretsdump, the LM hash being checked then ignored
+func ParseHash(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if lm, nt, ok := strings.Cut(s, ":"); ok {
+		if _, err := decodeHash(lm); err != nil {
+			return nil, fmt.Errorf("%w: LM hash: %v", ErrInvalidHash, err)
+		}
+		s = nt
+	}
+	hash, err := decodeHash(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: NT hash: %v", ErrInvalidHash, err)
+	}
+	return hash, nil
+}
+
+// decodeHash decodes a 16 bytes hash written as 32 hexadecimal digits
+func decodeHash(s string) ([]byte, error) {
+	if len(s) != 32 {
+		return nil, fmt.Errorf("%d hexadecimal digits instead of 32", len(s))
+	}
+	return hex.DecodeString(s)
+}
+
+// LMOWFv1 computes the LM hash of the password: DES("KGS!@#$%") keyed with the first 14
+// characters of the uppercased password. Only used by the legacy LMv1 response
+func LMOWFv1(password string) []byte {
+	key := make([]byte, 14)
+	copy(key, strings.ToUpper(password))
+
+	magic := []byte("KGS!@#$%")
+	hash := make([]byte, 16)
+	for i := 0; i < 2; i++ {
+		// The key is 7 bytes long, so this can't fail
+		cipher, _ := des.NewCipher(desKey(key[7*i : 7*i+7]))
+		cipher.Encrypt(hash[8*i:8*i+8], magic)
+	}
+	return hash
+}
+
+// desl encrypts the 8 bytes of data with three DES keys taken out of the 16 bytes key
+func desl(key, data []byte) ([]byte, error) {
+	k := make([]byte, 21)
+	copy(k, key)
+
+	out := make([]byte, 24)
+	for i := 0; i < 3; i++ {
+		cipher, err := des.NewCipher(desKey(k[7*i : 7*i+7]))
+		if err != nil {
+			return nil, err
+		}
+		cipher.Encrypt(out[8*i:8*i+8], data)
+	}
+	return out, nil
+}
+
+// desKey spreads a 7 bytes key over 8 bytes, leaving room for the (ignored) parity bits
+func desKey(k []byte) []byte {
+	return []byte{
+		k[0],
+		k[0]<<7 | k[1]>>1,
+		k[1]<<6 | k[2]>>2,
+		k[2]<<5 | k[3]>>3,
+		k[3]<<4 | k[4]>>4,
+		k[4]<<3 | k[5]>>5,
+		k[5]<<2 | k[6]>>6,
+		k[6] << 1,
+	}
 }
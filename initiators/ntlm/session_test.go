@@ -0,0 +1,946 @@
+package ntlm_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rc4"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/msultra/encoder"
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+// newSessionPair returns two providers sharing mirrored session keys, so that
+// everything signed by one of them can be verified by the other one
+func newSessionPair(t *testing.T, flags uint32) (client, server *ntlm.NtlmProvider) {
+	t.Helper()
+
+	clientSigningKey := bytes.Repeat([]byte{0x11}, 16)
+	serverSigningKey := bytes.Repeat([]byte{0x22}, 16)
+	clientSealingKey := bytes.Repeat([]byte{0x33}, 16)
+	serverSealingKey := bytes.Repeat([]byte{0x44}, 16)
+
+	newCipher := func(key []byte) *rc4.Cipher {
+		c, err := rc4.NewCipher(key)
+		if err != nil {
+			t.Fatalf("rc4.NewCipher() failed: %v", err)
+		}
+		return c
+	}
+
+	client = &ntlm.NtlmProvider{
+		NegotiateFlags:   flags,
+		ClientSigningKey: clientSigningKey,
+		ServerSigningKey: serverSigningKey,
+		ClientSealingKey: clientSealingKey,
+		ServerSealingKey: serverSealingKey,
+		ClientHandle:     newCipher(clientSealingKey),
+		ServerHandle:     newCipher(serverSealingKey),
+	}
+	server = &ntlm.NtlmProvider{
+		NegotiateFlags:   flags,
+		ClientSigningKey: serverSigningKey,
+		ServerSigningKey: clientSigningKey,
+		ClientSealingKey: serverSealingKey,
+		ServerSealingKey: clientSealingKey,
+		ClientHandle:     newCipher(serverSealingKey),
+		ServerHandle:     newCipher(clientSealingKey),
+	}
+	return client, server
+}
+
+func getMIC(t *testing.T, provider *ntlm.NtlmProvider, msg []byte) []byte {
+	t.Helper()
+	mic, err := provider.GetMIC(msg)
+	if err != nil {
+		t.Fatalf("GetMIC() failed: %v", err)
+	}
+	return mic
+}
+
+func TestVerifyMIC(t *testing.T) {
+	client, server := newSessionPair(t, ntlm.DefaultNegotiateFlags)
+
+	msg := []byte("signed by the server")
+	for i := 0; i < 3; i++ {
+		mic := getMIC(t, server, msg)
+		if err := client.VerifyMIC(msg, mic); err != nil {
+			t.Fatalf("VerifyMIC() failed on message %d: %v", i, err)
+		}
+	}
+
+	if client.ServerSequenceNumber != 3 {
+		t.Fatalf("ServerSequenceNumber is %d, expected 3", client.ServerSequenceNumber)
+	}
+	if client.ClientSequenceNumber != 0 {
+		t.Fatalf("ClientSequenceNumber is %d, expected 0", client.ClientSequenceNumber)
+	}
+}
+
+func TestSequenceNumbersInterleaved(t *testing.T) {
+	client, server := newSessionPair(t, ntlm.DefaultNegotiateFlags)
+
+	for i := uint32(1); i <= 4; i++ {
+		request := []byte("request from the client")
+		if err := server.VerifyMIC(request, getMIC(t, client, request)); err != nil {
+			t.Fatalf("server failed to verify request %d: %v", i, err)
+		}
+
+		// The server replies twice for each request
+		for j := 0; j < 2; j++ {
+			response := []byte("response from the server")
+			if err := client.VerifyMIC(response, getMIC(t, server, response)); err != nil {
+				t.Fatalf("client failed to verify response %d: %v", i, err)
+			}
+		}
+
+		if client.ClientSequenceNumber != i {
+			t.Fatalf("ClientSequenceNumber is %d, expected %d", client.ClientSequenceNumber, i)
+		}
+		if client.ServerSequenceNumber != 2*i {
+			t.Fatalf("ServerSequenceNumber is %d, expected %d", client.ServerSequenceNumber, 2*i)
+		}
+		if client.SequenceNumber != client.ClientSequenceNumber {
+			t.Fatalf("SequenceNumber does not mirror ClientSequenceNumber")
+		}
+	}
+}
+
+func TestVerifyMICMismatch(t *testing.T) {
+	client, server := newSessionPair(t, ntlm.DefaultNegotiateFlags)
+
+	mic := getMIC(t, server, []byte("original message"))
+	err := client.VerifyMIC([]byte("tampered message"), mic)
+	if !errors.Is(err, ntlm.ErrMICMismatch) {
+		t.Fatalf("VerifyMIC() returned %v, expected %v", err, ntlm.ErrMICMismatch)
+	}
+}
+
+func TestVerifyMICWithoutSigning(t *testing.T) {
+	client, _ := newSessionPair(t, ntlm.DefaultNegotiateFlags&^ntlm.NegotiateSign)
+
+	if err := client.VerifyMIC([]byte("message"), nil); err != nil {
+		t.Fatalf("VerifyMIC() failed: %v", err)
+	}
+	if err := client.VerifyMIC([]byte("message"), make([]byte, 16)); !errors.Is(err, ntlm.ErrMICMismatch) {
+		t.Fatalf("VerifyMIC() returned %v, expected %v", err, ntlm.ErrMICMismatch)
+	}
+}
+
+// MS-NLMP 4.2.4.4: GSS_WrapEx with NTLMv2 and extended session security
+const (
+	sealFlags      = 0xe28a8233
+	sealSigningKey = "4788dc861b4782f35d43fd98fe1a2d39"
+	sealSealingKey = "59f600973cc4960a25480a7c196e4c58"
+	sealPlaintext  = "50006c00610069006e007400650078007400"
+	sealSealed     = "54e50165bf1936dc996020c1811b0f06fb5f"
+	sealSignature  = "010000007fb38ec5c55d497600000000"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Failed to decode hex string: %v", err)
+	}
+	return b
+}
+
+func TestSeal(t *testing.T) {
+	handle, err := rc4.NewCipher(decodeHex(t, sealSealingKey))
+	if err != nil {
+		t.Fatalf("rc4.NewCipher() failed: %v", err)
+	}
+	client := &ntlm.NtlmProvider{
+		NegotiateFlags:   sealFlags,
+		ClientSigningKey: decodeHex(t, sealSigningKey),
+		ClientHandle:     handle,
+	}
+
+	sealed, signature, err := client.Seal(decodeHex(t, sealPlaintext))
+	if err != nil {
+		t.Fatalf("Seal() failed: %v", err)
+	}
+	if !bytes.Equal(sealed, decodeHex(t, sealSealed)) {
+		t.Fatalf("sealed data is incorrect: %x", sealed)
+	}
+	if !bytes.Equal(signature, decodeHex(t, sealSignature)) {
+		t.Fatalf("signature is incorrect: %x", signature)
+	}
+	if client.ClientSequenceNumber != 1 {
+		t.Fatalf("ClientSequenceNumber is %d, expected 1", client.ClientSequenceNumber)
+	}
+}
+
+func TestUnseal(t *testing.T) {
+	handle, err := rc4.NewCipher(decodeHex(t, sealSealingKey))
+	if err != nil {
+		t.Fatalf("rc4.NewCipher() failed: %v", err)
+	}
+	server := &ntlm.NtlmProvider{
+		NegotiateFlags:   sealFlags,
+		ServerSigningKey: decodeHex(t, sealSigningKey),
+		ServerHandle:     handle,
+	}
+
+	plaintext, err := server.Unseal(decodeHex(t, sealSealed), decodeHex(t, sealSignature))
+	if err != nil {
+		t.Fatalf("Unseal() failed: %v", err)
+	}
+	if !bytes.Equal(plaintext, decodeHex(t, sealPlaintext)) {
+		t.Fatalf("plaintext is incorrect: %x", plaintext)
+	}
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	client, server := newSessionPair(t, ntlm.DefaultNegotiateFlags|ntlm.NegotiateSeal)
+
+	for _, msg := range []string{"first message", "second message", ""} {
+		sealed, signature, err := client.Seal([]byte(msg))
+		if err != nil {
+			t.Fatalf("Seal() failed: %v", err)
+		}
+		if len(msg) > 0 && bytes.Equal(sealed, []byte(msg)) {
+			t.Fatalf("message was not encrypted")
+		}
+
+		plaintext, err := server.Unseal(sealed, signature)
+		if err != nil {
+			t.Fatalf("Unseal() failed: %v", err)
+		}
+		if string(plaintext) != msg {
+			t.Fatalf("plaintext is %q, expected %q", plaintext, msg)
+		}
+	}
+
+	sealed, signature, err := client.Seal([]byte("tampered message"))
+	if err != nil {
+		t.Fatalf("Seal() failed: %v", err)
+	}
+	sealed[0] ^= 0xff
+	if _, err := server.Unseal(sealed, signature); !errors.Is(err, ntlm.ErrMICMismatch) {
+		t.Fatalf("Unseal() returned %v, expected %v", err, ntlm.ErrMICMismatch)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	for _, flags := range []uint32{ntlm.DefaultNegotiateFlags, ntlm.DefaultNegotiateFlags | ntlm.NegotiateSeal} {
+		client, server := newSessionPair(t, flags)
+		sealed := flags&ntlm.NegotiateSeal != 0
+
+		for _, msg := range []string{"first message", "second message"} {
+			token, err := client.Wrap([]byte(msg))
+			if err != nil {
+				t.Fatalf("Wrap() failed: %v", err)
+			}
+			if len(token) != 16+len(msg) || bytes.Equal(token[16:], []byte(msg)) != !sealed {
+				t.Fatalf("sealed %v: wrapped token is %x", sealed, token)
+			}
+
+			plaintext, err := server.Unwrap(token)
+			if err != nil {
+				t.Fatalf("Unwrap() failed: %v", err)
+			}
+			if string(plaintext) != msg {
+				t.Fatalf("plaintext is %q, expected %q", plaintext, msg)
+			}
+		}
+
+		token, err := client.Wrap([]byte("tampered message"))
+		if err != nil {
+			t.Fatalf("Wrap() failed: %v", err)
+		}
+		token[len(token)-1] ^= 0xff
+		if _, err := server.Unwrap(token); !errors.Is(err, ntlm.ErrMICMismatch) {
+			t.Fatalf("Unwrap() returned %v, expected %v", err, ntlm.ErrMICMismatch)
+		}
+		if _, err := server.Unwrap(token[:15]); !errors.Is(err, ntlm.ErrTruncatedMessage) {
+			t.Fatalf("Unwrap() returned %v, expected %v", err, ntlm.ErrTruncatedMessage)
+		}
+	}
+}
+
+func TestSealNotNegotiated(t *testing.T) {
+	client, _ := newSessionPair(t, ntlm.DefaultNegotiateFlags)
+
+	if _, _, err := client.Seal([]byte("message")); !errors.Is(err, ntlm.ErrSealNotNegotiated) {
+		t.Fatalf("Seal() returned %v, expected %v", err, ntlm.ErrSealNotNegotiated)
+	}
+	if _, err := client.Unseal([]byte("message"), nil); !errors.Is(err, ntlm.ErrSealNotNegotiated) {
+		t.Fatalf("Unseal() returned %v, expected %v", err, ntlm.ErrSealNotNegotiated)
+	}
+}
+
+func TestSigningNotNegotiated(t *testing.T) {
+	var flags uint32 = ntlm.DefaultNegotiateFlags &^ (ntlm.NegotiateSign | ntlm.NegotiateAlwaysSign)
+	client, server := newSessionPair(t, flags)
+
+	if _, err := client.Wrap([]byte("message")); !errors.Is(err, ntlm.ErrSigningNotNegotiated) {
+		t.Fatalf("Wrap() returned %v, expected %v", err, ntlm.ErrSigningNotNegotiated)
+	}
+	if _, err := server.Unwrap(make([]byte, 32)); !errors.Is(err, ntlm.ErrSigningNotNegotiated) {
+		t.Fatalf("Unwrap() returned %v, expected %v", err, ntlm.ErrSigningNotNegotiated)
+	}
+
+	client, _ = newSessionPair(t, flags|ntlm.NegotiateDatagram)
+	if _, err := client.GetMICWithSeqNum([]byte("message"), 1); !errors.Is(err, ntlm.ErrSigningNotNegotiated) {
+		t.Fatalf("GetMICWithSeqNum() returned %v, expected %v", err, ntlm.ErrSigningNotNegotiated)
+	}
+	if err := client.VerifyMICWithSeqNum([]byte("message"), make([]byte, 16), 1); !errors.Is(err, ntlm.ErrSigningNotNegotiated) {
+		t.Fatalf("VerifyMICWithSeqNum() returned %v, expected %v", err, ntlm.ErrSigningNotNegotiated)
+	}
+}
+
+func TestSealConcurrent(t *testing.T) {
+	client, server := newSessionPair(t, ntlm.DefaultNegotiateFlags|ntlm.NegotiateSeal)
+
+	type sealedMessage struct {
+		message, sealed, signature []byte
+	}
+	const workers, perWorker = 8, 50
+	results := make(chan sealedMessage, workers*perWorker)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				message := []byte(fmt.Sprintf("message %d from worker %d", i, w))
+				if i%2 == 0 {
+					mic, err := client.GetMIC(message)
+					if err != nil {
+						t.Errorf("GetMIC() failed: %v", err)
+						return
+					}
+					results <- sealedMessage{message: message, signature: mic}
+					continue
+				}
+
+				sealed, signature, err := client.Seal(message)
+				if err != nil {
+					t.Errorf("Seal() failed: %v", err)
+					return
+				}
+				results <- sealedMessage{message, sealed, signature}
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	// The server must process the messages in the order of their sequence numbers
+	ordered := make([]sealedMessage, workers*perWorker)
+	for msg := range results {
+		ordered[binary.LittleEndian.Uint32(msg.signature[12:16])] = msg
+	}
+	for i, msg := range ordered {
+		if msg.sealed == nil {
+			if err := server.VerifyMIC(msg.message, msg.signature); err != nil {
+				t.Fatalf("VerifyMIC() of message %d failed: %v", i, err)
+			}
+			continue
+		}
+
+		plaintext, err := server.Unseal(msg.sealed, msg.signature)
+		if err != nil {
+			t.Fatalf("Unseal() of message %d failed: %v", i, err)
+		}
+		if !bytes.Equal(plaintext, msg.message) {
+			t.Fatalf("Unseal() of message %d = %q, expected %q", i, plaintext, msg.message)
+		}
+	}
+}
+
+func TestWipe(t *testing.T) {
+	provider := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Hash: ntlm.NTOWFv1("Password")}
+	authenticate(t, provider, testChallenge)
+
+	secrets := map[string][]byte{
+		"Hash":               provider.Hash,
+		"SessionBaseKey":     provider.SessionBaseKey,
+		"KeyExchangeKey":     provider.KeyExchangeKey,
+		"RandomSessionKey":   provider.RandomSessionKey,
+		"ExportedSessionKey": provider.ExportedSessionKey,
+		"ClientSigningKey":   provider.ClientSigningKey,
+		"ServerSigningKey":   provider.ServerSigningKey,
+		"ClientSealingKey":   provider.ClientSealingKey,
+		"ServerSealingKey":   provider.ServerSealingKey,
+	}
+	provider.Wipe()
+
+	for name, secret := range secrets {
+		if len(secret) == 0 {
+			t.Fatalf("%s was not set by the handshake", name)
+		}
+		if !bytes.Equal(secret, make([]byte, len(secret))) {
+			t.Fatalf("%s is not zeroed after Wipe(): %x", name, secret)
+		}
+	}
+	if provider.ClientHandle != nil || provider.ServerHandle != nil {
+		t.Fatalf("RC4 handles should be released by Wipe()")
+	}
+	if provider.Hash != nil || provider.SessionBaseKey != nil || provider.ClientSealingKey != nil {
+		t.Fatalf("secrets should be released by Wipe()")
+	}
+	if provider.IsEstablished() || provider.State() != ntlm.StateWiped {
+		t.Fatalf("provider should not be established after Wipe(), state is %v", provider.State())
+	}
+
+	// The credentials are gone, even after Reset
+	provider.Reset()
+	if _, err := provider.InitSecContext(); !errors.Is(err, ntlm.ErrWiped) {
+		t.Fatalf("InitSecContext() after Wipe() returned %v, expected %v", err, ntlm.ErrWiped)
+	}
+	if _, err := provider.GetMIC([]byte("message")); !errors.Is(err, ntlm.ErrContextNotEstablished) {
+		t.Fatalf("GetMIC() after Wipe() returned %v, expected %v", err, ntlm.ErrContextNotEstablished)
+	}
+}
+
+// MS-NLMP 4.2.2: NTLMv1 authentication
+func TestNtlmv1Response(t *testing.T) {
+	provider := ntlm.NtlmProvider{
+		User:            "User",
+		Domain:          "Domain",
+		Password:        "Password",
+		UseNTLMv1:       true,
+		AllowLMResponse: true,
+		NegotiateFlags:  0xe2028233,
+		ServerChallenge: decodeHex(t, "0123456789abcdef"),
+	}
+
+	lm, err := provider.NewLMChallengeResponse()
+	if err != nil {
+		t.Fatalf("NewLMChallengeResponse() failed: %v", err)
+	}
+	if !bytes.Equal(lm, decodeHex(t, "98def7b87f88aa5dafe2df779688a172def11c7d5ccdef13")) {
+		t.Fatalf("LM response is incorrect: %x", lm)
+	}
+
+	nt, err := provider.NewNtChallengeResponse(nil)
+	if err != nil {
+		t.Fatalf("NewNtChallengeResponse() failed: %v", err)
+	}
+	if !bytes.Equal(nt, decodeHex(t, "67c43011f30298a2ad35ece64f16331c44bdbed927841f94")) {
+		t.Fatalf("NT response is incorrect: %x", nt)
+	}
+
+	if !bytes.Equal(provider.SessionBaseKey, decodeHex(t, "d87262b0cde4b1cb7499becccdf10784")) {
+		t.Fatalf("SessionBaseKey is incorrect: %x", provider.SessionBaseKey)
+	}
+}
+
+// MS-NLMP 4.2.3: NTLMv1 with client challenge (extended session security)
+func TestNtlmv1ExtendedSessionSecurityResponse(t *testing.T) {
+	provider := ntlm.NtlmProvider{
+		User:            "User",
+		Domain:          "Domain",
+		Password:        "Password",
+		UseNTLMv1:       true,
+		NegotiateFlags:  0x820a8233,
+		ServerChallenge: decodeHex(t, "0123456789abcdef"),
+		ClientChallenge: decodeHex(t, "aaaaaaaaaaaaaaaa"),
+	}
+
+	lm, err := provider.NewLMChallengeResponse()
+	if err != nil {
+		t.Fatalf("NewLMChallengeResponse() failed: %v", err)
+	}
+	if !bytes.Equal(lm, decodeHex(t, "aaaaaaaaaaaaaaaa00000000000000000000000000000000")) {
+		t.Fatalf("LM response is incorrect: %x", lm)
+	}
+
+	nt, err := provider.NewNtChallengeResponse(nil)
+	if err != nil {
+		t.Fatalf("NewNtChallengeResponse() failed: %v", err)
+	}
+	if !bytes.Equal(nt, decodeHex(t, "7537f803ae367128ca458204bde7caf81e97ed2683267232")) {
+		t.Fatalf("NT response is incorrect: %x", nt)
+	}
+
+	if !bytes.Equal(provider.SessionBaseKey, decodeHex(t, "d87262b0cde4b1cb7499becccdf10784")) {
+		t.Fatalf("SessionBaseKey is incorrect: %x", provider.SessionBaseKey)
+	}
+}
+
+func newChannelBindingProvider(t *testing.T, channelBinding []byte) *ntlm.NtlmProvider {
+	t.Helper()
+
+	pairs := make(ntlm.AvPairs)
+	pairs[ntlm.AvIDMsvAvNbComputerName] = encoder.StrToUTF16("Server")
+	pairs[ntlm.AvIDMsvAvNbDomainName] = encoder.StrToUTF16("Domain")
+	targetInfo, err := ntlm.NewTargetInformation(pairs)
+	if err != nil {
+		t.Fatalf("failed to create target information: %v", err)
+	}
+
+	return &ntlm.NtlmProvider{
+		User:            "User",
+		Domain:          "Domain",
+		Password:        "Password",
+		ChannelBinding:  channelBinding,
+		ServerChallenge: decodeHex(t, "0123456789abcdef"),
+		ClientChallenge: decodeHex(t, "aaaaaaaaaaaaaaaa"),
+		TargetInfo:      targetInfo,
+	}
+}
+
+func TestChannelBindingAvPair(t *testing.T) {
+	// SHA-256 of the endpoint certificate, as used by tls-server-end-point
+	certHash := decodeHex(t, "866cd39c7dc69772b5ae6dcf014f97beba35617964b9dbfed896b2abff17e5b4")
+	provider := newChannelBindingProvider(t, append([]byte("tls-server-end-point:"), certHash...))
+
+	nt, err := provider.NewNtChallengeResponse(nil)
+	if err != nil {
+		t.Fatalf("NewNtChallengeResponse() failed: %v", err)
+	}
+
+	// AvId (MsvAvChannelBindings) || AvLen || MD5(gss_channel_bindings_struct)
+	expected := decodeHex(t, "0a001000cb320cf3174922d80418f29bb9ae9b24")
+	if !bytes.Contains(nt[16+28:], expected) {
+		t.Fatalf("MsvAvChannelBindings is missing or incorrect: %x", nt[16+28:])
+	}
+
+	if _, ok := provider.TargetInfo.AvPairs[ntlm.AvIDMsvChannelBindings]; ok {
+		t.Fatalf("target information received from the server was modified")
+	}
+}
+
+func TestChannelBindingAvPairWithoutBinding(t *testing.T) {
+	provider := newChannelBindingProvider(t, nil)
+
+	nt, err := provider.NewNtChallengeResponse(nil)
+	if err != nil {
+		t.Fatalf("NewNtChallengeResponse() failed: %v", err)
+	}
+
+	expected := append(decodeHex(t, "0a001000"), make([]byte, 16)...)
+	if !bytes.Contains(nt[16+28:], expected) {
+		t.Fatalf("MsvAvChannelBindings is missing or not zeroed: %x", nt[16+28:])
+	}
+}
+
+func TestMechListMIC(t *testing.T) {
+	client, server := newSessionPair(t, ntlm.DefaultNegotiateFlags)
+
+	mechList, err := asn1.Marshal([]asn1.ObjectIdentifier{ntlm.NtlmOID})
+	if err != nil {
+		t.Fatalf("failed to marshal mechanism list: %v", err)
+	}
+
+	mic, err := client.GenerateMechListMIC(mechList)
+	if err != nil {
+		t.Fatalf("GenerateMechListMIC() failed: %v", err)
+	}
+	if err := server.VerifyMechListMIC(mechList, mic); err != nil {
+		t.Fatalf("VerifyMechListMIC() failed: %v", err)
+	}
+
+	mic, err = server.GenerateMechListMIC(mechList)
+	if err != nil {
+		t.Fatalf("GenerateMechListMIC() failed: %v", err)
+	}
+	if err := client.VerifyMechListMIC(mechList, mic); err != nil {
+		t.Fatalf("VerifyMechListMIC() failed: %v", err)
+	}
+}
+
+func TestMechListMICTampered(t *testing.T) {
+	client, server := newSessionPair(t, ntlm.DefaultNegotiateFlags)
+
+	mechList, err := asn1.Marshal([]asn1.ObjectIdentifier{{1, 2, 840, 113554, 1, 2, 2}, ntlm.NtlmOID})
+	if err != nil {
+		t.Fatalf("failed to marshal mechanism list: %v", err)
+	}
+	mic, err := client.GenerateMechListMIC(mechList)
+	if err != nil {
+		t.Fatalf("GenerateMechListMIC() failed: %v", err)
+	}
+
+	// Kerberos was removed from the offered mechanisms
+	tampered, err := asn1.Marshal([]asn1.ObjectIdentifier{ntlm.NtlmOID})
+	if err != nil {
+		t.Fatalf("failed to marshal mechanism list: %v", err)
+	}
+	if err := server.VerifyMechListMIC(tampered, mic); !errors.Is(err, ntlm.ErrMICMismatch) {
+		t.Fatalf("VerifyMechListMIC() returned %v, expected %v", err, ntlm.ErrMICMismatch)
+	}
+}
+
+func TestMechListMICNotEstablished(t *testing.T) {
+	provider := &ntlm.NtlmProvider{}
+
+	if _, err := provider.GenerateMechListMIC([]byte{}); !errors.Is(err, ntlm.ErrContextNotEstablished) {
+		t.Fatalf("GenerateMechListMIC() returned %v, expected %v", err, ntlm.ErrContextNotEstablished)
+	}
+	if err := provider.VerifyMechListMIC([]byte{}, nil); !errors.Is(err, ntlm.ErrContextNotEstablished) {
+		t.Fatalf("VerifyMechListMIC() returned %v, expected %v", err, ntlm.ErrContextNotEstablished)
+	}
+}
+
+func TestPassTheHash(t *testing.T) {
+	hash := decodeHex(t, "a4f49c406510bdcab6824ee7c30fd852") // NTOWFv1("Password")
+
+	for _, v1 := range []bool{true, false} {
+		responses := make([][]byte, 2)
+		for i, provider := range []*ntlm.NtlmProvider{
+			{User: "User", Domain: "Domain", Password: "Password"},
+			{User: "User", Domain: "Domain", Hash: hash},
+		} {
+			provider.UseNTLMv1 = v1
+			provider.ServerChallenge = decodeHex(t, "0123456789abcdef")
+			provider.ClientChallenge = decodeHex(t, "aaaaaaaaaaaaaaaa")
+			provider.TargetInfo = &ntlm.TargetInformation{Timestamp: 1}
+
+			nt, err := provider.NewNtChallengeResponse(nil)
+			if err != nil {
+				t.Fatalf("NewNtChallengeResponse() failed: %v", err)
+			}
+			responses[i] = nt
+		}
+
+		if !bytes.Equal(responses[0], responses[1]) {
+			t.Fatalf("NTLMv1=%v: hash response %x differs from password response %x", v1, responses[1], responses[0])
+		}
+	}
+}
+
+func TestPassTheHashInvalidLength(t *testing.T) {
+	provider := ntlm.NtlmProvider{
+		User:            "User",
+		Hash:            []byte{0x01, 0x02},
+		ServerChallenge: decodeHex(t, "0123456789abcdef"),
+		TargetInfo:      &ntlm.TargetInformation{},
+	}
+
+	if _, err := provider.NewNtChallengeResponse(nil); !errors.Is(err, ntlm.ErrInvalidHash) {
+		t.Fatalf("NewNtChallengeResponse() returned %v, expected %v", err, ntlm.ErrInvalidHash)
+	}
+}
+
+// MS-NLMP 4.2.2.1.2
+func TestNTOWFv1(t *testing.T) {
+	if hash := ntlm.NTOWFv1("Password"); !bytes.Equal(hash, decodeHex(t, "a4f49c406510bdcab6824ee7c30fd852")) {
+		t.Fatalf("NTOWFv1 is incorrect: %x", hash)
+	}
+}
+
+// MS-NLMP 4.2.4.1.1
+func TestNTOWFv2(t *testing.T) {
+	expected := decodeHex(t, "0c868a403bfd7a93a3001ef22ef02e3f")
+	if hash := ntlm.NTOWFv2("Domain", "User", "Password"); !bytes.Equal(hash, expected) {
+		t.Fatalf("NTOWFv2 is incorrect: %x", hash)
+	}
+
+	// The user name is case insensitive, the domain is not normalized
+	if hash := ntlm.NTOWFv2("Domain", "uSeR", "Password"); !bytes.Equal(hash, expected) {
+		t.Fatalf("NTOWFv2 should uppercase the user name: %x", hash)
+	}
+	if hash := ntlm.NTOWFv2("DOMAIN", "User", "Password"); bytes.Equal(hash, expected) {
+		t.Fatalf("NTOWFv2 should not uppercase the domain")
+	}
+}
+
+// MS-NLMP 4.2.2.1.1
+func TestLMOWFv1(t *testing.T) {
+	expected := decodeHex(t, "e52cac67419a9a224a3b108f3fa6cb6d")
+	if hash := ntlm.LMOWFv1("Password"); !bytes.Equal(hash, expected) {
+		t.Fatalf("LMOWFv1 is incorrect: %x", hash)
+	}
+	if hash := ntlm.LMOWFv1("password"); !bytes.Equal(hash, expected) {
+		t.Fatalf("LMOWFv1 should uppercase the password: %x", hash)
+	}
+}
+
+func TestSealingKeys(t *testing.T) {
+	provider := ntlm.NtlmProvider{
+		User:           "User",
+		Domain:         "Domain",
+		Password:       "Password",
+		NegotiateFlags: ntlm.DefaultNegotiateFlags | ntlm.NegotiateSeal,
+	}
+	authenticate(t, &provider, testChallenge)
+
+	if len(provider.ClientSealingKey) != 16 || len(provider.ServerSealingKey) != 16 {
+		t.Fatalf("sealing keys are not stored after the handshake")
+	}
+
+	// The client handle is an RC4 stream keyed by the client sealing key
+	sealed, _, err := provider.Seal([]byte("message"))
+	if err != nil {
+		t.Fatalf("Seal() failed: %v", err)
+	}
+	handle, err := rc4.NewCipher(provider.ClientSealingKey)
+	if err != nil {
+		t.Fatalf("rc4.NewCipher() failed: %v", err)
+	}
+	expected := make([]byte, len(sealed))
+	handle.XORKeyStream(expected, []byte("message"))
+	if !bytes.Equal(sealed, expected) {
+		t.Fatalf("sealed message is %x, expected %x", sealed, expected)
+	}
+}
+
+func TestSealPastSequenceBoundary(t *testing.T) {
+	client, server := newSessionPair(t, ntlm.DefaultNegotiateFlags|ntlm.NegotiateSeal)
+
+	// Connection-oriented RC4 streams are continuous, crossing 2^20 messages needs no re-keying
+	client.ClientSequenceNumber = 1<<20 - 2
+	server.ServerSequenceNumber = 1<<20 - 2
+	for i := 0; i < 4; i++ {
+		msg := []byte("message sealed around the boundary")
+		sealed, signature, err := client.Seal(msg)
+		if err != nil {
+			t.Fatalf("Seal() failed: %v", err)
+		}
+		plaintext, err := server.Unseal(sealed, signature)
+		if err != nil {
+			t.Fatalf("Unseal() failed on sequence number %d: %v", server.ServerSequenceNumber, err)
+		}
+		if !bytes.Equal(plaintext, msg) {
+			t.Fatalf("unsealed message is %q", plaintext)
+		}
+	}
+}
+
+func TestSealDatagram(t *testing.T) {
+	client, server := newSessionPair(t, ntlm.DefaultNegotiateFlags|ntlm.NegotiateSeal|ntlm.NegotiateDatagram)
+
+	msg := []byte("datagram message")
+	for seqNum := uint32(0); seqNum < 3; seqNum++ {
+		sealed, signature, err := client.Seal(msg)
+		if err != nil {
+			t.Fatalf("Seal() failed: %v", err)
+		}
+
+		// SealingKey' = MD5(SealingKey || SeqNum), reinitialized for every message
+		var seq [4]byte
+		binary.LittleEndian.PutUint32(seq[:], seqNum)
+		key := md5.Sum(append(bytes.Repeat([]byte{0x33}, 16), seq[:]...))
+		handle, err := rc4.NewCipher(key[:])
+		if err != nil {
+			t.Fatalf("rc4.NewCipher() failed: %v", err)
+		}
+
+		expectedSealed := make([]byte, len(msg))
+		handle.XORKeyStream(expectedSealed, msg)
+		if !bytes.Equal(sealed, expectedSealed) {
+			t.Fatalf("sealed message %d is %x, expected %x", seqNum, sealed, expectedSealed)
+		}
+
+		h := hmac.New(md5.New, bytes.Repeat([]byte{0x11}, 16))
+		h.Write(seq[:])
+		h.Write(msg)
+		checksum := h.Sum(nil)[:8]
+		handle.XORKeyStream(checksum, checksum)
+		expectedSignature := append(append([]byte{0x01, 0x00, 0x00, 0x00}, checksum...), seq[:]...)
+		if !bytes.Equal(signature, expectedSignature) {
+			t.Fatalf("signature %d is %x, expected %x", seqNum, signature, expectedSignature)
+		}
+
+		plaintext, err := server.Unseal(sealed, signature)
+		if err != nil {
+			t.Fatalf("Unseal() failed: %v", err)
+		}
+		if !bytes.Equal(plaintext, msg) {
+			t.Fatalf("unsealed message is %q", plaintext)
+		}
+	}
+}
+
+func TestSealDatagramOutOfOrder(t *testing.T) {
+	client, server := newSessionPair(t, ntlm.DefaultNegotiateFlags|ntlm.NegotiateSeal|ntlm.NegotiateDatagram)
+
+	type datagram struct {
+		seqNum                 uint32
+		sealed, signature, mic []byte
+	}
+	var datagrams []datagram
+	for _, seqNum := range []uint32{7, 3, 42} {
+		sealed, signature, err := client.SealWithSeqNum([]byte("datagram message"), seqNum)
+		if err != nil {
+			t.Fatalf("SealWithSeqNum() failed: %v", err)
+		}
+
+		mic, err := client.GetMICWithSeqNum([]byte("datagram message"), seqNum)
+		if err != nil {
+			t.Fatalf("GetMICWithSeqNum() failed: %v", err)
+		}
+		datagrams = append(datagrams, datagram{seqNum, sealed, signature, mic})
+	}
+
+	// Datagrams can be received in any order
+	for _, i := range []int{2, 0, 1} {
+		d := datagrams[i]
+		plaintext, err := server.UnsealWithSeqNum(d.sealed, d.signature, d.seqNum)
+		if err != nil {
+			t.Fatalf("UnsealWithSeqNum() failed on %d: %v", d.seqNum, err)
+		}
+		if !bytes.Equal(plaintext, []byte("datagram message")) {
+			t.Fatalf("unsealed message is %q", plaintext)
+		}
+		if err := server.VerifyMICWithSeqNum([]byte("datagram message"), d.mic, d.seqNum); err != nil {
+			t.Fatalf("VerifyMICWithSeqNum() failed on %d: %v", d.seqNum, err)
+		}
+	}
+
+	if err := server.VerifyMICWithSeqNum([]byte("datagram message"), datagrams[0].mic, 8); !errors.Is(err, ntlm.ErrMICMismatch) {
+		t.Fatalf("VerifyMICWithSeqNum() with a wrong sequence number returned %v, expected %v", err, ntlm.ErrMICMismatch)
+	}
+}
+
+func TestSealWithSeqNumNotDatagram(t *testing.T) {
+	client, _ := newSessionPair(t, ntlm.DefaultNegotiateFlags|ntlm.NegotiateSeal)
+	if _, _, err := client.SealWithSeqNum([]byte("message"), 1); !errors.Is(err, ntlm.ErrDatagramNotNegotiated) {
+		t.Fatalf("SealWithSeqNum() returned %v, expected %v", err, ntlm.ErrDatagramNotNegotiated)
+	}
+}
+
+func TestDatagramNegotiateFlag(t *testing.T) {
+	provider := ntlm.NtlmProvider{Datagram: true}
+	neg, err := provider.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	if flags := binary.LittleEndian.Uint32(neg[12:16]); flags&ntlm.NegotiateDatagram == 0 {
+		t.Fatalf("NegotiateDatagram is not set in the NEGOTIATE message flags %08x", flags)
+	}
+}
+
+func TestConnectionless(t *testing.T) {
+	client := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", Datagram: true, NegotiateFlags: ntlm.DefaultNegotiateFlags | ntlm.NegotiateSeal}
+	server := ntlm.NewAcceptor(&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", Workstation: "SERVER", Datagram: true, NegotiateFlags: ntlm.DefaultNegotiateFlags | ntlm.NegotiateSeal})
+
+	// No NEGOTIATE message: the server starts with the CHALLENGE message
+	challenge, err := server.AcceptSecContext(nil)
+	if err != nil {
+		t.Fatalf("AcceptSecContext() failed on the server: %v", err)
+	}
+	authenticate, err := client.AcceptSecContext(challenge)
+	if err != nil {
+		t.Fatalf("AcceptSecContext() failed on the client: %v", err)
+	}
+	if client.NegotiateMessage != nil {
+		t.Fatalf("a NEGOTIATE message was generated: %x", client.NegotiateMessage)
+	}
+	if _, err := server.AcceptSecContext(authenticate); err != nil {
+		t.Fatalf("AcceptSecContext() failed on the AUTHENTICATE message: %v", err)
+	}
+	if !client.IsEstablished() || !server.IsEstablished() {
+		t.Fatal("context is not established")
+	}
+
+	sealed, signature, err := client.SealWithSeqNum([]byte("datagram message"), 5)
+	if err != nil {
+		t.Fatalf("SealWithSeqNum() failed: %v", err)
+	}
+	plaintext, err := server.UnsealWithSeqNum(sealed, signature, 5)
+	if err != nil {
+		t.Fatalf("UnsealWithSeqNum() failed: %v", err)
+	}
+	if !bytes.Equal(plaintext, []byte("datagram message")) {
+		t.Fatalf("unsealed message is %q", plaintext)
+	}
+}
+
+func TestConnectionlessNotOffered(t *testing.T) {
+	client := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", Datagram: true}
+	server := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	challenge, err := server.GenerateChallengeMessage()
+	if err != nil {
+		t.Fatalf("GenerateChallengeMessage() failed: %v", err)
+	}
+	if _, err := client.AcceptSecContext(challenge); !errors.Is(err, ntlm.ErrDatagramNotNegotiated) {
+		t.Fatalf("AcceptSecContext() returned %v, expected %v", err, ntlm.ErrDatagramNotNegotiated)
+	}
+}
+
+// MS-NLMP 4.2.4.2.1
+func TestLMv2Response(t *testing.T) {
+	provider := ntlm.NtlmProvider{
+		User:            "User",
+		Domain:          "Domain",
+		Password:        "Password",
+		AllowLMResponse: true,
+		ServerChallenge: decodeHex(t, "0123456789abcdef"),
+		ClientChallenge: decodeHex(t, "aaaaaaaaaaaaaaaa"),
+		TargetInfo:      &ntlm.TargetInformation{},
+	}
+
+	lm, err := provider.NewLMChallengeResponse()
+	if err != nil {
+		t.Fatalf("NewLMChallengeResponse() failed: %v", err)
+	}
+	if !bytes.Equal(lm, decodeHex(t, "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa")) {
+		t.Fatalf("LMv2 response is incorrect: %x", lm)
+	}
+
+	provider.AllowLMResponse = false
+	if lm, err = provider.NewLMChallengeResponse(); err != nil {
+		t.Fatalf("NewLMChallengeResponse() failed: %v", err)
+	}
+	if !bytes.Equal(lm, make([]byte, 24)) {
+		t.Fatalf("LMv2 response should be zeroed when not allowed: %x", lm)
+	}
+}
+
+func TestLMv2ResponseWithTimestamp(t *testing.T) {
+	provider := ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	_, _, auth, _ := authenticate(t, &provider, testChallenge)
+
+	// 12-20: LmChallengeResponseFields
+	length := binary.LittleEndian.Uint16(auth[12:14])
+	offset := binary.LittleEndian.Uint32(auth[16:20])
+	if lm := auth[offset : offset+uint32(length)]; !bytes.Equal(lm, make([]byte, 24)) {
+		t.Fatalf("LMv2 response should be Z(24) when the server sends a timestamp: %x", lm)
+	}
+
+	provider = ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", AllowLMResponse: true}
+	_, _, auth, _ = authenticate(t, &provider, testChallengeWithoutTimestamp)
+	offset = binary.LittleEndian.Uint32(auth[16:20])
+	if lm := auth[offset : offset+24]; bytes.Equal(lm, make([]byte, 24)) || !bytes.Equal(lm[16:], provider.ClientChallenge) {
+		t.Fatalf("LMv2 response should be sent without a server timestamp: %x", lm)
+	}
+}
+
+func TestString(t *testing.T) {
+	provider := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Workstation: "COMPUTER", Password: "S3cretPassw0rd"}
+	authenticate(t, provider, testChallenge)
+
+	for _, out := range []string{provider.String(), fmt.Sprint(provider), fmt.Sprintf("%+v", provider), fmt.Sprintf("%#v", provider)} {
+		for _, expected := range []string{`User: "User"`, `Domain: "Domain"`, `Workstation: "COMPUTER"`, "State: Authenticated", "Password: [redacted]", "SessionKey: [redacted]"} {
+			if !strings.Contains(out, expected) {
+				t.Fatalf("String() = %s, expected it to contain %s", out, expected)
+			}
+		}
+
+		if strings.Contains(out, provider.Password) {
+			t.Fatalf("String() leaks the password: %s", out)
+		}
+		for _, secret := range [][]byte{
+			ntlm.NTOWFv1(provider.Password),
+			provider.SessionBaseKey,
+			provider.ExportedSessionKey,
+			provider.ClientSigningKey,
+			provider.ServerSigningKey,
+			provider.ClientSealingKey,
+			provider.ServerSealingKey,
+		} {
+			if strings.Contains(out, hex.EncodeToString(secret)) || strings.Contains(out, string(secret)) || strings.Contains(out, fmt.Sprint(secret)) {
+				t.Fatalf("String() leaks secret bytes: %s", out)
+			}
+		}
+	}
+
+	if out := (&ntlm.NtlmProvider{User: "User", Hash: ntlm.NTOWFv1("Password")}).String(); !strings.Contains(out, "Hash: [redacted]") || !strings.Contains(out, "State: Initial") {
+		t.Fatalf("String() = %s", out)
+	}
+}
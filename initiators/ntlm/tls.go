@@ -0,0 +1,38 @@
+package ntlm
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// tlsServerEndPointPrefix starts the application data of the tls-server-end-point bindings
+const tlsServerEndPointPrefix = "tls-server-end-point:"
+
+// TLSServerEndPoint returns the application data of the tls-server-end-point channel
+// bindings (RFC 5929 4.1) of the connection, to be set as ChannelBinding: the prefix
+// followed by the hash of the server certificate. It is the binding checked by the
+// servers enforcing Extended Protection for Authentication, e.g. IIS and LDAPS
+func TLSServerEndPoint(state *tls.ConnectionState) ([]byte, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil, errors.New("no server certificate in the TLS connection state")
+	}
+	cert := state.PeerCertificates[0]
+
+	// The hash of the signature of the certificate, SHA-256 replacing MD5 and SHA-1
+	hash := crypto.SHA256
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		hash = crypto.SHA512
+	}
+
+	h := hash.New()
+	h.Write(cert.Raw)
+	return h.Sum([]byte(tlsServerEndPointPrefix)), nil
+}
@@ -0,0 +1,38 @@
+package ntlm_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+func TestTLSServerEndPoint(t *testing.T) {
+	raw := []byte("certificate")
+	sha256Hash, sha384Hash := sha256.Sum256(raw), sha512.Sum384(raw)
+	for _, tc := range []struct {
+		algorithm x509.SignatureAlgorithm
+		hash      []byte
+	}{
+		{x509.SHA1WithRSA, sha256Hash[:]}, // SHA-1 is replaced by SHA-256
+		{x509.SHA256WithRSA, sha256Hash[:]},
+		{x509.ECDSAWithSHA384, sha384Hash[:]},
+	} {
+		state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: raw, SignatureAlgorithm: tc.algorithm}}}
+		data, err := ntlm.TLSServerEndPoint(state)
+		if err != nil {
+			t.Fatalf("%v: TLSServerEndPoint() failed: %v", tc.algorithm, err)
+		}
+		if expected := append([]byte("tls-server-end-point:"), tc.hash...); !bytes.Equal(data, expected) {
+			t.Fatalf("%v: application data is %x, expected %x", tc.algorithm, data, expected)
+		}
+	}
+
+	if _, err := ntlm.TLSServerEndPoint(&tls.ConnectionState{}); err == nil {
+		t.Fatalf("TLSServerEndPoint() should fail without a server certificate")
+	}
+}
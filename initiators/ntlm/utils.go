@@ -47,3 +47,16 @@ func growSlice(in []byte, n int) (head, tail []byte) {
 	tail = head[len(in):]
 	return
 }
+
+// toOEM encodes the string in the OEM character set. The code page of the
+// server is unknown, so only ASCII is kept and other characters become '?'
+func toOEM(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0x7f {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	return b
+}
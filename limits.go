@@ -0,0 +1,37 @@
+package spnego
+
+import "strconv"
+
+// TokenLimits bound the tokens accepted by the parsers, a zero field disables its limit
+type TokenLimits struct {
+	MaxTokenLength int // Bytes of a SPNEGO, GSS-API or NEGOEX token
+	MaxMechTypes   int // Mechanisms offered in a NegTokenInit or in a NEGOEX NEGO_MESSAGE
+}
+
+// Limits are enforced by the parsers of the package, so that the tokens received from
+// untrusted networks are rejected with a *LimitError before being decoded. They are read
+// on every token and should be set before the first negotiation. The NTLM messages are
+// bounded by ntlm.Limits
+var Limits = TokenLimits{
+	MaxTokenLength: 64 << 10,
+	MaxMechTypes:   32,
+}
+
+// LimitError is returned by the parsers when a token is over one of the Limits
+type LimitError struct {
+	Limit string // Name of the TokenLimits field
+	Value int
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return strconv.Itoa(e.Value) + " is over " + e.Limit + " of " + strconv.Itoa(e.Max)
+}
+
+// checkLimit returns a *LimitError if the value is over the limit
+func checkLimit(name string, value, limit int) error {
+	if limit > 0 && value > limit {
+		return &LimitError{Limit: name, Value: value, Max: limit}
+	}
+	return nil
+}
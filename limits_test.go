@@ -0,0 +1,62 @@
+package spnego_test
+
+import (
+	"encoding/asn1"
+	"errors"
+	"testing"
+
+	"github.com/msultra/spnego"
+)
+
+func TestLimits(t *testing.T) {
+	defaults := spnego.Limits
+	defer func() { spnego.Limits = defaults }()
+
+	mechTypes := make([]asn1.ObjectIdentifier, defaults.MaxMechTypes+1)
+	for i := range mechTypes {
+		mechTypes[i] = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10, i}
+	}
+	init, err := spnego.EncodeNegTokenInitGeneric(spnego.NegTokenInit{MechTypes: mechTypes})
+	if err != nil {
+		t.Fatalf("EncodeNegTokenInitGeneric() failed: %v", err)
+	}
+	resp, err := spnego.EncodeNegTokenResp(spnego.NegTokenResp{NegState: spnego.AcceptIncomplete, ResponseToken: make([]byte, defaults.MaxTokenLength)})
+	if err != nil {
+		t.Fatalf("EncodeNegTokenResp() failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		limit string
+		parse func() error
+	}{
+		{"NegTokenInit", "MaxMechTypes", func() error { _, err := spnego.UnwrapInitialToken(init); return err }},
+		{"NegTokenInit2", "MaxMechTypes", func() error { _, err := spnego.UnwrapInitialToken2(init); return err }},
+		{"NegTokenResp", "MaxTokenLength", func() error { _, err := spnego.ParseResponseToken(resp); return err }},
+		{"InitialContextToken", "MaxTokenLength", func() error {
+			_, _, err := spnego.UnwrapGSSToken(gssToken(t, spnego.KerberosOID, make([]byte, defaults.MaxTokenLength)))
+			return err
+		}},
+		{"NEGOEX", "MaxTokenLength", func() error {
+			_, err := spnego.ParseNegoexMessages(append(negoexToken(), make([]byte, defaults.MaxTokenLength)...))
+			return err
+		}},
+		{"SPNEGOServer", "MaxMechTypes", func() error {
+			_, err := spnego.NewSPNEGOServer([]spnego.Acceptor{&fakeAcceptor{fakeInitiator{oid: spnego.NtlmOID}}}).AcceptSecContext(init)
+			return err
+		}},
+	} {
+		var limitErr *spnego.LimitError
+		if err := tc.parse(); !errors.As(err, &limitErr) || limitErr.Limit != tc.limit {
+			t.Fatalf("%s: error = %v, want a LimitError of %s", tc.name, err, tc.limit)
+		}
+	}
+
+	spnego.Limits = spnego.TokenLimits{}
+	if _, err := spnego.UnwrapInitialToken(init); err != nil {
+		t.Fatalf("UnwrapInitialToken() without limits failed: %v", err)
+	}
+	if _, err := spnego.ParseResponseToken(resp); err != nil {
+		t.Fatalf("ParseResponseToken() without limits failed: %v", err)
+	}
+}
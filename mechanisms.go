@@ -0,0 +1,156 @@
+package spnego
+
+import (
+	"encoding/asn1"
+	"errors"
+	"sync"
+)
+
+// mechanismNames maps the built-in mechanism OIDs to their names
+var mechanismNames = map[string]string{
+	SpnegoOID.String():     "SPNEGO",
+	KerberosOID.String():   "Kerberos 5",
+	MsKerberosOid.String(): "MS Kerberos 5",
+	NegotiateOID.String():  "NEGOEX",
+	NtlmOID.String():       "NTLM",
+}
+
+// MechanismName returns a human readable name for the mechanism OID,
+// or its dotted representation if the mechanism is unknown
+func MechanismName(oid asn1.ObjectIdentifier) string {
+	if name, ok := mechanismNames[oid.String()]; ok {
+		return name
+	}
+	return oid.String()
+}
+
+// MechanismFactory creates a new Initiator for a mechanism
+type MechanismFactory func() Initiator
+
+// AcceptorFactory creates a new Acceptor for a mechanism
+type AcceptorFactory func() Acceptor
+
+// registry holds the mechanisms registered with RegisterMechanism and RegisterAcceptor,
+// in order of preference
+var registry struct {
+	sync.RWMutex
+	oids      []asn1.ObjectIdentifier
+	factories map[string]MechanismFactory
+
+	acceptorOIDs []asn1.ObjectIdentifier
+	acceptors    map[string]AcceptorFactory
+
+	importers map[string]ContextImporter
+}
+
+// RegisterMechanism makes a mechanism available to NewMechanism and SupportedMechanisms.
+// Mechanisms registered first are preferred, registering an OID again replaces its factory
+func RegisterMechanism(oid asn1.ObjectIdentifier, factory MechanismFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if registry.factories == nil {
+		registry.factories = make(map[string]MechanismFactory)
+	}
+	if _, ok := registry.factories[oid.String()]; !ok {
+		registry.oids = append(registry.oids, oid)
+	}
+	registry.factories[oid.String()] = factory
+}
+
+// SupportedMechanisms returns the OIDs of the registered mechanisms, the preferred one first
+func SupportedMechanisms() []asn1.ObjectIdentifier {
+	registry.RLock()
+	defer registry.RUnlock()
+	return append([]asn1.ObjectIdentifier(nil), registry.oids...)
+}
+
+// NewMechanism creates an Initiator with the factory registered for the OID
+func NewMechanism(oid asn1.ObjectIdentifier) (Initiator, error) {
+	registry.RLock()
+	factory, ok := registry.factories[oid.String()]
+	registry.RUnlock()
+
+	if !ok {
+		return nil, errors.New("unsupported mechanism: " + MechanismName(oid))
+	}
+	return factory(), nil
+}
+
+// PreferredMechanism returns the first registered mechanism offered in mechTypes
+func PreferredMechanism(mechTypes []asn1.ObjectIdentifier) (asn1.ObjectIdentifier, error) {
+	for _, supported := range SupportedMechanisms() {
+		for _, offered := range mechTypes {
+			if supported.Equal(offered) {
+				return supported, nil
+			}
+		}
+	}
+	return nil, errors.New("no supported mechanism offered")
+}
+
+// NewRegisteredSPNEGOClient creates a SPNEGO client offering all the registered mechanisms
+func NewRegisteredSPNEGOClient() (*SPNEGOClient, error) {
+	var mechs []Initiator
+	for _, oid := range SupportedMechanisms() {
+		mech, err := NewMechanism(oid)
+		if err != nil {
+			return nil, err
+		}
+		mechs = append(mechs, mech)
+	}
+	if len(mechs) == 0 {
+		return nil, errors.New("no mechanisms registered")
+	}
+	return NewSPNEGOClient(mechs), nil
+}
+
+// RegisterAcceptor makes the acceptor side of a mechanism available to NewAcceptor and
+// NewRegisteredSPNEGOServer, with the same rules as RegisterMechanism
+func RegisterAcceptor(oid asn1.ObjectIdentifier, factory AcceptorFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if registry.acceptors == nil {
+		registry.acceptors = make(map[string]AcceptorFactory)
+	}
+	if _, ok := registry.acceptors[oid.String()]; !ok {
+		registry.acceptorOIDs = append(registry.acceptorOIDs, oid)
+	}
+	registry.acceptors[oid.String()] = factory
+}
+
+// SupportedAcceptors returns the OIDs of the registered acceptors, the preferred one first
+func SupportedAcceptors() []asn1.ObjectIdentifier {
+	registry.RLock()
+	defer registry.RUnlock()
+	return append([]asn1.ObjectIdentifier(nil), registry.acceptorOIDs...)
+}
+
+// NewAcceptor creates an Acceptor with the factory registered for the OID
+func NewAcceptor(oid asn1.ObjectIdentifier) (Acceptor, error) {
+	registry.RLock()
+	factory, ok := registry.acceptors[oid.String()]
+	registry.RUnlock()
+
+	if !ok {
+		return nil, errors.New("unsupported acceptor mechanism: " + MechanismName(oid))
+	}
+	return factory(), nil
+}
+
+// NewRegisteredSPNEGOServer creates a SPNEGO server accepting all the registered acceptors
+func NewRegisteredSPNEGOServer() (*SPNEGOServer, error) {
+	var mechs []Acceptor
+	for _, oid := range SupportedAcceptors() {
+		mech, err := NewAcceptor(oid)
+		if err != nil {
+			return nil, err
+		}
+		mechs = append(mechs, mech)
+	}
+	if len(mechs) == 0 {
+		return nil, errors.New("no acceptors registered")
+	}
+	return NewSPNEGOServer(mechs), nil
+}
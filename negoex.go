@@ -0,0 +1,191 @@
+package spnego
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// NegoexSignature starts every NEGOEX message, "NEGOEXTS" (MS-NEGOEX 2.2.6.2)
+var NegoexSignature = [8]byte{'N', 'E', 'G', 'O', 'E', 'X', 'T', 'S'}
+
+// NEGOEX message types (MS-NEGOEX 2.2.6.1)
+const (
+	NegoexInitiatorNego     = 0
+	NegoexAcceptorNego      = 1
+	NegoexInitiatorMetaData = 2
+	NegoexAcceptorMetaData  = 3
+	NegoexChallenge         = 4
+	NegoexAPRequest         = 5
+	NegoexVerify            = 6
+	NegoexAlert             = 7
+)
+
+// negoexHeaderLen is the size of the MESSAGE_HEADER
+const negoexHeaderLen = 40
+
+// NegoexMessage is a message of a NEGOEX token. Only the fields of its type are set
+type NegoexMessage struct {
+	Type           uint32
+	SequenceNum    uint32
+	ConversationID [16]byte
+
+	// NEGO_MESSAGE
+	Random          [32]byte
+	ProtocolVersion uint64
+	AuthSchemes     [][16]byte // Offered security mechanisms, the preferred one first
+
+	// EXCHANGE_MESSAGE, VERIFY_MESSAGE and ALERT_MESSAGE
+	AuthScheme [16]byte
+
+	// EXCHANGE_MESSAGE: the metadata or the token of the security mechanism
+	Exchange []byte
+
+	// VERIFY_MESSAGE
+	ChecksumType uint32
+	Checksum     []byte
+
+	// ALERT_MESSAGE
+	ErrorCode uint32
+
+	// Raw is the whole message, the VERIFY_MESSAGE checksums the messages of the conversation
+	Raw []byte
+}
+
+// IsNegoexToken reports whether the mechanism token is a NEGOEX token. Windows clients
+// offer NEGOEX first, so the optimistic token of their NegTokenInit is often one
+func IsNegoexToken(token []byte) bool {
+	return len(token) >= negoexHeaderLen && bytes.Equal(token[:8], NegoexSignature[:])
+}
+
+// ParseNegoexMessages decodes the messages of a NEGOEX token
+func ParseNegoexMessages(token []byte) ([]NegoexMessage, error) {
+	if err := checkLimit("MaxTokenLength", len(token), Limits.MaxTokenLength); err != nil {
+		return nil, err
+	}
+
+	var msgs []NegoexMessage
+	for len(token) > 0 {
+		//        MESSAGE_HEADER
+		//   0-8: Signature
+		//  8-12: MessageType
+		// 12-16: SequenceNum
+		// 16-20: cbHeaderLength
+		// 20-24: cbMessageLength
+		// 24-40: ConversationId
+		if !IsNegoexToken(token) {
+			return nil, errors.New("invalid NEGOEX message header")
+		}
+		headerLen := binary.LittleEndian.Uint32(token[16:20])
+		msgLen := binary.LittleEndian.Uint32(token[20:24])
+		if headerLen < negoexHeaderLen || headerLen > msgLen || uint64(msgLen) > uint64(len(token)) {
+			return nil, errors.New("NEGOEX message is truncated")
+		}
+
+		raw := token[:msgLen]
+		msg := NegoexMessage{
+			Type:           binary.LittleEndian.Uint32(raw[8:12]),
+			SequenceNum:    binary.LittleEndian.Uint32(raw[12:16]),
+			ConversationID: [16]byte(raw[24:40]),
+			Raw:            raw,
+		}
+		if err := msg.decode(raw[:headerLen]); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+		token = token[msgLen:]
+	}
+	return msgs, nil
+}
+
+// decode reads the fields following the MESSAGE_HEADER, the vectors point into Raw
+func (m *NegoexMessage) decode(header []byte) error {
+	switch m.Type {
+	case NegoexInitiatorNego, NegoexAcceptorNego:
+		//        NEGO_MESSAGE
+		// 40-72: Random
+		// 72-80: ProtocolVersion
+		// 80-88: AuthSchemes
+		// 88-96: Extensions
+		if len(header) < 96 {
+			return errors.New("NEGOEX NEGO_MESSAGE is truncated")
+		}
+		m.Random = [32]byte(header[40:72])
+		m.ProtocolVersion = binary.LittleEndian.Uint64(header[72:80])
+		schemes, err := m.vector(header[80:], 16, 2)
+		if err != nil {
+			return err
+		}
+		if err := checkLimit("MaxMechTypes", len(schemes)/16, Limits.MaxMechTypes); err != nil {
+			return err
+		}
+		for i := 0; i < len(schemes); i += 16 {
+			m.AuthSchemes = append(m.AuthSchemes, [16]byte(schemes[i:i+16]))
+		}
+
+	case NegoexInitiatorMetaData, NegoexAcceptorMetaData, NegoexChallenge, NegoexAPRequest:
+		//        EXCHANGE_MESSAGE
+		// 40-56: AuthScheme
+		// 56-64: Exchange
+		if len(header) < 64 {
+			return errors.New("NEGOEX EXCHANGE_MESSAGE is truncated")
+		}
+		m.AuthScheme = [16]byte(header[40:56])
+		exchange, err := m.vector(header[56:], 1, 4)
+		if err != nil {
+			return err
+		}
+		m.Exchange = exchange
+
+	case NegoexVerify:
+		//        VERIFY_MESSAGE
+		// 40-56: AuthScheme
+		// 56-60: Checksum cbHeaderLength
+		// 60-64: ChecksumScheme
+		// 64-68: ChecksumType
+		// 68-76: ChecksumValue
+		if len(header) < 76 {
+			return errors.New("NEGOEX VERIFY_MESSAGE is truncated")
+		}
+		m.AuthScheme = [16]byte(header[40:56])
+		m.ChecksumType = binary.LittleEndian.Uint32(header[64:68])
+		checksum, err := m.vector(header[68:], 1, 4)
+		if err != nil {
+			return err
+		}
+		m.Checksum = checksum
+
+	case NegoexAlert:
+		//        ALERT_MESSAGE
+		// 40-56: AuthScheme
+		// 56-60: ErrorCode
+		if len(header) < 60 {
+			return errors.New("NEGOEX ALERT_MESSAGE is truncated")
+		}
+		m.AuthScheme = [16]byte(header[40:56])
+		m.ErrorCode = binary.LittleEndian.Uint32(header[56:60])
+
+	default:
+		return errors.New("unknown NEGOEX message type: " + strconv.Itoa(int(m.Type)))
+	}
+	return nil
+}
+
+// vector extracts the elements of a vector whose offset is relative to the message.
+// The offset is followed by the count, on countLen bytes
+func (m *NegoexMessage) vector(field []byte, elemLen, countLen int) ([]byte, error) {
+	offset := uint64(binary.LittleEndian.Uint32(field[:4]))
+	var count uint64
+	if countLen == 2 {
+		count = uint64(binary.LittleEndian.Uint16(field[4:6]))
+	} else {
+		count = uint64(binary.LittleEndian.Uint32(field[4:8]))
+	}
+
+	end := offset + count*uint64(elemLen)
+	if end > uint64(len(m.Raw)) {
+		return nil, errors.New("NEGOEX vector is out of bounds")
+	}
+	return m.Raw[offset:end], nil
+}
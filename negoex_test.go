@@ -0,0 +1,94 @@
+package spnego_test
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"testing"
+
+	"github.com/msultra/spnego"
+	"github.com/msultra/spnego/initiators/ntlm"
+)
+
+// negoexMessage builds a NEGOEX message with the given fields after the header and payload
+func negoexMessage(msgType, seq uint32, fields func(headerLen uint32) []byte, payload []byte) []byte {
+	headerLen := uint32(40 + len(fields(0)))
+	msg := append([]byte(nil), spnego.NegoexSignature[:]...)
+	msg = binary.LittleEndian.AppendUint32(msg, msgType)
+	msg = binary.LittleEndian.AppendUint32(msg, seq)
+	msg = binary.LittleEndian.AppendUint32(msg, headerLen)
+	msg = binary.LittleEndian.AppendUint32(msg, headerLen+uint32(len(payload)))
+	msg = append(msg, bytes.Repeat([]byte{0xc0}, 16)...)
+	msg = append(msg, fields(headerLen)...)
+	return append(msg, payload...)
+}
+
+func negoexToken() []byte {
+	scheme := bytes.Repeat([]byte{0x5c}, 16)
+	nego := negoexMessage(spnego.NegoexInitiatorNego, 0, func(offset uint32) []byte {
+		b := append(bytes.Repeat([]byte{0x42}, 32), 0, 0, 0, 0, 0, 0, 0, 0)
+		b = binary.LittleEndian.AppendUint32(b, offset)
+		b = append(b, 1, 0, 0, 0)
+		return append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	}, scheme)
+	apReq := negoexMessage(spnego.NegoexAPRequest, 1, func(offset uint32) []byte {
+		b := append([]byte(nil), scheme...)
+		b = binary.LittleEndian.AppendUint32(b, offset)
+		return binary.LittleEndian.AppendUint32(b, 6)
+	}, []byte("ap-req"))
+	return append(nego, apReq...)
+}
+
+func TestParseNegoexMessages(t *testing.T) {
+	token := negoexToken()
+	if !spnego.IsNegoexToken(token) {
+		t.Fatalf("IsNegoexToken() should detect the NEGOEX token")
+	}
+
+	msgs, err := spnego.ParseNegoexMessages(token)
+	if err != nil {
+		t.Fatalf("ParseNegoexMessages() failed: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if msgs[0].Type != spnego.NegoexInitiatorNego || len(msgs[0].AuthSchemes) != 1 || msgs[0].AuthSchemes[0][0] != 0x5c {
+		t.Fatalf("invalid NEGO_MESSAGE: %+v", msgs[0])
+	}
+	if msgs[1].Type != spnego.NegoexAPRequest || msgs[1].SequenceNum != 1 || string(msgs[1].Exchange) != "ap-req" {
+		t.Fatalf("invalid EXCHANGE_MESSAGE: %+v", msgs[1])
+	}
+	if !bytes.Equal(append(msgs[0].Raw, msgs[1].Raw...), token) {
+		t.Fatalf("raw messages should cover the token")
+	}
+
+	for _, invalid := range [][]byte{
+		token[:len(token)-1],
+		token[:39],
+		append([]byte("NEGOEXTX"), token[8:]...),
+	} {
+		if _, err := spnego.ParseNegoexMessages(invalid); err == nil {
+			t.Fatalf("ParseNegoexMessages() should fail for %x", invalid)
+		}
+	}
+}
+
+func TestSPNEGOServerSkipsNegoex(t *testing.T) {
+	server := spnego.NewSPNEGOServer([]spnego.Acceptor{ntlm.NewAcceptor(&ntlm.NtlmProvider{User: "User", Password: "Password"})})
+	init, err := spnego.EncodeNegTokenInit([]asn1.ObjectIdentifier{spnego.NegotiateOID, spnego.NtlmOID}, negoexToken())
+	if err != nil {
+		t.Fatalf("EncodeNegTokenInit() failed: %v", err)
+	}
+
+	bs, err := server.AcceptSecContext(init)
+	if err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+	resp, err := spnego.ParseResponseToken(bs)
+	if err != nil {
+		t.Fatalf("ParseResponseToken() failed: %v", err)
+	}
+	if !resp.SupportedMech.Equal(spnego.NtlmOID) || len(resp.ResponseToken) != 0 || resp.NegState != spnego.RequestMIC {
+		t.Fatalf("NTLM should be selected without using the NEGOEX token, got %+v", resp)
+	}
+}
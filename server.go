@@ -0,0 +1,413 @@
+package spnego
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// Acceptor is the server side of an authentication mechanism that can be negotiated
+// with SPNEGO, e.g. ntlm.Acceptor
+type Acceptor interface {
+	GetOID() asn1.ObjectIdentifier              // Mechanism OID selected in supportedMech
+	AcceptSecContext(sc []byte) ([]byte, error) // GSS_Accept_sec_context
+	GetMIC(bs []byte) ([]byte, error)           // GSS_getMIC
+	VerifyMIC(bs, mic []byte) error             // GSS_verifyMIC
+	SessionKey() []byte                         // QueryContextAttributes(ctx, SECPKG_ATTR_SESSION_KEY, &out)
+	IsEstablished() bool                        // GSS_Inquire_context(ctx, ..., &open)
+}
+
+// SPNEGOServer handles the acceptor side of the SPNEGO negotiation
+type SPNEGOServer struct {
+	Mechanisms   []Acceptor
+	MechTypes    []asn1.ObjectIdentifier // Offered by the initiator
+	SelectedMech Acceptor
+
+	// SelectMechanism overrides the selection of the mechanism from the offer of the
+	// initiator, see MechanismSelector. By default the first supported one is selected
+	SelectMechanism MechanismSelector
+
+	// Strict rejects the tokens of the initiator which are not DER encoded
+	Strict bool
+
+	// Compatibility toggles the handling of the Microsoft deviations from RFC 4178
+	Compatibility Compatibility
+
+	// RequireMechListMIC fails the negotiation if the initiator does not send the
+	// mechListMIC, even if its preferred mechanism was selected
+	RequireMechListMIC bool
+
+	// MaxTokenSize is the largest NegTokenResp the transport can carry, 0 for no limit.
+	// A larger responseToken is split over several accept-incomplete legs, each answered by
+	// an empty NegTokenResp of the initiator, which reassembles it, see SPNEGOClient. Only
+	// the tokens with the GSS-API framing, e.g. of Kerberos, can be split: the others fail
+	// the handshake with ErrTokenTooLarge
+	MaxTokenSize int
+
+	// The initiator sent bare mechanism tokens, see SPNEGOClient.Raw
+	raw bool
+
+	// The mechanism completed in the first leg and request-mic was sent for the
+	// missing mechListMIC of the initiator
+	awaitingMIC bool
+
+	// NegTokenResp fragments of the responseToken which are still to be sent
+	fragments [][]byte
+}
+
+// ErrTokenTooLarge is returned when a NegTokenResp is over SPNEGOServer.MaxTokenSize and
+// its responseToken cannot be fragmented
+var ErrTokenTooLarge = errors.New("NegTokenResp exceeds MaxTokenSize")
+
+// MechanismSelector picks the mechanism of the negotiation among the mechTypes offered by
+// the initiator, in its order of preference, e.g. to only allow Kerberos from some networks.
+// The returned OID must be offered and one of the mechanisms of the server, an error
+// rejects the negotiation
+type MechanismSelector func(offered []asn1.ObjectIdentifier) (asn1.ObjectIdentifier, error)
+
+// NewSPNEGOServer creates a new SPNEGO server with the given mechanisms
+func NewSPNEGOServer(mechs []Acceptor) *SPNEGOServer {
+	return &SPNEGOServer{Mechanisms: mechs}
+}
+
+func (s *SPNEGOServer) GetOID() asn1.ObjectIdentifier {
+	return SpnegoOID
+}
+
+// GetMIC generates a Message Integrity Code with the selected mechanism
+func (s *SPNEGOServer) GetMIC(bs []byte) ([]byte, error) {
+	if s.SelectedMech == nil {
+		return nil, errors.New("no mechanism selected")
+	}
+	return s.SelectedMech.GetMIC(bs)
+}
+
+// VerifyMIC checks a Message Integrity Code with the selected mechanism
+func (s *SPNEGOServer) VerifyMIC(bs, mic []byte) error {
+	if s.SelectedMech == nil {
+		return errors.New("no mechanism selected")
+	}
+	return s.SelectedMech.VerifyMIC(bs, mic)
+}
+
+// SessionKey returns the session key established by the selected mechanism
+func (s *SPNEGOServer) SessionKey() []byte {
+	if s.SelectedMech == nil {
+		return nil
+	}
+	return s.SelectedMech.SessionKey()
+}
+
+// IsEstablished reports whether the selected mechanism completed its handshake, the
+// mechListMIC requested from the initiator, if any, was received and the fragments of
+// the last responseToken were all sent
+func (s *SPNEGOServer) IsEstablished() bool {
+	return s.SelectedMech != nil && s.SelectedMech.IsEstablished() && !s.awaitingMIC && len(s.fragments) == 0
+}
+
+// InitialToken generates the NegTokenInit2 listing the mechanisms of the server, sent
+// before the initiator speaks, e.g. as the security blob of the SMB2 NEGOTIATE response.
+// With CompatRFC4178, it is a NegTokenInit without negHints
+func (s *SPNEGOServer) InitialToken() ([]byte, error) {
+	if len(s.Mechanisms) == 0 {
+		return nil, errors.New("no mechanisms available")
+	}
+	mechTypes := make([]asn1.ObjectIdentifier, len(s.Mechanisms))
+	for i, mech := range s.Mechanisms {
+		mechTypes[i] = mech.GetOID()
+	}
+	if s.Compatibility != CompatMicrosoft {
+		return EncodeNegTokenInitGeneric(NegTokenInit{MechTypes: mechTypes})
+	}
+	return EncodeNegTokenInit2(mechTypes)
+}
+
+// AcceptSecContext processes a token of the initiator and returns the NegTokenResp to
+// send back. The first token is the InitialContextToken: the first offered mechanism
+// which is supported is selected, and its optimistic token is only used if it is the
+// preferred one of the initiator. Then the response tokens are handed to the selected
+// mechanism until it completes, the final NegTokenResp carrying the mechListMIC.
+// A bare NTLM or Kerberos first token selects its mechanism without SPNEGO framing.
+// The NegTokenResp over MaxTokenSize are sent in fragments, one per leg
+func (s *SPNEGOServer) AcceptSecContext(sc []byte) ([]byte, error) {
+	if len(s.fragments) > 0 {
+		return s.nextFragment(sc)
+	}
+	token, err := s.acceptSecContext(sc)
+	if err != nil {
+		return nil, err
+	}
+	if s.MaxTokenSize > 0 && len(token) > s.MaxTokenSize {
+		return s.fragment(token)
+	}
+	return token, nil
+}
+
+// fragment splits the responseToken of the NegTokenResp in accept-incomplete NegTokenResp
+// of at most MaxTokenSize bytes, the last one carrying the negState and mechListMIC.
+// The first fragment is returned, the others are sent by nextFragment
+func (s *SPNEGOServer) fragment(token []byte) ([]byte, error) {
+	tooLarge := fmt.Errorf("%w: %d bytes for %d", ErrTokenTooLarge, len(token), s.MaxTokenSize)
+	if s.raw {
+		return nil, tooLarge
+	}
+	resp, err := ParseResponseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	// The initiator detects the missing fragments from the length of the GSS-API token
+	if length, ok := gssTokenLength(resp.ResponseToken); !ok || length != len(resp.ResponseToken) {
+		return nil, tooLarge
+	}
+
+	var fragments [][]byte
+	header, rest := NegTokenResp{NegState: AcceptIncomplete, SupportedMech: resp.SupportedMech}, resp.ResponseToken
+	for {
+		last := *resp
+		last.SupportedMech, last.ResponseToken = header.SupportedMech, rest
+		if b, err := EncodeNegTokenResp(last); err != nil {
+			return nil, err
+		} else if len(b) <= s.MaxTokenSize {
+			fragments = append(fragments, b)
+			break
+		}
+
+		b, n, err := s.fitFragment(header, rest)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, tooLarge
+		}
+		fragments, rest, header.SupportedMech = append(fragments, b), rest[n:], nil
+	}
+	s.fragments = fragments[1:]
+	return fragments[0], nil
+}
+
+// fitFragment encodes the NegTokenResp with the largest prefix of data fitting in MaxTokenSize,
+// returning the number of bytes of data it carries
+func (s *SPNEGOServer) fitFragment(header NegTokenResp, data []byte) ([]byte, int, error) {
+	for n := min(len(data), s.MaxTokenSize); n > 0; {
+		header.ResponseToken = data[:n]
+		b, err := EncodeNegTokenResp(header)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(b) <= s.MaxTokenSize {
+			return b, n, nil
+		}
+		n -= len(b) - s.MaxTokenSize
+	}
+	return nil, 0, nil
+}
+
+// nextFragment answers the empty NegTokenResp of the initiator with the next fragment
+func (s *SPNEGOServer) nextFragment(sc []byte) ([]byte, error) {
+	parse := ParseResponseToken
+	if s.Strict {
+		parse = ParseResponseTokenStrict
+	}
+	resp, err := parse(sc)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	if len(resp.ResponseToken) > 0 || len(resp.MechListMIC) > 0 {
+		return nil, errors.New("initiator sent a token before receiving all the fragments of the responseToken")
+	}
+	token := s.fragments[0]
+	s.fragments = s.fragments[1:]
+	return token, nil
+}
+
+func (s *SPNEGOServer) acceptSecContext(sc []byte) ([]byte, error) {
+	if s.IsEstablished() {
+		return nil, errors.New("security context already established")
+	}
+
+	unwrap, parse := UnwrapInitialToken, ParseResponseToken
+	if s.Strict {
+		unwrap, parse = UnwrapInitialTokenStrict, ParseResponseTokenStrict
+	}
+
+	if s.raw {
+		return s.SelectedMech.AcceptSecContext(sc)
+	}
+	if s.SelectedMech == nil && DetectTokenType(sc) != TokenSPNEGOInit {
+		return s.acceptRaw(sc)
+	}
+
+	if s.SelectedMech == nil {
+		init, err := unwrap(sc)
+		if err != nil {
+			return nil, err
+		}
+		return s.selectMechanism(init)
+	}
+
+	resp, err := parse(sc)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	if s.awaitingMIC {
+		s.awaitingMIC = false
+		return s.complete(nil, resp.MechListMIC, nil)
+	}
+	return s.accept(resp.ResponseToken, resp.MechListMIC, false)
+}
+
+// rawMechanisms are the mechanisms accepted without the SPNEGO framing, by token type
+var rawMechanisms = map[TokenType][]asn1.ObjectIdentifier{
+	TokenNTLMSSP:     {NtlmOID},
+	TokenKerberos:    {KerberosOID, MsKerberosOid},
+	TokenKerberosRaw: {KerberosOID, MsKerberosOid},
+}
+
+// acceptRaw selects the mechanism of a bare mechanism token, like Windows servers do when
+// the client skips SPNEGO. The next tokens are handed to the mechanism as they are
+func (s *SPNEGOServer) acceptRaw(sc []byte) ([]byte, error) {
+	for _, oid := range rawMechanisms[DetectTokenType(sc)] {
+		for _, mech := range s.Mechanisms {
+			if mech.GetOID().Equal(oid) {
+				s.SelectedMech, s.raw = mech, true
+				return mech.AcceptSecContext(sc)
+			}
+		}
+	}
+	return nil, errors.New("not a SPNEGO token nor a token of a supported mechanism")
+}
+
+// selectMechanism picks the mechanism of the negotiation from the NegTokenInit
+func (s *SPNEGOServer) selectMechanism(init *NegTokenInit) ([]byte, error) {
+	i, mech, err := s.choose(init.MechTypes)
+	if err != nil {
+		return nil, err
+	}
+	s.MechTypes, s.SelectedMech = init.MechTypes, mech
+
+	// RFC 4178 5: the mechListMIC is requested in the first reply when the preferred
+	// mechanism of the initiator is not the selected one
+	negState := asn1.Enumerated(AcceptIncomplete)
+	if s.needsMIC() && len(init.MechListMIC) == 0 {
+		negState = RequestMIC
+	}
+
+	// The optimistic token was generated by the preferred mechanism of the initiator,
+	// otherwise it is discarded, e.g. the NEGOEX token that Windows clients lead with
+	if i == 0 && len(init.MechToken) > 0 {
+		return s.accept(init.MechToken, init.MechListMIC, true)
+	}
+	return EncodeNegTokenResp(NegTokenResp{
+		NegState:      negState,
+		SupportedMech: init.MechTypes[i],
+	})
+}
+
+// choose returns the index in the offer and the mechanism selected, either by the
+// SelectMechanism policy or as the first supported one
+func (s *SPNEGOServer) choose(offered []asn1.ObjectIdentifier) (int, Acceptor, error) {
+	var selected asn1.ObjectIdentifier
+	if s.SelectMechanism != nil {
+		oid, err := s.SelectMechanism(offered)
+		if err != nil {
+			return 0, nil, errors.New("mechanism selection failed: " + err.Error())
+		}
+		selected = oid
+	}
+
+	for i, mechType := range offered {
+		if selected != nil && !selected.Equal(mechType) {
+			continue
+		}
+		for _, mech := range s.Mechanisms {
+			if s.Compatibility.sameMechanism(mech.GetOID(), mechType) {
+				return i, mech, nil
+			}
+		}
+	}
+	if selected != nil {
+		return 0, nil, errors.New("selected mechanism is not offered or not supported: " + selected.String())
+	}
+	return 0, nil, errors.New("no supported mechanism offered")
+}
+
+// needsMIC reports whether the mechListMIC of the initiator is mandatory. RFC 4178 5 requires
+// it when the preferred mechanism of the initiator was not selected, as the downgrade is
+// undetectable otherwise
+func (s *SPNEGOServer) needsMIC() bool {
+	return !s.Compatibility.sameMechanism(s.SelectedMech.GetOID(), s.MechTypes[0]) || s.RequireMechListMIC
+}
+
+// accept hands a token to the selected mechanism. Once established, the mechListMIC
+// of the initiator is verified. If the mechanism completes in the first leg without the
+// required mechListMIC, it is requested with the request-mic negState
+func (s *SPNEGOServer) accept(mechToken, mechListMIC []byte, first bool) ([]byte, error) {
+	respToken, err := s.SelectedMech.AcceptSecContext(mechToken)
+	if err != nil {
+		return nil, errors.New("failed to accept security context: " + err.Error())
+	}
+
+	// The optimistic token is only accepted for the preferred mechanism, the OID is
+	// echoed as offered, e.g. MsKerberosOid for the Kerberos mechanism
+	var supportedMech asn1.ObjectIdentifier
+	if first {
+		supportedMech = s.MechTypes[0]
+	}
+	if !s.SelectedMech.IsEstablished() {
+		negState := asn1.Enumerated(AcceptIncomplete)
+		if first && s.needsMIC() && len(mechListMIC) == 0 {
+			negState = RequestMIC
+		}
+		return EncodeNegTokenResp(NegTokenResp{
+			NegState:      negState,
+			SupportedMech: supportedMech,
+			ResponseToken: respToken,
+		})
+	}
+
+	if first && s.needsMIC() && len(mechListMIC) == 0 {
+		s.awaitingMIC = true
+		return EncodeNegTokenResp(NegTokenResp{
+			NegState:      RequestMIC,
+			SupportedMech: supportedMech,
+			ResponseToken: respToken,
+		})
+	}
+	return s.complete(respToken, mechListMIC, supportedMech)
+}
+
+// complete verifies the mechListMIC of the initiator and sends the accept-completed
+// NegTokenResp with the mechListMIC of the acceptor
+func (s *SPNEGOServer) complete(respToken, mechListMIC []byte, supportedMech asn1.ObjectIdentifier) ([]byte, error) {
+	supportedMICs, err := asn1.Marshal(s.MechTypes)
+	if err != nil {
+		return nil, errors.New("failed to marshal supported mechanisms: " + err.Error())
+	}
+	if len(mechListMIC) > 0 {
+		if err := s.SelectedMech.VerifyMIC(supportedMICs, mechListMIC); err != nil {
+			return nil, errors.New("failed to verify mechListMIC: " + err.Error())
+		}
+	} else if s.needsMIC() {
+		return nil, errors.New("initiator did not send the mechListMIC")
+	}
+
+	mic, err := s.SelectedMech.GetMIC(supportedMICs)
+	if err != nil {
+		return nil, errors.New("failed to generate mechListMIC: " + err.Error())
+	}
+	if len(mic) == 0 {
+		mic = nil
+	}
+	return EncodeNegTokenResp(NegTokenResp{
+		NegState:      AcceptCompleted,
+		SupportedMech: supportedMech,
+		ResponseToken: respToken,
+		MechListMIC:   mic,
+	})
+}
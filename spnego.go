@@ -1,6 +1,7 @@
 package spnego
 
 import (
+	"bytes"
 	"encoding/asn1"
 	"encoding/hex"
 	"errors"
@@ -15,6 +16,7 @@ var (
 	MsKerberosOid = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
 	KerberosOID   = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
 	NegotiateOID  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 30}
+	NtlmOID       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}
 )
 
 // "not_defined_in_RFC4178@please_ignore"
@@ -26,12 +28,16 @@ var NegHints = asn1.RawValue{
 	},
 }
 
+// Initiator is the client side of an authentication mechanism that can be negotiated
+// with SPNEGO. Providers in the initiators directory implement it, so that negotiation
+// loops can be written without depending on a specific mechanism
 type Initiator interface {
-	GetOID() asn1.ObjectIdentifier
+	GetOID() asn1.ObjectIdentifier              // Mechanism OID offered in mechTypes
 	InitSecContext() ([]byte, error)            // GSS_Init_sec_context
 	AcceptSecContext(sc []byte) ([]byte, error) // GSS_Accept_sec_context
-	GetMIC(bs []byte) []byte                    // GSS_getMIC
+	GetMIC(bs []byte) ([]byte, error)           // GSS_getMIC
 	SessionKey() []byte                         // QueryContextAttributes(ctx, SECPKG_ATTR_SESSION_KEY, &out)
+	IsEstablished() bool                        // GSS_Inquire_context(ctx, ..., &open)
 }
 
 // NegTokenInit represents the initial negotiation token
@@ -42,6 +48,66 @@ type NegTokenInit struct {
 	MechListMIC []byte                  `asn1:"explicit,optional,tag:3"`
 }
 
+// ContextFlag is a bit of the reqFlags ContextFlags BIT STRING (RFC 4178 4.2.1)
+type ContextFlag int
+
+// ContextFlags values as defined in RFC 4178
+const (
+	DelegFlag ContextFlag = iota
+	MutualFlag
+	ReplayFlag
+	SequenceFlag
+	AnonFlag
+	ConfFlag
+	IntegFlag
+)
+
+// NewReqFlags encodes the context flags requested in a NegTokenInit
+func NewReqFlags(flags ...ContextFlag) asn1.BitString {
+	reqFlags := asn1.BitString{Bytes: []byte{0}, BitLength: int(IntegFlag) + 1}
+	for _, flag := range flags {
+		reqFlags.Bytes[0] |= 0x80 >> flag
+	}
+	return reqFlags
+}
+
+// gssFlags maps the context flags to the GSS-API flags (RFC 2744) used by the mechanisms
+var gssFlags = map[ContextFlag]uint32{
+	DelegFlag:    1,
+	MutualFlag:   2,
+	ReplayFlag:   4,
+	SequenceFlag: 8,
+	ConfFlag:     16,
+	IntegFlag:    32,
+	AnonFlag:     64,
+}
+
+// ContextFlagsRequester is implemented by the mechanisms able to request context flags,
+// given as GSS-API flags, before InitSecContext
+type ContextFlagsRequester interface {
+	RequestContextFlags(flags uint32)
+}
+
+// ContextFlagsReporter is implemented by the mechanisms reporting the GSS-API flags
+// of the established context
+type ContextFlagsReporter interface {
+	NegotiatedContextFlags() uint32
+}
+
+// HasFlag reports whether the flag is requested in the reqFlags of the NegTokenInit
+func (t *NegTokenInit) HasFlag(flag ContextFlag) bool {
+	return t.ReqFlags.At(int(flag)) == 1
+}
+
+// EncodeInitialToken wraps a complete NegTokenInit, including reqFlags and mechListMIC,
+// into a GSS-API InitialContextToken. UnwrapInitialToken decodes it
+func EncodeInitialToken(init NegTokenInit) ([]byte, error) {
+	if len(init.MechTypes) == 0 {
+		return nil, errors.New("no mechanisms available")
+	}
+	return EncodeNegTokenInitGeneric(init)
+}
+
 // NegTokenInit2 is the useless extension to the NegTokenInit made by MS
 type NegTokenInit2 struct {
 	MechTypes   []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
@@ -51,7 +117,13 @@ type NegTokenInit2 struct {
 	MechListMIC []byte                  `asn1:"explicit,optional,tag:4"`
 }
 
+// EncodeNegTokenInitGeneric wraps a NegTokenInit or a NegTokenInit2 in the InitialContextToken
+// of SPNEGO. The NegTokenInit is encoded without reflection, see marshalInitialToken
 func EncodeNegTokenInitGeneric(token interface{}) ([]byte, error) {
+	if init, ok := token.(NegTokenInit); ok {
+		return marshalInitialToken(init)
+	}
+
 	type initialCtxToken struct { // `asn1:"application,tag:0"`
 		ThisMech asn1.ObjectIdentifier `asn1:"optional"`
 		Init     []interface{}         `asn1:"optional,explict,tag:0"`
@@ -77,6 +149,65 @@ func EncodeNegTokenInit(types []asn1.ObjectIdentifier, token []byte) ([]byte, er
 	})
 }
 
+// WrapInitialToken wraps a mechanism token into a GSS-API InitialContextToken carrying
+// a NegTokenInit. The first mechanism (usually Initiator.GetOID) is the preferred one
+// and the token must have been generated by it
+func WrapInitialToken(mechs []asn1.ObjectIdentifier, mechToken []byte) ([]byte, error) {
+	if len(mechs) == 0 {
+		return nil, errors.New("no mechanisms available")
+	}
+	return EncodeNegTokenInit(mechs, mechToken)
+}
+
+// UnwrapInitialToken decodes a GSS-API InitialContextToken carrying a NegTokenInit
+func UnwrapInitialToken(data []byte) (*NegTokenInit, error) {
+	inner, err := unwrapSpnegoToken(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var init NegTokenInit
+	if _, err := asn1.UnmarshalWithParams(inner, &init, "explicit,tag:0"); err != nil {
+		return nil, errors.New("failed to unmarshal NegTokenInit: " + err.Error())
+	}
+	if err := checkLimit("MaxMechTypes", len(init.MechTypes), Limits.MaxMechTypes); err != nil {
+		return nil, err
+	}
+	return &init, nil
+}
+
+// unwrapSpnegoToken returns the NegotiationToken of a SPNEGO InitialContextToken
+func unwrapSpnegoToken(data []byte) ([]byte, error) {
+	mech, inner, err := UnwrapGSSToken(data)
+	if err != nil {
+		return nil, err
+	}
+	if !mech.Equal(SpnegoOID) {
+		return nil, errors.New("not a SPNEGO token: " + mech.String())
+	}
+	return inner, nil
+}
+
+// UnwrapInitialTokenStrict is UnwrapInitialToken rejecting the tokens which are not the
+// DER encoding of their NegTokenInit: BER constructions, non-minimal lengths, unknown
+// fields or trailing data, which lenient parsers may interpret differently
+func UnwrapInitialTokenStrict(data []byte) (*NegTokenInit, error) {
+	init, err := UnwrapInitialToken(data)
+	if err != nil {
+		return nil, err
+	}
+	der, err := EncodeNegTokenInitGeneric(*init)
+	if err != nil {
+		return nil, errors.New("failed to marshal NegTokenInit: " + err.Error())
+	}
+	if !bytes.Equal(der, data) {
+		return nil, errors.New("InitialContextToken is not DER encoded")
+	}
+	return init, nil
+}
+
+// EncodeNegTokenInit2 generates the NegTokenInit2 sent by Windows servers before the
+// initiator speaks, e.g. in the SMB2 NEGOTIATE response, with the fixed negHints
 func EncodeNegTokenInit2(types []asn1.ObjectIdentifier) ([]byte, error) {
 	return EncodeNegTokenInitGeneric(NegTokenInit2{
 		MechTypes: types,
@@ -84,53 +215,189 @@ func EncodeNegTokenInit2(types []asn1.ObjectIdentifier) ([]byte, error) {
 	})
 }
 
+// negHints is the NegHints sequence of the NegTokenInit2 (MS-SPNG 2.2.1)
+type negHints struct {
+	HintName    string `asn1:"explicit,optional,tag:0"`
+	HintAddress []byte `asn1:"explicit,optional,tag:1"`
+}
+
+// UnwrapInitialToken2 decodes a GSS-API InitialContextToken carrying a NegTokenInit2,
+// which also parses the NegTokenInit sent by non Windows acceptors
+func UnwrapInitialToken2(data []byte) (*NegTokenInit2, error) {
+	inner, err := unwrapSpnegoToken(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var init NegTokenInit2
+	if _, err := asn1.UnmarshalWithParams(inner, &init, "explicit,tag:0"); err != nil {
+		return nil, errors.New("failed to unmarshal NegTokenInit2: " + err.Error())
+	}
+	if err := checkLimit("MaxMechTypes", len(init.MechTypes), Limits.MaxMechTypes); err != nil {
+		return nil, err
+	}
+	return &init, nil
+}
+
+// HintName returns the hintName of the negHints, which Windows sets to
+// "not_defined_in_RFC4178@please_ignore", or an empty string if negHints is absent
+func (t *NegTokenInit2) HintName() (string, error) {
+	if len(t.NegHints.FullBytes) == 0 {
+		return "", nil
+	}
+
+	var hints negHints
+	if _, err := asn1.UnmarshalWithParams(t.NegHints.FullBytes, &hints, "explicit,tag:3"); err != nil {
+		return "", errors.New("failed to unmarshal negHints: " + err.Error())
+	}
+	return hints.HintName, nil
+}
+
 // NegTokenResp represents all subsequent negotiation messages
+// NegState is NegStateAbsent when the field is not present in the token
 type NegTokenResp struct {
-	NegState      asn1.Enumerated       `asn1:"explicit,optional,tag:0"`
+	NegState      asn1.Enumerated       `asn1:"explicit,optional,default:-1,tag:0"`
 	SupportedMech asn1.ObjectIdentifier `asn1:"explicit,optional,tag:1"`
 	ResponseToken []byte                `asn1:"explicit,optional,tag:2"`
 	MechListMIC   []byte                `asn1:"explicit,optional,tag:3"`
 }
 
+// EncodeNegTokenResp encodes a NegTokenResp as the [1] tagged choice of NegotiationToken,
+// the framing expected by the acceptors and by ParseResponseToken
 func EncodeNegTokenResp(token NegTokenResp) ([]byte, error) {
-	data, err := asn1.Marshal(token)
+	data, err := marshalNegTokenResp(token)
 	if err != nil {
 		return nil, errors.New("failed to marshal NegTokenResp: " + err.Error())
 	}
+	return data, nil
+}
+
+// ParseResponseToken decodes a NegTokenResp sent by the acceptor. Only the fields present
+// in the token are filled, as the acceptor may omit some of them in subsequent legs.
+// The responseToken may be a fragment of the mechanism token, see SPNEGOServer.MaxTokenSize
+func ParseResponseToken(data []byte) (*NegTokenResp, error) {
+	if err := checkLimit("MaxTokenLength", len(data), Limits.MaxTokenLength); err != nil {
+		return nil, err
+	}
 
-	// Skip GSS-API framing
-	skip := 1
-	if data[skip] > 128 {
-		skip += int(data[skip]) - 128
+	var resp NegTokenResp
+	rest, err := asn1.UnmarshalWithParams(data, &resp, "explicit,tag:1")
+	if err != nil {
+		return nil, errors.New("failed to unmarshal NegTokenResp: " + err.Error())
 	}
-	return data[skip+1:], nil
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after NegTokenResp")
+	}
+	return &resp, nil
 }
 
-func DecodeNegTokenResp(data []byte) (*NegTokenResp, error) {
-	var resp *NegTokenResp
-	if _, err := asn1.Unmarshal(data, &resp); err != nil {
-		// MS-SPNG 3.1: Handle potential raw token without ASN.1 wrapper
-		if len(data) > 0 {
-			return resp, nil
-		}
+// ParseResponseTokenStrict is ParseResponseToken rejecting the tokens which are not
+// the DER encoding of their NegTokenResp, see UnwrapInitialTokenStrict
+func ParseResponseTokenStrict(data []byte) (*NegTokenResp, error) {
+	resp, err := ParseResponseToken(data)
+	if err != nil {
+		return nil, err
+	}
+	der, err := EncodeNegTokenResp(*resp)
+	if err != nil {
 		return nil, err
 	}
+	if !bytes.Equal(der, data) {
+		return nil, errors.New("NegTokenResp is not DER encoded")
+	}
 	return resp, nil
 }
 
+// DecodeNegTokenResp decodes a NegTokenResp sent by the acceptor
+//
+// Deprecated: use ParseResponseToken instead
+func DecodeNegTokenResp(data []byte) (*NegTokenResp, error) {
+	return ParseResponseToken(data)
+}
+
 // NegotiationState values as defined in RFC 4178
 const (
 	AcceptCompleted  = 0
 	AcceptIncomplete = 1
 	Reject           = 2
 	RequestMIC       = 3
+
+	// NegStateAbsent is not part of RFC 4178, it means that negState was omitted
+	// and that the state has to be inferred from the mechanism
+	NegStateAbsent = -1
 )
 
+var negStateNames = map[asn1.Enumerated]string{
+	AcceptCompleted:  "accept-completed",
+	AcceptIncomplete: "accept-incomplete",
+	Reject:           "reject",
+	RequestMIC:       "request-mic",
+	NegStateAbsent:   "absent",
+}
+
+// NegStateName returns the RFC 4178 name of the negotiation state
+func NegStateName(state asn1.Enumerated) string {
+	if name, ok := negStateNames[state]; ok {
+		return name
+	}
+	return "unknown(" + strconv.Itoa(int(state)) + ")"
+}
+
+// Completed reports whether the acceptor completed the negotiation
+func (r *NegTokenResp) Completed() bool {
+	return r.NegState == AcceptCompleted
+}
+
+// Continue reports whether the initiator has to send another token, either because
+// the acceptor needs more mechanism tokens, a mechListMIC, or omitted negState
+func (r *NegTokenResp) Continue() bool {
+	return r.NegState == AcceptIncomplete || r.NegState == RequestMIC || r.NegState == NegStateAbsent
+}
+
+// Err returns an error if the acceptor rejected the negotiation or sent an unknown state
+func (r *NegTokenResp) Err() error {
+	switch {
+	case r.NegState == Reject:
+		return errors.New("negotiation rejected by acceptor")
+	case !r.Completed() && !r.Continue():
+		return errors.New("unknown negState: " + strconv.Itoa(int(r.NegState)))
+	}
+	return nil
+}
+
 // SPNEGOClient handles SPNEGO negotiation
 type SPNEGOClient struct {
 	Mechanisms   []Initiator
 	MechTypes    []asn1.ObjectIdentifier
 	SelectedMech Initiator
+
+	// ReqFlags are sent in the NegTokenInit and requested from the mechanisms
+	// implementing ContextFlagsRequester
+	ReqFlags []ContextFlag
+
+	// Strict rejects the tokens of the acceptor which are not DER encoded
+	Strict bool
+
+	// RequireMechListMIC fails the negotiation if the acceptor does not send the
+	// mechListMIC, even if the optimistic mechanism was selected
+	RequireMechListMIC bool
+
+	// Raw sends and expects the bare tokens of the first mechanism able to initialize,
+	// without the SPNEGO framing, e.g. for HTTP servers only offering the NTLM scheme
+	Raw bool
+
+	// NoOptimisticToken sends the NegTokenInit without mechToken, the mechanism selected
+	// by the acceptor generating its first token in the next leg
+	NoOptimisticToken bool
+
+	// Compatibility toggles the handling of the Microsoft deviations from RFC 4178
+	Compatibility Compatibility
+
+	// Mechanism which produced the optimistic token of the NegTokenInit
+	optimistic Initiator
+
+	// Fragments of the responseToken received so far, see SPNEGOServer.MaxTokenSize
+	partial []byte
 }
 
 // NewSPNEGOClient creates a new SPNEGO client with the given mechanisms
@@ -149,73 +416,298 @@ func (c *SPNEGOClient) GetOID() asn1.ObjectIdentifier {
 	return SpnegoOID
 }
 
-// InitSecContext generates the initial negotiation token
+// GetMIC generates a Message Integrity Code with the selected mechanism
+func (c *SPNEGOClient) GetMIC(bs []byte) ([]byte, error) {
+	if c.SelectedMech == nil {
+		return nil, errors.New("no mechanism selected")
+	}
+	return c.SelectedMech.GetMIC(bs)
+}
+
+// SessionKey returns the session key established by the selected mechanism
+func (c *SPNEGOClient) SessionKey() []byte {
+	if c.SelectedMech == nil {
+		return nil
+	}
+	return c.SelectedMech.SessionKey()
+}
+
+// IsEstablished reports whether the selected mechanism completed its handshake
+func (c *SPNEGOClient) IsEstablished() bool {
+	return c.SelectedMech != nil && c.SelectedMech.IsEstablished()
+}
+
+// ContextFlags returns the flags of the established context, as reported by the selected
+// mechanism if it implements ContextFlagsReporter
+func (c *SPNEGOClient) ContextFlags() []ContextFlag {
+	if !c.IsEstablished() {
+		return nil
+	}
+	return contextFlags(c.SelectedMech)
+}
+
+// mechanismAliases are the OIDs which may be offered for the mechanism of another OID
+var mechanismAliases = map[string]asn1.ObjectIdentifier{
+	MsKerberosOid.String(): KerberosOID,
+}
+
+// SetMechTypes sets the order of the OIDs offered in mechTypes, the preferred one first.
+// Each OID is the one of a mechanism, or MsKerberosOid which is offered for the Kerberos
+// mechanism, e.g. MsKerberosOid, KerberosOID, NtlmOID like Windows does. Mechanisms whose
+// OID is not listed are not offered
+func (c *SPNEGOClient) SetMechTypes(mechTypes ...asn1.ObjectIdentifier) error {
+	mechs := make([]Initiator, len(mechTypes))
+	for i, oid := range mechTypes {
+		target := oid
+		if alias, ok := mechanismAliases[oid.String()]; ok {
+			target = alias
+		}
+		for _, mech := range c.Mechanisms {
+			if mech.GetOID().Equal(target) {
+				mechs[i] = mech
+				break
+			}
+		}
+		if mechs[i] == nil {
+			return errors.New("no mechanism for " + MechanismName(oid))
+		}
+	}
+	c.Mechanisms, c.MechTypes = mechs, append([]asn1.ObjectIdentifier(nil), mechTypes...)
+	return nil
+}
+
+// InitSecContext generates the initial negotiation token. The optimistic token is generated
+// by the first mechanism able to, like Windows does when Kerberos has no credentials: the
+// mechanisms failing before it are removed from MechTypes, so that it is the preferred one.
+// ReqFlags are requested from the mechanisms before they generate their token. With
+// NoOptimisticToken, only the mechanisms are offered
 func (c *SPNEGOClient) InitSecContext() ([]byte, error) {
 	if len(c.Mechanisms) == 0 {
 		return nil, errors.New("no mechanisms available")
 	}
 
-	mechToken, err := c.Mechanisms[0].InitSecContext()
-	if err != nil {
-		return nil, errors.New("failed to initialize security context: " + err.Error())
+	var requested uint32
+	for _, flag := range c.ReqFlags {
+		requested |= gssFlags[flag]
+	}
+
+	for _, mech := range c.Mechanisms {
+		if requester, ok := mech.(ContextFlagsRequester); ok && requested != 0 {
+			requester.RequestContextFlags(requested)
+		}
+	}
+
+	init := NegTokenInit{MechTypes: c.MechTypes}
+	if len(c.ReqFlags) > 0 {
+		init.ReqFlags = NewReqFlags(c.ReqFlags...)
+	}
+	if c.NoOptimisticToken && !c.Raw {
+		return EncodeNegTokenInitGeneric(init)
+	}
+
+	var errs []error
+	tried := make(map[Initiator]bool)
+	for i, mech := range c.Mechanisms {
+		// A mechanism offered under several OIDs is only initialized once
+		if tried[mech] {
+			continue
+		}
+		tried[mech] = true
+
+		mechToken, err := mech.InitSecContext()
+		if err != nil {
+			errs = append(errs, errors.New(MechanismName(mech.GetOID())+": "+err.Error()))
+			continue
+		}
+
+		c.Mechanisms, c.MechTypes = c.Mechanisms[i:], c.MechTypes[i:]
+		c.optimistic = mech
+		if c.Raw {
+			c.SelectedMech = mech
+			return mechToken, nil
+		}
+		init.MechTypes, init.MechToken = c.MechTypes, mechToken
+		return EncodeNegTokenInitGeneric(init)
 	}
+	return nil, errors.New("failed to initialize security context: " + errors.Join(errs...).Error())
+}
 
-	return EncodeNegTokenInit(c.MechTypes, mechToken)
+// MechListMICVerifier is implemented by the mechanisms able to verify the mechListMIC
+// sent by the acceptor, which protects the negotiation against mechanism downgrades
+type MechListMICVerifier interface {
+	VerifyMechListMIC(mechList, mic []byte) error
 }
 
-// AcceptSecContext handles the response token from the acceptor
+// AcceptSecContext handles the response token from the acceptor. If the acceptor selects
+// another mechanism than the optimistic one, its initial token is sent in this leg.
+// On the last leg, the mechListMIC of the acceptor is verified by the selected mechanism.
+// A request-mic received once the mechanism completed is answered with the mechListMIC.
+// A responseToken shorter than the length of its GSS-API framing is a fragment: an empty
+// NegTokenResp is sent back until the acceptor sent the rest of it
 func (c *SPNEGOClient) AcceptSecContext(responseToken []byte) ([]byte, error) {
-	resp, err := DecodeNegTokenResp(responseToken)
+	if c.Raw {
+		if c.SelectedMech == nil {
+			return nil, errors.New("no mechanism selected")
+		}
+		return c.SelectedMech.AcceptSecContext(responseToken)
+	}
+
+	parse := ParseResponseToken
+	if c.Strict {
+		parse = ParseResponseTokenStrict
+	}
+	resp, err := parse(responseToken)
 	if err != nil {
 		return nil, err
 	}
+	if c.Compatibility == CompatMicrosoft && len(resp.MechListMIC) > 0 && bytes.Equal(resp.MechListMIC, resp.ResponseToken) {
+		// Windows 2000 acceptors copy the responseToken in the mechListMIC field
+		resp.MechListMIC = nil
+	}
 
 	switch resp.NegState {
-	case AcceptCompleted:
-		// MS-SPNG 3.1: Handle both wrapped and unwrapped tokens
-		if len(resp.ResponseToken) > 0 {
-			return resp.ResponseToken, nil
-		}
-		return nil, nil
+	case AcceptCompleted, AcceptIncomplete, RequestMIC, NegStateAbsent:
+		// Continue negotiation (if received AcceptIncomplete, we need to send another response token)
+		// As stated in RFC 4178 Section 3.1, the initiator, upon receiving an AcceptIncomplete
+		// state from the acceptor, can OPTIONALLY send a MIC in the next response token.
+		// So, to generalize, we always send a MIC in the response token
 	case Reject:
 		// MS-SPNG 2.2.1: Include more specific error info if available
 		if len(resp.ResponseToken) > 0 {
 			return nil, errors.New("negotiation rejected with token: " + hex.EncodeToString(resp.ResponseToken))
 		}
 		return nil, errors.New("negotiation rejected by acceptor")
-
-	case AcceptIncomplete, RequestMIC:
-		// Continue negotiation (if received AcceptIncomplete, we need to send another response token)
-		// As stated in RFC 4178 Section 3.1, the initiator, upon receiving an AcceptIncomplete
-		// state from the acceptor, can OPTIONALLY send a MIC in the next response token.
-		// So, to generalize, we always send a MIC in the response token
-
 	default:
 		return nil, errors.New("unknown negState: " + strconv.Itoa(int(resp.NegState)))
 	}
 
-	for i, mechType := range c.MechTypes {
-		if mechType.Equal(resp.SupportedMech) {
-			c.SelectedMech = c.Mechanisms[i]
-			break
+	// supportedMech is only present in the first reply of the acceptor
+	if len(resp.SupportedMech) > 0 && c.SelectedMech == nil {
+		for i, mechType := range c.MechTypes {
+			if c.Compatibility.sameMechanism(mechType, resp.SupportedMech) {
+				c.SelectedMech = c.Mechanisms[i]
+				break
+			}
+		}
+		if c.SelectedMech == nil {
+			return nil, errors.New("acceptor selected an unoffered mechanism: " + MechanismName(resp.SupportedMech))
+		}
+
+		// The optimistic token was discarded, the selected mechanism starts its own handshake
+		if c.SelectedMech != c.optimistic && !resp.Completed() {
+			mechToken, err := c.SelectedMech.InitSecContext()
+			if err != nil {
+				return nil, errors.New("failed to initialize security context: " + err.Error())
+			}
+			return EncodeNegTokenResp(NegTokenResp{
+				NegState:      NegStateAbsent,
+				ResponseToken: mechToken,
+			})
+		}
+	}
+	if c.SelectedMech == nil {
+		return nil, errors.New("no mechanism selected")
+	}
+
+	if len(c.partial) > 0 || derTruncated(resp.ResponseToken) {
+		c.partial = append(c.partial, resp.ResponseToken...)
+		if derTruncated(c.partial) {
+			if resp.NegState != AcceptIncomplete {
+				return nil, errors.New("responseToken is truncated")
+			}
+			return EncodeNegTokenResp(NegTokenResp{NegState: NegStateAbsent})
 		}
+		resp.ResponseToken, c.partial = c.partial, nil
+	}
+
+	supportedMICs, err := asn1.Marshal(c.MechTypes)
+	if err != nil {
+		return nil, errors.New("failed to marshal supported mechanisms: " + err.Error())
+	}
+
+	if resp.Completed() {
+		return c.complete(resp, supportedMICs)
+	}
+	if resp.NegState == RequestMIC && c.SelectedMech.IsEstablished() {
+		return c.answerMIC(resp, nil, supportedMICs)
 	}
 
 	initiatorResponse, err := c.SelectedMech.AcceptSecContext(resp.ResponseToken)
 	if err != nil {
 		return nil, errors.New("failed to accept security context: " + err.Error())
 	}
+	if resp.NegState == RequestMIC && c.SelectedMech.IsEstablished() {
+		return c.answerMIC(resp, initiatorResponse, supportedMICs)
+	}
 
-	supportedMICs, err := asn1.Marshal(c.MechTypes)
+	mechListMIC, err := c.SelectedMech.GetMIC(supportedMICs)
 	if err != nil {
-		return nil, errors.New("failed to marshal supported mechanisms: " + err.Error())
+		return nil, errors.New("failed to generate mechListMIC: " + err.Error())
 	}
-	mechListMIC := c.SelectedMech.GetMIC(supportedMICs)
 
+	// request-mic is only sent by the acceptor, the negotiation continues
+	negState := resp.NegState
+	if negState == RequestMIC {
+		negState = AcceptIncomplete
+	}
 	return EncodeNegTokenResp(NegTokenResp{
-		NegState:      resp.NegState,
+		NegState:      negState,
 		SupportedMech: resp.SupportedMech,
 		ResponseToken: initiatorResponse,
 		MechListMIC:   mechListMIC,
 	})
 }
+
+// answerMIC handles the request-mic of an acceptor whose mechanism completed: its
+// mechListMIC is verified if sent, and the one of the initiator is sent back with
+// the last mechanism token, if any
+func (c *SPNEGOClient) answerMIC(resp *NegTokenResp, mechToken, supportedMICs []byte) ([]byte, error) {
+	if len(resp.MechListMIC) > 0 {
+		verifier, ok := c.SelectedMech.(MechListMICVerifier)
+		if !ok {
+			return nil, errors.New("mechListMIC cannot be verified by " + MechanismName(c.SelectedMech.GetOID()))
+		}
+		if err := verifier.VerifyMechListMIC(supportedMICs, resp.MechListMIC); err != nil {
+			return nil, errors.New("failed to verify mechListMIC: " + err.Error())
+		}
+	}
+
+	mechListMIC, err := c.SelectedMech.GetMIC(supportedMICs)
+	if err != nil {
+		return nil, errors.New("failed to generate mechListMIC: " + err.Error())
+	}
+	return EncodeNegTokenResp(NegTokenResp{
+		NegState:      AcceptCompleted,
+		ResponseToken: mechToken,
+		MechListMIC:   mechListMIC,
+	})
+}
+
+// complete handles the accept-completed leg: the last mechanism token, e.g. the Kerberos
+// AP-REP, is processed and the mechListMIC of the acceptor is verified. RFC 4178 5 requires
+// the MIC when the preferred mechanism was not selected, as the downgrade is undetectable otherwise
+func (c *SPNEGOClient) complete(resp *NegTokenResp, supportedMICs []byte) ([]byte, error) {
+	var mechToken []byte
+	if len(resp.ResponseToken) > 0 && !c.SelectedMech.IsEstablished() {
+		var err error
+		if mechToken, err = c.SelectedMech.AcceptSecContext(resp.ResponseToken); err != nil {
+			return nil, errors.New("failed to accept security context: " + err.Error())
+		}
+	}
+
+	if len(resp.MechListMIC) == 0 {
+		if c.SelectedMech != c.Mechanisms[0] || c.RequireMechListMIC {
+			return nil, errors.New("acceptor did not send the mechListMIC")
+		}
+		return mechToken, nil
+	}
+
+	verifier, ok := c.SelectedMech.(MechListMICVerifier)
+	if !ok {
+		return nil, errors.New("mechListMIC cannot be verified by " + MechanismName(c.SelectedMech.GetOID()))
+	}
+	if err := verifier.VerifyMechListMIC(supportedMICs, resp.MechListMIC); err != nil {
+		return nil, errors.New("failed to verify mechListMIC: " + err.Error())
+	}
+	return mechToken, nil
+}
@@ -4,12 +4,32 @@ import (
 	"bytes"
 	"encoding/asn1"
 	"encoding/hex"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/msultra/spnego"
+	"github.com/msultra/spnego/initiators/mskrb"
 	"github.com/msultra/spnego/initiators/ntlm"
 )
 
+var (
+	_ spnego.Initiator = (*spnego.SPNEGOClient)(nil)
+	_ spnego.Initiator = (*ntlm.NtlmProvider)(nil)
+	_ spnego.Initiator = (*mskrb.KerberosProvider)(nil)
+
+	_ spnego.Acceptor = (*spnego.SPNEGOServer)(nil)
+	_ spnego.Acceptor = (*ntlm.Acceptor)(nil)
+
+	_ spnego.MechListMICVerifier = (*ntlm.NtlmProvider)(nil)
+	_ spnego.MechListMICVerifier = (*mskrb.KerberosProvider)(nil)
+
+	_ spnego.ContextFlagsRequester = (*ntlm.NtlmProvider)(nil)
+	_ spnego.ContextFlagsRequester = (*mskrb.KerberosProvider)(nil)
+	_ spnego.ContextFlagsReporter  = (*ntlm.NtlmProvider)(nil)
+	_ spnego.ContextFlagsReporter  = (*mskrb.KerberosProvider)(nil)
+)
+
 func TestEncodeNegTokenInit(t *testing.T) {
 	var testEncodeNegTokenInit = []struct {
 		Types    []asn1.ObjectIdentifier
@@ -40,3 +60,1057 @@ func TestEncodeNegTokenInit(t *testing.T) {
 		}
 	}
 }
+
+func TestWrapInitialToken(t *testing.T) {
+	provider := &ntlm.NtlmProvider{}
+	mechToken, err := provider.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+
+	mechs := []asn1.ObjectIdentifier{provider.GetOID(), spnego.KerberosOID}
+	bs, err := spnego.WrapInitialToken(mechs, mechToken)
+	if err != nil {
+		t.Fatalf("WrapInitialToken() failed: %v", err)
+	}
+
+	init, err := spnego.UnwrapInitialToken(bs)
+	if err != nil {
+		t.Fatalf("UnwrapInitialToken() failed: %v", err)
+	}
+	if len(init.MechTypes) != len(mechs) {
+		t.Fatalf("got %d mechanisms, expected %d", len(init.MechTypes), len(mechs))
+	}
+	for i, mech := range mechs {
+		if !init.MechTypes[i].Equal(mech) {
+			t.Fatalf("mechanism %d is %v, expected %v", i, init.MechTypes[i], mech)
+		}
+	}
+	if !bytes.Equal(init.MechToken, mechToken) {
+		t.Fatalf("mechToken is different from the wrapped one")
+	}
+}
+
+func TestEncodeInitialToken(t *testing.T) {
+	init := spnego.NegTokenInit{
+		MechTypes:   []asn1.ObjectIdentifier{spnego.NtlmOID, spnego.KerberosOID},
+		ReqFlags:    spnego.NewReqFlags(spnego.MutualFlag, spnego.IntegFlag),
+		MechToken:   []byte("NTLMSSP\x00"),
+		MechListMIC: []byte("mechListMIC"),
+	}
+	bs, err := spnego.EncodeInitialToken(init)
+	if err != nil {
+		t.Fatalf("EncodeInitialToken() failed: %v", err)
+	}
+
+	decoded, err := spnego.UnwrapInitialToken(bs)
+	if err != nil {
+		t.Fatalf("UnwrapInitialToken() failed: %v", err)
+	}
+	if len(decoded.MechTypes) != 2 || !decoded.MechTypes[0].Equal(spnego.NtlmOID) {
+		t.Fatalf("mechTypes are %v", decoded.MechTypes)
+	}
+	if !bytes.Equal(decoded.MechToken, init.MechToken) || !bytes.Equal(decoded.MechListMIC, init.MechListMIC) {
+		t.Fatalf("mechToken or mechListMIC are different from the encoded ones")
+	}
+	for _, tc := range []struct {
+		flag     spnego.ContextFlag
+		expected bool
+	}{
+		{spnego.DelegFlag, false},
+		{spnego.MutualFlag, true},
+		{spnego.ConfFlag, false},
+		{spnego.IntegFlag, true},
+	} {
+		if decoded.HasFlag(tc.flag) != tc.expected {
+			t.Fatalf("HasFlag(%d) = %v, expected %v", tc.flag, !tc.expected, tc.expected)
+		}
+	}
+
+	if _, err := spnego.EncodeInitialToken(spnego.NegTokenInit{}); err == nil {
+		t.Fatalf("EncodeInitialToken() should fail without mechanisms")
+	}
+}
+
+func TestNegTokenInit2(t *testing.T) {
+	// Security blob of the SMB2 NEGOTIATE response of Windows Server 2019
+	const windows = "607606062b0601050502a06c306aa03c303a060a2b06010401823702021e06092a864882f71201020206092a864886f712010202060a2a864886f71201020203060a2b06010401823702020aa32a3028a0261b246e6f745f646566696e65645f696e5f5246433431373840706c656173655f69676e6f7265"
+	bs, err := hex.DecodeString(windows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	init, err := spnego.UnwrapInitialToken2(bs)
+	if err != nil {
+		t.Fatalf("UnwrapInitialToken2() failed: %v", err)
+	}
+	if len(init.MechTypes) != 5 || !init.MechTypes[0].Equal(spnego.NegotiateOID) || !init.MechTypes[4].Equal(spnego.NtlmOID) {
+		t.Fatalf("mechTypes are %v", init.MechTypes)
+	}
+	if name, err := init.HintName(); err != nil || name != "not_defined_in_RFC4178@please_ignore" {
+		t.Fatalf("HintName() = %q, %v", name, err)
+	}
+
+	encoded, err := spnego.EncodeNegTokenInit2(init.MechTypes)
+	if err != nil || hex.EncodeToString(encoded) != windows {
+		t.Fatalf("EncodeNegTokenInit2() = %x, %v", encoded, err)
+	}
+	if encoded, err := spnego.EncodeNegTokenInitGeneric(*init); err != nil || hex.EncodeToString(encoded) != windows {
+		t.Fatalf("EncodeNegTokenInitGeneric() = %x, %v", encoded, err)
+	}
+
+	server := spnego.NewSPNEGOServer([]spnego.Acceptor{ntlm.NewAcceptor(&ntlm.NtlmProvider{})})
+	if bs, err = server.InitialToken(); err != nil {
+		t.Fatalf("InitialToken() failed: %v", err)
+	}
+	if init, err = spnego.UnwrapInitialToken2(bs); err != nil || len(init.MechTypes) != 1 || !init.MechTypes[0].Equal(spnego.NtlmOID) {
+		t.Fatalf("UnwrapInitialToken2() = %v, %v", init, err)
+	}
+
+	// A NegTokenInit has no negHints
+	bs, err = spnego.EncodeNegTokenInit([]asn1.ObjectIdentifier{spnego.NtlmOID}, []byte("token"))
+	if err != nil {
+		t.Fatalf("EncodeNegTokenInit() failed: %v", err)
+	}
+	if init, err = spnego.UnwrapInitialToken2(bs); err != nil {
+		t.Fatalf("UnwrapInitialToken2() failed: %v", err)
+	}
+	if name, err := init.HintName(); err != nil || name != "" || string(init.MechToken) != "token" {
+		t.Fatalf("HintName() = %q, %v", name, err)
+	}
+}
+
+func TestUnwrapInitialTokenInvalid(t *testing.T) {
+	for i, e := range []string{
+		"",
+		"4e544c4d5353500001000000978208e2000000000000000000000000000000000a005a290000000f",
+		// Kerberos OID instead of SPNEGO
+		"600d06092a864886f71201020230",
+		// trailing data
+		"604806062b0601050502a03e303ca00e300c060a2b06010401823702020aa22a04284e544c4d5353500001000000978208e2000000000000000000000000000000000a005a290000000f00",
+	} {
+		bs, err := hex.DecodeString(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := spnego.UnwrapInitialToken(bs); err == nil {
+			t.Errorf("%d: expected an error\n", i)
+		}
+	}
+}
+
+func TestStrictDER(t *testing.T) {
+	init, err := spnego.EncodeNegTokenInit([]asn1.ObjectIdentifier{spnego.NtlmOID}, []byte("token"))
+	if err != nil {
+		t.Fatalf("EncodeNegTokenInit() failed: %v", err)
+	}
+	if _, err := spnego.UnwrapInitialTokenStrict(init); err != nil {
+		t.Fatalf("UnwrapInitialTokenStrict() failed: %v", err)
+	}
+	resp, err := hex.DecodeString("a11b3019a0030a0100a312041001000000a3b9d2a7c3e6e0b200000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spnego.ParseResponseTokenStrict(resp); err != nil {
+		t.Fatalf("ParseResponseTokenStrict() failed: %v", err)
+	}
+
+	for i, e := range []string{
+		// trailing data inside the NegTokenResp sequence
+		"a11d301ba0030a0100a312041001000000a3b9d2a7c3e6e0b2000000000500",
+		// negState encoded with its DEFAULT value
+		"a11b3019a0030a01ffa312041001000000a3b9d2a7c3e6e0b200000000",
+		// mechListMIC as a constructed OCTET STRING
+		"a11d301ba0030a0100a3142412041001000000a3b9d2a7c3e6e0b200000000",
+	} {
+		bs, err := hex.DecodeString(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := spnego.ParseResponseTokenStrict(bs); err == nil {
+			t.Errorf("%d: expected an error\n", i)
+		}
+	}
+
+	// mechToken followed by an unknown field inside the NegTokenInit sequence
+	lenient, err := hex.DecodeString("602406062b0601050502a01a3018a00e300c060a2b06010401823702020aa2020400a4020500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spnego.UnwrapInitialTokenStrict(lenient); err == nil {
+		t.Errorf("UnwrapInitialTokenStrict() should reject unknown fields")
+	}
+}
+
+func TestParseResponseToken(t *testing.T) {
+	var testParseResponseToken = []struct {
+		Token         string
+		NegState      asn1.Enumerated
+		SupportedMech asn1.ObjectIdentifier
+		ResponseToken string
+		MechListMIC   string
+	}{
+		{
+			// First leg: NTLM selected, carrying the CHALLENGE message
+			"a181b83081b5a0030a0101a10c060a2b06010401823702020aa2819f04819c4e544c4d53535000020000000600060038000000358299e2212ba239356b3d8200000000000000005e005e003e0000000a0063450000000f4c0041004200020006004c0041004200010004004400430004000e006c00610062002e006c0061006e0003001400440043002e006c00610062002e006c0061006e0005000e006c00610062002e006c0061006e0007000800f364eebe92ecd80100000000",
+			spnego.AcceptIncomplete,
+			ntlm.NtlmOID,
+			"4e544c4d53535000020000000600060038000000358299e2212ba239356b3d8200000000000000005e005e003e0000000a0063450000000f4c0041004200020006004c0041004200010004004400430004000e006c00610062002e006c0061006e0003001400440043002e006c00610062002e006c0061006e0005000e006c00610062002e006c0061006e0007000800f364eebe92ecd80100000000",
+			"",
+		},
+		{
+			// Last leg: no supportedMech nor responseToken, only the mechListMIC
+			"a11b3019a0030a0100a312041001000000a3b9d2a7c3e6e0b200000000",
+			spnego.AcceptCompleted,
+			nil,
+			"",
+			"01000000a3b9d2a7c3e6e0b200000000",
+		},
+		{
+			// negState omitted
+			"a1023000",
+			spnego.NegStateAbsent,
+			nil,
+			"",
+			"",
+		},
+	}
+	for i, e := range testParseResponseToken {
+		tok, err := hex.DecodeString(e.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := spnego.ParseResponseToken(tok)
+		if err != nil {
+			t.Errorf("%d: %v\n", i, err)
+			continue
+		}
+		if resp.NegState != e.NegState {
+			t.Errorf("%d: negState is %d, expected %d\n", i, resp.NegState, e.NegState)
+		}
+		if !resp.SupportedMech.Equal(e.SupportedMech) {
+			t.Errorf("%d: supportedMech is %v, expected %v\n", i, resp.SupportedMech, e.SupportedMech)
+		}
+		if hex.EncodeToString(resp.ResponseToken) != e.ResponseToken {
+			t.Errorf("%d: responseToken is %x\n", i, resp.ResponseToken)
+		}
+		if hex.EncodeToString(resp.MechListMIC) != e.MechListMIC {
+			t.Errorf("%d: mechListMIC is %x\n", i, resp.MechListMIC)
+		}
+
+		// The token is encoded back as sent by the acceptor
+		if encoded, err := spnego.EncodeNegTokenResp(*resp); err != nil || hex.EncodeToString(encoded) != e.Token {
+			t.Errorf("%d: EncodeNegTokenResp() = %x, %v\n", i, encoded, err)
+		}
+	}
+}
+
+func TestMechanismName(t *testing.T) {
+	for _, tc := range []struct {
+		oid  asn1.ObjectIdentifier
+		name string
+	}{
+		{ntlm.NtlmOID, "NTLM"},
+		{mskrb.KerberosOID, "Kerberos 5"},
+		{mskrb.MsKerberosOID, "MS Kerberos 5"},
+		{spnego.SpnegoOID, "SPNEGO"},
+		{asn1.ObjectIdentifier{1, 2, 3}, "1.2.3"},
+	} {
+		if name := spnego.MechanismName(tc.oid); name != tc.name {
+			t.Fatalf("MechanismName(%s) = %q, expected %q", tc.oid, name, tc.name)
+		}
+	}
+
+	if !spnego.NtlmOID.Equal(ntlm.NtlmOID) || !spnego.KerberosOID.Equal(mskrb.KerberosOID) || !spnego.MsKerberosOid.Equal(mskrb.MsKerberosOID) {
+		t.Fatalf("mechanism OIDs do not match the initiators ones")
+	}
+}
+
+func TestRegisterMechanism(t *testing.T) {
+	testOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	if _, err := spnego.NewMechanism(testOID); err == nil {
+		t.Fatalf("NewMechanism() should fail for an unregistered mechanism")
+	}
+
+	spnego.RegisterMechanism(ntlm.NtlmOID, func() spnego.Initiator { return &ntlm.NtlmProvider{} })
+	spnego.RegisterMechanism(testOID, func() spnego.Initiator { return &mskrb.KerberosProvider{} })
+	spnego.RegisterMechanism(testOID, func() spnego.Initiator { return &ntlm.NtlmProvider{User: "User"} })
+
+	mech, err := spnego.NewMechanism(testOID)
+	if err != nil {
+		t.Fatalf("NewMechanism() failed: %v", err)
+	}
+	if provider, ok := mech.(*ntlm.NtlmProvider); !ok || provider.User != "User" {
+		t.Fatalf("registering an OID again should replace its factory, got %T", mech)
+	}
+
+	supported := spnego.SupportedMechanisms()
+	if len(supported) != 2 || !supported[0].Equal(ntlm.NtlmOID) || !supported[1].Equal(testOID) {
+		t.Fatalf("SupportedMechanisms() = %v", supported)
+	}
+	client, err := spnego.NewRegisteredSPNEGOClient()
+	if err != nil || len(client.Mechanisms) != 2 {
+		t.Fatalf("NewRegisteredSPNEGOClient() = %v, %v", client, err)
+	}
+
+	preferred, err := spnego.PreferredMechanism([]asn1.ObjectIdentifier{mskrb.KerberosOID, testOID, ntlm.NtlmOID})
+	if err != nil || !preferred.Equal(ntlm.NtlmOID) {
+		t.Fatalf("PreferredMechanism() = %v, %v", preferred, err)
+	}
+	if _, err := spnego.PreferredMechanism([]asn1.ObjectIdentifier{mskrb.KerberosOID}); err == nil {
+		t.Fatalf("PreferredMechanism() should fail without a supported mechanism")
+	}
+}
+
+func TestRegisterAcceptor(t *testing.T) {
+	if _, err := spnego.NewAcceptor(spnego.NtlmOID); err == nil {
+		t.Fatalf("NewAcceptor() should fail for an unregistered mechanism")
+	}
+	spnego.RegisterAcceptor(spnego.NtlmOID, func() spnego.Acceptor {
+		return ntlm.NewAcceptor(&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"})
+	})
+	if supported := spnego.SupportedAcceptors(); len(supported) != 1 || !supported[0].Equal(spnego.NtlmOID) {
+		t.Fatalf("SupportedAcceptors() = %v", supported)
+	}
+
+	server, err := spnego.NewRegisteredSPNEGOServer()
+	if err != nil {
+		t.Fatalf("NewRegisteredSPNEGOServer() failed: %v", err)
+	}
+	client := spnego.NewSPNEGOClient([]spnego.Initiator{&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}})
+	if err := negotiate(t, client, server); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+}
+
+func TestNegTokenRespState(t *testing.T) {
+	for _, tc := range []struct {
+		state     asn1.Enumerated
+		name      string
+		completed bool
+		more      bool
+		err       bool
+	}{
+		{spnego.AcceptCompleted, "accept-completed", true, false, false},
+		{spnego.AcceptIncomplete, "accept-incomplete", false, true, false},
+		{spnego.Reject, "reject", false, false, true},
+		{spnego.RequestMIC, "request-mic", false, true, false},
+		{spnego.NegStateAbsent, "absent", false, true, false},
+		{42, "unknown(42)", false, false, true},
+	} {
+		resp := &spnego.NegTokenResp{NegState: tc.state}
+		if name := spnego.NegStateName(tc.state); name != tc.name {
+			t.Fatalf("NegStateName(%d) = %q, expected %q", tc.state, name, tc.name)
+		}
+		if resp.Completed() != tc.completed || resp.Continue() != tc.more || (resp.Err() != nil) != tc.err {
+			t.Fatalf("%s: Completed() = %v, Continue() = %v, Err() = %v", tc.name, resp.Completed(), resp.Continue(), resp.Err())
+		}
+	}
+}
+
+// fakeInitiator is a mechanism with a two legs handshake
+type fakeInitiator struct {
+	oid         asn1.ObjectIdentifier
+	initErr     error
+	established bool
+}
+
+func (f *fakeInitiator) GetOID() asn1.ObjectIdentifier { return f.oid }
+func (f *fakeInitiator) InitSecContext() ([]byte, error) {
+	if f.initErr != nil {
+		return nil, f.initErr
+	}
+	return []byte("init " + f.oid.String()), nil
+}
+func (f *fakeInitiator) AcceptSecContext(sc []byte) ([]byte, error) {
+	f.established = true
+	return append([]byte("accept "), sc...), nil
+}
+func (f *fakeInitiator) GetMIC(bs []byte) ([]byte, error) { return []byte("mic"), nil }
+func (f *fakeInitiator) SessionKey() []byte               { return nil }
+func (f *fakeInitiator) IsEstablished() bool              { return f.established }
+func (f *fakeInitiator) VerifyMechListMIC(mechList, mic []byte) error {
+	if string(mic) != "mic" {
+		return errors.New("invalid mic")
+	}
+	return nil
+}
+
+func TestSPNEGOClientFallback(t *testing.T) {
+	krb := &fakeInitiator{oid: spnego.KerberosOID, initErr: errors.New("no credentials")}
+	ntlmMech := &fakeInitiator{oid: spnego.NtlmOID}
+	client := spnego.NewSPNEGOClient([]spnego.Initiator{krb, ntlmMech})
+
+	bs, err := client.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	init, err := spnego.UnwrapInitialToken(bs)
+	if err != nil {
+		t.Fatalf("UnwrapInitialToken() failed: %v", err)
+	}
+	if len(init.MechTypes) != 1 || !init.MechTypes[0].Equal(spnego.NtlmOID) {
+		t.Fatalf("mechanism without credentials should not be offered, got %v", init.MechTypes)
+	}
+	if string(init.MechToken) != "init "+spnego.NtlmOID.String() {
+		t.Fatalf("optimistic token is %q", init.MechToken)
+	}
+
+	resp, err := spnego.EncodeNegTokenResp(spnego.NegTokenResp{NegState: spnego.AcceptIncomplete, SupportedMech: spnego.NtlmOID, ResponseToken: []byte("challenge")})
+	if err != nil {
+		t.Fatalf("EncodeNegTokenResp() failed: %v", err)
+	}
+	bs, err = client.AcceptSecContext(resp)
+	if err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+	next, err := spnego.ParseResponseToken(bs)
+	if err != nil {
+		t.Fatalf("ParseResponseToken() failed: %v", err)
+	}
+	if string(next.ResponseToken) != "accept challenge" || !client.IsEstablished() {
+		t.Fatalf("selected mechanism did not process the challenge, got %q", next.ResponseToken)
+	}
+
+	failing := spnego.NewSPNEGOClient([]spnego.Initiator{&fakeInitiator{oid: spnego.KerberosOID, initErr: errors.New("no credentials")}})
+	if _, err := failing.InitSecContext(); err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Fatalf("InitSecContext() should fail when no mechanism can start, got %v", err)
+	}
+}
+
+func TestSPNEGOClientAcceptorSelectsOtherMechanism(t *testing.T) {
+	krb := &fakeInitiator{oid: spnego.KerberosOID}
+	ntlmMech := &fakeInitiator{oid: spnego.NtlmOID}
+	client := spnego.NewSPNEGOClient([]spnego.Initiator{krb, ntlmMech})
+	if _, err := client.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+
+	// The acceptor discards the Kerberos optimistic token and selects NTLM
+	resp, err := spnego.EncodeNegTokenResp(spnego.NegTokenResp{NegState: spnego.AcceptIncomplete, SupportedMech: spnego.NtlmOID})
+	if err != nil {
+		t.Fatalf("EncodeNegTokenResp() failed: %v", err)
+	}
+	bs, err := client.AcceptSecContext(resp)
+	if err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+	next, err := spnego.ParseResponseToken(bs)
+	if err != nil {
+		t.Fatalf("ParseResponseToken() failed: %v", err)
+	}
+	if string(next.ResponseToken) != "init "+spnego.NtlmOID.String() || next.NegState != spnego.NegStateAbsent {
+		t.Fatalf("selected mechanism should send its initial token, got %q", next.ResponseToken)
+	}
+
+	// Next legs carry no supportedMech
+	if resp, err = spnego.EncodeNegTokenResp(spnego.NegTokenResp{NegState: spnego.AcceptIncomplete, ResponseToken: []byte("challenge")}); err != nil {
+		t.Fatalf("EncodeNegTokenResp() failed: %v", err)
+	}
+	if _, err := client.AcceptSecContext(resp); err != nil {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+	if !ntlmMech.IsEstablished() || krb.IsEstablished() {
+		t.Fatalf("the selected mechanism should be established")
+	}
+
+	other := spnego.NewSPNEGOClient([]spnego.Initiator{&fakeInitiator{oid: spnego.NtlmOID}})
+	if _, err := other.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	if resp, err = spnego.EncodeNegTokenResp(spnego.NegTokenResp{NegState: spnego.AcceptIncomplete, SupportedMech: spnego.KerberosOID}); err != nil {
+		t.Fatalf("EncodeNegTokenResp() failed: %v", err)
+	}
+	if _, err := other.AcceptSecContext(resp); err == nil {
+		t.Fatalf("AcceptSecContext() should fail when an unoffered mechanism is selected")
+	}
+}
+
+func TestSPNEGOClientMechListMIC(t *testing.T) {
+	newClient := func() (*spnego.SPNEGOClient, *fakeInitiator) {
+		krb := &fakeInitiator{oid: spnego.KerberosOID}
+		client := spnego.NewSPNEGOClient([]spnego.Initiator{krb, &fakeInitiator{oid: spnego.NtlmOID}})
+		if _, err := client.InitSecContext(); err != nil {
+			t.Fatalf("InitSecContext() failed: %v", err)
+		}
+		return client, krb
+	}
+
+	tests := []struct {
+		name     string
+		resp     spnego.NegTokenResp
+		required bool
+		ok       bool
+	}{
+		{"optimistic without mic", spnego.NegTokenResp{NegState: spnego.AcceptCompleted, SupportedMech: spnego.KerberosOID, ResponseToken: []byte("ap-rep")}, false, true},
+		{"optimistic with mic", spnego.NegTokenResp{NegState: spnego.AcceptCompleted, SupportedMech: spnego.KerberosOID, ResponseToken: []byte("ap-rep"), MechListMIC: []byte("mic")}, false, true},
+		{"invalid mic", spnego.NegTokenResp{NegState: spnego.AcceptCompleted, SupportedMech: spnego.KerberosOID, ResponseToken: []byte("ap-rep"), MechListMIC: []byte("bad")}, false, false},
+		{"other mechanism without mic", spnego.NegTokenResp{NegState: spnego.AcceptCompleted, SupportedMech: spnego.NtlmOID}, false, false},
+		{"required mic", spnego.NegTokenResp{NegState: spnego.AcceptCompleted, SupportedMech: spnego.KerberosOID, ResponseToken: []byte("ap-rep"), MechListMIC: []byte("mic")}, true, true},
+		{"required mic missing", spnego.NegTokenResp{NegState: spnego.AcceptCompleted, SupportedMech: spnego.KerberosOID, ResponseToken: []byte("ap-rep")}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, krb := newClient()
+			client.RequireMechListMIC = tt.required
+			resp, err := spnego.EncodeNegTokenResp(tt.resp)
+			if err != nil {
+				t.Fatalf("EncodeNegTokenResp() failed: %v", err)
+			}
+			bs, err := client.AcceptSecContext(resp)
+			if (err == nil) != tt.ok {
+				t.Fatalf("AcceptSecContext() error = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && (!krb.IsEstablished() || string(bs) != "accept ap-rep") {
+				t.Fatalf("the last mechanism token should be processed, got %q", bs)
+			}
+		})
+	}
+}
+
+// negotiate runs the SPNEGO handshake between the client and the server
+func negotiate(t *testing.T, client *spnego.SPNEGOClient, server *spnego.SPNEGOServer) error {
+	t.Helper()
+
+	token, err := client.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if token, err = server.AcceptSecContext(token); err != nil {
+			return err
+		}
+		if token, err = client.AcceptSecContext(token); err != nil {
+			return err
+		}
+		if server.IsEstablished() {
+			return nil
+		}
+	}
+	return errors.New("handshake did not complete")
+}
+
+// fakeAcceptor is a mechanism accepting the context in a single leg
+type fakeAcceptor struct {
+	fakeInitiator
+}
+
+func (f *fakeAcceptor) VerifyMIC(bs, mic []byte) error { return f.VerifyMechListMIC(bs, mic) }
+
+func TestSPNEGOServerRequireMechListMIC(t *testing.T) {
+	for _, tc := range []struct {
+		mic      []byte
+		required bool
+		ok       bool
+		negState asn1.Enumerated
+	}{
+		{nil, false, true, spnego.AcceptCompleted},
+		{nil, true, true, spnego.RequestMIC},
+		{[]byte("mic"), true, true, spnego.AcceptCompleted},
+		{[]byte("bad"), false, false, 0},
+	} {
+		server := spnego.NewSPNEGOServer([]spnego.Acceptor{&fakeAcceptor{fakeInitiator{oid: spnego.KerberosOID}}})
+		server.RequireMechListMIC = tc.required
+		init, err := spnego.EncodeNegTokenInitGeneric(spnego.NegTokenInit{
+			MechTypes:   []asn1.ObjectIdentifier{spnego.KerberosOID, spnego.NtlmOID},
+			MechToken:   []byte("ap-req"),
+			MechListMIC: tc.mic,
+		})
+		if err != nil {
+			t.Fatalf("EncodeNegTokenInitGeneric() failed: %v", err)
+		}
+		bs, err := server.AcceptSecContext(init)
+		if (err == nil) != tc.ok {
+			t.Fatalf("mic %q, required %v: AcceptSecContext() error = %v", tc.mic, tc.required, err)
+		}
+		if !tc.ok {
+			continue
+		}
+		resp, err := spnego.ParseResponseToken(bs)
+		if err != nil {
+			t.Fatalf("ParseResponseToken() failed: %v", err)
+		}
+		if resp.NegState != tc.negState || server.IsEstablished() != (tc.negState == spnego.AcceptCompleted) {
+			t.Fatalf("mic %q, required %v: negState %s, established %v", tc.mic, tc.required, spnego.NegStateName(resp.NegState), server.IsEstablished())
+		}
+	}
+}
+
+func TestRequestMIC(t *testing.T) {
+	// The acceptor completes with the optimistic token and requests the missing mechListMIC
+	krb := &fakeInitiator{oid: spnego.KerberosOID}
+	client := spnego.NewSPNEGOClient([]spnego.Initiator{krb})
+	server := spnego.NewSPNEGOServer([]spnego.Acceptor{&fakeAcceptor{fakeInitiator{oid: spnego.KerberosOID}}})
+	server.RequireMechListMIC = true
+	if err := negotiate(t, client, server); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if !client.IsEstablished() || !server.IsEstablished() {
+		t.Fatalf("both sides should be established")
+	}
+
+	// request-mic in the first reply, the acceptor selecting a non preferred mechanism
+	clientNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	serverNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	client = spnego.NewSPNEGOClient([]spnego.Initiator{&fakeInitiator{oid: spnego.KerberosOID}, clientNtlm})
+	server = spnego.NewSPNEGOServer([]spnego.Acceptor{ntlm.NewAcceptor(serverNtlm)})
+	if err := negotiate(t, client, server); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	// The initiator answers request-mic with its mechListMIC, and verifies the one of the acceptor
+	krb = &fakeInitiator{oid: spnego.KerberosOID}
+	client = spnego.NewSPNEGOClient([]spnego.Initiator{krb})
+	if _, err := client.InitSecContext(); err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	for _, tc := range []struct {
+		name string
+		mic  []byte
+		ok   bool
+	}{
+		{"without mechListMIC", nil, true},
+		{"valid mechListMIC", []byte("mic"), true},
+		{"invalid mechListMIC", []byte("bad"), false},
+	} {
+		requestMIC, err := spnego.EncodeNegTokenResp(spnego.NegTokenResp{
+			NegState:      spnego.RequestMIC,
+			SupportedMech: spnego.KerberosOID,
+			ResponseToken: []byte("ap-rep"),
+			MechListMIC:   tc.mic,
+		})
+		if err != nil {
+			t.Fatalf("EncodeNegTokenResp() failed: %v", err)
+		}
+		bs, err := client.AcceptSecContext(requestMIC)
+		if (err == nil) != tc.ok {
+			t.Fatalf("%s: AcceptSecContext() error = %v", tc.name, err)
+		}
+		if !tc.ok {
+			continue
+		}
+		resp, err := spnego.ParseResponseToken(bs)
+		if err != nil {
+			t.Fatalf("ParseResponseToken() failed: %v", err)
+		}
+		if string(resp.MechListMIC) != "mic" || resp.NegState == spnego.RequestMIC {
+			t.Fatalf("%s: the initiator should answer with its mechListMIC, got %+v", tc.name, resp)
+		}
+	}
+}
+
+// largeAcceptor answers with a Kerberos token larger than the MaxTokenSize of the tests
+type largeAcceptor struct {
+	fakeAcceptor
+}
+
+func (f *largeAcceptor) AcceptSecContext(sc []byte) ([]byte, error) {
+	f.established = true
+	return append([]byte{0x60, 0x82, 0x03, 0xe8, 0x06}, bytes.Repeat([]byte("ap-rep"), 1000/6+1)[:999]...), nil
+}
+
+func TestMaxTokenSize(t *testing.T) {
+	client := spnego.NewSPNEGOClient([]spnego.Initiator{&fakeInitiator{oid: spnego.KerberosOID}})
+	server := spnego.NewSPNEGOServer([]spnego.Acceptor{&largeAcceptor{fakeAcceptor{fakeInitiator{oid: spnego.KerberosOID}}}})
+	server.MaxTokenSize = 100
+
+	token, err := client.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	legs := 0
+	for ; !server.IsEstablished(); legs++ {
+		if token, err = server.AcceptSecContext(token); err != nil {
+			t.Fatalf("leg %d: server AcceptSecContext() failed: %v", legs, err)
+		}
+		if len(token) > server.MaxTokenSize {
+			t.Fatalf("leg %d: NegTokenResp is %d bytes long", legs, len(token))
+		}
+		if token, err = client.AcceptSecContext(token); err != nil {
+			t.Fatalf("leg %d: client AcceptSecContext() failed: %v", legs, err)
+		}
+	}
+	if legs < 10 || !client.IsEstablished() {
+		t.Fatalf("handshake completed in %d legs, client established %v", legs, client.IsEstablished())
+	}
+	expected, _ := (&largeAcceptor{}).AcceptSecContext(nil)
+	if !bytes.Equal(token, append([]byte("accept "), expected...)) {
+		t.Fatalf("the responseToken was not reassembled, got %d bytes", len(token))
+	}
+
+	// The NTLM messages have no GSS-API framing the initiator could reassemble them with
+	clientNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	serverNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	server = spnego.NewSPNEGOServer([]spnego.Acceptor{ntlm.NewAcceptor(serverNtlm)})
+	server.MaxTokenSize = 100
+	err = negotiate(t, spnego.NewSPNEGOClient([]spnego.Initiator{clientNtlm}), server)
+	if !errors.Is(err, spnego.ErrTokenTooLarge) {
+		t.Fatalf("negotiate() returned %v, expected %v", err, spnego.ErrTokenTooLarge)
+	}
+}
+
+func TestSPNEGOServerSelectMechanism(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy spnego.MechanismSelector
+		ok     bool
+	}{
+		{"NTLM", func([]asn1.ObjectIdentifier) (asn1.ObjectIdentifier, error) { return spnego.NtlmOID, nil }, true},
+		{"denied", func([]asn1.ObjectIdentifier) (asn1.ObjectIdentifier, error) { return nil, errors.New("denied") }, false},
+		{"not offered", func([]asn1.ObjectIdentifier) (asn1.ObjectIdentifier, error) { return spnego.MsKerberosOid, nil }, false},
+	} {
+		clientNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+		serverNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+		client := spnego.NewSPNEGOClient([]spnego.Initiator{&fakeInitiator{oid: spnego.KerberosOID}, clientNtlm})
+		server := spnego.NewSPNEGOServer([]spnego.Acceptor{&fakeAcceptor{fakeInitiator{oid: spnego.KerberosOID}}, ntlm.NewAcceptor(serverNtlm)})
+		server.SelectMechanism = tc.policy
+
+		err := negotiate(t, client, server)
+		if (err == nil) != tc.ok {
+			t.Fatalf("%s: handshake error = %v", tc.name, err)
+		}
+		if tc.ok && !server.SelectedMech.GetOID().Equal(spnego.NtlmOID) {
+			t.Fatalf("%s: selected %v, want NTLM", tc.name, server.SelectedMech.GetOID())
+		}
+	}
+}
+
+func TestSPNEGOClientContextFlags(t *testing.T) {
+	clientNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	serverNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password", NegotiateFlags: ntlm.DefaultNegotiateFlags | ntlm.NegotiateSeal}
+	client := spnego.NewSPNEGOClient([]spnego.Initiator{clientNtlm})
+	client.ReqFlags = []spnego.ContextFlag{spnego.MutualFlag, spnego.ConfFlag, spnego.IntegFlag}
+	server := spnego.NewSPNEGOServer([]spnego.Acceptor{ntlm.NewAcceptor(serverNtlm)})
+
+	bs, err := client.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	init, err := spnego.UnwrapInitialToken(bs)
+	if err != nil {
+		t.Fatalf("UnwrapInitialToken() failed: %v", err)
+	}
+	if !init.HasFlag(spnego.MutualFlag) || !init.HasFlag(spnego.ConfFlag) || init.HasFlag(spnego.DelegFlag) {
+		t.Fatalf("reqFlags are %x", init.ReqFlags.Bytes)
+	}
+	if clientNtlm.NegotiateFlags&ntlm.NegotiateSeal == 0 {
+		t.Fatalf("confidentiality should be requested from NTLM")
+	}
+
+	token := bs
+	for !server.IsEstablished() {
+		if token, err = server.AcceptSecContext(token); err != nil {
+			t.Fatalf("server AcceptSecContext() failed: %v", err)
+		}
+		if token, err = client.AcceptSecContext(token); err != nil {
+			t.Fatalf("client AcceptSecContext() failed: %v", err)
+		}
+	}
+
+	expected := []spnego.ContextFlag{spnego.ReplayFlag, spnego.SequenceFlag, spnego.ConfFlag, spnego.IntegFlag}
+	if flags := client.ContextFlags(); len(flags) != len(expected) || flags[0] != expected[0] || flags[2] != expected[2] {
+		t.Fatalf("ContextFlags() = %v, expected %v", flags, expected)
+	}
+}
+
+func TestExportSecContext(t *testing.T) {
+	clientNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	serverNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	client := spnego.NewSPNEGOClient([]spnego.Initiator{clientNtlm})
+	if _, err := spnego.ExportSecContext(client); err == nil {
+		t.Fatalf("ExportSecContext() should fail before the context is established")
+	}
+	if err := negotiate(t, client, spnego.NewSPNEGOServer([]spnego.Acceptor{ntlm.NewAcceptor(serverNtlm)})); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	b, err := spnego.ExportSecContext(client)
+	if err != nil {
+		t.Fatalf("ExportSecContext() failed: %v", err)
+	}
+	if _, err := spnego.ImportSecContext(b); err == nil {
+		t.Fatalf("ImportSecContext() should fail without an importer")
+	}
+	spnego.RegisterContextImporter(spnego.NtlmOID, func(b []byte) (spnego.Initiator, error) { return ntlm.Import(b) })
+
+	imported, err := spnego.ImportSecContext(b)
+	if err != nil {
+		t.Fatalf("ImportSecContext() failed: %v", err)
+	}
+	if !imported.IsEstablished() || !bytes.Equal(imported.SessionKey(), client.SessionKey()) {
+		t.Fatalf("imported context differs from the exported one")
+	}
+
+	// The worker signs the next messages in place of the client
+	mic, err := imported.GetMIC([]byte("message"))
+	if err != nil {
+		t.Fatalf("GetMIC() failed: %v", err)
+	}
+	if err := serverNtlm.VerifyMIC([]byte("message"), mic); err != nil {
+		t.Fatalf("VerifyMIC() failed: %v", err)
+	}
+}
+
+func TestExportSecContextAcceptor(t *testing.T) {
+	clientNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	server := spnego.NewSPNEGOServer([]spnego.Acceptor{ntlm.NewAcceptor(&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"})})
+	if _, err := spnego.ExportSecContext(server); err == nil {
+		t.Fatalf("ExportSecContext() should fail before the context is established")
+	}
+	if err := negotiate(t, spnego.NewSPNEGOClient([]spnego.Initiator{clientNtlm}), server); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	b, err := spnego.ExportSecContext(server)
+	if err != nil {
+		t.Fatalf("ExportSecContext() failed: %v", err)
+	}
+	spnego.RegisterContextImporter(spnego.NtlmOID, func(b []byte) (spnego.Initiator, error) { return ntlm.Import(b) })
+
+	imported, err := spnego.ImportSecContext(b)
+	if err != nil {
+		t.Fatalf("ImportSecContext() failed: %v", err)
+	}
+	if !imported.IsEstablished() || !bytes.Equal(imported.SessionKey(), server.SessionKey()) {
+		t.Fatalf("imported context differs from the exported one")
+	}
+
+	// The worker answers the client in place of the server
+	worker, ok := imported.(*ntlm.NtlmProvider)
+	if !ok {
+		t.Fatalf("imported context is a %T", imported)
+	}
+	mic, err := clientNtlm.GetMIC([]byte("request"))
+	if err != nil {
+		t.Fatalf("GetMIC() failed: %v", err)
+	}
+	if err := worker.VerifyMIC([]byte("request"), mic); err != nil {
+		t.Fatalf("VerifyMIC() failed: %v", err)
+	}
+	token, err := worker.Wrap([]byte("response"))
+	if err != nil {
+		t.Fatalf("Wrap() failed: %v", err)
+	}
+	if msg, err := clientNtlm.Unwrap(token); err != nil || string(msg) != "response" {
+		t.Fatalf("Unwrap() = %q, %v", msg, err)
+	}
+}
+
+func TestSecContextStatus(t *testing.T) {
+	client := spnego.NewSPNEGOClient([]spnego.Initiator{&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}})
+	server := spnego.NewSPNEGOServer([]spnego.Acceptor{ntlm.NewAcceptor(&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"})})
+
+	token, status, err := spnego.InitSecContextStatus(client)
+	if err != nil || status != spnego.ContinueNeeded {
+		t.Fatalf("InitSecContextStatus() = %s, %v", status, err)
+	}
+
+	// Generic loop, the peers exchange tokens until both are complete
+	var statuses []spnego.Status
+	peers := []spnego.SecContext{server, client}
+	for i := 0; len(token) > 0; i++ {
+		if token, status, err = spnego.AcceptSecContextStatus(peers[i%2], token); err != nil {
+			t.Fatalf("AcceptSecContextStatus() = %s, %v", status, err)
+		}
+		statuses = append(statuses, status)
+	}
+	expected := []spnego.Status{spnego.ContinueNeeded, spnego.Complete, spnego.Complete, spnego.Complete}
+	if len(statuses) != len(expected) || statuses[0] != expected[0] || statuses[3] != expected[3] {
+		t.Fatalf("statuses are %v, expected %v", statuses, expected)
+	}
+
+	if _, status, err := spnego.AcceptSecContextStatus(server, []byte("garbage")); err == nil || status != spnego.Rejected {
+		t.Fatalf("AcceptSecContextStatus() = %s, %v", status, err)
+	}
+}
+
+func TestContextAttributes(t *testing.T) {
+	clientNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	serverNtlm := &ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}
+	client := spnego.NewSPNEGOClient([]spnego.Initiator{clientNtlm})
+	server := spnego.NewSPNEGOServer([]spnego.Acceptor{ntlm.NewAcceptor(serverNtlm)})
+	if client.Attributes() != nil || server.Attributes() != nil {
+		t.Fatalf("attributes should be nil before the context is established")
+	}
+	if err := negotiate(t, client, server); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		attrs    *spnego.ContextAttributes
+		peerName string
+	}{
+		{client.Attributes(), "Domain"},
+		{server.Attributes(), `DOMAIN\USER`},
+	} {
+		if !tc.attrs.Mech.Equal(spnego.NtlmOID) || !tc.attrs.Integrity || tc.attrs.Confidentiality || tc.attrs.Mutual {
+			t.Fatalf("attributes are %+v", tc.attrs)
+		}
+		if tc.attrs.PeerName != tc.peerName {
+			t.Fatalf("peer name is %q, expected %q", tc.attrs.PeerName, tc.peerName)
+		}
+	}
+}
+
+func TestRawMechanism(t *testing.T) {
+	client := spnego.NewSPNEGOClient([]spnego.Initiator{
+		&fakeInitiator{oid: spnego.KerberosOID, initErr: errors.New("no credentials")},
+		&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"},
+	})
+	client.Raw = true
+	server := spnego.NewSPNEGOServer([]spnego.Acceptor{ntlm.NewAcceptor(&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"})})
+
+	negotiate, err := client.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	if spnego.DetectTokenType(negotiate) != spnego.TokenNTLMSSP {
+		t.Fatalf("raw mode should send the NEGOTIATE message as is")
+	}
+	challenge, err := server.AcceptSecContext(negotiate)
+	if err != nil || spnego.DetectTokenType(challenge) != spnego.TokenNTLMSSP {
+		t.Fatalf("server AcceptSecContext() = %x, %v", challenge, err)
+	}
+	authenticate, err := client.AcceptSecContext(challenge)
+	if err != nil || spnego.DetectTokenType(authenticate) != spnego.TokenNTLMSSP {
+		t.Fatalf("client AcceptSecContext() = %x, %v", authenticate, err)
+	}
+	if _, err := server.AcceptSecContext(authenticate); err != nil {
+		t.Fatalf("server AcceptSecContext() failed: %v", err)
+	}
+	if !client.IsEstablished() || !server.IsEstablished() || !bytes.Equal(client.SessionKey(), server.SessionKey()) {
+		t.Fatalf("both sides should be established with the same session key")
+	}
+}
+
+func TestSPNEGOClientMechTypes(t *testing.T) {
+	krb := &fakeInitiator{oid: spnego.KerberosOID}
+	client := spnego.NewSPNEGOClient([]spnego.Initiator{&ntlm.NtlmProvider{}, krb})
+	if err := client.SetMechTypes(spnego.MsKerberosOid, spnego.KerberosOID, spnego.NtlmOID); err != nil {
+		t.Fatalf("SetMechTypes() failed: %v", err)
+	}
+	if err := client.SetMechTypes(spnego.NegotiateOID); err == nil {
+		t.Fatalf("SetMechTypes() should fail without a mechanism for the OID")
+	}
+
+	bs, err := client.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	init, err := spnego.UnwrapInitialToken(bs)
+	if err != nil {
+		t.Fatalf("UnwrapInitialToken() failed: %v", err)
+	}
+	if len(init.MechTypes) != 3 || !init.MechTypes[0].Equal(spnego.MsKerberosOid) || !init.MechTypes[2].Equal(spnego.NtlmOID) {
+		t.Fatalf("mechTypes are %v", init.MechTypes)
+	}
+	if string(init.MechToken) != "init "+spnego.KerberosOID.String() {
+		t.Fatalf("optimistic token is %q", init.MechToken)
+	}
+
+	// The acceptor selects the MS Kerberos OID, handled by the Kerberos mechanism
+	resp, err := spnego.EncodeNegTokenResp(spnego.NegTokenResp{NegState: spnego.AcceptCompleted, SupportedMech: spnego.MsKerberosOid, ResponseToken: []byte("ap-rep")})
+	if err != nil {
+		t.Fatalf("EncodeNegTokenResp() failed: %v", err)
+	}
+	if _, err := client.AcceptSecContext(resp); err != nil || !krb.IsEstablished() {
+		t.Fatalf("AcceptSecContext() failed: %v", err)
+	}
+}
+
+func TestSPNEGOClientNoOptimisticToken(t *testing.T) {
+	client := spnego.NewSPNEGOClient([]spnego.Initiator{&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"}})
+	client.NoOptimisticToken = true
+	server := spnego.NewSPNEGOServer([]spnego.Acceptor{ntlm.NewAcceptor(&ntlm.NtlmProvider{User: "User", Domain: "Domain", Password: "Password"})})
+
+	bs, err := client.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() failed: %v", err)
+	}
+	init, err := spnego.UnwrapInitialToken(bs)
+	if err != nil || len(init.MechToken) != 0 {
+		t.Fatalf("NegTokenInit should not carry a mechToken: %v", err)
+	}
+
+	token := bs
+	for !server.IsEstablished() {
+		if token, err = server.AcceptSecContext(token); err != nil {
+			t.Fatalf("server AcceptSecContext() failed: %v", err)
+		}
+		if token, err = client.AcceptSecContext(token); err != nil {
+			t.Fatalf("client AcceptSecContext() failed: %v", err)
+		}
+	}
+	if !client.IsEstablished() || !bytes.Equal(client.SessionKey(), server.SessionKey()) {
+		t.Fatalf("both sides should be established with the same session key")
+	}
+}
+
+func TestCompatibility(t *testing.T) {
+	for _, tc := range []struct {
+		compat    spnego.Compatibility
+		microsoft bool
+	}{
+		{spnego.CompatMicrosoft, true},
+		{spnego.CompatRFC4178, false},
+	} {
+		// The acceptor selects its Kerberos mechanism for the MS OID offered first by Windows
+		client := spnego.NewSPNEGOClient([]spnego.Initiator{&fakeInitiator{oid: spnego.MsKerberosOid}})
+		server := spnego.NewSPNEGOServer([]spnego.Acceptor{&fakeAcceptor{fakeInitiator{oid: spnego.KerberosOID}}})
+		server.Compatibility = tc.compat
+		if err := negotiate(t, client, server); (err == nil) != tc.microsoft {
+			t.Fatalf("%s: handshake with the MS OID error = %v", tc.compat, err)
+		}
+
+		// The initiator accepts the MS OID as supportedMech for its Kerberos mechanism
+		client = spnego.NewSPNEGOClient([]spnego.Initiator{&fakeInitiator{oid: spnego.KerberosOID}})
+		client.Compatibility = tc.compat
+		if _, err := client.InitSecContext(); err != nil {
+			t.Fatalf("InitSecContext() failed: %v", err)
+		}
+		resp, err := spnego.EncodeNegTokenResp(spnego.NegTokenResp{
+			NegState:      spnego.AcceptCompleted,
+			SupportedMech: spnego.MsKerberosOid,
+			ResponseToken: []byte("ap-rep"),
+			MechListMIC:   []byte("ap-rep"), // Windows 2000 copies the responseToken
+		})
+		if err != nil {
+			t.Fatalf("EncodeNegTokenResp() failed: %v", err)
+		}
+		if _, err := client.AcceptSecContext(resp); (err == nil) != tc.microsoft {
+			t.Fatalf("%s: AcceptSecContext() with the MS OID error = %v", tc.compat, err)
+		}
+
+		client = spnego.NewSPNEGOClient([]spnego.Initiator{&fakeInitiator{oid: spnego.KerberosOID}})
+		client.Compatibility = tc.compat
+		if _, err := client.InitSecContext(); err != nil {
+			t.Fatalf("InitSecContext() failed: %v", err)
+		}
+		if resp, err = spnego.EncodeNegTokenResp(spnego.NegTokenResp{
+			NegState:      spnego.AcceptCompleted,
+			SupportedMech: spnego.KerberosOID,
+			ResponseToken: []byte("ap-rep"),
+			MechListMIC:   []byte("ap-rep"),
+		}); err != nil {
+			t.Fatalf("EncodeNegTokenResp() failed: %v", err)
+		}
+		if _, err := client.AcceptSecContext(resp); (err == nil) != tc.microsoft {
+			t.Fatalf("%s: AcceptSecContext() with a copied mechListMIC error = %v", tc.compat, err)
+		}
+
+		// The acceptor only leads with negHints in the Microsoft mode
+		server = spnego.NewSPNEGOServer([]spnego.Acceptor{ntlm.NewAcceptor(&ntlm.NtlmProvider{})})
+		server.Compatibility = tc.compat
+		bs, err := server.InitialToken()
+		if err != nil {
+			t.Fatalf("InitialToken() failed: %v", err)
+		}
+		init, err := spnego.UnwrapInitialToken2(bs)
+		if err != nil {
+			t.Fatalf("UnwrapInitialToken2() failed: %v", err)
+		}
+		if hint, err := init.HintName(); err != nil || (hint != "") != tc.microsoft {
+			t.Fatalf("%s: HintName() = %q, %v", tc.compat, hint, err)
+		}
+	}
+}
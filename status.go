@@ -0,0 +1,56 @@
+package spnego
+
+import "strconv"
+
+// Status is the outcome of a handshake leg, like the GSS-API major status
+type Status int
+
+// Status values returned by InitSecContextStatus and AcceptSecContextStatus
+const (
+	ContinueNeeded Status = iota // The output token must be sent and the peer answer processed
+	Complete                     // The context is established, the output token is sent if not empty
+	Rejected                     // The handshake failed, the error tells why
+)
+
+var statusNames = map[Status]string{
+	ContinueNeeded: "continue-needed",
+	Complete:       "complete",
+	Rejected:       "rejected",
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return "unknown(" + strconv.Itoa(int(s)) + ")"
+}
+
+// SecContext is the part of Initiator and Acceptor processing the tokens of the peer
+type SecContext interface {
+	AcceptSecContext(sc []byte) ([]byte, error)
+	IsEstablished() bool
+}
+
+// InitSecContextStatus generates the first token of the mechanism along with the status
+// of the handshake, so that callers do not infer it from the output token
+func InitSecContextStatus(mech Initiator) ([]byte, Status, error) {
+	token, err := mech.InitSecContext()
+	return token, status(mech, err), err
+}
+
+// AcceptSecContextStatus processes a token of the peer, see InitSecContextStatus.
+// It drives initiators and acceptors alike, e.g. SPNEGOClient and SPNEGOServer
+func AcceptSecContextStatus(ctx SecContext, token []byte) ([]byte, Status, error) {
+	out, err := ctx.AcceptSecContext(token)
+	return out, status(ctx, err), err
+}
+
+func status(ctx SecContext, err error) Status {
+	switch {
+	case err != nil:
+		return Rejected
+	case ctx.IsEstablished():
+		return Complete
+	}
+	return ContinueNeeded
+}